@@ -33,3 +33,25 @@ type Backend interface {
 	// Close the backend handler.
 	Close() error
 }
+
+/*
+BaseStream is a BackendStream which counts events ever deleted from it's beginning.
+
+The base plus a position of an event is it's offset, which doesn't change when older events are deleted,
+but deleting events other than a prefix still moves offsets of the following ones.
+*/
+type BaseStream interface {
+	BackendStream
+	// Get the number of events ever deleted from the beginning of the stream and the number of events in it at once.
+	Base() (uint, uint, error)
+}
+
+// Get the base and the length of a stream, streams which aren't BaseStreams have zero base.
+func Base(s BackendStream) (uint, uint, error) {
+	if b, ok := s.(BaseStream); ok {
+		return b.Base()
+	}
+
+	l, err := s.Len()
+	return 0, l, err
+}
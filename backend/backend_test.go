@@ -0,0 +1,315 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Create a backend of every type, reopen recreates it on the same storage.
+type testBackend struct {
+	name   string
+	open   func() (Backend, error)
+	reopen bool
+}
+
+func testBackends(t *testing.T) []testBackend {
+	dir := t.TempDir()
+	return []testBackend{
+		{"mem", func() (Backend, error) { return NewMem(), nil }, false},
+		{"dir", func() (Backend, error) { return NewDir(dir + "/dir") }, true},
+		{"bolt", func() (Backend, error) { return NewBolt(dir + "/bolt") }, true},
+		{"sqlite", func() (Backend, error) { return NewSqlite(dir + "/sqlite.db") }, true},
+		{"ledis", func() (Backend, error) { return NewLedis(dir + "/ledis") }, true},
+	}
+}
+
+func testEvents(from, to int) []string {
+	res := []string{}
+	for i := from; i < to; i++ {
+		res = append(res, fmt.Sprintf(`{"n": %d}`, i))
+	}
+	return res
+}
+
+func addEvents(t *testing.T, s BackendStream, evts []string) {
+	for _, v := range evts {
+		assert.Nil(t, s.Add([]byte(v)))
+	}
+}
+
+func readRange(t *testing.T, s BackendStream, from, to uint) []string {
+	data, err := s.Read(from, to)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+
+	res := []string{}
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			return res
+		}
+		if !assert.Nil(t, err) {
+			stream.Drain(data)
+			return res
+		}
+		res = append(res, string(evt.([]byte)))
+	}
+}
+
+func readAll(t *testing.T, s BackendStream) []string {
+	l, err := s.Len()
+	assert.Nil(t, err)
+	return readRange(t, s, 0, l)
+}
+
+// Check that the stream has the events and it's base is right.
+func checkStream(t *testing.T, name string, s BackendStream, evts []string, base uint) {
+	l, err := s.Len()
+	assert.Nil(t, err, name)
+	assert.Equal(t, uint(len(evts)), l, name)
+	assert.Equal(t, evts, readAll(t, s), name)
+
+	b, bl, err := Base(s)
+	assert.Nil(t, err, name)
+	assert.Equal(t, base, b, name)
+	assert.Equal(t, l, bl, name)
+
+	if len(evts) > 2 {
+		assert.Equal(t, evts[1:len(evts)-1], readRange(t, s, 1, uint(len(evts)-1)), name)
+	}
+}
+
+// Test that all backends delete ranges of events the same way and count events deleted from the beginning.
+func TestStreamDel(t *testing.T) {
+	dels := []struct {
+		From uint
+		To   uint
+	}{
+		{0, 0},
+		{0, 3},
+		{5, 10},
+		{20, 30},
+		{0, 1},
+		{10, 12},
+		{0, 5},
+	}
+	for _, tb := range testBackends(t) {
+		b, err := tb.open()
+		if !assert.Nil(t, err, tb.name) {
+			continue
+		}
+
+		s, err := b.GetStream("s")
+		assert.Nil(t, err, tb.name)
+
+		model := testEvents(0, 40)
+		addEvents(t, s, model)
+		base := uint(0)
+		for _, d := range dels {
+			name := fmt.Sprintf("%s: Del(%v, %v)", tb.name, d.From, d.To)
+			_, err := s.Del(d.From, d.To)
+			assert.Nil(t, err, name)
+
+			model = append(append([]string{}, model[:d.From]...), model[d.To:]...)
+			if d.From == 0 {
+				base += d.To
+			}
+			checkStream(t, name, s, model, base)
+		}
+
+		l := uint(len(model))
+		_, err = s.Read(0, l+1)
+		assert.NotNil(t, err, tb.name)
+		_, err = s.Del(l, l+1)
+		assert.NotNil(t, err, tb.name)
+		checkStream(t, tb.name, s, model, base)
+
+		more := testEvents(40, 45)
+		addEvents(t, s, more)
+		model = append(model, more...)
+		checkStream(t, tb.name, s, model, base)
+
+		_, err = s.Del(0, uint(len(model)))
+		assert.Nil(t, err, tb.name)
+		base += uint(len(model))
+		checkStream(t, tb.name, s, []string{}, base)
+
+		if tb.reopen {
+			assert.Nil(t, s.Close(), tb.name)
+			assert.Nil(t, b.Close(), tb.name)
+
+			b, err = tb.open()
+			if !assert.Nil(t, err, tb.name) {
+				continue
+			}
+
+			s, err = b.GetStream("s")
+			assert.Nil(t, err, tb.name)
+			checkStream(t, tb.name+": reopened", s, []string{}, base)
+		}
+
+		addEvents(t, s, more)
+		checkStream(t, tb.name, s, more, base)
+
+		assert.Nil(t, s.Close(), tb.name)
+		assert.Nil(t, b.Drop(), tb.name)
+	}
+}
+
+// Test that reading more events than fit in a page reads all of them in order.
+func TestStreamPages(t *testing.T) {
+	model := testEvents(0, 2500)
+	for _, tb := range testBackends(t) {
+		b, err := tb.open()
+		if !assert.Nil(t, err, tb.name) {
+			continue
+		}
+
+		s, err := b.GetStream("s")
+		assert.Nil(t, err, tb.name)
+
+		assert.Nil(t, AddBatch(s, toEvents(model)), tb.name)
+
+		assert.Equal(t, model, readAll(t, s), tb.name)
+		assert.Equal(t, model[1000:2100], readRange(t, s, 1000, 2100), tb.name)
+
+		// deleted events in the middle don't break paging
+		_, err = s.Del(1020, 1030)
+		assert.Nil(t, err, tb.name)
+		assert.Equal(t, append(append([]string{}, model[:1020]...), model[1030:]...), readAll(t, s), tb.name)
+
+		// a reader that's done early doesn't keep anything
+		data, err := s.Read(0, 2000)
+		assert.Nil(t, err, tb.name)
+		_, err = data.Next()
+		assert.Nil(t, err, tb.name)
+		stream.Drain(data)
+
+		_, err = s.Del(0, 10)
+		assert.Nil(t, err, tb.name)
+
+		assert.Nil(t, s.Close(), tb.name)
+		assert.Nil(t, b.Drop(), tb.name)
+	}
+}
+
+// A stream which isn't a BatchAdder, so events of a batch are added to it one by one.
+type plainStream struct {
+	Stream
+}
+
+func toEvents(evts []string) []stream.Event {
+	res := make([]stream.Event, len(evts))
+	for i, v := range evts {
+		res[i] = []byte(v)
+	}
+	return res
+}
+
+// Test that events added in batches are stored in order after the ones added before, both by backends and one by one.
+func TestStreamAddBatch(t *testing.T) {
+	for _, tb := range testBackends(t) {
+		b, err := tb.open()
+		if !assert.Nil(t, err, tb.name) {
+			continue
+		}
+
+		s, err := b.GetStream("s")
+		assert.Nil(t, err, tb.name)
+		_, ok := s.(BatchAdder)
+		assert.True(t, ok, tb.name)
+
+		assert.Nil(t, AddBatch(s, nil), tb.name)
+		checkStream(t, tb.name+": empty batch", s, []string{}, 0)
+
+		model := testEvents(0, 1)
+		addEvents(t, s, model)
+		for _, n := range []int{1, 100, 1500} {
+			evts := testEvents(len(model), len(model)+n)
+			assert.Nil(t, AddBatch(s, toEvents(evts)), tb.name)
+			model = append(model, evts...)
+			checkStream(t, fmt.Sprintf("%s: batch of %v", tb.name, n), s, model, 0)
+		}
+
+		evts := testEvents(len(model), len(model)+10)
+		assert.Nil(t, AddBatch(plainStream{s}, toEvents(evts)), tb.name)
+		model = append(model, evts...)
+		checkStream(t, tb.name+": one by one", s, model, 0)
+
+		assert.Nil(t, s.Close(), tb.name)
+		assert.Nil(t, b.Drop(), tb.name)
+	}
+}
+
+/*
+Test that a reader of a backend that's left open doesn't block deletes
+and doesn't skip or repeat events when events are deleted while it reads.
+*/
+func testReaderDel(t *testing.T, b Backend, err error) {
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer b.Drop()
+
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+	defer s.Close()
+
+	model := testEvents(0, 3000)
+	addEvents(t, s, model)
+
+	data, err := s.Read(0, 3000)
+	assert.Nil(t, err)
+
+	res := []string{}
+	for i := 0; i < 1500; i++ {
+		evt, err := data.Next()
+		assert.Nil(t, err)
+		res = append(res, string(evt.([]byte)))
+	}
+
+	// events the reader has already read and the ones after the page it has read
+	_, err = s.Del(0, 1000)
+	assert.Nil(t, err)
+	_, err = s.Del(1100, 1200)
+	assert.Nil(t, err)
+
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		assert.Nil(t, err)
+		res = append(res, string(evt.([]byte)))
+	}
+
+	expected := append(append([]string{}, model[:2100]...), model[2200:]...)
+	assert.Equal(t, expected, res)
+
+	// an abandoned reader doesn't block deletes either
+	_, err = s.Read(0, 100)
+	assert.Nil(t, err)
+	_, err = s.Del(0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, model[1010:1020], readRange(t, s, 0, 10))
+}
+
+func TestBoltReaderDel(t *testing.T) {
+	b, err := NewBolt(t.TempDir())
+	testReaderDel(t, b, err)
+}
+
+func TestSqliteReaderDel(t *testing.T) {
+	b, err := NewSqlite(t.TempDir() + "/sqlite.db")
+	testReaderDel(t, b, err)
+}
+
+func TestLedisReaderDel(t *testing.T) {
+	b, err := NewLedis(t.TempDir())
+	testReaderDel(t, b, err)
+}
@@ -0,0 +1,567 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of events a reader gets in one transaction.
+const boltReadPage = 1024
+
+func boltKey(seq uint64) []byte {
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, seq)
+	return res
+}
+
+// Get sequence numbers of the first event and the one after the last, all events in between are stored under consecutive keys.
+func boltRange(b *bolt.Bucket) (uint64, uint64) {
+	if b == nil {
+		return 0, 0
+	}
+
+	c := b.Cursor()
+	first, _ := c.First()
+	if first == nil {
+		return 0, 0
+	}
+
+	last, _ := c.Last()
+	return binary.BigEndian.Uint64(first), binary.BigEndian.Uint64(last) + 1
+}
+
+// Values are events prefixed with time when they were added.
+func encodeBoltValue(t time.Time, evt []byte) []byte {
+	res := make([]byte, 8+len(evt))
+	binary.BigEndian.PutUint64(res, uint64(t.UnixNano()))
+	copy(res[8:], evt)
+	return res
+}
+
+func decodeBoltValue(data []byte) (time.Time, []byte) {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), data[8:]
+}
+
+/*
+A stream of events read in pages, each in it's own transaction, so that a slow reader doesn't keep a transaction open.
+
+Readers don't lock out deletes between pages.
+Instead, a delete moves keys of unfinished readers along with the events, so that they don't skip or repeat events.
+*/
+type boltReadStream struct {
+	obj *boltStreamObj
+	// key of the next event to read and the end of the range, changed by Del
+	seq  uint64
+	to   uint64
+	page [][]byte
+}
+
+// Stop reading, the stream's read lock has to be held.
+func (self *boltReadStream) finish() {
+	self.seq = self.to
+	self.page = nil
+	self.obj.rmReader(self)
+}
+
+func (self *boltReadStream) read() ([][]byte, error) {
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	// deletes might have removed the rest of the range
+	if self.seq >= self.to {
+		self.obj.rmReader(self)
+		return nil, nil
+	}
+
+	n := self.to - self.seq
+	if n > boltReadPage {
+		n = boltReadPage
+	}
+
+	page := make([][]byte, 0, n)
+	err := self.obj.back.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.obj.key)
+		if b == nil {
+			return errors.New(fmt.Sprintf("boltReadStream.read: stream \"%s\" does not exist", self.obj.name))
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(boltKey(self.seq)); k != nil && uint64(len(page)) < n; k, v = c.Next() {
+			_, evt := decodeBoltValue(v)
+			// values are only valid during the transaction
+			page = append(page, append([]byte{}, evt...))
+		}
+
+		if uint64(len(page)) != n {
+			return errors.New(fmt.Sprintf("boltReadStream.read: unexpected end of stream \"%s\"", self.obj.name))
+		}
+		return nil
+	})
+	if err != nil {
+		self.finish()
+		return nil, err
+	}
+
+	self.seq += n
+	if self.seq == self.to {
+		self.obj.rmReader(self)
+	}
+	return page, nil
+}
+
+func (self *boltReadStream) Next() (stream.Event, error) {
+	if len(self.page) == 0 {
+		page, err := self.read()
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return nil, stream.EOI
+		}
+
+		self.page = page
+	}
+
+	res := self.page[0]
+	self.page = self.page[1:]
+	return stream.Event(res), nil
+}
+
+func (self *boltReadStream) Len() int {
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	return int(self.to-self.seq) + len(self.page)
+}
+
+func (self *boltReadStream) Drain() {
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	if self.seq < self.to {
+		self.finish()
+	}
+	self.page = nil
+}
+
+type boltStreamObj struct {
+	back *boltBackend
+	name string
+	key  []byte
+
+	// held for reading while a page is read, so that events are not moved under it
+	delLock sync.RWMutex
+
+	readersLock sync.Mutex
+	readers     map[*boltReadStream]struct{}
+}
+
+func (self *boltStreamObj) addReader(r *boltReadStream) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	self.readers[r] = struct{}{}
+}
+
+func (self *boltStreamObj) rmReader(r *boltReadStream) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	delete(self.readers, r)
+}
+
+/*
+Move keys of unfinished readers after deleting keys from lo to hi and moving the ones before or after them by n = hi - lo,
+keys within the deleted range are moved to the key of the event after it.
+*/
+func (self *boltStreamObj) moveReaders(lo uint64, hi uint64, before bool) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	move := func(seq uint64) uint64 {
+		if before {
+			if seq < lo {
+				return seq + (hi - lo)
+			}
+			if seq < hi {
+				return hi
+			}
+			return seq
+		}
+
+		if seq >= hi {
+			return seq - (hi - lo)
+		}
+		if seq > lo {
+			return lo
+		}
+		return seq
+	}
+
+	for r, _ := range self.readers {
+		r.seq = move(r.seq)
+		r.to = move(r.to)
+	}
+}
+
+func (self *boltStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("boltStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	return self.add([][]byte{bs})
+}
+
+func (self *boltStreamObj) AddBatch(evts []stream.Event) error {
+	bss := make([][]byte, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("boltStreamObj.AddBatch: Expected []byte, got %v", evt))
+		}
+
+		bss[i] = bs
+	}
+
+	return self.add(bss)
+}
+
+func (self *boltStreamObj) add(bss [][]byte) error {
+	now := time.Now()
+	return self.back.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(self.key)
+		if err != nil {
+			return err
+		}
+
+		// keys are only appended, so pages can be filled up
+		b.FillPercent = 0.9
+
+		_, next := boltRange(b)
+		for _, bs := range bss {
+			if err := b.Put(boltKey(next), encodeBoltValue(now, bs)); err != nil {
+				return err
+			}
+			next++
+		}
+		return nil
+	})
+}
+
+func (self *boltStreamObj) Read(from uint, to uint) (stream.Stream, error) {
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	var first, next uint64
+	err := self.back.db.View(func(tx *bolt.Tx) error {
+		first, next = boltRange(tx.Bucket(self.key))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := convRange(int(from), int(to), int(next-first), "boltStreamObj.Read"); err != nil {
+		return nil, err
+	}
+
+	res := &boltReadStream{self, first + uint64(from), first + uint64(to), nil}
+	self.addReader(res)
+	return res, nil
+}
+
+func (self *boltStreamObj) Interval(from int, to int) (uint, uint, error) {
+	if from == to {
+		return 0, 0, nil
+	}
+
+	l, err := self.Len()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	f, t, err := convRange(from, to, int(l), "boltStreamObj.Interval")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if f == t {
+		return 0, 0, nil
+	}
+
+	return f, t, nil
+}
+
+/*
+Delete a range of events.
+
+Events on the shorter side of the range are moved to keep keys consecutive,
+so deleting a prefix or a suffix of the stream doesn't move anything.
+Keys of unfinished readers are moved along with the events.
+The base of the stream is kept as the sequence of it's bucket.
+*/
+func (self *boltStreamObj) Del(from uint, to uint) (bool, error) {
+	if from == to {
+		return true, nil
+	}
+
+	self.delLock.Lock()
+	defer self.delLock.Unlock()
+
+	var lo, hi uint64
+	before := false
+	err := self.back.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.key)
+		first, next := boltRange(b)
+		if _, _, err := convRange(int(from), int(to), int(next-first), "boltStreamObj.Del"); err != nil {
+			return err
+		}
+
+		if from == 0 {
+			if err := b.SetSequence(b.Sequence() + uint64(to)); err != nil {
+				return err
+			}
+		}
+
+		lo, hi = first+uint64(from), first+uint64(to)
+		for seq := lo; seq < hi; seq++ {
+			if err := b.Delete(boltKey(seq)); err != nil {
+				return err
+			}
+		}
+
+		move := func(src, dst uint64) error {
+			v := append([]byte{}, b.Get(boltKey(src))...)
+			if err := b.Put(boltKey(dst), v); err != nil {
+				return err
+			}
+			return b.Delete(boltKey(src))
+		}
+
+		n := hi - lo
+		if lo-first < next-hi {
+			before = true
+			for seq := lo; seq > first; seq-- {
+				if err := move(seq-1, seq-1+n); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for seq := hi; seq < next; seq++ {
+			if err := move(seq, seq-n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	self.moveReaders(lo, hi, before)
+	return true, nil
+}
+
+func (self *boltStreamObj) Len() (uint, error) {
+	var first, next uint64
+	err := self.back.db.View(func(tx *bolt.Tx) error {
+		first, next = boltRange(tx.Bucket(self.key))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint(next - first), nil
+}
+
+func (self *boltStreamObj) Base() (uint, uint, error) {
+	var base, first, next uint64
+	err := self.back.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.key)
+		if b != nil {
+			base = b.Sequence()
+		}
+		first, next = boltRange(b)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(base), uint(next - first), nil
+}
+
+func (self *boltStreamObj) Close() error {
+	return nil
+}
+
+func (self *boltStreamObj) countOlder(t time.Time) (uint, error) {
+	res := uint(0)
+	err := self.back.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.key)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if at, _ := decodeBoltValue(v); !at.Before(t) {
+				break
+			}
+			res++
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (self *boltStreamObj) countOver(bytes uint64) (uint, error) {
+	res := uint(0)
+	err := self.back.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.key)
+		if b == nil {
+			return nil
+		}
+
+		first, _ := boltRange(b)
+		size := uint64(0)
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			_, evt := decodeBoltValue(v)
+			size += uint64(len(evt))
+			if size > bytes {
+				res = uint(binary.BigEndian.Uint64(k) - first + 1)
+				break
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+type boltBackend struct {
+	dir       string
+	db        *bolt.DB
+	lock      sync.Mutex
+	data      map[string]*boltStreamObj
+	retention *retainer
+}
+
+func (self *boltBackend) Config() (interface{}, error) {
+	return self.retention.config(map[string]interface{}{
+		"type": "bolt",
+		"arg":  self.dir,
+	}), nil
+}
+
+func (self *boltBackend) SetRetention(name string, r Retention) error {
+	return self.retention.set(name, r)
+}
+
+func (self *boltBackend) Retention() (map[string]Retention, error) {
+	return self.retention.all(), nil
+}
+
+func (self *boltBackend) Streams() ([]string, error) {
+	res := []string{}
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			res = append(res, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (self *boltBackend) GetStream(name string) (BackendStream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s, ok := self.data[name]
+	if !ok {
+		s = &boltStreamObj{self, name, []byte(name), sync.RWMutex{}, sync.Mutex{}, map[*boltReadStream]struct{}{}}
+		self.data[name] = s
+	}
+	return s, nil
+}
+
+func (self *boltBackend) Drop() error {
+	self.retention.drop()
+
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		names := [][]byte{}
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			names = append(names, append([]byte{}, name...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return errors.List().
+		Add(err).
+		Add(self.db.Close()).
+		Add(os.RemoveAll(self.dir)).
+		Err()
+}
+
+func (self *boltBackend) Close() error {
+	self.retention.close()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.data = nil
+	return self.db.Close()
+}
+
+/*
+Create a backend that stores pushed events in a bbolt database in a specified directory.
+
+Events of a stream are stored in a bucket under consecutive sequence numbers,
+so reading and deleting ranges of events and getting the length of a stream are cheap.
+*/
+func NewBolt(dir string) (Backend, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	// fail instead of waiting forever if the database is already opened by another process
+	db, err := bolt.Open(dir+"/events.db", 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &boltBackend{dir, db, sync.Mutex{}, map[string]*boltStreamObj{}, nil}
+	res.retention = newRetainer(func(name string) (retentionStream, func(), error) {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.(*boltStreamObj), func() {}, nil
+	})
+	return res, nil
+}
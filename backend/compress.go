@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression codecs for blocks of events stored by backends.
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// A block compression codec with an id to store in files.
+type codec struct {
+	id         byte
+	name       string
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+}
+
+// zstd encoders and decoders are expensive to create and can be used concurrently.
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdErr error
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+var codecs = []*codec{
+	&codec{1, CompressionGzip, func(data []byte) ([]byte, error) {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}, func(data []byte) ([]byte, error) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}},
+	&codec{2, CompressionZstd, func(data []byte) ([]byte, error) {
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}, func(data []byte) ([]byte, error) {
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}},
+	&codec{3, CompressionSnappy, func(data []byte) ([]byte, error) {
+		return snappy.Encode(nil, data), nil
+	}, func(data []byte) ([]byte, error) {
+		return snappy.Decode(nil, data)
+	}},
+}
+
+// Get a codec by it's name, CompressionNone and an empty name mean no codec.
+func codecByName(name string) (*codec, error) {
+	if name == "" || name == CompressionNone {
+		return nil, nil
+	}
+
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("codecByName: Expected one of \"%s\", \"%s\", \"%s\" and \"%s\", got \"%s\"", CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy, name))
+}
+
+func codecById(id byte) (*codec, error) {
+	for _, c := range codecs {
+		if c.id == id {
+			return c, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("codecById: Unknown codec %d", id))
+}
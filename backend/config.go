@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of backend config fields.
+const (
+	// A string, possibly one of the listed values.
+	FieldString = "string"
+	// A non-negative duration string, as in time.ParseDuration, parsed to a time.Duration.
+	FieldDuration = "duration"
+	// Any JSON value, passed as is.
+	FieldAny = "any"
+)
+
+/*
+A field of a backend config arg.
+
+A missing field gets the Default value, unless it's Required.
+If Values are not empty, a string field must be one of them.
+*/
+type ConfigField struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  interface{}
+	Values   []string
+}
+
+/*
+A schema of a backend config arg: an object with the listed fields.
+
+If Short is not empty, the arg can also be a string, which is the value of the field named Short.
+A schema without fields also accepts no arg at all or any string, which is ignored,
+so that plain args of backends that don't need any keep working.
+*/
+type ConfigSchema struct {
+	Short  string
+	Fields []ConfigField
+}
+
+func (self ConfigSchema) field(name string) (ConfigField, bool) {
+	for _, f := range self.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return ConfigField{}, false
+}
+
+func (self ConfigField) parse(v interface{}) (interface{}, error) {
+	switch self.Type {
+	case FieldString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Expected field \"%s\" to be string, got %v", self.Name, v))
+		}
+
+		if len(self.Values) == 0 {
+			return s, nil
+		}
+
+		for _, val := range self.Values {
+			if s == val {
+				return s, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("Expected field \"%s\" to be one of \"%s\", got \"%s\"", self.Name, strings.Join(self.Values, "\", \""), s))
+	case FieldDuration:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Expected field \"%s\" to be duration string, got %v", self.Name, v))
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, errors.New(fmt.Sprintf("Expected field \"%s\" to be non-negative duration, got %v", self.Name, v))
+		}
+		return d, nil
+	case FieldAny:
+		return v, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown type \"%s\" of field \"%s\"", self.Type, self.Name))
+}
+
+/*
+Check a config arg against the schema and get it as an object with all the fields:
+strings for FieldString, time.Duration for FieldDuration and defaults for missing ones.
+*/
+func (self ConfigSchema) Parse(arg interface{}) (map[string]interface{}, error) {
+	if s, ok := arg.(string); ok && self.Short != "" {
+		arg = map[string]interface{}{self.Short: s}
+	}
+	if _, ok := arg.(string); (ok || arg == nil) && len(self.Fields) == 0 {
+		arg = map[string]interface{}{}
+	}
+
+	cfg, ok := arg.(map[string]interface{})
+	if !ok {
+		if self.Short != "" {
+			return nil, errors.New(fmt.Sprintf("ConfigSchema.Parse: Expected string or object, got %v", arg))
+		}
+		return nil, errors.New(fmt.Sprintf("ConfigSchema.Parse: Expected object, got %v", arg))
+	}
+
+	for k, _ := range cfg {
+		if _, ok := self.field(k); !ok {
+			return nil, errors.New(fmt.Sprintf("ConfigSchema.Parse: Unknown field \"%s\"", k))
+		}
+	}
+
+	res := make(map[string]interface{}, len(self.Fields))
+	for _, f := range self.Fields {
+		v, ok := cfg[f.Name]
+		if !ok {
+			if f.Required {
+				return nil, errors.New(fmt.Sprintf("ConfigSchema.Parse: Missing field \"%s\"", f.Name))
+			}
+
+			res[f.Name] = f.Default
+			continue
+		}
+
+		pv, err := f.parse(v)
+		if err != nil {
+			return nil, errors.New("ConfigSchema.Parse: " + err.Error())
+		}
+		res[f.Name] = pv
+	}
+	return res, nil
+}
@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Get a config as it would be read from JSON.
+func jsonConfig(t *testing.T, cfg interface{}) interface{} {
+	data, err := json.Marshal(cfg)
+	assert.Nil(t, err)
+
+	var res interface{}
+	assert.Nil(t, json.Unmarshal(data, &res))
+	return res
+}
+
+// Test that config schemas fill defaults and reject invalid args.
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema{"dir", []ConfigField{
+		ConfigField{"dir", FieldString, true, nil, nil},
+		ConfigField{"mode", FieldString, false, "a", []string{"a", "b"}},
+		ConfigField{"interval", FieldDuration, false, time.Duration(0), nil},
+		ConfigField{"extra", FieldAny, false, nil, nil},
+	}}
+
+	examples := []struct {
+		Arg interface{}
+		Res map[string]interface{}
+		Ok  bool
+	}{
+		{"/tmp", map[string]interface{}{"dir": "/tmp", "mode": "a", "interval": time.Duration(0), "extra": nil}, true},
+		{map[string]interface{}{"dir": "/tmp", "mode": "b", "interval": "1s", "extra": 1.0}, map[string]interface{}{"dir": "/tmp", "mode": "b", "interval": time.Second, "extra": 1.0}, true},
+		{map[string]interface{}{"mode": "b"}, nil, false},
+		{map[string]interface{}{"dir": "/tmp", "mode": "c"}, nil, false},
+		{map[string]interface{}{"dir": "/tmp", "interval": 1.0}, nil, false},
+		{map[string]interface{}{"dir": "/tmp", "interval": "-1s"}, nil, false},
+		{map[string]interface{}{"dir": 1.0}, nil, false},
+		{map[string]interface{}{"dir": "/tmp", "bad": 1.0}, nil, false},
+		{1.0, nil, false},
+		{nil, nil, false},
+	}
+	for _, e := range examples {
+		res, err := schema.Parse(e.Arg)
+		if !e.Ok {
+			assert.NotNil(t, err, fmt.Sprint(e.Arg))
+			continue
+		}
+
+		assert.Nil(t, err, fmt.Sprint(e.Arg))
+		assert.Equal(t, e.Res, res, fmt.Sprint(e.Arg))
+	}
+
+	res, err := ConfigSchema{}.Parse(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{}, res)
+
+	res, err = ConfigSchema{}.Parse("ignored")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{}, res)
+}
+
+// Test that backends created from their configs have the same configs, with options and retention policies.
+func TestConfigRoundTrip(t *testing.T) {
+	RegisterDefault()
+
+	dir := t.TempDir()
+	examples := []struct {
+		Type string
+		Arg  interface{}
+	}{
+		{"mem", nil},
+		{"dir", dir + "/dir"},
+		{"dir", map[string]interface{}{"dir": dir + "/group", "sync": DirSyncGroup, "sync_interval": "5ms", "compression": CompressionZstd}},
+		{"dir", map[string]interface{}{"dir": dir + "/fsync", "sync": DirSyncAlways}},
+		{"bolt", dir + "/bolt"},
+		{"sqlite", dir + "/sqlite.db"},
+		{"ledis", dir + "/ledis"},
+	}
+	for _, e := range examples {
+		b, err := Create(e.Type, e.Arg)
+		if !assert.Nil(t, err, e.Type) {
+			continue
+		}
+
+		rb, ok := b.(RetentionBackend)
+		if assert.True(t, ok, e.Type) {
+			assert.Nil(t, rb.SetRetention("s", Retention{5, time.Hour, 1024}), e.Type)
+		}
+
+		cfg, err := b.Config()
+		assert.Nil(t, err, e.Type)
+		assert.Equal(t, e.Type, cfg.(map[string]interface{})["type"])
+		assert.Nil(t, b.Close(), e.Type)
+
+		jcfg := jsonConfig(t, cfg)
+		b, err = CreateConfig(jcfg)
+		if !assert.Nil(t, err, e.Type) {
+			continue
+		}
+
+		cfg2, err := b.Config()
+		assert.Nil(t, err, e.Type)
+		assert.Equal(t, jcfg, jsonConfig(t, cfg2), e.Type)
+		assert.Nil(t, b.Close(), e.Type)
+	}
+}
+
+// Test that invalid configs are rejected.
+func TestConfigInvalid(t *testing.T) {
+	RegisterDefault()
+
+	dir := t.TempDir()
+	examples := []interface{}{
+		map[string]interface{}{"type": "dir", "arg": map[string]interface{}{"dir": dir, "sync": "bad"}},
+		map[string]interface{}{"type": "dir", "arg": map[string]interface{}{"dir": dir, "sync_interval": 5.0}},
+		map[string]interface{}{"type": "dir", "arg": map[string]interface{}{"dir": dir, "compresion": CompressionZstd}},
+		map[string]interface{}{"type": "dir", "arg": map[string]interface{}{"sync": DirSyncNone}},
+		map[string]interface{}{"type": "dir", "arg": 5.0},
+		map[string]interface{}{"type": "http", "arg": map[string]interface{}{"url": "http://localhost", "timeout": "x"}},
+		map[string]interface{}{"type": "mem", "arg": nil, "foo": 1.0},
+		map[string]interface{}{"type": "mem", "arg": nil, "retention": map[string]interface{}{"s": map[string]interface{}{"bad": 1.0}}},
+		map[string]interface{}{"type": "nil", "arg": nil, "retention": map[string]interface{}{"s": map[string]interface{}{"max_count": 1.0}}},
+		map[string]interface{}{"type": "unknown", "arg": nil},
+		map[string]interface{}{"arg": nil},
+		"mem",
+	}
+	for _, e := range examples {
+		_, err := CreateConfig(e)
+		assert.NotNil(t, err, fmt.Sprint(e))
+	}
+}
+
+// Test that backends without config fields still accept plain string args and no arg at all.
+func TestConfigPlain(t *testing.T) {
+	RegisterDefault()
+
+	examples := []struct {
+		Type string
+		Arg  interface{}
+	}{
+		{"mem", ""},
+		{"mem", "anything"},
+		{"mem", nil},
+		{"nil", ""},
+		{"nil", nil},
+	}
+	for _, e := range examples {
+		b, err := Create(e.Type, e.Arg)
+		if !assert.Nil(t, err, fmt.Sprint(e)) {
+			continue
+		}
+		assert.Nil(t, b.Close(), fmt.Sprint(e))
+	}
+}
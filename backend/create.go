@@ -1,9 +1,10 @@
 package backend
 
 import (
-	"errors"
 	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
 	"sync"
+	"time"
 )
 
 // BackendCreator is a function that created a specific type of backend from config.
@@ -11,6 +12,7 @@ type BackendCreator func(args interface{}) (Backend, error)
 
 var block sync.Mutex
 var backends map[string]BackendCreator
+var schemas map[string]ConfigSchema
 
 // Register backend creator by backend type.
 func RegisterCreator(btype string, creator BackendCreator) error {
@@ -30,6 +32,42 @@ func RegisterCreator(btype string, creator BackendCreator) error {
 	return nil
 }
 
+/*
+Register backend creator by backend type with a schema of it's arg.
+
+The creator gets the arg parsed with ConfigSchema.Parse, so it doesn't have to validate it.
+*/
+func RegisterSchemaCreator(btype string, schema ConfigSchema, creator func(cfg map[string]interface{}) (Backend, error)) error {
+	err := RegisterCreator(btype, func(arg interface{}) (Backend, error) {
+		cfg, err := schema.Parse(arg)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Create: Invalid arg of backend type \"%s\": %s", btype, err.Error()))
+		}
+		return creator(cfg)
+	})
+	if err != nil {
+		return err
+	}
+
+	block.Lock()
+	defer block.Unlock()
+
+	if schemas == nil {
+		schemas = map[string]ConfigSchema{}
+	}
+	schemas[btype] = schema
+	return nil
+}
+
+// Get a schema of a backend type arg, if it was registered with one.
+func Schema(btype string) (ConfigSchema, bool) {
+	block.Lock()
+	defer block.Unlock()
+
+	res, ok := schemas[btype]
+	return res, ok
+}
+
 // Create a backend by it's type and config.
 func Create(btype string, args interface{}) (Backend, error) {
 	block.Lock()
@@ -54,33 +92,84 @@ func CreatorTypes() []string {
 	return res
 }
 
+/*
+Create a backend from it's full config as returned by Backend.Config():
+an object with the "type" and "arg" fields, which are passed to Create,
+and an optional "retention" field, which is passed to SetRetentionConfig.
+*/
+func CreateConfig(icfg interface{}) (Backend, error) {
+	cfg, ok := icfg.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("CreateConfig: Expected object, got %v", icfg))
+	}
+
+	for k, _ := range cfg {
+		switch k {
+		case "type", "arg", "retention":
+		// set by remote backends, which are created the same way
+		case "remote":
+		default:
+			return nil, errors.New(fmt.Sprintf("CreateConfig: Unknown field \"%s\"", k))
+		}
+	}
+
+	btype, ok := cfg["type"].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("CreateConfig: Expected field \"type\" to be string, got %v", cfg["type"]))
+	}
+
+	b, err := Create(btype, cfg["arg"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SetRetentionConfig(b, cfg["retention"]); err != nil {
+		return nil, errors.List().Add(err).Add(b.Close()).Err()
+	}
+	return b, nil
+}
+
 // Register backend creators provided by this library.
 func RegisterDefault() {
-	RegisterCreator("nil", func(arg interface{}) (Backend, error) {
+	RegisterSchemaCreator("nil", ConfigSchema{}, func(cfg map[string]interface{}) (Backend, error) {
 		return NewNil(), nil
 	})
-	RegisterCreator("mem", func(arg interface{}) (Backend, error) {
+	RegisterSchemaCreator("mem", ConfigSchema{}, func(cfg map[string]interface{}) (Backend, error) {
 		return NewMem(), nil
 	})
-	RegisterCreator("ledis", func(arg interface{}) (Backend, error) {
-		dir, ok := arg.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("ledis creator: Expected string as arg, got %v", arg))
-		}
-		return NewLedis(dir)
+	RegisterSchemaCreator("ledis", ConfigSchema{"dir", []ConfigField{
+		ConfigField{"dir", FieldString, true, nil, nil},
+	}}, func(cfg map[string]interface{}) (Backend, error) {
+		return NewLedis(cfg["dir"].(string))
 	})
-	RegisterCreator("http", func(arg interface{}) (Backend, error) {
-		url, ok := arg.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("http-default creator: Expected string as arg, got %v", arg))
-		}
-		return NewHttp(url, nil), nil
+	// config of the http backend also has a config of the remote backend in the "base" field of it's arg
+	RegisterSchemaCreator("http", ConfigSchema{"url", []ConfigField{
+		ConfigField{"url", FieldString, true, nil, nil},
+		ConfigField{"timeout", FieldDuration, false, time.Duration(0), nil},
+		ConfigField{"base", FieldAny, false, nil, nil},
+	}}, func(cfg map[string]interface{}) (Backend, error) {
+		return NewHttpTimeout(cfg["url"].(string), cfg["timeout"].(time.Duration)), nil
 	})
-	RegisterCreator("dir", func(arg interface{}) (Backend, error) {
-		dir, ok := arg.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("dir creator: Expected string as arg, got %v", arg))
-		}
-		return NewDir(dir)
+	RegisterSchemaCreator("dir", ConfigSchema{"dir", []ConfigField{
+		ConfigField{"dir", FieldString, true, nil, nil},
+		ConfigField{"sync", FieldString, false, DirSyncNone, []string{DirSyncNone, DirSyncAlways, DirSyncGroup}},
+		ConfigField{"sync_interval", FieldDuration, false, time.Duration(0), nil},
+		ConfigField{"compression", FieldString, false, CompressionNone, []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy}},
+	}}, func(cfg map[string]interface{}) (Backend, error) {
+		return NewDirOptions(cfg["dir"].(string), DirOptions{
+			cfg["sync"].(string),
+			cfg["sync_interval"].(time.Duration),
+			cfg["compression"].(string),
+		})
+	})
+	RegisterSchemaCreator("bolt", ConfigSchema{"dir", []ConfigField{
+		ConfigField{"dir", FieldString, true, nil, nil},
+	}}, func(cfg map[string]interface{}) (Backend, error) {
+		return NewBolt(cfg["dir"].(string))
+	})
+	RegisterSchemaCreator("sqlite", ConfigSchema{"path", []ConfigField{
+		ConfigField{"path", FieldString, true, nil, nil},
+	}}, func(cfg map[string]interface{}) (Backend, error) {
+		return NewSqlite(cfg["path"].(string))
 	})
 }
@@ -3,44 +3,1364 @@ package backend
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/Monnoroch/golfstream/errors"
 	"github.com/Monnoroch/golfstream/stream"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Max size of a segment file, after which a new segment is started.
+var dirSegmentSize int64 = 16 * 1024 * 1024
+
+const (
+	// Number of bytes between entries of a sparse offset index of a segment.
+	dirIndexInterval = 4 * 1024
+	// Size of an index entry in the index file.
+	dirIndexEntrySize = 24
+	// Size of a record header: length of the event and a checksum of the length and the event.
+	dirRecordHeaderSize = 8
+	// Max size of an event, a record claiming to be bigger is corrupted.
+	dirMaxRecordSize = 1 << 30
+	// Size of records compressed together in compressed segments.
+	dirBlockSize = 64 * 1024
+	// Size of the end of a compressed segment's footer: number of events, time of the last one, number of index entries and a checksum.
+	dirFooterSize = 24
+)
+
+// Magic bytes at the beginning of segments with framed records, segments of older versions just have events separated by newlines.
+var dirSegmentMagic = []byte("GSSEG01\n")
+
+// Magic bytes at the beginning of compressed segments, followed by the codec id.
+var dirCompressedMagic = []byte("GSSEGZ1\n")
+
+var dirCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A partially written or corrupted record.
+var errDirTornRecord = errors.New("torn or corrupted record")
+
+func appendRecord(buf []byte, evt []byte) []byte {
+	var header [dirRecordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(evt)))
+	crc := crc32.Update(crc32.Checksum(header[:4], dirCrcTable), dirCrcTable, evt)
+	binary.BigEndian.PutUint32(header[4:], crc)
+	return append(append(buf, header[:]...), evt...)
+}
+
+// An entry of a sparse offset index: number of the event in the segment, it's position in the segment file and time when it was added in nanoseconds.
+type dirIndexEntry struct {
+	num  uint64
+	pos  int64
+	time int64
+}
+
+/*
+A segment of a stream: an append-only file with events framed as records with checksums and a sparse index file,
+which has entries for events every dirIndexInterval bytes so that finding an event by number only reads a small part of the segment.
+
+Segments which are not appended to anymore might be compressed: their records are compressed in blocks
+and the index with an entry for each block is in the footer of the file instead of the index file.
+*/
+type dirSegment struct {
+	seq   uint64
+	count uint64
+	size  int64
+	index []dirIndexEntry
+	// bytes since the last index entry
+	sinceIndex int64
+	// time when the last event was added
+	mtime time.Time
+	// events are separated by newlines instead of being framed, such segments are never appended to
+	legacy bool
+	// codec of a compressed segment or nil
+	codec *codec
+	// number of readers of the segment
+	pins int
+	// another name of the segment's file, kept for it's readers after it was rewritten or removed, the last reader removes it
+	detached string
+}
+
+// Position of the first event or block in the segment file.
+func (self *dirSegment) start() int64 {
+	if self.legacy {
+		return 0
+	}
+	if self.codec != nil {
+		return int64(len(dirCompressedMagic) + 1)
+	}
+	return int64(len(dirSegmentMagic))
+}
+
+// Position of the footer of a compressed segment, which is the end of the blocks.
+func (self *dirSegment) end() int64 {
+	if self.codec == nil {
+		return self.size
+	}
+	return self.size - int64(len(self.index)*dirIndexEntrySize+dirFooterSize)
+}
+
+// Size of an event in the segment file.
+func (self *dirSegment) recordSize(evt []byte) int64 {
+	if self.legacy {
+		return int64(len(evt) + 1)
+	}
+	return int64(len(evt) + dirRecordHeaderSize)
+}
+
+// Read the next event of the segment, returns io.EOF at the end of the segment and errDirTornRecord for a broken record.
+func (self *dirSegment) readRecord(reader *bufio.Reader) ([]byte, error) {
+	if !self.legacy {
+		return readRecord(reader)
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && len(line) != 0 {
+		return nil, errDirTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return line[:len(line)-1], nil
+}
+
+// Read a record written by appendRecord.
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	var header [dirRecordHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errDirTornRecord
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > dirMaxRecordSize {
+		return nil, errDirTornRecord
+	}
+
+	evt := make([]byte, size)
+	if _, err := io.ReadFull(reader, evt); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errDirTornRecord
+		}
+		return nil, err
+	}
+
+	if crc32.Update(crc32.Checksum(header[:4], dirCrcTable), dirCrcTable, evt) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errDirTornRecord
+	}
+	return evt, nil
+}
+
+// Account for an event of a given size appended to the segment at a given time, returns a new index entry if there should be one for this event.
+func (self *dirSegment) push(size int64, t time.Time) (dirIndexEntry, bool) {
+	self.mtime = t
+
+	var entry dirIndexEntry
+	ok := false
+	if self.sinceIndex >= dirIndexInterval {
+		entry = dirIndexEntry{self.count, self.size, t.UnixNano()}
+		self.index = append(self.index, entry)
+		self.sinceIndex = 0
+		ok = true
+	}
+
+	self.count++
+	self.size += size
+	self.sinceIndex += size
+	return entry, ok
+}
+
+// Find the closest index entry before the event with a given number.
+func (self *dirSegment) seek(num uint64) dirIndexEntry {
+	i := sort.Search(len(self.index), func(i int) bool {
+		return self.index[i].num > num
+	})
+	if i == 0 {
+		return dirIndexEntry{0, self.start(), 0}
+	}
+	return self.index[i-1]
+}
+
+// Get the latest time the event with a given number could have been added at.
+func (self *dirSegment) timeOf(num uint64) time.Time {
+	i := sort.Search(len(self.index), func(i int) bool {
+		return self.index[i].num >= num
+	})
+	if i == len(self.index) {
+		return self.mtime
+	}
+	return time.Unix(0, self.index[i].time)
+}
+
+func encodeIndexEntry(entry dirIndexEntry) []byte {
+	buf := make([]byte, dirIndexEntrySize)
+	binary.BigEndian.PutUint64(buf, entry.num)
+	binary.BigEndian.PutUint64(buf[8:], uint64(entry.pos))
+	binary.BigEndian.PutUint64(buf[16:], uint64(entry.time))
+	return buf
+}
+
+func decodeIndexEntry(data []byte) dirIndexEntry {
+	return dirIndexEntry{
+		binary.BigEndian.Uint64(data),
+		int64(binary.BigEndian.Uint64(data[8:])),
+		int64(binary.BigEndian.Uint64(data[16:])),
+	}
+}
+
+// A reader of events of a segment in any format.
+type dirSegmentReader struct {
+	seg    *dirSegment
+	file   *os.File
+	reader *bufio.Reader
+	// position of the next block of a compressed segment, the end of blocks and the rest of the current block
+	pos   int64
+	end   int64
+	block *bufio.Reader
+}
+
+// Read the next event, returns io.EOF at the end of the segment and errDirTornRecord for a broken record.
+func (self *dirSegmentReader) next() ([]byte, error) {
+	if self.seg.codec == nil {
+		return self.seg.readRecord(self.reader)
+	}
+
+	for {
+		if self.block != nil {
+			evt, err := readRecord(self.block)
+			if err != io.EOF {
+				return evt, err
+			}
+			self.block = nil
+		}
+
+		if self.pos >= self.end {
+			return nil, io.EOF
+		}
+
+		data, err := readRecord(self.reader)
+		if err == io.EOF {
+			return nil, errDirTornRecord
+		}
+		if err != nil {
+			return nil, err
+		}
+		self.pos += int64(len(data) + dirRecordHeaderSize)
+
+		block, err := self.seg.codec.decompress(data)
+		if err != nil {
+			return nil, err
+		}
+		self.block = bufio.NewReader(bytes.NewReader(block))
+	}
+}
+
+// Call a function for each event left in the segment, numbered starting with a given number, until it returns an error.
+func (self *dirSegmentReader) scan(num uint64, fn func(uint64, []byte) error) error {
+	for {
+		evt, err := self.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(num, evt); err != nil {
+			return err
+		}
+		num++
+	}
+}
+
+func (self *dirSegmentReader) close() error {
+	return self.file.Close()
+}
+
+// A writer of a new segment, compressed if it has a codec.
+type dirSegmentWriter struct {
+	seg    *dirSegment
+	writer *bufio.Writer
+	// records of the current block of a compressed segment and it's index entry
+	block []byte
+	entry dirIndexEntry
+}
+
+func newDirSegmentWriter(w io.Writer, seq uint64, c *codec) (*dirSegmentWriter, error) {
+	header := dirSegmentMagic
+	if c != nil {
+		header = append(append([]byte{}, dirCompressedMagic...), c.id)
+	}
+
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	seg := &dirSegment{seq, 0, int64(len(header)), []dirIndexEntry{}, 0, time.Time{}, false, c, 0, ""}
+	return &dirSegmentWriter{seg, writer, []byte{}, dirIndexEntry{}}, nil
+}
+
+func (self *dirSegmentWriter) add(evt []byte, t time.Time) error {
+	if self.seg.codec == nil {
+		self.seg.push(self.seg.recordSize(evt), t)
+		_, err := self.writer.Write(appendRecord(nil, evt))
+		return err
+	}
+
+	if len(self.block) == 0 {
+		self.entry = dirIndexEntry{self.seg.count, self.seg.size, t.UnixNano()}
+	}
+
+	self.block = appendRecord(self.block, evt)
+	self.seg.count++
+	self.seg.mtime = t
+	if len(self.block) >= dirBlockSize {
+		return self.flushBlock()
+	}
+	return nil
+}
+
+func (self *dirSegmentWriter) flushBlock() error {
+	if len(self.block) == 0 {
+		return nil
+	}
+
+	data, err := self.seg.codec.compress(self.block)
+	if err != nil {
+		return err
+	}
+
+	rec := appendRecord(nil, data)
+	if _, err := self.writer.Write(rec); err != nil {
+		return err
+	}
+
+	self.seg.index = append(self.seg.index, self.entry)
+	self.seg.size += int64(len(rec))
+	self.block = self.block[:0]
+	return nil
+}
+
+// Write the rest of the segment and the footer of a compressed segment.
+func (self *dirSegmentWriter) finish() error {
+	if self.seg.codec == nil {
+		return self.writer.Flush()
+	}
+
+	if err := self.flushBlock(); err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, len(self.seg.index)*dirIndexEntrySize+dirFooterSize)
+	for _, entry := range self.seg.index {
+		footer = append(footer, encodeIndexEntry(entry)...)
+	}
+
+	var tail [dirFooterSize]byte
+	binary.BigEndian.PutUint64(tail[:], self.seg.count)
+	binary.BigEndian.PutUint64(tail[8:], uint64(self.seg.mtime.UnixNano()))
+	binary.BigEndian.PutUint32(tail[16:], uint32(len(self.seg.index)))
+	footer = append(footer, tail[:dirFooterSize-4]...)
+	footer = append(footer, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(footer[len(footer)-4:], crc32.Checksum(footer[:len(footer)-4], dirCrcTable))
+
+	if _, err := self.writer.Write(footer); err != nil {
+		return err
+	}
+
+	self.seg.size += int64(len(footer))
+	return self.writer.Flush()
+}
+
+/*
+A stream stored in a directory as a list of segments.
+
+Events are addressed by their number in a concatenation of all segments,
+skip events at the beginning of the first segment are deleted and
+are stored in the head file along with the first segment's sequence number
+and the base: the number of events ever deleted from the beginning of the stream.
+*/
 type dirStreamObj struct {
 	back *dirBackend
 	name string
 	lock sync.Mutex
+
+	segs    []*dirSegment
+	skip    uint64
+	base    uint64
+	nextSeq uint64
+
+	// last segment files opened for appending
+	file *os.File
+	idx  *os.File
+
+	// full segments are being compressed
+	compacting bool
+	// number of segment files detached for readers, to name them
+	detaches uint64
+}
+
+func (self *dirStreamObj) path() string {
+	return self.back.dir + "/" + self.name
+}
+
+func (self *dirStreamObj) segPath(seq uint64, ext string) string {
+	return fmt.Sprintf("%s/%020d.%s", self.path(), seq, ext)
+}
+
+func (self *dirStreamObj) headPath() string {
+	return self.path() + "/head"
+}
+
+// Convert a stream in an old format, just a single file, to a segment.
+func (self *dirStreamObj) migrate() error {
+	tmp := self.back.dir + "/." + self.name + ".migrate"
+
+	st, err := os.Lstat(self.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil && st.Mode().IsRegular() {
+		if err := os.MkdirAll(tmp, 0777); err != nil {
+			return err
+		}
+
+		if err := os.Rename(self.path(), fmt.Sprintf("%s/%020d.log", tmp, 0)); err != nil {
+			return err
+		}
+	} else if err == nil {
+		return nil
+	}
+
+	// the migration might have been interrupted
+	if _, err := os.Stat(tmp); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Rename(tmp, self.path())
+}
+
+func (self *dirStreamObj) load() error {
+	if err := self.migrate(); err != nil {
+		return err
+	}
+
+	fs, err := ioutil.ReadDir(self.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	seqs := []uint64{}
+	for _, f := range fs {
+		// nobody reads files detached before a restart
+		if strings.HasSuffix(f.Name(), ".detached") {
+			if err := os.Remove(self.path() + "/" + f.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(f.Name(), ".log") {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(uint64s(seqs))
+
+	hseq, skip, base, err := self.readHead()
+	if err != nil {
+		return err
+	}
+
+	self.base = base
+	// all segments might be deleted, new ones still go after the head
+	self.nextSeq = hseq
+
+	for _, seq := range seqs {
+		// the deletion of segments before the head might have been interrupted
+		if seq < hseq {
+			if err := self.rmSegment(seq); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seg, err := self.loadSegment(seq)
+		if err != nil {
+			return err
+		}
+
+		self.segs = append(self.segs, seg)
+		self.nextSeq = seq + 1
+	}
+
+	if len(self.segs) != 0 && self.segs[0].seq == hseq && skip <= self.segs[0].count {
+		self.skip = skip
+	}
+	return nil
+}
+
+// Head files written by older versions don't have the base.
+func (self *dirStreamObj) readHead() (uint64, uint64, uint64, error) {
+	data, err := ioutil.ReadFile(self.headPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, 0, nil
+		}
+		return 0, 0, 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 && len(fields) != 3 {
+		return 0, 0, 0, errors.New(fmt.Sprintf("dirStreamObj.readHead: Invalid head file %s: Expected 2 or 3 numbers, got %v", self.headPath(), len(fields)))
+	}
+
+	res := [3]uint64{}
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, 0, errors.New(fmt.Sprintf("dirStreamObj.readHead: Invalid head file %s: %s", self.headPath(), err.Error()))
+		}
+		res[i] = n
+	}
+	return res[0], res[1], res[2], nil
+}
+
+// Without segments the head keeps the base and the sequence number of the next segment.
+func (self *dirStreamObj) writeHead() (rerr error) {
+	if len(self.segs) == 0 && self.base == 0 {
+		if err := os.Remove(self.headPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(self.path(), "head")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			rerr = errors.List().Add(rerr).Add(os.Remove(tmp.Name())).Err()
+		}
+	}()
+
+	seq := self.nextSeq
+	if len(self.segs) != 0 {
+		seq = self.segs[0].seq
+	}
+
+	if _, err := fmt.Fprintf(tmp, "%d %d %d", seq, self.skip, self.base); err != nil {
+		return errors.List().Add(err).Add(tmp.Close()).Err()
+	}
+
+	if err := self.back.syncFile(tmp); err != nil {
+		return errors.List().Add(err).Add(tmp.Close()).Err()
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), self.headPath()); err != nil {
+		return err
+	}
+	return self.back.syncDir(self.path())
+}
+
+/*
+Find out the format of a segment file by it's magic bytes: legacy, compressed with a codec or framed.
+
+Files with partially written magic bytes are framed.
+*/
+func (self *dirStreamObj) segmentFormat(seq uint64) (rlegacy bool, rcodec *codec, rerr error) {
+	file, err := os.Open(self.segPath(seq, "log"))
+	if err != nil {
+		return false, nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
+	}()
+
+	buf := make([]byte, len(dirCompressedMagic)+1)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, nil, err
+	}
+
+	if n == len(buf) && bytes.Equal(buf[:n-1], dirCompressedMagic) {
+		c, err := codecById(buf[n-1])
+		return false, c, err
+	}
+
+	if n > len(dirSegmentMagic) {
+		n = len(dirSegmentMagic)
+	}
+	return !bytes.Equal(buf[:n], dirSegmentMagic[:n]), nil, nil
+}
+
+// Load a compressed segment from it's footer.
+func (self *dirStreamObj) loadCompressed(seq uint64, c *codec, size int64) (rseg *dirSegment, rerr error) {
+	file, err := os.Open(self.segPath(seq, "log"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
+	}()
+
+	corrupted := errors.New(fmt.Sprintf("dirStreamObj.loadCompressed: corrupted footer of segment %s", self.segPath(seq, "log")))
+	start := int64(len(dirCompressedMagic) + 1)
+	if size < start+dirFooterSize {
+		return nil, corrupted
+	}
+
+	tail := make([]byte, dirFooterSize)
+	if _, err := file.ReadAt(tail, size-dirFooterSize); err != nil {
+		return nil, err
+	}
+
+	n := int64(binary.BigEndian.Uint32(tail[16:]))
+	footerSize := n*dirIndexEntrySize + dirFooterSize
+	if footerSize > size-start {
+		return nil, corrupted
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, size-footerSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(footer[:footerSize-4], dirCrcTable) != binary.BigEndian.Uint32(footer[footerSize-4:]) {
+		return nil, corrupted
+	}
+
+	mtime := time.Unix(0, int64(binary.BigEndian.Uint64(tail[8:])))
+	seg := &dirSegment{seq, binary.BigEndian.Uint64(tail), size, make([]dirIndexEntry, n), 0, mtime, false, c, 0, ""}
+	for i := range seg.index {
+		seg.index[i] = decodeIndexEntry(footer[i*dirIndexEntrySize:])
+	}
+	return seg, nil
+}
+
+/*
+Load segment's size, number of events and index.
+
+Only the part of the segment after the last index entry is read,
+missing index entries for that part are appended to the index file.
+A torn tail of the segment, left by a crash in the middle of a write, is truncated.
+*/
+func (self *dirStreamObj) loadSegment(seq uint64) (rseg *dirSegment, rerr error) {
+	st, err := os.Stat(self.segPath(seq, "log"))
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, c, err := self.segmentFormat(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil {
+		return self.loadCompressed(seq, c, st.Size())
+	}
+
+	seg := &dirSegment{seq, 0, 0, []dirIndexEntry{}, 0, st.ModTime(), legacy, nil, 0, ""}
+	if !legacy && st.Size() <= seg.start() {
+		// magic bytes might be partially written, they are written again on the next Add
+		if err := os.Truncate(self.segPath(seq, "log"), 0); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(self.segPath(seq, "idx")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return seg, nil
+	}
+
+	data, err := ioutil.ReadFile(self.segPath(seq, "idx"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for i := 0; i+dirIndexEntrySize <= len(data); i += dirIndexEntrySize {
+		entry := decodeIndexEntry(data[i:])
+		if entry.pos < seg.start() || entry.pos >= st.Size() {
+			break
+		}
+		if l := len(seg.index); l != 0 && (entry.num <= seg.index[l-1].num || entry.pos <= seg.index[l-1].pos) {
+			break
+		}
+
+		seg.index = append(seg.index, entry)
+	}
+
+	idx, err := os.OpenFile(self.segPath(seq, "idx"), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(idx.Close()).Err()
+		if rerr != nil {
+			rseg = nil
+		}
+	}()
+
+	// drop a broken part of the index
+	if err := idx.Truncate(int64(len(seg.index) * dirIndexEntrySize)); err != nil {
+		return nil, err
+	}
+	if _, err := idx.Seek(0, os.SEEK_END); err != nil {
+		return nil, err
+	}
+
+	last := seg.seek(^uint64(0))
+	seg.count = last.num
+	seg.size = last.pos
+
+	// the modification time of the file is the latest time events could have been added at
+	err = self.scanSegment(seg, last, func(num uint64, evt []byte) error {
+		entry, ok := seg.push(seg.recordSize(evt), st.ModTime())
+		if !ok {
+			return nil
+		}
+
+		_, err := idx.Write(encodeIndexEntry(entry))
+		return err
+	})
+	if err != nil && err != errDirTornRecord {
+		return nil, err
+	}
+
+	if seg.size == st.Size() {
+		return seg, nil
+	}
+
+	// drop the torn tail, the last index entry might point to it
+	if err := os.Truncate(self.segPath(seq, "log"), seg.size); err != nil {
+		return nil, err
+	}
+
+	if l := len(seg.index); l != 0 && seg.index[l-1].pos >= seg.size {
+		seg.index = seg.index[:l-1]
+		if err := idx.Truncate(int64(len(seg.index) * dirIndexEntrySize)); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+/*
+Call a function for each event in the segment, starting with a given index entry, until it returns an error.
+
+Returns errDirTornRecord if the segment has a broken record.
+*/
+func (self *dirStreamObj) scanSegment(seg *dirSegment, from dirIndexEntry, fn func(uint64, []byte) error) (rerr error) {
+	reader, err := self.openSegment(seg, from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(reader.close()).Err()
+	}()
+
+	return reader.scan(from.num, fn)
+}
+
+// Open a segment for reading starting with a given index entry.
+func (self *dirStreamObj) openSegment(seg *dirSegment, from dirIndexEntry) (*dirSegmentReader, error) {
+	path := seg.detached
+	if path == "" {
+		path = self.segPath(seg.seq, "log")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(from.pos, os.SEEK_SET); err != nil {
+		return nil, errors.List().Add(err).Add(file.Close()).Err()
+	}
+
+	// the last segment might be appended to, but it's never compressed
+	end := int64(0)
+	if seg.codec != nil {
+		end = seg.end()
+	}
+	return &dirSegmentReader{seg, file, bufio.NewReader(file), from.pos, end, nil}, nil
+}
+
+func (self *dirStreamObj) rmSegment(seq uint64) error {
+	err := os.Remove(self.segPath(seq, "idx"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(self.segPath(seq, "log"))
+}
+
+// Link the file of a segment being read to another name for it's readers, so that the segment can be rewritten or removed.
+func (self *dirStreamObj) detach(seg *dirSegment) error {
+	if seg.pins == 0 {
+		return nil
+	}
+
+	self.detaches++
+	path := self.segPath(seg.seq, fmt.Sprintf("%d.detached", self.detaches))
+	if err := os.Link(self.segPath(seg.seq, "log"), path); err != nil {
+		return err
+	}
+
+	seg.detached = path
+	return nil
+}
+
+/*
+Rewrite the segment without the events for which a function returns true, compressing it with a codec if it's not nil.
+Returns the new segment, which replaces the old one in the stream, the old one is left to it's readers.
+
+Legacy segments are converted to framed records.
+*/
+func (self *dirStreamObj) rewriteSegment(seg *dirSegment, c *codec, drop func(uint64) bool) (*dirSegment, error) {
+	reader, err := self.openSegment(seg, dirIndexEntry{0, seg.start(), 0})
+	if err != nil {
+		return nil, err
+	}
+
+	nseg, path, err := self.writeSegment(seg, reader, c, drop)
+	if err != nil {
+		return nil, err
+	}
+	return nseg, self.swapSegment(seg, nseg, path)
+}
+
+/*
+Write events of a segment read from it's start into a new file, like rewriteSegment does, and close the reader.
+Returns the new segment and the synced file, which replaces the segment's one with swapSegment.
+
+It doesn't need the stream's lock.
+*/
+func (self *dirStreamObj) writeSegment(seg *dirSegment, reader *dirSegmentReader, c *codec, drop func(uint64) bool) (*dirSegment, string, error) {
+	tmp, err := ioutil.TempFile(self.path(), fmt.Sprintf("%020d", seg.seq))
+	if err != nil {
+		return nil, "", errors.List().Add(err).Add(reader.close()).Err()
+	}
+
+	writer, err := newDirSegmentWriter(tmp, seg.seq, c)
+	if err == nil {
+		err = reader.scan(0, func(num uint64, evt []byte) error {
+			if drop(num) {
+				return nil
+			}
+			return writer.add(evt, seg.timeOf(num))
+		})
+	}
+	err = errors.List().Add(err).Add(reader.close()).Err()
+	if err == nil {
+		writer.seg.mtime = seg.mtime
+		err = writer.finish()
+	}
+	if err == nil {
+		err = self.back.syncFile(tmp)
+	}
+	if err != nil {
+		return nil, "", errors.List().Add(err).Add(tmp.Close()).Add(os.Remove(tmp.Name())).Err()
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, "", errors.List().Add(err).Add(os.Remove(tmp.Name())).Err()
+	}
+	return writer.seg, tmp.Name(), nil
+}
+
+// Replace the file of a segment with a file written by writeSegment, detaching the old one if it's being read.
+func (self *dirStreamObj) swapSegment(seg *dirSegment, nseg *dirSegment, path string) (rerr error) {
+	defer func() {
+		if rerr != nil {
+			rerr = errors.List().Add(rerr).Add(os.Remove(path)).Err()
+		}
+	}()
+
+	if err := self.detach(seg); err != nil {
+		return err
+	}
+
+	// an index is rebuilt on load if it's missing, but a stale one is not detected, compressed segments don't need one
+	if err := os.Remove(self.segPath(seg.seq, "idx")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := self.back.syncDir(self.path()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, self.segPath(seg.seq, "log")); err != nil {
+		return err
+	}
+	if err := self.back.syncDir(self.path()); err != nil {
+		return err
+	}
+
+	if nseg.codec != nil {
+		return nil
+	}
+
+	idx := make([]byte, 0, len(nseg.index)*dirIndexEntrySize)
+	for _, entry := range nseg.index {
+		idx = append(idx, encodeIndexEntry(entry)...)
+	}
+	return ioutil.WriteFile(self.segPath(seg.seq, "idx"), idx, 0600)
+}
+
+func (self *dirStreamObj) closeFiles() error {
+	errs := errors.List()
+	if self.file != nil {
+		// writes waiting for a group commit are synced before the file is gone
+		if self.back.opts.Sync == DirSyncGroup {
+			errs.Add(self.file.Sync())
+		}
+		errs.Add(self.file.Close())
+		self.file = nil
+	}
+	if self.idx != nil {
+		errs.Add(self.idx.Close())
+		self.idx = nil
+	}
+	return errs.Err()
+}
+
+// Get the last segment opened for appending, starting a new one if needed or if the last one is legacy.
+func (self *dirStreamObj) active() (*dirSegment, error) {
+	if len(self.segs) != 0 && self.segs[len(self.segs)-1].size >= dirSegmentSize {
+		if err := self.closeFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	if self.file != nil {
+		return self.segs[len(self.segs)-1], nil
+	}
+
+	if err := os.MkdirAll(self.path(), 0777); err != nil {
+		return nil, err
+	}
+
+	if l := len(self.segs); l == 0 || self.segs[l-1].size >= dirSegmentSize || self.segs[l-1].legacy || self.segs[l-1].codec != nil {
+		self.segs = append(self.segs, &dirSegment{self.nextSeq, 0, 0, []dirIndexEntry{}, 0, time.Now(), false, nil, 0, ""})
+		self.nextSeq++
+		self.compactLater()
+	}
+
+	seg := self.segs[len(self.segs)-1]
+	file, err := os.OpenFile(self.segPath(seg.seq, "log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// a missing index of a segment with events is rebuilt on load, appending to it would leave out the entries before
+	flags := os.O_APPEND | os.O_WRONLY
+	if seg.size == 0 {
+		flags |= os.O_CREATE
+	}
+	idx, err := os.OpenFile(self.segPath(seg.seq, "idx"), flags, 0600)
+	if err != nil && !(os.IsNotExist(err) && seg.size != 0) {
+		return nil, errors.List().Add(err).Add(file.Close()).Err()
+	}
+
+	if seg.size == 0 {
+		if _, err := file.Write(dirSegmentMagic); err != nil {
+			return nil, errors.List().Add(err).Add(file.Close()).Add(idx.Close()).Err()
+		}
+		seg.size = int64(len(dirSegmentMagic))
+
+		// the new file and, for a new stream, it's directory have to be synced too
+		if err := errors.List().Add(self.back.syncDir(self.path())).Add(self.back.syncDir(self.back.dir)).Err(); err != nil {
+			return nil, errors.List().Add(err).Add(file.Close()).Add(idx.Close()).Err()
+		}
+	}
+
+	self.file = file
+	self.idx = idx
+	return seg, nil
+}
+
+// Start compressing full segments in the background if the backend compresses them and there are any left uncompressed.
+func (self *dirStreamObj) compactLater() {
+	if self.back.codec == nil || self.compacting || len(self.segs) == 0 {
+		return
+	}
+
+	uncompressed := false
+	for _, seg := range self.segs[:len(self.segs)-1] {
+		if seg.codec == nil {
+			uncompressed = true
+		}
+	}
+	if !uncompressed {
+		return
+	}
+
+	self.compacting = true
+	self.back.compactions.Add(1)
+	go func() {
+		defer self.back.compactions.Done()
+
+		if err := self.compact(); err != nil {
+			log.Println(fmt.Sprintf("dirStreamObj.compact: failed to compress segments of stream \"%s\": %s", self.name, err.Error()))
+		}
+	}()
+}
+
+/*
+Compress all segments but the last one, which might be appended to.
+
+Segments are compressed one by one without holding the lock, so events are added, read and deleted meanwhile.
+A compressed segment replaces the original one only if it was not rewritten or removed and is not being read,
+skipped segments are compressed after the next segment is started.
+*/
+func (self *dirStreamObj) compact() error {
+	tried := map[*dirSegment]bool{}
+	for {
+		seg, reader, err := self.nextUncompressed(tried)
+		if err != nil || seg == nil {
+			return err
+		}
+		tried[seg] = true
+
+		nseg, path, err := self.writeSegment(seg, reader, self.back.codec, func(uint64) bool {
+			return false
+		})
+		if err == nil {
+			err = self.swapCompressed(seg, nseg, path)
+		}
+		if err != nil {
+			self.lock.Lock()
+			self.compacting = false
+			self.lock.Unlock()
+			return err
+		}
+	}
+}
+
+// Open the first full uncompressed segment, which is not being read and was not tried yet, or finish compacting if there is none.
+func (self *dirStreamObj) nextUncompressed(tried map[*dirSegment]bool) (*dirSegment, *dirSegmentReader, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.segs) != 0 {
+		for _, seg := range self.segs[:len(self.segs)-1] {
+			if seg.codec != nil || seg.pins != 0 || tried[seg] {
+				continue
+			}
+
+			reader, err := self.openSegment(seg, dirIndexEntry{0, seg.start(), 0})
+			if err != nil {
+				self.compacting = false
+				return nil, nil, err
+			}
+			return seg, reader, nil
+		}
+	}
+
+	self.compacting = false
+	return nil, nil, nil
+}
+
+// Replace a segment with it's compressed version, unless it was rewritten or removed or it's being read.
+func (self *dirStreamObj) swapCompressed(seg *dirSegment, nseg *dirSegment, path string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, s := range self.segs {
+		if s != seg {
+			continue
+		}
+
+		if seg.pins != 0 {
+			break
+		}
+
+		if err := self.swapSegment(seg, nseg, path); err != nil {
+			return err
+		}
+		self.segs[i] = nseg
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// Sync the active segment, if it's closed it was synced on close.
+func (self *dirStreamObj) sync() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.file == nil {
+		return nil
+	}
+	return self.file.Sync()
+}
+
+// Append events and wait until they are synced according to the durability mode of the backend.
+func (self *dirStreamObj) write(bss [][]byte) error {
+	self.lock.Lock()
+	if err := self.add(bss); err != nil {
+		self.lock.Unlock()
+		return err
+	}
+
+	var commit *dirCommit
+	if self.back.opts.Sync == DirSyncGroup {
+		commit = self.back.syncer.add(self)
+	}
+	self.lock.Unlock()
+
+	if commit != nil {
+		return commit.wait(self)
+	}
+
+	// the backend is closed, so there will be no more group commits
+	if self.back.opts.Sync == DirSyncGroup {
+		return self.sync()
+	}
+	return nil
+}
+
+func (self *dirStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("dirStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	return self.write([][]byte{bs})
+}
+
+func (self *dirStreamObj) AddBatch(evts []stream.Event) error {
+	bss := make([][]byte, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("dirStreamObj.AddBatch: Expected []byte, got %v", evt))
+		}
+
+		bss[i] = bs
+	}
+
+	return self.write(bss)
+}
+
+// Append events writing each segment's part of them at once.
+func (self *dirStreamObj) add(bss [][]byte) error {
+	for len(bss) != 0 {
+		seg, err := self.active()
+		if err != nil {
+			return err
+		}
+
+		size := seg.size
+		now := time.Now()
+		buf := []byte{}
+		idx := []byte{}
+		n := 0
+		for ; n < len(bss) && (n == 0 || seg.size < dirSegmentSize); n++ {
+			buf = appendRecord(buf, bss[n])
+			if entry, ok := seg.push(seg.recordSize(bss[n]), now); ok {
+				idx = append(idx, encodeIndexEntry(entry)...)
+			}
+		}
+
+		if _, err := self.file.Write(buf); err != nil {
+			return errors.List().Add(err).Add(self.reloadActive()).Err()
+		}
+
+		if self.back.opts.Sync == DirSyncAlways {
+			// the events might be lost, so they are dropped for a retry not to add them twice
+			if err := self.file.Sync(); err != nil {
+				return errors.List().Add(err).Add(os.Truncate(self.segPath(seg.seq, "log"), size)).Add(self.reloadActive()).Err()
+			}
+		}
+
+		// the events are already written, failing would make a retry add them again
+		if len(idx) != 0 && self.idx != nil {
+			if _, err := self.idx.Write(idx); err != nil {
+				log.Println(fmt.Sprintf("dirStreamObj.add: failed to write the index of segment %020d of stream \"%s\": %s", seg.seq, self.name, err.Error()))
+				self.dropIndex(seg)
+			}
+		}
+
+		bss = bss[n:]
+	}
+	return nil
+}
+
+// Stop writing the index of the active segment and remove it's file, so that it's rebuilt from the segment on load.
+func (self *dirStreamObj) dropIndex(seg *dirSegment) {
+	self.idx.Close()
+	self.idx = nil
+	if err := os.Remove(self.segPath(seg.seq, "idx")); err != nil && !os.IsNotExist(err) {
+		log.Println(fmt.Sprintf("dirStreamObj.dropIndex: failed to remove the index of segment %020d of stream \"%s\": %s", seg.seq, self.name, err.Error()))
+	}
+}
+
+// Reload the last segment from disk after a failed write.
+func (self *dirStreamObj) reloadActive() error {
+	if err := self.closeFiles(); err != nil {
+		return err
+	}
+
+	seg, err := self.loadSegment(self.segs[len(self.segs)-1].seq)
+	if err != nil {
+		return err
+	}
+
+	self.segs[len(self.segs)-1] = seg
+	return nil
+}
+
+func (self *dirStreamObj) slen() uint {
+	res := uint64(0)
+	for _, seg := range self.segs {
+		res += seg.count
+	}
+	return uint(res - self.skip)
+}
+
+// Find the segment and the number of the event in it by the event's number in the stream.
+func (self *dirStreamObj) locate(num uint64) (int, uint64) {
+	num += self.skip
+	for i, seg := range self.segs {
+		if num < seg.count {
+			return i, num
+		}
+		num -= seg.count
+	}
+	return len(self.segs), 0
 }
 
-func (self *dirStreamObj) Add(evt stream.Event) (rerr error) {
-	bs, ok := evt.([]byte)
-	if !ok {
-		return errors.New(fmt.Sprintf("dirStreamObj.Add: Expected []byte, got %v", evt))
+/*
+A stream of events read from segments one by one.
+
+It pins the segments it's going to read until it's done with each of them, segments rewritten or removed while being read
+are detached, so the reader keeps reading the events that were there when it was created,
+and an unfinished reader doesn't block adding or deleting events.
+*/
+type dirReadStream struct {
+	obj  *dirStreamObj
+	segs []*dirSegment
+	// where to start reading the first segment and how many events to skip from there
+	start dirIndexEntry
+	skip  uint64
+	left  uint64
+
+	reader *dirSegmentReader
+}
+
+func (self *dirReadStream) finish() error {
+	if self.segs == nil {
+		return nil
 	}
 
-	self.lock.Lock()
-	defer self.lock.Unlock()
+	var err error
+	if self.reader != nil {
+		err = self.reader.close()
+		self.reader = nil
+	}
 
-	file, err := os.OpenFile(self.back.dir+"/"+self.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
+	segs := self.segs
+	self.segs = nil
+	self.left = 0
+	return errors.List().Add(err).Add(self.obj.unpin(segs)).Err()
+}
+
+func (self *dirReadStream) Next() (stream.Event, error) {
+	for self.left != 0 {
+		if self.reader == nil {
+			// the segment might be being detached
+			self.obj.lock.Lock()
+			reader, err := self.obj.openSegment(self.segs[0], self.start)
+			self.obj.lock.Unlock()
+			if err != nil {
+				return nil, errors.List().Add(err).Add(self.finish()).Err()
+			}
+			self.reader = reader
+		}
+
+		evt, err := self.reader.next()
+		if err == io.EOF {
+			// go to the next segment
+			if err := self.reader.close(); err != nil {
+				return nil, errors.List().Add(err).Add(self.finish()).Err()
+			}
+
+			self.reader = nil
+			if err := self.obj.unpin(self.segs[:1]); err != nil {
+				return nil, errors.List().Add(err).Add(self.finish()).Err()
+			}
+			self.segs = self.segs[1:]
+			self.skip = 0
+			if len(self.segs) == 0 {
+				return nil, errors.List().
+					Add(errors.New(fmt.Sprintf("dirReadStream.Next: unexpected end of stream \"%s\"", self.obj.name))).
+					Add(self.finish()).
+					Err()
+			}
+
+			self.start = dirIndexEntry{0, self.segs[0].start(), 0}
+			continue
+		}
+		if err == errDirTornRecord {
+			err = errors.New(fmt.Sprintf("dirReadStream.Next: corrupted segment %020d of stream \"%s\"", self.segs[0].seq, self.obj.name))
+		}
+		if err != nil {
+			return nil, errors.List().Add(err).Add(self.finish()).Err()
+		}
+
+		if self.skip != 0 {
+			self.skip--
+			continue
+		}
+
+		self.left--
+		if self.left == 0 {
+			if err := self.finish(); err != nil {
+				return nil, err
+			}
+		}
+		return stream.Event(evt), nil
 	}
-	defer func() {
-		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
-	}()
+	return nil, stream.EOI
+}
 
-	bs = append(bs, '\n')
-	_, err = file.Write(bs)
-	return err
+func (self *dirReadStream) Len() int {
+	return int(self.left)
 }
 
-func (self *dirStreamObj) Read(from uint, to uint) (sres stream.Stream, rerr error) {
+func (self *dirReadStream) Drain() {
+	self.finish()
+}
+
+func (self *dirStreamObj) Read(from uint, to uint) (stream.Stream, error) {
 	if from == to {
 		return stream.Empty(), nil
 	}
@@ -48,41 +1368,33 @@ func (self *dirStreamObj) Read(from uint, to uint) (sres stream.Stream, rerr err
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	l, err := self.slen()
-	if err != nil {
+	if _, _, err := convRange(int(from), int(to), int(self.slen()), "dirStreamObj.Read"); err != nil {
 		return nil, err
 	}
 
-	if _, _, err := convRange(int(from), int(to), int(l), "dirStreamObj.Read"); err != nil {
-		return nil, err
+	i, num := self.locate(uint64(from))
+	j, _ := self.locate(uint64(to - 1))
+	segs := append([]*dirSegment{}, self.segs[i:j+1]...)
+	for _, seg := range segs {
+		seg.pins++
 	}
+	start := self.segs[i].seek(num)
+	return &dirReadStream{self, segs, start, num - start.num, uint64(to - from), nil}, nil
+}
 
-	res := []stream.Event{}
-
-	file, err := os.Open(self.back.dir + "/" + self.name)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
-		if rerr != nil {
-			sres = nil
-		}
-	}()
+// Release segments pinned by a reader, removing files detached for it.
+func (self *dirStreamObj) unpin(segs []*dirSegment) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-	scanner := bufio.NewScanner(file)
-	lineNum := uint(0)
-	for scanner.Scan() {
-		if lineNum >= from && lineNum < to {
-			res = append(res, scanner.Bytes())
+	errs := errors.List()
+	for _, seg := range segs {
+		seg.pins--
+		if seg.pins == 0 && seg.detached != "" {
+			errs.Add(os.Remove(seg.detached))
 		}
-		lineNum++
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return stream.List(res), nil
+	return errs.Err()
 }
 
 func (self *dirStreamObj) Interval(from int, to int) (uint, uint, error) {
@@ -107,7 +1419,15 @@ func (self *dirStreamObj) Interval(from int, to int) (uint, uint, error) {
 	return f, t, nil
 }
 
-func (self *dirStreamObj) Del(from uint, to uint) (res bool, rerr error) {
+/*
+Delete a range of events.
+
+Segments within the range are removed and a deleted prefix of the first remaining segment is only recorded in the head file,
+so deleting a prefix of the stream never rewrites files. Other segments are rewritten without deleted events.
+
+Files of segments being read are detached and removed when their readers are done, so deleting never waits for readers.
+*/
+func (self *dirStreamObj) Del(from uint, to uint) (bool, error) {
 	if from == to {
 		return true, nil
 	}
@@ -115,104 +1435,412 @@ func (self *dirStreamObj) Del(from uint, to uint) (res bool, rerr error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	l, err := self.slen()
-	if err != nil {
+	if _, _, err := convRange(int(from), int(to), int(self.slen()), "dirStreamObj.Del"); err != nil {
 		return false, err
 	}
 
-	if _, _, err := convRange(int(from), int(to), int(l), "dirStreamObj.Del"); err != nil {
+	// the active segment might be rewritten or removed, it will be reopened on the next Add
+	if err := self.closeFiles(); err != nil {
 		return false, err
 	}
 
-	file, err := os.Open(self.back.dir + "/" + self.name)
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
-		res = rerr == nil
-	}()
+	absFrom := uint64(from) + self.skip
+	absTo := uint64(to) + self.skip
+	keep := []*dirSegment{}
+	rm := []*dirSegment{}
+	skip := self.skip
+	start := uint64(0)
+	for i, seg := range self.segs {
+		sfrom := start
+		sto := start + seg.count
+		start = sto
 
-	tmp, err := ioutil.TempFile(self.back.dir, self.name)
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		rerr = errors.List().Add(rerr).Add(tmp.Close()).Add(os.Remove(tmp.Name())).Err()
-		res = rerr == nil
-	}()
+		lo, hi := absFrom, absTo
+		if lo < sfrom {
+			lo = sfrom
+		}
+		if hi > sto {
+			hi = sto
+		}
+
+		first := sfrom
+		if i == 0 {
+			first += self.skip
+		}
+
+		if lo >= hi {
+			keep = append(keep, seg)
+			continue
+		}
 
-	scanner := bufio.NewScanner(file)
-	lineNum := uint(0)
-	for scanner.Scan() {
-		if lineNum < from || lineNum >= to {
-			if _, err := tmp.Write(scanner.Bytes()); err != nil {
-				return false, err
+		if lo <= first && hi == sto {
+			if i == 0 {
+				skip = 0
 			}
+			rm = append(rm, seg)
+			continue
+		}
+
+		if len(keep) == 0 && lo <= first {
+			skip = hi - sfrom
+			keep = append(keep, seg)
+			continue
+		}
+
+		segSkip := first - sfrom
+		seg, err := self.rewriteSegment(seg, seg.codec, func(num uint64) bool {
+			return num < segSkip || (num >= lo-sfrom && num < hi-sfrom)
+		})
+		if err != nil {
+			return false, err
 		}
-		lineNum++
+		self.segs[i] = seg
+
+		if len(keep) == 0 {
+			skip = 0
+		}
+		keep = append(keep, seg)
+	}
+
+	self.segs = keep
+	self.skip = skip
+	if from == 0 {
+		self.base += uint64(to)
 	}
-	if err := scanner.Err(); err != nil {
+	// write the head first so that interrupted removal of segments is finished on load
+	if err := self.writeHead(); err != nil {
 		return false, err
 	}
 
-	return true, os.Rename(tmp.Name(), file.Name())
+	for _, seg := range rm {
+		if err := self.detach(seg); err != nil {
+			return false, err
+		}
+
+		if err := self.rmSegment(seg.seq); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (self *dirStreamObj) Len() (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.slen(), nil
 }
 
-func (self *dirStreamObj) slen() (_ uint, rerr error) {
-	file, err := os.Open(self.back.dir + "/" + self.name)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil
+func (self *dirStreamObj) Base() (uint, uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return uint(self.base), self.slen(), nil
+}
+
+func (self *dirStreamObj) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.closeFiles()
+}
+
+/*
+Times of events are only known at the granularity of index entries,
+so events added a bit before the time might not be counted.
+*/
+func (self *dirStreamObj) countOlder(t time.Time) (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := uint64(0)
+	for i, seg := range self.segs {
+		skip := uint64(0)
+		if i == 0 {
+			skip = self.skip
 		}
-		return 0, err
+
+		if seg.mtime.Before(t) {
+			res += seg.count - skip
+			continue
+		}
+
+		// the last index entry added before the time
+		j := sort.Search(len(seg.index), func(j int) bool {
+			return !time.Unix(0, seg.index[j].time).Before(t)
+		})
+		if j != 0 && seg.index[j-1].num+1 > skip {
+			res += seg.index[j-1].num + 1 - skip
+		}
+		break
 	}
-	defer func() {
-		rerr = errors.List().Add(rerr).Add(file.Close()).Err()
-	}()
+	return uint(res), nil
+}
 
-	buf := make([]byte, 8196)
-	count := uint(0)
-	lineSep := []byte{'\n'}
-	for {
-		c, err := file.Read(buf)
+func (self *dirStreamObj) countOver(bytes uint64) (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// find the segment where the limit is reached
+	size := uint64(0)
+	i := len(self.segs) - 1
+	for ; i >= 0; i-- {
+		if size+uint64(self.segs[i].size) > bytes {
+			break
+		}
+		size += uint64(self.segs[i].size)
+	}
+	if i < 0 {
+		return 0, nil
+	}
+
+	// all events after this position fit
+	seg := self.segs[i]
+	pos := seg.size - int64(bytes-size)
+	entry := dirIndexEntry{0, seg.start(), 0}
+	for _, e := range seg.index {
+		if e.pos > pos {
+			break
+		}
+		entry = e
+	}
+
+	num := seg.count
+	if seg.codec != nil {
+		// sizes of compressed events are only known for whole blocks
+		for _, e := range seg.index {
+			if e.pos >= pos {
+				num = e.num
+				break
+			}
+		}
+	} else {
+		cur := entry.pos
+		err := self.scanSegment(seg, entry, func(n uint64, evt []byte) error {
+			if cur >= pos {
+				num = n
+				return io.EOF
+			}
+
+			cur += seg.recordSize(evt)
+			return nil
+		})
 		if err != nil && err != io.EOF {
 			return 0, err
 		}
+	}
 
-		count += uint(bytes.Count(buf[:c], lineSep))
+	res := num
+	for _, s := range self.segs[:i] {
+		res += s.count
+	}
+	if res < self.skip {
+		return 0, nil
+	}
+	return uint(res - self.skip), nil
+}
 
-		if err == io.EOF {
-			break
-		}
+type uint64s []uint64
+
+func (self uint64s) Len() int {
+	return len(self)
+}
+
+func (self uint64s) Less(i, j int) bool {
+	return self[i] < self[j]
+}
+
+func (self uint64s) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// Durability modes of the dir backend.
+const (
+	// Writes are synced to disk by the OS, events added right before a crash might be lost.
+	DirSyncNone = "none"
+	// Every write is synced before Add returns.
+	DirSyncAlways = "fsync"
+	// Writes are synced every DirOptions.SyncInterval all at once, Add returns after the sync.
+	DirSyncGroup = "group"
+)
+
+// Default interval of group commits.
+const DefaultDirSyncInterval = 10 * time.Millisecond
+
+// Options of the dir backend.
+type DirOptions struct {
+	// Durability mode, one of DirSyncNone, DirSyncAlways and DirSyncGroup.
+	Sync string
+	// Interval of group commits in the DirSyncGroup mode.
+	SyncInterval time.Duration
+	// Codec to compress segments with once they are full: CompressionNone or an empty string, CompressionGzip, CompressionZstd or CompressionSnappy.
+	Compression string
+}
+
+/*
+Get a config arg of the dir backend with these options.
+
+It's just the directory for the default options, so that configs of older versions still work.
+*/
+func (self DirOptions) arg(dir string) interface{} {
+	compressed := self.Compression != "" && self.Compression != CompressionNone
+	if self.Sync == DirSyncNone && !compressed {
+		return dir
 	}
-	return count, nil
 
+	res := map[string]interface{}{
+		"dir":  dir,
+		"sync": self.Sync,
+	}
+	if self.Sync == DirSyncGroup {
+		res["sync_interval"] = self.SyncInterval.String()
+	}
+	if compressed {
+		res["compression"] = self.Compression
+	}
+	return res
 }
 
-func (self *dirStreamObj) Len() (uint, error) {
+// A group commit: it's done when all streams written to before it are synced.
+type dirCommit struct {
+	done chan struct{}
+	errs map[*dirStreamObj]error
+}
+
+// Wait for the commit to be done and get the error of syncing a stream.
+func (self *dirCommit) wait(s *dirStreamObj) error {
+	<-self.done
+	return self.errs[s]
+}
+
+// Syncs streams written to since the last sync every interval, so that many small writes cost one fsync per stream.
+type dirSyncer struct {
+	lock   sync.Mutex
+	dirty  map[*dirStreamObj]struct{}
+	commit *dirCommit
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newDirSyncer(interval time.Duration) *dirSyncer {
+	res := &dirSyncer{
+		sync.Mutex{},
+		map[*dirStreamObj]struct{}{},
+		&dirCommit{make(chan struct{}), nil},
+		make(chan struct{}),
+		make(chan struct{}),
+		sync.Once{},
+	}
+	go res.run(interval)
+	return res
+}
+
+// Mark a stream as written to, returns the commit to wait for or nil if the syncer is closed.
+func (self *dirSyncer) add(s *dirStreamObj) *dirCommit {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	return self.slen()
+	if self.commit == nil {
+		return nil
+	}
 
+	self.dirty[s] = struct{}{}
+	return self.commit
 }
 
-func (self *dirStreamObj) Close() error {
-	return nil
+func (self *dirSyncer) sync(last bool) {
+	self.lock.Lock()
+	dirty, commit := self.dirty, self.commit
+	self.dirty = map[*dirStreamObj]struct{}{}
+	self.commit = nil
+	if !last {
+		self.commit = &dirCommit{make(chan struct{}), nil}
+	}
+	self.lock.Unlock()
+
+	commit.errs = make(map[*dirStreamObj]error, len(dirty))
+	for s, _ := range dirty {
+		if err := s.sync(); err != nil {
+			commit.errs[s] = err
+		}
+	}
+	close(commit.done)
+}
+
+func (self *dirSyncer) run(interval time.Duration) {
+	defer close(self.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			self.sync(true)
+			return
+		case <-ticker.C:
+			self.sync(false)
+		}
+	}
+}
+
+// Stop the syncer after the last group commit, closing it again does nothing.
+func (self *dirSyncer) close() {
+	self.once.Do(func() {
+		close(self.stop)
+	})
+	<-self.done
 }
 
 type dirBackend struct {
-	dir  string
-	lock sync.Mutex
-	data map[string]*dirStreamObj
+	dir       string
+	opts      DirOptions
+	lock      sync.Mutex
+	data      map[string]*dirStreamObj
+	retention *retainer
+	// only in the DirSyncGroup mode
+	syncer *dirSyncer
+	// codec of full segments, nil if they are not compressed
+	codec *codec
+	// running compressions of segments
+	compactions sync.WaitGroup
 }
 
 func (self *dirBackend) Config() (interface{}, error) {
-	return map[string]interface{}{
+	return self.retention.config(map[string]interface{}{
 		"type": "dir",
-		"arg":  self.dir,
-	}, nil
+		"arg":  self.opts.arg(self.dir),
+	}), nil
+}
+
+// Sync a file unless syncing is left to the OS.
+func (self *dirBackend) syncFile(file *os.File) error {
+	if self.opts.Sync == DirSyncNone {
+		return nil
+	}
+	return file.Sync()
+}
+
+// Sync a directory after files in it were created, renamed or removed, unless syncing is left to the OS.
+func (self *dirBackend) syncDir(path string) error {
+	if self.opts.Sync == DirSyncNone {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return errors.List().Add(dir.Sync()).Add(dir.Close()).Err()
+}
+
+func (self *dirBackend) SetRetention(name string, r Retention) error {
+	return self.retention.set(name, r)
+}
+
+func (self *dirBackend) Retention() (map[string]Retention, error) {
+	return self.retention.all(), nil
 }
 
 func (self *dirBackend) Streams() ([]string, error) {
@@ -223,7 +1851,7 @@ func (self *dirBackend) Streams() ([]string, error) {
 
 	names := []string{}
 	for _, f := range fs {
-		if f.IsDir() {
+		if strings.HasPrefix(f.Name(), ".") {
 			continue
 		}
 
@@ -238,27 +1866,126 @@ func (self *dirBackend) GetStream(name string) (BackendStream, error) {
 
 	s, ok := self.data[name]
 	if !ok {
-		s = &dirStreamObj{self, name, sync.Mutex{}}
+		s = &dirStreamObj{back: self, name: name}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+
 		self.data[name] = s
 	}
 	return s, nil
 }
 
+func (self *dirBackend) closeStreams() error {
+	errs := errors.List()
+	for _, s := range self.data {
+		errs.Add(s.Close())
+	}
+	self.data = map[string]*dirStreamObj{}
+	return errs.Err()
+}
+
 func (self *dirBackend) Drop() error {
-	return os.RemoveAll(self.dir)
+	self.retention.drop()
+	if self.syncer != nil {
+		self.syncer.close()
+	}
+	self.compactions.Wait()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return errors.List().
+		Add(self.closeStreams()).
+		Add(os.RemoveAll(self.dir)).
+		Err()
 }
 
 func (self *dirBackend) Close() error {
+	self.retention.close()
+	if self.syncer != nil {
+		self.syncer.close()
+	}
+	self.compactions.Wait()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	err := self.closeStreams()
 	self.data = nil
-	return nil
+	return err
 }
 
 /*
-Create a backend that stores pushed events in files in a specified directory, one file per stream.
+Create a backend that stores pushed events in a specified directory, one subdirectory per stream.
+
+Each stream is stored as a list of segment files with sparse offset indexes,
+so reading, deleting a prefix and getting the length of a stream don't depend on the size of the whole stream.
+Streams stored in single files by older versions are converted on first use.
+
+Writes are not synced, use NewDirOptions for other durability modes.
 */
 func NewDir(dir string) (Backend, error) {
+	return NewDirOptions(dir, DirOptions{DirSyncNone, 0, CompressionNone})
+}
+
+/*
+Create a dir backend with given options, see NewDir.
+
+Every event is stored with a checksum and all streams are loaded on creation,
+so that events torn by a crash in the middle of a write are found and truncated.
+
+With compression, full segments are compressed in the background and reads decompress them transparently.
+Compressed segments stay readable after compression is turned off.
+*/
+func NewDirOptions(dir string, opts DirOptions) (Backend, error) {
+	c, err := codecByName(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Sync {
+	case DirSyncNone, DirSyncAlways:
+	case DirSyncGroup:
+		if opts.SyncInterval <= 0 {
+			opts.SyncInterval = DefaultDirSyncInterval
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("NewDirOptions: Expected one of \"%s\", \"%s\" and \"%s\" sync modes, got \"%s\"", DirSyncNone, DirSyncAlways, DirSyncGroup, opts.Sync))
+	}
+
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
-	return &dirBackend{dir, sync.Mutex{}, map[string]*dirStreamObj{}}, nil
+	res := &dirBackend{dir, opts, sync.Mutex{}, map[string]*dirStreamObj{}, nil, nil, c, sync.WaitGroup{}}
+	res.retention = newRetainer(func(name string) (retentionStream, func(), error) {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.(*dirStreamObj), func() {}, nil
+	})
+
+	names, err := res.Streams()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, errors.List().Add(err).Add(res.Close()).Err()
+		}
+
+		// compression might have been turned on since the stream was written
+		obj := s.(*dirStreamObj)
+		obj.lock.Lock()
+		obj.compactLater()
+		obj.lock.Unlock()
+	}
+
+	if opts.Sync == DirSyncGroup {
+		res.syncer = newDirSyncer(opts.SyncInterval)
+	}
+	return res, nil
 }
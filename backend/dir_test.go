@@ -0,0 +1,429 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Use small segments in a test.
+func smallSegments(size int64) func() {
+	old := dirSegmentSize
+	dirSegmentSize = size
+	return func() {
+		dirSegmentSize = old
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	res, err := filepath.Glob(dir + "/*.log")
+	assert.Nil(t, err)
+	return res
+}
+
+func openDirStream(t *testing.T, dir string, opts DirOptions) (Backend, BackendStream) {
+	b, err := NewDirOptions(dir, opts)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	s, err := b.GetStream("s")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return b, s
+}
+
+// Test that a torn or corrupted tail of a segment is dropped and the stream works after it.
+func TestDirTornTail(t *testing.T) {
+	examples := []struct {
+		Name    string
+		Corrupt func([]byte) []byte
+		Left    int
+	}{
+		{"partial header", func(data []byte) []byte {
+			return append(data, 0, 0, 0)
+		}, 10},
+		{"partial record", func(data []byte) []byte {
+			return appendRecord(data, []byte(`{"n": 10}`))[:len(data)+dirRecordHeaderSize+3]
+		}, 10},
+		{"garbage", func(data []byte) []byte {
+			return append(data, []byte("garbage, not a record")...)
+		}, 10},
+		{"flipped byte", func(data []byte) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}, 9},
+		{"truncated", func(data []byte) []byte {
+			return data[:len(data)-3]
+		}, 9},
+		{"magic only", func(data []byte) []byte {
+			return data[:len(dirSegmentMagic)]
+		}, 0},
+		{"partial magic", func(data []byte) []byte {
+			return data[:3]
+		}, 0},
+	}
+
+	model := testEvents(0, 11)
+	for _, e := range examples {
+		dir := t.TempDir()
+		b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+		addEvents(t, s, model[:10])
+		assert.Nil(t, b.Close(), e.Name)
+
+		path := fmt.Sprintf("%s/s/%020d.log", dir, 0)
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err, e.Name)
+		assert.Nil(t, ioutil.WriteFile(path, e.Corrupt(data), 0600), e.Name)
+
+		b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+		assert.Equal(t, model[:e.Left], readAll(t, s), e.Name)
+
+		assert.Nil(t, s.Add([]byte(model[10])), e.Name)
+		expected := append(append([]string{}, model[:e.Left]...), model[10])
+		assert.Equal(t, expected, readAll(t, s), e.Name)
+		assert.Nil(t, b.Close(), e.Name)
+
+		b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+		assert.Equal(t, expected, readAll(t, s), e.Name)
+		assert.Nil(t, b.Close(), e.Name)
+	}
+}
+
+// Test that events are split into segments, deleted segments are removed and it all survives reopening.
+func TestDirSegments(t *testing.T) {
+	defer smallSegments(1024)()
+
+	dir := t.TempDir()
+	b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+
+	model := testEvents(0, 500)
+	addEvents(t, s, model)
+	n := len(segmentFiles(t, dir+"/s"))
+	assert.True(t, n > 5, n)
+	checkStream(t, "added", s, model, 0)
+	assert.Equal(t, model[123:321], readRange(t, s, 123, 321))
+
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	checkStream(t, "reopened", s, model, 0)
+
+	_, err := s.Del(0, 200)
+	assert.Nil(t, err)
+	model = model[200:]
+	assert.True(t, len(segmentFiles(t, dir+"/s")) < n)
+	checkStream(t, "prefix deleted", s, model, 200)
+
+	_, err = s.Del(50, 60)
+	assert.Nil(t, err)
+	model = append(append([]string{}, model[:50]...), model[60:]...)
+	checkStream(t, "middle deleted", s, model, 200)
+
+	more := testEvents(500, 600)
+	addEvents(t, s, more)
+	model = append(model, more...)
+
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	checkStream(t, "reopened after delete", s, model, 200)
+
+	_, err = s.Del(0, uint(len(model)))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(segmentFiles(t, dir+"/s")))
+
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	checkStream(t, "reopened empty", s, []string{}, uint(200+len(model)))
+	assert.Nil(t, b.Close())
+}
+
+// Test that full segments get compressed and are readable after turning the compression off.
+func TestDirCompression(t *testing.T) {
+	defer smallSegments(1024)()
+
+	for _, c := range []string{CompressionGzip, CompressionZstd, CompressionSnappy} {
+		dir := t.TempDir()
+		b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, c})
+
+		model := testEvents(0, 500)
+		addEvents(t, s, model)
+		// waits for compactions
+		assert.Nil(t, b.Close(), c)
+
+		b, s = openDirStream(t, dir, DirOptions{DirSyncGroup, time.Millisecond, c})
+		compressed := 0
+		for _, seg := range s.(*dirStreamObj).segs {
+			if seg.codec != nil {
+				compressed++
+			}
+		}
+		assert.True(t, compressed > 5, c)
+		checkStream(t, c, s, model, 0)
+
+		_, err := s.Del(10, 300)
+		assert.Nil(t, err, c)
+		model = append(append([]string{}, model[:10]...), model[300:]...)
+		_, err = s.Del(0, 5)
+		assert.Nil(t, err, c)
+		model = model[5:]
+		checkStream(t, c+": deleted", s, model, 5)
+		assert.Nil(t, b.Close(), c)
+
+		b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+		checkStream(t, c+": uncompressed", s, model, 5)
+
+		more := testEvents(500, 600)
+		addEvents(t, s, more)
+		model = append(model, more...)
+		assert.Nil(t, b.Close(), c)
+
+		b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+		checkStream(t, c+": added uncompressed", s, model, 5)
+		assert.Nil(t, b.Close(), c)
+	}
+}
+
+// Test that compressing segments doesn't block adding, reading and deleting events.
+func TestDirCompactUnlocked(t *testing.T) {
+	defer smallSegments(1024)()
+
+	dir := t.TempDir()
+	b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, CompressionGzip})
+
+	obj := s.(*dirStreamObj)
+	gz := obj.back.codec
+	started := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	obj.back.codec = &codec{gz.id, gz.name, func(data []byte) ([]byte, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-gate
+		return gz.compress(data)
+	}, gz.decompress}
+
+	model := testEvents(0, 300)
+	addEvents(t, s, model[:200])
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		addEvents(t, s, model[200:])
+		checkStream(t, "added", s, model, 0)
+		_, err := s.Del(100, 150)
+		assert.Nil(t, err)
+		_, err = s.Del(0, 10)
+		assert.Nil(t, err)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected compressing not to block the stream")
+	}
+	close(gate)
+	<-done
+	model = append(append([]string{}, model[10:100]...), model[150:]...)
+	checkStream(t, "deleted", s, model, 10)
+	assert.Nil(t, b.Close())
+
+	// all full segments are compressed in the end
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	defer b.Close()
+	segs := s.(*dirStreamObj).segs
+	for _, seg := range segs[:len(segs)-1] {
+		assert.NotNil(t, seg.codec)
+	}
+	assert.True(t, len(segs) > 3)
+	checkStream(t, "reopened", s, model, 10)
+}
+
+// Test that deleting events from the beginning doesn't wait for readers and deleting events in the middle does.
+func TestDirPinnedRead(t *testing.T) {
+	defer smallSegments(1024)()
+
+	dir := t.TempDir()
+	b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+
+	model := testEvents(0, 2000)
+	addEvents(t, s, model)
+
+	data, err := s.Read(0, 2000)
+	assert.Nil(t, err)
+	res := []string{}
+	evt, err := data.Next()
+	assert.Nil(t, err)
+	res = append(res, string(evt.([]byte)))
+
+	_, err = s.Del(0, 1500)
+	assert.Nil(t, err)
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		assert.Nil(t, err)
+		res = append(res, string(evt.([]byte)))
+	}
+	assert.Equal(t, model, res)
+
+	// deleting in the middle of segments being read by the same goroutine rewrites them for the stream only
+	data, err = s.Read(0, 500)
+	assert.Nil(t, err)
+	res = []string{}
+	evt, err = data.Next()
+	assert.Nil(t, err)
+	res = append(res, string(evt.([]byte)))
+
+	_, err = s.Del(10, 20)
+	assert.Nil(t, err)
+	_, err = s.Del(100, 400)
+	assert.Nil(t, err)
+	left := append(append(append([]string{}, model[1500:1510]...), model[1520:1610]...), model[1910:]...)
+	checkStream(t, "deleted", s, left, 1500)
+
+	detached, err := filepath.Glob(dir + "/s/*.detached")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(detached))
+
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		assert.Nil(t, err)
+		res = append(res, string(evt.([]byte)))
+	}
+	assert.Equal(t, model[1500:2000], res)
+
+	detached, err = filepath.Glob(dir + "/s/*.detached")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(detached))
+
+	// an abandoned reader doesn't block deleting
+	_, err = s.Read(0, 100)
+	assert.Nil(t, err)
+	_, err = s.Del(5, 50)
+	assert.Nil(t, err)
+	left = append(left[:5], left[50:]...)
+	checkStream(t, "abandoned", s, left, 1500)
+
+	// files detached for readers gone with a restart are removed
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	defer b.Close()
+	checkStream(t, "reopened", s, left, 1500)
+	detached, err = filepath.Glob(dir + "/s/*.detached")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(detached))
+}
+
+// Test that events are added once when writing the index fails and the index is rebuilt on load.
+func TestDirIndexFailure(t *testing.T) {
+	dir := t.TempDir()
+	b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+
+	model := testEvents(0, 2000)
+	addEvents(t, s, model[:100])
+
+	obj := s.(*dirStreamObj)
+	obj.lock.Lock()
+	assert.Nil(t, obj.idx.Close())
+	obj.lock.Unlock()
+
+	addEvents(t, s, model[100:1000])
+	checkStream(t, "failed", s, model[:1000], 0)
+	_, err := os.Stat(dir + "/s/00000000000000000000.idx")
+	assert.True(t, os.IsNotExist(err))
+
+	// the index is not written until it's rebuilt
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	defer b.Close()
+	addEvents(t, s, model[1000:])
+	checkStream(t, "rebuilt", s, model, 0)
+
+	obj = s.(*dirStreamObj)
+	data, err := ioutil.ReadFile(dir + "/s/00000000000000000000.idx")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(obj.segs[0].index))
+	assert.Equal(t, len(obj.segs[0].index)*dirIndexEntrySize, len(data))
+}
+
+// Test that events are not added when syncing them fails, so that retrying doesn't add them twice.
+func TestDirSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	b, s := openDirStream(t, dir, DirOptions{DirSyncAlways, 0, ""})
+
+	model := testEvents(0, 200)
+	addEvents(t, s, model[:100])
+	st, err := os.Stat(dir + "/s/00000000000000000000.log")
+	assert.Nil(t, err)
+
+	// writing to a pipe succeeds, but syncing it fails
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r.Close()
+
+	obj := s.(*dirStreamObj)
+	obj.lock.Lock()
+	assert.Nil(t, obj.file.Close())
+	obj.file = w
+	obj.lock.Unlock()
+
+	assert.NotNil(t, AddBatch(s, toEvents(model[100:102])))
+	checkStream(t, "failed", s, model[:100], 0)
+	nst, err := os.Stat(dir + "/s/00000000000000000000.log")
+	assert.Nil(t, err)
+	assert.Equal(t, st.Size(), nst.Size())
+
+	addEvents(t, s, model[100:])
+	checkStream(t, "retried", s, model, 0)
+
+	assert.Nil(t, b.Close())
+	b, s = openDirStream(t, dir, DirOptions{DirSyncAlways, 0, ""})
+	defer b.Close()
+	checkStream(t, "reopened", s, model, 0)
+}
+
+// Test that streams in formats of older versions are read.
+func TestDirOldFormats(t *testing.T) {
+	dir := t.TempDir()
+
+	// a single file with events separated by newlines
+	assert.Nil(t, ioutil.WriteFile(dir+"/s", []byte("a\nb\nc\n"), 0600))
+	b, s := openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	assert.Equal(t, []string{"a", "b", "c"}, readAll(t, s))
+	assert.Nil(t, s.Add([]byte("d")))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, readAll(t, s))
+
+	_, err := s.Del(0, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	// a head without the base
+	data, err := ioutil.ReadFile(dir + "/s/head")
+	assert.Nil(t, err)
+	assert.Equal(t, "0 1 1", string(data))
+	assert.Nil(t, ioutil.WriteFile(dir+"/s/head", []byte("0 1"), 0600))
+
+	b, s = openDirStream(t, dir, DirOptions{DirSyncNone, 0, ""})
+	checkStream(t, "old head", s, []string{"b", "c", "d"}, 0)
+	assert.Nil(t, b.Close())
+
+	// streams are loaded on creation
+	assert.Nil(t, ioutil.WriteFile(dir+"/s/head", []byte("0 1 2 3"), 0600))
+	_, err = NewDir(dir)
+	assert.NotNil(t, err)
+}
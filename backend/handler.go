@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/Monnoroch/golfstream/errors"
@@ -29,10 +30,104 @@ func sendErr(w http.ResponseWriter, err error, errorCb func(error)) (rerr error)
 	return json.NewEncoder(w).Encode(&errorObj{Err: err.Error()})
 }
 
+// How many events are written before flushing the response.
+const flushEvents = 1000
+
+/*
+Write events to the response as they are read, in the same format as arrErrorObj: {"events": [...], "error": "..."}.
+
+The error field is only written if reading events fails, as it can happen after some of them were already sent.
+The response is sent in chunks as it's flushed and the client decodes it as it comes, so neither side holds all events at once.
+It's not NDJSON because events are arbitrary JSON values which might have newlines in them,
+and so that clients which read the whole response as one JSON object still work.
+The stream is always drained, so that readers which hold resources until they are done release them.
+*/
+func writeEvents(w http.ResponseWriter, str stream.Stream) error {
+	defer stream.Drain(str)
+
+	w.Header().Set("Content-Type", "text/json")
+
+	flusher, _ := w.(http.Flusher)
+	writer := bufio.NewWriter(w)
+	if _, err := writer.WriteString(`{"events":[`); err != nil {
+		return err
+	}
+
+	var rerr error
+	for n := 0; ; n++ {
+		evt, err := str.Next()
+		if err == stream.EOI {
+			break
+		}
+		if err != nil {
+			rerr = err
+			break
+		}
+
+		bs, ok := evt.([]byte)
+		if !ok {
+			rerr = errors.New(fmt.Sprintf("Expected []byte event, got %v", evt))
+			break
+		}
+
+		// an invalid event would break the whole response
+		if !json.Valid(bs) {
+			rerr = errors.New(fmt.Sprintf("Expected JSON event, got %s", string(bs)))
+			break
+		}
+
+		if n != 0 {
+			if err := writer.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		if _, err := writer.Write(bs); err != nil {
+			return err
+		}
+
+		if n%flushEvents == flushEvents-1 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	if _, err := writer.WriteString("]"); err != nil {
+		return err
+	}
+
+	if rerr != nil {
+		msg, err := json.Marshal(rerr.Error())
+		if err != nil {
+			return err
+		}
+
+		if _, err := writer.WriteString(`,"error":` + string(msg)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := writer.WriteString("}\n"); err != nil {
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return rerr
+}
+
 /*
 Create a http.Handler that maps URLs from HTTP backend to a methods of an object implementing Backend interface.
 */
 func NewHandler(b Backend, errorCb func(error)) http.Handler {
+	if errorCb == nil {
+		errorCb = func(error) {}
+	}
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
@@ -86,6 +181,31 @@ func NewHandler(b Backend, errorCb func(error)) http.Handler {
 		sendErr(w, s.Add(stream.Event(data)), errorCb)
 	}).Methods("POST")
 
+	r.HandleFunc("/streams/{name}/push_batch", func(w http.ResponseWriter, r *http.Request) {
+		var data []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		s, err := b.GetStream(mux.Vars(r)["name"])
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				errorCb(err)
+			}
+		}()
+
+		evts := make([]stream.Event, len(data))
+		for i, v := range data {
+			evts[i] = stream.Event([]byte(v))
+		}
+		sendErr(w, AddBatch(s, evts), errorCb)
+	}).Methods("POST")
+
 	r.HandleFunc("/streams/{name}/interval/{from}:{to}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		s, err := b.GetStream(vars["name"])
@@ -164,34 +284,8 @@ func NewHandler(b Backend, errorCb func(error)) http.Handler {
 			return
 		}
 
-		l := 0
-		if to >= 0 {
-			l = to - from
-		}
-
-		res := make([]json.RawMessage, 0, l)
-		for {
-			evt, err := str.Next()
-			if err == stream.EOI {
-				break
-			}
-			if err != nil {
-				sendErr(w, err, errorCb)
-				return
-			}
-
-			bs, ok := evt.([]byte)
-			if !ok {
-				sendErr(w, errors.New(fmt.Sprintf("Expected []byte event, got %v", evt)), errorCb)
-				return
-			}
-
-			res = append(res, json.RawMessage(bs))
-		}
-
-		if err := json.NewEncoder(w).Encode(&arrErrorObj{Events: res}); err != nil {
-			sendErr(w, err, errorCb)
-			return
+		if err := writeEvents(w, str); err != nil {
+			errorCb(err)
 		}
 	}).Methods("POST")
 
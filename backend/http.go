@@ -7,16 +7,19 @@ import (
 	"github.com/Monnoroch/golfstream/errors"
 	"github.com/Monnoroch/golfstream/poster"
 	"github.com/Monnoroch/golfstream/stream"
+	"io"
 	"sync"
+	"time"
 )
 
 type httpBackendStream struct {
-	addUrl  string
-	intUrl  string
-	readUrl string
-	delUrl  string
-	lenUrl  string
-	p       poster.Poster
+	addUrl   string
+	batchUrl string
+	intUrl   string
+	readUrl  string
+	delUrl   string
+	lenUrl   string
+	p        poster.Poster
 }
 
 type errorObj struct {
@@ -47,11 +50,149 @@ func (self *httpBackendStream) Add(evt stream.Event) error {
 	return nil
 }
 
+func (self *httpBackendStream) AddBatch(evts []stream.Event) error {
+	if len(evts) == 0 {
+		return nil
+	}
+
+	data := make([]json.RawMessage, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("httpBackendStream.AddBatch: Expected []byte, got %v", evt))
+		}
+
+		data[i] = json.RawMessage(bs)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+
+	resp, err := self.p.Post(self.batchUrl, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res := errorObj{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+
+	return nil
+}
+
 type arrErrorObj struct {
 	Events []json.RawMessage `json:"events,omitempty"`
 	Err    string            `json:"error,omitempty"`
 }
 
+/*
+A stream of events decoded from the response as they arrive.
+
+The response is an arrErrorObj, but the error might come after the events.
+*/
+type httpReadStream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	left    int
+	done    bool
+}
+
+func (self *httpReadStream) finish(err error) error {
+	if self.done {
+		return err
+	}
+
+	self.done = true
+	return errors.List().Add(err).Add(self.body.Close()).Err()
+}
+
+func (self *httpReadStream) expect(delim json.Delim) error {
+	t, err := self.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return errors.New(fmt.Sprintf("httpReadStream: Expected %v, got %v", delim, t))
+	}
+	return nil
+}
+
+// Read fields of the response object until the events array or the end of the object.
+func (self *httpReadStream) readFields() (bool, error) {
+	for self.decoder.More() {
+		t, err := self.decoder.Token()
+		if err != nil {
+			return false, err
+		}
+
+		switch t {
+		case "events":
+			return true, self.expect('[')
+		case "error":
+			var msg string
+			if err := self.decoder.Decode(&msg); err != nil {
+				return false, err
+			}
+			if msg != "" {
+				return false, errors.New(msg)
+			}
+		default:
+			var v json.RawMessage
+			if err := self.decoder.Decode(&v); err != nil {
+				return false, err
+			}
+		}
+	}
+	return false, self.expect('}')
+}
+
+func (self *httpReadStream) Next() (stream.Event, error) {
+	if self.done {
+		return nil, stream.EOI
+	}
+
+	if self.decoder.More() {
+		var v json.RawMessage
+		if err := self.decoder.Decode(&v); err != nil {
+			return nil, self.finish(err)
+		}
+
+		self.left--
+		return stream.Event([]byte(v)), nil
+	}
+
+	// the end of events, but there might be an error after them
+	if err := self.expect(']'); err != nil {
+		return nil, self.finish(err)
+	}
+
+	if _, err := self.readFields(); err != nil {
+		return nil, self.finish(err)
+	}
+
+	if err := self.finish(nil); err != nil {
+		return nil, err
+	}
+	return nil, stream.EOI
+}
+
+func (self *httpReadStream) Len() int {
+	return self.left
+}
+
+func (self *httpReadStream) Drain() {
+	self.finish(nil)
+}
+
 func (self *httpBackendStream) Read(from uint, to uint) (stream.Stream, error) {
 	if from == to {
 		return stream.Empty(), nil
@@ -61,22 +202,21 @@ func (self *httpBackendStream) Read(from uint, to uint) (stream.Stream, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	res := arrErrorObj{}
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, err
+	res := &httpReadStream{resp.Body, json.NewDecoder(resp.Body), int(to - from), false}
+	if err := res.expect('{'); err != nil {
+		return nil, res.finish(err)
 	}
 
-	if res.Err != "" {
-		return nil, errors.New(res.Err)
+	events, err := res.readFields()
+	if err != nil {
+		return nil, res.finish(err)
 	}
 
-	r := make([]stream.Event, len(res.Events))
-	for i, v := range res.Events {
-		r[i] = stream.Event([]byte(v))
+	if !events {
+		return stream.Empty(), res.finish(nil)
 	}
-	return stream.List(r), nil
+	return res, nil
 }
 
 type interErrorObj struct {
@@ -170,6 +310,7 @@ type httpBackend struct {
 	listUrl   string
 	dropUrl   string
 	streamUrl string
+	timeout   time.Duration
 	p         poster.Poster
 	lock      sync.Mutex
 	data      map[string]*httpBackendStream
@@ -196,13 +337,18 @@ func (self *httpBackend) Config() (interface{}, error) {
 		return nil, errors.New(res.Err)
 	}
 
+	arg := map[string]interface{}{
+		"url":  self.baseUrl,
+		"base": res.Cfg,
+	}
+	if self.timeout != 0 {
+		arg["timeout"] = self.timeout.String()
+	}
+
 	return map[string]interface{}{
 		"type":   "http",
 		"remote": true,
-		"arg": map[string]interface{}{
-			"url":  self.baseUrl,
-			"base": res.Cfg,
-		},
+		"arg":    arg,
 	}, nil
 }
 
@@ -239,6 +385,7 @@ func (self *httpBackend) GetStream(name string) (BackendStream, error) {
 		baseUrl := fmt.Sprintf(self.streamUrl, name)
 		s = &httpBackendStream{
 			fmt.Sprintf("%s/push", baseUrl),
+			fmt.Sprintf("%s/push_batch", baseUrl),
 			fmt.Sprintf("%s/interval/%%v:%%v", baseUrl),
 			fmt.Sprintf("%s/read/%%v:%%v", baseUrl),
 			fmt.Sprintf("%s/del/%%v:%%v", baseUrl),
@@ -276,6 +423,15 @@ func (self *httpBackend) Close() error {
 Create a remote http backend/ It doesn't store anything and just send commants to a remote server via HTTP.
 */
 func NewHttp(baseUrl string, p poster.Poster) Backend {
+	return newHttp(baseUrl, 0, p)
+}
+
+// Create a remote http backend with a time limit for requests, zero means no limit.
+func NewHttpTimeout(baseUrl string, timeout time.Duration) Backend {
+	return newHttp(baseUrl, timeout, poster.HttpTimeout(timeout))
+}
+
+func newHttp(baseUrl string, timeout time.Duration, p poster.Poster) Backend {
 	if p == nil {
 		p = poster.Http()
 	}
@@ -285,6 +441,7 @@ func NewHttp(baseUrl string, p poster.Poster) Backend {
 		fmt.Sprintf("%s/streams", baseUrl),
 		fmt.Sprintf("%s/drop", baseUrl),
 		fmt.Sprintf("%s/streams/%%s", baseUrl),
+		timeout,
 		p,
 		sync.Mutex{},
 		map[string]*httpBackendStream{},
@@ -0,0 +1,243 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Monnoroch/golfstream/poster"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Events as compact JSON, since the events of a batch are compacted when it's encoded.
+func compactEvents(from, to int) []string {
+	res := []string{}
+	for i := from; i < to; i++ {
+		res = append(res, fmt.Sprintf(`{"n":%d}`, i))
+	}
+	return res
+}
+
+// Start a server of a mem backend and create a http backend which is it's client.
+func startHttp(t *testing.T) (*httptest.Server, Backend, Backend) {
+	b := NewMem()
+	srv := httptest.NewServer(NewHandler(b, func(err error) {
+		t.Log(err)
+	}))
+	return srv, b, NewHttp(srv.URL, nil)
+}
+
+// Test that batches pushed over HTTP are added to the backend in order.
+func TestHttpAddBatch(t *testing.T) {
+	srv, b, hb := startHttp(t)
+	defer srv.Close()
+
+	hs, err := hb.GetStream("s")
+	assert.Nil(t, err)
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+
+	model := compactEvents(0, 5)
+	addEvents(t, hs, model)
+	assert.Nil(t, AddBatch(hs, []stream.Event{}))
+	batch := append(compactEvents(5, 300), `{"n":[1,{"deep":"value"}]}`)
+	assert.Nil(t, AddBatch(hs, toEvents(batch)))
+	model = append(model, batch...)
+
+	assert.Equal(t, model, readAll(t, s))
+	assert.Equal(t, model, readAll(t, hs))
+
+	// a batch with a bad event is rejected as a whole
+	assert.NotNil(t, AddBatch(hs, []stream.Event{[]byte(`{"n": 1}`), "not bytes"}))
+	assert.NotNil(t, AddBatch(hs, toEvents([]string{`{"n": 1}`, `{"n": `})))
+	assert.Equal(t, model, readAll(t, s))
+}
+
+// A poster which counts responses with bodies that aren't closed yet.
+type countingPoster struct {
+	p    poster.Poster
+	open int32
+}
+
+type countingBody struct {
+	io.ReadCloser
+	p    *countingPoster
+	once sync.Once
+}
+
+func (self *countingBody) Close() error {
+	self.once.Do(func() {
+		atomic.AddInt32(&self.p.open, -1)
+	})
+	return self.ReadCloser.Close()
+}
+
+func (self *countingPoster) Post(url string, r io.Reader) (*http.Response, error) {
+	resp, err := self.p.Post(url, r)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&self.open, 1)
+	resp.Body = &countingBody{resp.Body, self, sync.Once{}}
+	return resp, nil
+}
+
+func (self *countingPoster) check(t *testing.T, name string) {
+	assert.Equal(t, int32(0), atomic.LoadInt32(&self.open), name)
+}
+
+// Test that ranges bigger than a page sent by the server at once are read in order and responses are closed when reading stops.
+func TestHttpRead(t *testing.T) {
+	b := NewMem()
+	srv := httptest.NewServer(NewHandler(b, nil))
+	defer srv.Close()
+
+	p := &countingPoster{poster.Http(), 0}
+	hs, err := NewHttp(srv.URL, p).GetStream("s")
+	assert.Nil(t, err)
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+
+	model := testEvents(0, flushEvents*2+500)
+	assert.Nil(t, AddBatch(s, toEvents(model)))
+
+	assert.Equal(t, model, readAll(t, hs))
+	p.check(t, "all")
+	assert.Equal(t, model[500:flushEvents*2+100], readRange(t, hs, 500, flushEvents*2+100))
+	p.check(t, "range")
+
+	// a reader that's done early closes the response
+	data, err := hs.Read(0, uint(len(model)))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		evt, err := data.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, model[i], string(evt.([]byte)))
+	}
+	stream.Drain(data)
+	p.check(t, "drained")
+	_, err = data.Next()
+	assert.Equal(t, stream.EOI, err)
+
+	// so does a failed one
+	_, err = hs.Read(0, uint(len(model)+1))
+	assert.NotNil(t, err)
+	p.check(t, "failed")
+}
+
+// Test that the events read before an invalid one are sent along with an error instead of a broken response.
+func TestHttpReadInvalid(t *testing.T) {
+	srv, b, hb := startHttp(t)
+	defer srv.Close()
+
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+	model := testEvents(0, 3)
+	assert.Nil(t, AddBatch(s, toEvents(append(append(model[:2:2], `{"n": `), model[2]))))
+
+	hs, err := hb.GetStream("s")
+	assert.Nil(t, err)
+	data, err := hs.Read(0, 4)
+	assert.Nil(t, err)
+
+	res := []string{}
+	for {
+		evt, err := data.Next()
+		if err != nil {
+			assert.True(t, strings.Contains(err.Error(), "Expected JSON event"), err.Error())
+			break
+		}
+		res = append(res, string(evt.([]byte)))
+	}
+	assert.Equal(t, model[:2], res)
+}
+
+// A backend which reads a page of events from it's streams and then waits for the gate to open.
+type gatedBackend struct {
+	Backend
+	gate    chan struct{}
+	drained chan struct{}
+}
+
+type gatedStream struct {
+	BackendStream
+	b *gatedBackend
+}
+
+type gatedRead struct {
+	stream.Stream
+	b *gatedBackend
+	n int
+}
+
+func (self *gatedBackend) GetStream(name string) (BackendStream, error) {
+	s, err := self.Backend.GetStream(name)
+	if err != nil {
+		return nil, err
+	}
+	return gatedStream{s, self}, nil
+}
+
+func (self gatedStream) Read(from uint, to uint) (stream.Stream, error) {
+	s, err := self.BackendStream.Read(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedRead{s, self.b, 0}, nil
+}
+
+func (self *gatedRead) Next() (stream.Event, error) {
+	if self.n == flushEvents {
+		<-self.b.gate
+	}
+	self.n++
+	return self.Stream.Next()
+}
+
+func (self *gatedRead) Drain() {
+	close(self.b.drained)
+	stream.Drain(self.Stream)
+}
+
+// Test that events are sent to the client as they are read and the server's reader is drained when the client stops reading.
+func TestHttpReadIncremental(t *testing.T) {
+	b := &gatedBackend{NewMem(), make(chan struct{}), make(chan struct{})}
+	srv := httptest.NewServer(NewHandler(b, nil))
+	defer srv.Close()
+
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+	model := testEvents(0, flushEvents*3)
+	assert.Nil(t, AddBatch(s, toEvents(model)))
+
+	hs, err := NewHttp(srv.URL, nil).GetStream("s")
+	assert.Nil(t, err)
+	data, err := hs.Read(0, uint(len(model)))
+	assert.Nil(t, err)
+
+	// the first page arrives while the server waits to read the rest
+	for i := 0; i < flushEvents; i++ {
+		evt, err := data.Next()
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.Equal(t, model[i], string(evt.([]byte)))
+	}
+
+	stream.Drain(data)
+	close(b.gate)
+	select {
+	case <-b.drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server's reader is not drained after the client stopped reading")
+	}
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/Monnoroch/golfstream/errors"
 	"github.com/Monnoroch/golfstream/stream"
@@ -8,47 +9,122 @@ import (
 	"github.com/siddontang/ledisdb/ledis"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// How many events a reader gets at once.
+const ledisReadPage = 1024
+
+/*
+A stream of events read from a list page by page.
+
+The stream's lock is only held while reading a page, so reading doesn't block deleting events.
+Instead, a delete moves positions of unfinished readers, so that they don't skip or repeat events.
+*/
 type ledisListStream struct {
-	db      *ledis.DB
-	key     []byte
-	num     int32
-	s       int32
-	l       int32
-	delLock *sync.RWMutex
+	obj *ledisStreamObj
+	// position of the next event to read and the end of the range, changed by Del
+	num  int64
+	to   int64
+	page [][]byte
 }
 
-func (self *ledisListStream) Next() (stream.Event, error) {
-	if self.num >= self.l {
-		return nil, stream.EOI
+// Stop reading, the stream's read lock has to be held.
+func (self *ledisListStream) finish() {
+	self.num = self.to
+	self.page = nil
+	self.obj.rmReader(self)
+}
+
+func (self *ledisListStream) read() ([][]byte, error) {
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	// deletes might have removed the rest of the range
+	if self.num >= self.to {
+		self.obj.rmReader(self)
+		return nil, nil
+	}
+
+	to := self.num + ledisReadPage
+	if to > self.to {
+		to = self.to
 	}
 
-	res, err := self.db.LIndex(self.key, self.num)
+	page, err := self.obj.db.LRange(self.obj.key, int32(self.num), int32(to-1))
 	if err != nil {
-		self.delLock.RUnlock()
+		self.finish()
 		return nil, err
 	}
 
-	self.num += 1
-	if self.num >= self.l {
-		self.delLock.RUnlock()
+	if int64(len(page)) != to-self.num {
+		self.finish()
+		return nil, errors.New(fmt.Sprintf("ledisListStream.read: unexpected end of stream \"%s\"", self.obj.name))
 	}
+
+	self.num = to
+	if self.num == self.to {
+		self.obj.rmReader(self)
+	}
+	return page, nil
+}
+
+func (self *ledisListStream) Next() (stream.Event, error) {
+	if len(self.page) == 0 {
+		page, err := self.read()
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return nil, stream.EOI
+		}
+
+		self.page = page
+	}
+
+	res := self.page[0]
+	self.page = self.page[1:]
 	return stream.Event(res), nil
 }
 
 func (self *ledisListStream) Len() int {
-	return int(self.s - self.num)
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	return int(self.to-self.num) + len(self.page)
 }
 
 func (self *ledisListStream) Drain() {
-	self.num = self.l
-	self.delLock.RUnlock()
+	self.obj.delLock.RLock()
+	defer self.obj.delLock.RUnlock()
+
+	if self.num < self.to {
+		self.finish()
+	}
+	self.page = nil
 }
 
+// Get a new position of an event after deleting a range of events, positions within the range are moved to it's end.
+func ledisShift(pos int64, from int64, to int64) int64 {
+	if pos >= to {
+		return pos - (to - from)
+	}
+	if pos > from {
+		return from
+	}
+	return pos
+}
+
+// A set of names of all streams in the meta database, so that listing streams doesn't scan keys.
+var ledisStreamsKey = []byte("streams")
+
 type ledisStreamObj struct {
-	db   *ledis.DB
+	db *ledis.DB
+	// a list of times when events were added and their sizes and a key with the base of the stream
+	meta *ledis.DB
 	back *ledisBackend
 	name string
 	key  []byte
@@ -56,6 +132,63 @@ type ledisStreamObj struct {
 	delLock sync.RWMutex
 
 	refcnt int
+
+	readersLock sync.Mutex
+	readers     map[*ledisListStream]struct{}
+
+	// the stream is in the set of streams
+	listLock sync.Mutex
+	listed   bool
+}
+
+func (self *ledisStreamObj) addReader(r *ledisListStream) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	self.readers[r] = struct{}{}
+	// a reader keeps the stream, so that a delete by another user of it moves the reader's positions
+	self.back.acquire(self)
+}
+
+func (self *ledisStreamObj) rmReader(r *ledisListStream) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	if _, ok := self.readers[r]; !ok {
+		return
+	}
+
+	delete(self.readers, r)
+	self.back.release(self)
+}
+
+// Add the stream to the set of streams, if it's not there.
+func (self *ledisStreamObj) list() error {
+	self.listLock.Lock()
+	defer self.listLock.Unlock()
+
+	if self.listed {
+		return nil
+	}
+
+	if _, err := self.meta.SAdd(ledisStreamsKey, self.key); err != nil {
+		return err
+	}
+
+	self.listed = true
+	return nil
+}
+
+func (self *ledisStreamObj) unlist() error {
+	self.listLock.Lock()
+	defer self.listLock.Unlock()
+
+	if _, err := self.meta.SRem(ledisStreamsKey, self.key); err != nil {
+		return err
+	}
+
+	self.listed = false
+	return nil
 }
 
 func (self *ledisStreamObj) Add(evt stream.Event) error {
@@ -67,16 +200,72 @@ func (self *ledisStreamObj) Add(evt stream.Event) error {
 	self.delLock.RLock()
 	defer self.delLock.RUnlock()
 
-	_, err := self.db.RPush(self.key, bs)
+	if err := self.list(); err != nil {
+		return err
+	}
+
+	if _, err := self.db.RPush(self.key, bs); err != nil {
+		return err
+	}
+
+	_, err := self.meta.RPush(self.key, encodeLedisMeta(time.Now(), len(bs)))
 	return err
 }
 
+func (self *ledisStreamObj) AddBatch(evts []stream.Event) error {
+	if len(evts) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	bss := make([][]byte, len(evts))
+	metas := make([][]byte, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("ledisStreamObj.AddBatch: Expected []byte, got %v", evt))
+		}
+
+		bss[i] = bs
+		metas[i] = encodeLedisMeta(now, len(bs))
+	}
+
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	if err := self.list(); err != nil {
+		return err
+	}
+
+	if _, err := self.db.RPush(self.key, bss...); err != nil {
+		return err
+	}
+
+	_, err := self.meta.RPush(self.key, metas...)
+	return err
+}
+
+func encodeLedisMeta(t time.Time, size int) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:], uint64(size))
+	return buf
+}
+
+func decodeLedisMeta(data []byte) (time.Time, uint64) {
+	if len(data) != 16 {
+		return time.Unix(0, 0), 0
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), binary.BigEndian.Uint64(data[8:])
+}
+
 func (self *ledisStreamObj) Read(from uint, to uint) (stream.Stream, error) {
 	if from == to {
 		return stream.Empty(), nil
 	}
 
 	self.delLock.RLock()
+	defer self.delLock.RUnlock()
 
 	l, err := self.db.LLen(self.key)
 	if err != nil {
@@ -87,7 +276,9 @@ func (self *ledisStreamObj) Read(from uint, to uint) (stream.Stream, error) {
 		return nil, err
 	}
 
-	return &ledisListStream{self.db, self.key, int32(from), int32(from), int32(to), &self.delLock}, nil
+	res := &ledisListStream{self, int64(from), int64(to), nil}
+	self.addReader(res)
+	return res, nil
 }
 
 func (self *ledisStreamObj) Interval(from int, to int) (uint, uint, error) {
@@ -134,8 +325,53 @@ func (self *ledisStreamObj) Del(afrom uint, ato uint) (bool, error) {
 		return false, err
 	}
 
+	res, err := ledisDel(self.db, self.key, from, to, l)
+	if err != nil {
+		return false, err
+	}
+
+	if from == 0 {
+		if _, err := self.meta.IncrBy(self.key, to); err != nil {
+			return false, err
+		}
+	}
+
+	self.readersLock.Lock()
+	for r, _ := range self.readers {
+		r.num = ledisShift(r.num, from, to)
+		r.to = ledisShift(r.to, from, to)
+	}
+	self.readersLock.Unlock()
+
+	if from == 0 && to == l {
+		if err := self.unlist(); err != nil {
+			return false, err
+		}
+	}
+
+	// events added by older versions don't have metadata
+	ml, err := self.meta.LLen(self.key)
+	if err != nil {
+		return false, err
+	}
+
+	off := l - ml
+	from -= off
+	to -= off
+	if from < 0 {
+		from = 0
+	}
+	if to > 0 {
+		if _, err := ledisDel(self.meta, self.key, from, to, ml); err != nil {
+			return false, err
+		}
+	}
+	return res, nil
+}
+
+func ledisDel(db *ledis.DB, key []byte, from int64, to int64, l int64) (bool, error) {
 	if from == 0 && to == l {
-		cnt, err := self.db.LClear(self.key)
+		cnt, err := db.LClear(key)
 		if err != nil {
 			return false, err
 		}
@@ -143,27 +379,27 @@ func (self *ledisStreamObj) Del(afrom uint, ato uint) (bool, error) {
 	}
 
 	if from == 0 {
-		err := self.db.LTrim(self.key, int64(to-1), l)
+		err := db.LTrim(key, to, l-1)
 		return err == nil, err
 	}
 
 	if to == l {
-		err := self.db.LTrim(self.key, 0, from-1)
+		err := db.LTrim(key, 0, from-1)
 		return err == nil, err
 	}
 
 	// TODO: optimize: read smaller part to the memory
-	rest, err := self.db.LRange(self.key, int32(to), int32(l))
+	rest, err := db.LRange(key, int32(to), int32(l))
 	if err != nil {
 		return false, err
 	}
 
-	if err := self.db.LTrim(self.key, 0, from-1); err != nil {
+	if err := db.LTrim(key, 0, from-1); err != nil {
 		return false, err
 	}
 
 	// TODO: if this fails, we should roll back the trim... but whatever. For now.
-	_, err = self.db.RPush(self.key, rest...)
+	_, err = db.RPush(key, rest...)
 	if err != nil {
 		log.Println(fmt.Sprintf("ledisStreamObj.Del: WARNING: RPush failed, but Trim wasn't rolled back. Lost the data."))
 	}
@@ -179,27 +415,166 @@ func (self *ledisStreamObj) Len() (uint, error) {
 	return uint(l), nil
 }
 
+func (self *ledisStreamObj) Base() (uint, uint, error) {
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	data, err := self.meta.Get(self.key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	base := uint64(0)
+	if data != nil {
+		base, err = strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	l, err := self.db.LLen(self.key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(base), uint(l), nil
+}
+
 func (self *ledisStreamObj) Close() error {
 	self.back.release(self)
 	return nil
 }
 
+// Events added by older versions don't have their times, so they are considered old.
+func (self *ledisStreamObj) countOlder(t time.Time) (uint, error) {
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	l, err := self.db.LLen(self.key)
+	if err != nil {
+		return 0, err
+	}
+
+	ml, err := self.meta.LLen(self.key)
+	if err != nil {
+		return 0, err
+	}
+
+	var serr error
+	n := sort.Search(int(ml), func(i int) bool {
+		if serr != nil {
+			return true
+		}
+
+		data, err := self.meta.LIndex(self.key, int32(i))
+		if err != nil {
+			serr = err
+			return true
+		}
+
+		et, _ := decodeLedisMeta(data)
+		return !et.Before(t)
+	})
+	if serr != nil {
+		return 0, serr
+	}
+
+	return uint(l - ml + int64(n)), nil
+}
+
+// How many metadata entries are read at once.
+const ledisMetaPage = 1024
+
+func (self *ledisStreamObj) countOver(bytes uint64) (uint, error) {
+	self.delLock.RLock()
+	defer self.delLock.RUnlock()
+
+	l, err := self.db.LLen(self.key)
+	if err != nil {
+		return 0, err
+	}
+
+	ml, err := self.meta.LLen(self.key)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(0)
+	for to := ml; to > 0; to -= ledisMetaPage {
+		from := to - ledisMetaPage
+		if from < 0 {
+			from = 0
+		}
+
+		page, err := self.meta.LRange(self.key, int32(from), int32(to-1))
+		if err != nil {
+			return 0, err
+		}
+
+		for i := len(page) - 1; i >= 0; i-- {
+			_, s := decodeLedisMeta(page[i])
+			size += s
+			if size > bytes {
+				return uint(l - ml + from + int64(i) + 1), nil
+			}
+		}
+	}
+
+	// events added by older versions don't have their sizes
+	for i := l - ml - 1; i >= 0; i-- {
+		data, err := self.db.LIndex(self.key, int32(i))
+		if err != nil {
+			return 0, err
+		}
+
+		size += uint64(len(data))
+		if size > bytes {
+			return uint(i + 1), nil
+		}
+	}
+	return 0, nil
+}
+
 type ledisBackend struct {
-	dirname string
-	ledis   *ledis.Ledis
-	db      *ledis.DB
-	lock    sync.Mutex
-	data    map[string]*ledisStreamObj
+	dirname   string
+	ledis     *ledis.Ledis
+	db        *ledis.DB
+	meta      *ledis.DB
+	lock      sync.Mutex
+	data      map[string]*ledisStreamObj
+	retention *retainer
 }
 
 func (self *ledisBackend) Config() (interface{}, error) {
-	return map[string]interface{}{
+	return self.retention.config(map[string]interface{}{
 		"type": "ledis",
 		"arg":  self.dirname,
-	}, nil
+	}), nil
+}
+
+func (self *ledisBackend) SetRetention(name string, r Retention) error {
+	return self.retention.set(name, r)
+}
+
+func (self *ledisBackend) Retention() (map[string]Retention, error) {
+	return self.retention.all(), nil
 }
 
 func (self *ledisBackend) Streams() ([]string, error) {
+	names, err := self.meta.SMembers(ledisStreamsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, len(names))
+	for i, v := range names {
+		res[i] = string(v)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// List streams by scanning keys, for databases created by older versions without the set of streams.
+func (self *ledisBackend) scanStreams() ([]string, error) {
 	r := make([][]byte, 0, 10)
 	lastKey := []byte{}
 	for {
@@ -229,7 +604,7 @@ func (self *ledisBackend) GetStream(name string) (BackendStream, error) {
 
 	v, ok := self.data[name]
 	if !ok {
-		v = &ledisStreamObj{self.db, self, name, []byte(name), sync.RWMutex{}, 0}
+		v = &ledisStreamObj{self.db, self.meta, self, name, []byte(name), sync.RWMutex{}, 0, sync.Mutex{}, map[*ledisListStream]struct{}{}, sync.Mutex{}, false}
 		self.data[name] = v
 	}
 
@@ -237,7 +612,16 @@ func (self *ledisBackend) GetStream(name string) (BackendStream, error) {
 	return v, nil
 }
 
+func (self *ledisBackend) acquire(s *ledisStreamObj) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s.refcnt += 1
+}
+
 func (self *ledisBackend) Drop() error {
+	self.retention.drop()
+
 	return errors.List().
 		Add(self.ledis.FlushAll()).
 		Add(os.RemoveAll(self.dirname)).
@@ -245,6 +629,7 @@ func (self *ledisBackend) Drop() error {
 }
 
 func (self *ledisBackend) Close() error {
+	self.retention.close()
 	self.data = nil
 	self.ledis.Close()
 	return nil
@@ -260,6 +645,26 @@ func (self *ledisBackend) release(s *ledisStreamObj) {
 	}
 }
 
+// Fill the set of streams for a database created by an older version.
+func (self *ledisBackend) migrateStreams() error {
+	n, err := self.meta.SCard(ledisStreamsKey)
+	if err != nil || n != 0 {
+		return err
+	}
+
+	names, err := self.scanStreams()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	keys := make([][]byte, len(names))
+	for i, v := range names {
+		keys[i] = []byte(v)
+	}
+	_, err = self.meta.SAdd(ledisStreamsKey, keys...)
+	return err
+}
+
 /*
 Create a backend that stores pushed events in ledisdb.
 */
@@ -267,7 +672,8 @@ func NewLedis(dirname string) (Backend, error) {
 	lcfg := config.NewConfigDefault()
 	lcfg.DataDir = dirname
 	lcfg.Addr = ""
-	lcfg.Databases = 1
+	// events and their metadata
+	lcfg.Databases = 2
 
 	ledis, err := ledis.Open(lcfg)
 	if err != nil {
@@ -279,5 +685,23 @@ func NewLedis(dirname string) (Backend, error) {
 		return nil, err
 	}
 
-	return &ledisBackend{dirname, ledis, db, sync.Mutex{}, map[string]*ledisStreamObj{}}, nil
+	meta, err := ledis.Select(1)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ledisBackend{dirname, ledis, db, meta, sync.Mutex{}, map[string]*ledisStreamObj{}, nil}
+	if err := res.migrateStreams(); err != nil {
+		ledis.Close()
+		return nil, err
+	}
+
+	res.retention = newRetainer(func(name string) (retentionStream, func(), error) {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.(*ledisStreamObj), func() { s.Close() }, nil
+	})
+	return res, nil
 }
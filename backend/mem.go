@@ -2,7 +2,9 @@ package backend
 
 import (
 	"github.com/Monnoroch/golfstream/stream"
+	"sort"
 	"sync"
+	"time"
 )
 
 type memStreamObj struct {
@@ -11,6 +13,10 @@ type memStreamObj struct {
 
 	lock sync.Mutex
 	data []stream.Event
+	// times when events were added
+	times []time.Time
+	// number of events deleted from the beginning
+	base uint
 }
 
 func (self *memStreamObj) Add(evt stream.Event) error {
@@ -18,6 +24,19 @@ func (self *memStreamObj) Add(evt stream.Event) error {
 	defer self.lock.Unlock()
 
 	self.data = append(self.data, evt)
+	self.times = append(self.times, time.Now())
+	return nil
+}
+
+func (self *memStreamObj) AddBatch(evts []stream.Event) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	self.data = append(self.data, evts...)
+	for _ = range evts {
+		self.times = append(self.times, now)
+	}
 	return nil
 }
 
@@ -75,6 +94,10 @@ func (self *memStreamObj) Del(from uint, to uint) (bool, error) {
 	}
 
 	self.data = append(self.data[:from], self.data[to:]...)
+	self.times = append(self.times[:from], self.times[to:]...)
+	if from == 0 {
+		self.base += to
+	}
 	return true, nil
 }
 
@@ -85,20 +108,61 @@ func (self *memStreamObj) Len() (uint, error) {
 	return uint(len(self.data)), nil
 }
 
+func (self *memStreamObj) Base() (uint, uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.base, uint(len(self.data)), nil
+}
+
 func (self *memStreamObj) Close() error {
 	return nil
 }
 
+func (self *memStreamObj) countOlder(t time.Time) (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return uint(sort.Search(len(self.times), func(i int) bool {
+		return !self.times[i].Before(t)
+	})), nil
+}
+
+func (self *memStreamObj) countOver(bytes uint64) (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	size := uint64(0)
+	for i := len(self.data) - 1; i >= 0; i-- {
+		if bs, ok := self.data[i].([]byte); ok {
+			size += uint64(len(bs))
+		}
+		if size > bytes {
+			return uint(i + 1), nil
+		}
+	}
+	return 0, nil
+}
+
 type memBackend struct {
-	lock sync.Mutex
-	data map[string]*memStreamObj
+	lock      sync.Mutex
+	data      map[string]*memStreamObj
+	retention *retainer
 }
 
 func (self *memBackend) Config() (interface{}, error) {
-	return map[string]interface{}{
+	return self.retention.config(map[string]interface{}{
 		"type": "mem",
 		"arg":  nil,
-	}, nil
+	}), nil
+}
+
+func (self *memBackend) SetRetention(name string, r Retention) error {
+	return self.retention.set(name, r)
+}
+
+func (self *memBackend) Retention() (map[string]Retention, error) {
+	return self.retention.all(), nil
 }
 
 func (self *memBackend) Streams() ([]string, error) {
@@ -118,13 +182,15 @@ func (self *memBackend) GetStream(name string) (BackendStream, error) {
 
 	s, ok := self.data[name]
 	if !ok {
-		s = &memStreamObj{self, name, sync.Mutex{}, []stream.Event{}}
+		s = &memStreamObj{self, name, sync.Mutex{}, []stream.Event{}, []time.Time{}, 0}
 		self.data[name] = s
 	}
 	return s, nil
 }
 
 func (self *memBackend) Drop() error {
+	self.retention.drop()
+
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
@@ -133,6 +199,7 @@ func (self *memBackend) Drop() error {
 }
 
 func (self *memBackend) Close() error {
+	self.retention.close()
 	self.data = nil
 	return nil
 }
@@ -143,5 +210,13 @@ Create a backend that stores pushed events in memory, so they don't persist on t
 Can be used for mocking a real backend in tests.
 */
 func NewMem() Backend {
-	return &memBackend{sync.Mutex{}, map[string]*memStreamObj{}}
+	res := &memBackend{sync.Mutex{}, map[string]*memStreamObj{}, nil}
+	res.retention = newRetainer(func(name string) (retentionStream, func(), error) {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.(*memStreamObj), func() {}, nil
+	})
+	return res
 }
@@ -0,0 +1,343 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Retention policy of a backend stream: the oldest events are deleted as soon as there are more than Count of them,
+they are older than Age or all events take more than Bytes. Zero values mean no limit.
+*/
+type Retention struct {
+	Count uint
+	Age   time.Duration
+	Bytes uint64
+}
+
+// Check if the policy doesn't limit anything.
+func (self Retention) Empty() bool {
+	return self.Count == 0 && self.Age == 0 && self.Bytes == 0
+}
+
+// Get the policy as a config, as in Backend.Config().
+func (self Retention) Config() map[string]interface{} {
+	res := map[string]interface{}{}
+	if self.Count != 0 {
+		res["max_count"] = self.Count
+	}
+	if self.Age != 0 {
+		res["max_age"] = self.Age.String()
+	}
+	if self.Bytes != 0 {
+		res["max_bytes"] = self.Bytes
+	}
+	return res
+}
+
+func getUint(arg interface{}) (uint64, bool) {
+	switch v := arg.(type) {
+	case float64:
+		if v < 0 || v != float64(uint64(v)) {
+			return 0, false
+		}
+		return uint64(v), true
+	case int64:
+		if v < 0 {
+			return 0, false
+		}
+		return uint64(v), true
+	case int:
+		if v < 0 {
+			return 0, false
+		}
+		return uint64(v), true
+	case uint:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Create a retention policy from it's config as returned by Retention.Config().
+func ParseRetention(arg interface{}) (Retention, error) {
+	cfg, ok := arg.(map[string]interface{})
+	if !ok {
+		return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Expected object, got %v", arg))
+	}
+
+	res := Retention{}
+	for k, v := range cfg {
+		switch k {
+		case "max_count":
+			n, ok := getUint(v)
+			if !ok {
+				return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Expected \"max_count\" to be non-negative integer, got %v", v))
+			}
+			res.Count = uint(n)
+		case "max_age":
+			s, ok := v.(string)
+			if !ok {
+				return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Expected \"max_age\" to be duration string, got %v", v))
+			}
+
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Expected \"max_age\" to be non-negative duration, got %v", v))
+			}
+			res.Age = d
+		case "max_bytes":
+			n, ok := getUint(v)
+			if !ok {
+				return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Expected \"max_bytes\" to be non-negative integer, got %v", v))
+			}
+			res.Bytes = n
+		default:
+			return Retention{}, errors.New(fmt.Sprintf("ParseRetention: Unknown field \"%s\"", k))
+		}
+	}
+	return res, nil
+}
+
+/*
+RetentionBackend is a Backend which can enforce retention policies of it's streams in the background.
+
+It's Config() has policies in the "retention" field, as a map from a stream name to it's policy config.
+*/
+type RetentionBackend interface {
+	Backend
+	// Set a retention policy of a stream, an empty policy removes it.
+	SetRetention(name string, r Retention) error
+	// Get retention policies of all streams which have them.
+	Retention() (map[string]Retention, error)
+}
+
+/*
+Set retention policies from the "retention" field of a backend config, as returned by RetentionBackend.Config().
+
+It's not an error for a config to not have any policies.
+*/
+func SetRetentionConfig(b Backend, cfg interface{}) error {
+	if cfg == nil {
+		return nil
+	}
+
+	policies, ok := cfg.(map[string]interface{})
+	if !ok {
+		return errors.New(fmt.Sprintf("SetRetentionConfig: Expected object, got %v", cfg))
+	}
+
+	if len(policies) == 0 {
+		return nil
+	}
+
+	rb, ok := b.(RetentionBackend)
+	if !ok {
+		return errors.New(fmt.Sprintf("SetRetentionConfig: Backend %v doesn't support retention", b))
+	}
+
+	for name, v := range policies {
+		r, err := ParseRetention(v)
+		if err != nil {
+			return err
+		}
+
+		if err := rb.SetRetention(name, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A backend stream that can find out how many of it's first events are beyond the retention policy limits.
+type retentionStream interface {
+	BackendStream
+	// Number of first events added before a given time.
+	countOlder(t time.Time) (uint, error)
+	// Number of first events to delete for the rest to take no more than a given number of bytes.
+	countOver(bytes uint64) (uint, error)
+}
+
+func enforceRetention(s retentionStream, r Retention, now time.Time) error {
+	l, err := s.Len()
+	if err != nil {
+		return err
+	}
+
+	n := uint(0)
+	if r.Count != 0 && l > r.Count {
+		n = l - r.Count
+	}
+
+	if r.Age != 0 {
+		c, err := s.countOlder(now.Add(-r.Age))
+		if err != nil {
+			return err
+		}
+
+		if c > n {
+			n = c
+		}
+	}
+
+	if r.Bytes != 0 {
+		c, err := s.countOver(r.Bytes)
+		if err != nil {
+			return err
+		}
+
+		if c > n {
+			n = c
+		}
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	if n > l {
+		n = l
+	}
+	_, err = s.Del(0, n)
+	return err
+}
+
+// How often retention policies are enforced.
+var retentionInterval = 10 * time.Second
+
+/*
+A background enforcer of retention policies of a backend.
+
+The get function gets a stream by name and a function to release it after enforcement.
+*/
+type retainer struct {
+	get func(name string) (retentionStream, func(), error)
+
+	lock     sync.Mutex
+	policies map[string]Retention
+	stop     chan struct{}
+	done     chan struct{}
+	// set when the backend is closed, so that policies are not enforced anymore
+	closed bool
+}
+
+func newRetainer(get func(name string) (retentionStream, func(), error)) *retainer {
+	return &retainer{get, sync.Mutex{}, map[string]Retention{}, nil, nil, false}
+}
+
+func (self *retainer) set(name string, r Retention) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return errors.New(fmt.Sprintf("retainer.set: Backend is closed, can't set retention of stream \"%s\"", name))
+	}
+
+	if r.Empty() {
+		delete(self.policies, name)
+		return nil
+	}
+
+	self.policies[name] = r
+	if self.stop == nil {
+		self.stop = make(chan struct{})
+		self.done = make(chan struct{})
+		go self.run(self.stop, self.done)
+	}
+	return nil
+}
+
+func (self *retainer) all() map[string]Retention {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make(map[string]Retention, len(self.policies))
+	for k, v := range self.policies {
+		res[k] = v
+	}
+	return res
+}
+
+// Add the "retention" field to a backend config, if there are any policies.
+func (self *retainer) config(cfg map[string]interface{}) map[string]interface{} {
+	policies := self.all()
+	if len(policies) == 0 {
+		return cfg
+	}
+
+	rcfg := make(map[string]interface{}, len(policies))
+	for k, v := range policies {
+		rcfg[k] = v.Config()
+	}
+	cfg["retention"] = rcfg
+	return cfg
+}
+
+func (self *retainer) enforce(name string, r Retention, now time.Time) error {
+	s, release, err := self.get(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return enforceRetention(s, r, now)
+}
+
+func (self *retainer) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for name, r := range self.all() {
+				if err := self.enforce(name, r, now); err != nil {
+					log.Println(fmt.Sprintf("retainer: failed to enforce retention of stream \"%s\": %s", name, err.Error()))
+				}
+			}
+		}
+	}
+}
+
+// Stop enforcing policies for good.
+func (self *retainer) close() {
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+
+	self.halt()
+}
+
+// Stop the background enforcement, it's started again when a policy is set.
+func (self *retainer) halt() {
+	self.lock.Lock()
+	stop, done := self.stop, self.done
+	self.stop = nil
+	self.done = nil
+	self.lock.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// Stop enforcing policies and remove them, for dropping the backend's data.
+func (self *retainer) drop() {
+	self.halt()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.policies = map[string]Retention{}
+}
@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Test that retention policies are parsed from configs and back.
+func TestParseRetention(t *testing.T) {
+	examples := []struct {
+		Arg interface{}
+		Res Retention
+		Ok  bool
+	}{
+		{map[string]interface{}{}, Retention{}, true},
+		{map[string]interface{}{"max_count": float64(10)}, Retention{10, 0, 0}, true},
+		{map[string]interface{}{"max_age": "1h30m"}, Retention{0, 90 * time.Minute, 0}, true},
+		{map[string]interface{}{"max_bytes": float64(1024)}, Retention{0, 0, 1024}, true},
+		{map[string]interface{}{"max_count": 5, "max_age": "1s", "max_bytes": uint64(7)}, Retention{5, time.Second, 7}, true},
+		{map[string]interface{}{"max_count": float64(-1)}, Retention{}, false},
+		{map[string]interface{}{"max_count": 1.5}, Retention{}, false},
+		{map[string]interface{}{"max_count": "10"}, Retention{}, false},
+		{map[string]interface{}{"max_age": "-1s"}, Retention{}, false},
+		{map[string]interface{}{"max_age": 10}, Retention{}, false},
+		{map[string]interface{}{"max_bytes": -5}, Retention{}, false},
+		{map[string]interface{}{"bad": 1}, Retention{}, false},
+		{"max_count", Retention{}, false},
+		{nil, Retention{}, false},
+	}
+	for _, e := range examples {
+		r, err := ParseRetention(e.Arg)
+		if !e.Ok {
+			assert.NotNil(t, err, fmt.Sprint(e.Arg))
+			continue
+		}
+
+		assert.Nil(t, err, fmt.Sprint(e.Arg))
+		assert.Equal(t, e.Res, r, fmt.Sprint(e.Arg))
+		assert.Equal(t, e.Res.Empty(), e.Res == Retention{})
+
+		r, err = ParseRetention(e.Res.Config())
+		assert.Nil(t, err)
+		assert.Equal(t, e.Res, r)
+	}
+}
+
+// Test that all backends delete their oldest events beyond the retention limits.
+func TestEnforceRetention(t *testing.T) {
+	model := []string{}
+	for i := 0; i < 100; i++ {
+		model = append(model, fmt.Sprintf("%09d", i))
+	}
+
+	for _, tb := range testBackends(t) {
+		b, err := tb.open()
+		if !assert.Nil(t, err, tb.name) {
+			continue
+		}
+
+		bs, err := b.GetStream("s")
+		assert.Nil(t, err, tb.name)
+		addEvents(t, bs, model)
+
+		s, ok := bs.(retentionStream)
+		if !assert.True(t, ok, tb.name) {
+			continue
+		}
+
+		now := time.Now()
+		assert.Nil(t, enforceRetention(s, Retention{}, now), tb.name)
+		checkStream(t, tb.name, s, model, 0)
+
+		assert.Nil(t, enforceRetention(s, Retention{Count: 200, Age: time.Hour, Bytes: 1 << 20}, now), tb.name)
+		checkStream(t, tb.name+": under limits", s, model, 0)
+
+		assert.Nil(t, enforceRetention(s, Retention{Count: 50}, now), tb.name)
+		checkStream(t, tb.name+": count", s, model[50:], 50)
+
+		// backends count some overhead with the events
+		assert.Nil(t, enforceRetention(s, Retention{Bytes: 95}, now), tb.name)
+		l, err := s.Len()
+		assert.Nil(t, err, tb.name)
+		assert.True(t, l > 0 && l <= 10, tb.name, l)
+		checkStream(t, tb.name+": bytes", s, model[100-l:], 100-l)
+
+		assert.Nil(t, enforceRetention(s, Retention{Age: time.Minute}, now.Add(time.Hour)), tb.name)
+		checkStream(t, tb.name+": age", s, []string{}, 100)
+
+		assert.Nil(t, s.Close(), tb.name)
+		assert.Nil(t, b.Drop(), tb.name)
+	}
+}
+
+// Test that retention policies are enforced in the background and are in the backend's config.
+func TestRetentionBackground(t *testing.T) {
+	old := retentionInterval
+	retentionInterval = 5 * time.Millisecond
+	defer func() {
+		retentionInterval = old
+	}()
+
+	b := NewMem()
+	defer b.Close()
+
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+	addEvents(t, s, testEvents(0, 100))
+
+	rb := b.(RetentionBackend)
+	assert.Nil(t, rb.SetRetention("s", Retention{Count: 10}))
+	for i := 0; i < 200; i++ {
+		if l, _ := s.Len(); l == 10 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkStream(t, "enforced", s, testEvents(90, 100), 90)
+
+	rs, err := rb.Retention()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Retention{"s": Retention{Count: 10}}, rs)
+
+	cfg, err := b.Config()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"s": map[string]interface{}{"max_count": uint(10)}}, cfg.(map[string]interface{})["retention"])
+
+	assert.Nil(t, rb.SetRetention("s", Retention{}))
+	rs, err = rb.Retention()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rs))
+
+	cfg, err = b.Config()
+	assert.Nil(t, err)
+	_, ok := cfg.(map[string]interface{})["retention"]
+	assert.False(t, ok)
+
+	// policies are not enforced on a closed backend
+	assert.Nil(t, b.Close())
+	assert.NotNil(t, rb.SetRetention("s", Retention{Count: 10}))
+	rs, err = rb.Retention()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rs))
+}
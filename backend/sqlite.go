@@ -0,0 +1,707 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of events a reader gets in one query.
+const sqlitePage = 1024
+
+/*
+Events of all streams are in one table, ordered by sequence numbers which are never reused within a stream.
+
+The streams table has the next sequence number, the number of events and their total size for each stream,
+so that getting the length of a stream doesn't count it's events.
+The bases table has the number of events ever deleted from the beginning of each stream,
+it's separate so that databases created by older versions get it too.
+The gaps table has ranges of sequence numbers deleted from the middle of each stream,
+so that the sequence number of an event at a position is found without counting events before it.
+*/
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS streams (
+		name TEXT PRIMARY KEY,
+		next_seq INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		size INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS events (
+		stream TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (stream, seq)
+	) WITHOUT ROWID`,
+	`CREATE TABLE IF NOT EXISTS bases (
+		stream TEXT PRIMARY KEY,
+		base INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS gaps (
+		stream TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (stream, seq)
+	) WITHOUT ROWID`,
+}
+
+// A row of the streams table.
+type sqliteStreamInfo struct {
+	next  int64
+	count int64
+	size  int64
+}
+
+func sqliteInfo(tx *sql.Tx, name string) (sqliteStreamInfo, error) {
+	res := sqliteStreamInfo{}
+	err := tx.QueryRow("SELECT next_seq, count, size FROM streams WHERE name = ?", name).Scan(&res.next, &res.count, &res.size)
+	if err == sql.ErrNoRows {
+		return res, nil
+	}
+	return res, err
+}
+
+// A range of sequence numbers deleted from the middle of a stream.
+type sqliteGap struct {
+	seq   int64
+	count int64
+}
+
+// Get gaps of a stream ordered by sequence numbers.
+func sqliteGaps(tx *sql.Tx, name string) (rres []sqliteGap, rerr error) {
+	rows, err := tx.Query("SELECT seq, count FROM gaps WHERE stream = ? ORDER BY seq", name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(rows.Close()).Err()
+	}()
+
+	res := []sqliteGap{}
+	for rows.Next() {
+		g := sqliteGap{}
+		if err := rows.Scan(&g.seq, &g.count); err != nil {
+			return nil, err
+		}
+		res = append(res, g)
+	}
+	return res, rows.Err()
+}
+
+/*
+Get the sequence number of the event at a given position in the stream, or the next sequence number for the end of the stream.
+
+It's an offset from the first one, moved past the gaps before it, so it only takes an indexed query and reading the gaps.
+*/
+func sqliteSeq(tx *sql.Tx, name string, info sqliteStreamInfo, pos int64) (int64, error) {
+	if pos == info.count {
+		return info.next, nil
+	}
+
+	var first int64
+	if err := tx.QueryRow("SELECT MIN(seq) FROM events WHERE stream = ?", name).Scan(&first); err != nil {
+		return 0, err
+	}
+
+	gaps, err := sqliteGaps(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	res := first + pos
+	for _, g := range gaps {
+		if g.seq > res {
+			break
+		}
+		res += g.count
+	}
+	return res, nil
+}
+
+/*
+Record that sequence numbers from lo to hi are deleted from the middle of a stream,
+merging the gaps within the range and the one just before it.
+*/
+func sqliteAddGap(tx *sql.Tx, name string, lo int64, hi int64) error {
+	var prev, count int64
+	err := tx.QueryRow("SELECT seq, count FROM gaps WHERE stream = ? AND seq < ? ORDER BY seq DESC LIMIT 1", name, lo).Scan(&prev, &count)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && prev+count == lo {
+		lo = prev
+	}
+
+	if _, err := tx.Exec("DELETE FROM gaps WHERE stream = ? AND seq >= ? AND seq < ?", name, lo, hi); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO gaps (stream, seq, count) VALUES (?, ?, ?)", name, lo, hi-lo)
+	return err
+}
+
+/*
+Rebuild gaps of streams that miss some, once for databases created by older versions, which didn't have gaps.
+
+Only streams with events deleted from the middle are scanned.
+*/
+func sqliteRebuildGaps(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rebuild := func() (rerr error) {
+		rows, err := tx.Query(`SELECT s.name FROM streams s WHERE s.count > 0 AND
+			s.next_seq - (SELECT MIN(seq) FROM events WHERE stream = s.name) - s.count !=
+			(SELECT COALESCE(SUM(count), 0) FROM gaps WHERE stream = s.name AND seq >= (SELECT MIN(seq) FROM events WHERE stream = s.name))`)
+		if err != nil {
+			return err
+		}
+
+		names := []string{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return errors.List().Add(err).Add(rows.Close()).Err()
+			}
+			names = append(names, name)
+		}
+		if err := errors.List().Add(rows.Err()).Add(rows.Close()).Err(); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := sqliteScanGaps(tx, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := rebuild(); err != nil {
+		return errors.List().Add(err).Add(tx.Rollback()).Err()
+	}
+	return tx.Commit()
+}
+
+// Find gaps of a stream by scanning it's sequence numbers.
+func sqliteScanGaps(tx *sql.Tx, name string) error {
+	info, err := sqliteInfo(tx, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM gaps WHERE stream = ?", name); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT seq FROM events WHERE stream = ? ORDER BY seq", name)
+	if err != nil {
+		return err
+	}
+
+	gaps := []sqliteGap{}
+	prev := int64(-1)
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return errors.List().Add(err).Add(rows.Close()).Err()
+		}
+		if prev != -1 && seq != prev+1 {
+			gaps = append(gaps, sqliteGap{prev + 1, seq - prev - 1})
+		}
+		prev = seq
+	}
+	if err := errors.List().Add(rows.Err()).Add(rows.Close()).Err(); err != nil {
+		return err
+	}
+
+	// events deleted from the end
+	if prev != -1 && prev+1 != info.next {
+		gaps = append(gaps, sqliteGap{prev + 1, info.next - prev - 1})
+	}
+
+	for _, g := range gaps {
+		if _, err := tx.Exec("INSERT INTO gaps (stream, seq, count) VALUES (?, ?, ?)", name, g.seq, g.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+A stream of events read in pages, each with it's own query.
+
+Sequence numbers are never reused, so a reader just reads the range of them it started with
+and events deleted under it are skipped without locking out deletes.
+*/
+type sqliteReadStream struct {
+	obj *sqliteStreamObj
+	// sequence number to start the next page from and the end of the range
+	seq  int64
+	to   int64
+	page [][]byte
+}
+
+func (self *sqliteReadStream) read() (rres [][]byte, rerr error) {
+	rows, err := self.obj.back.db.Query("SELECT seq, data FROM events WHERE stream = ? AND seq >= ? AND seq < ? ORDER BY seq LIMIT ?", self.obj.name, self.seq, self.to, sqlitePage)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(rows.Close()).Err()
+	}()
+
+	page := [][]byte{}
+	for rows.Next() {
+		var seq int64
+		var data []byte
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, err
+		}
+		page = append(page, data)
+		self.seq = seq + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page) == 0 {
+		self.seq = self.to
+	}
+	return page, nil
+}
+
+func (self *sqliteReadStream) Next() (stream.Event, error) {
+	if len(self.page) == 0 {
+		if self.seq == self.to {
+			return nil, stream.EOI
+		}
+
+		page, err := self.read()
+		if err != nil {
+			self.Drain()
+			return nil, err
+		}
+		if len(page) == 0 {
+			return nil, stream.EOI
+		}
+
+		self.page = page
+	}
+
+	res := self.page[0]
+	self.page = self.page[1:]
+	return stream.Event(res), nil
+}
+
+// Get the number of events left, or the number of sequence numbers left if counting fails.
+func (self *sqliteReadStream) Len() int {
+	var res int64
+	err := self.obj.back.db.QueryRow("SELECT COUNT(*) FROM events WHERE stream = ? AND seq >= ? AND seq < ?", self.obj.name, self.seq, self.to).Scan(&res)
+	if err != nil {
+		res = self.to - self.seq
+	}
+	return int(res) + len(self.page)
+}
+
+func (self *sqliteReadStream) Drain() {
+	self.seq = self.to
+	self.page = nil
+}
+
+type sqliteStreamObj struct {
+	back *sqliteBackend
+	name string
+}
+
+// Run a function in a transaction, which is committed if it succeeds and rolled back otherwise.
+func (self *sqliteStreamObj) tx(fn func(tx *sql.Tx) error) error {
+	tx, err := self.back.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		return errors.List().Add(err).Add(tx.Rollback()).Err()
+	}
+	return tx.Commit()
+}
+
+func (self *sqliteStreamObj) Add(evt stream.Event) error {
+	bs, ok := evt.([]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("sqliteStreamObj.Add: Expected []byte, got %v", evt))
+	}
+
+	return self.add([][]byte{bs})
+}
+
+func (self *sqliteStreamObj) AddBatch(evts []stream.Event) error {
+	bss := make([][]byte, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("sqliteStreamObj.AddBatch: Expected []byte, got %v", evt))
+		}
+
+		bss[i] = bs
+	}
+
+	return self.add(bss)
+}
+
+func (self *sqliteStreamObj) add(bss [][]byte) error {
+	now := time.Now().UnixNano()
+	return self.tx(func(tx *sql.Tx) error {
+		info, err := sqliteInfo(tx, self.name)
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare("INSERT INTO events (stream, seq, time, data) VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		size := int64(0)
+		for i, bs := range bss {
+			if _, err := stmt.Exec(self.name, info.next+int64(i), now, bs); err != nil {
+				return err
+			}
+			size += int64(len(bs))
+		}
+
+		_, err = tx.Exec(`INSERT INTO streams (name, next_seq, count, size) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET next_seq = excluded.next_seq, count = count + excluded.count, size = size + excluded.size`,
+			self.name, info.next+int64(len(bss)), len(bss), size)
+		return err
+	})
+}
+
+func (self *sqliteStreamObj) Read(from uint, to uint) (stream.Stream, error) {
+	if from == to {
+		return stream.Empty(), nil
+	}
+
+	var seq, end int64
+	err := self.tx(func(tx *sql.Tx) error {
+		info, err := sqliteInfo(tx, self.name)
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := convRange(int(from), int(to), int(info.count), "sqliteStreamObj.Read"); err != nil {
+			return err
+		}
+
+		seq, err = sqliteSeq(tx, self.name, info, int64(from))
+		if err != nil {
+			return err
+		}
+
+		end, err = sqliteSeq(tx, self.name, info, int64(to))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteReadStream{self, seq, end, nil}, nil
+}
+
+func (self *sqliteStreamObj) Interval(from int, to int) (uint, uint, error) {
+	if from == to {
+		return 0, 0, nil
+	}
+
+	l, err := self.Len()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	f, t, err := convRange(from, to, int(l), "sqliteStreamObj.Interval")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if f == t {
+		return 0, 0, nil
+	}
+
+	return f, t, nil
+}
+
+func (self *sqliteStreamObj) Del(from uint, to uint) (bool, error) {
+	if from == to {
+		return true, nil
+	}
+
+	err := self.tx(func(tx *sql.Tx) error {
+		info, err := sqliteInfo(tx, self.name)
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := convRange(int(from), int(to), int(info.count), "sqliteStreamObj.Del"); err != nil {
+			return err
+		}
+
+		lo, err := sqliteSeq(tx, self.name, info, int64(from))
+		if err != nil {
+			return err
+		}
+
+		hi, err := sqliteSeq(tx, self.name, info, int64(to))
+		if err != nil {
+			return err
+		}
+
+		var size int64
+		err = tx.QueryRow("SELECT COALESCE(SUM(LENGTH(data)), 0) FROM events WHERE stream = ? AND seq >= ? AND seq < ?", self.name, lo, hi).Scan(&size)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM events WHERE stream = ? AND seq >= ? AND seq < ?", self.name, lo, hi); err != nil {
+			return err
+		}
+
+		if from == 0 {
+			// gaps before the new first event don't matter anymore
+			if _, err := tx.Exec("DELETE FROM gaps WHERE stream = ? AND seq < ?", self.name, hi); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(`INSERT INTO bases (stream, base) VALUES (?, ?)
+				ON CONFLICT (stream) DO UPDATE SET base = base + excluded.base`,
+				self.name, to)
+			if err != nil {
+				return err
+			}
+		} else if err := sqliteAddGap(tx, self.name, lo, hi); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE streams SET count = count - ?, size = size - ? WHERE name = ?", to-from, size, self.name)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (self *sqliteStreamObj) Len() (uint, error) {
+	var count int64
+	err := self.back.db.QueryRow("SELECT count FROM streams WHERE name = ?", self.name).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint(count), nil
+}
+
+func (self *sqliteStreamObj) Base() (uint, uint, error) {
+	var base, count int64
+	err := self.tx(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT base FROM bases WHERE stream = ?", self.name).Scan(&base)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		info, err := sqliteInfo(tx, self.name)
+		count = info.count
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(base), uint(count), nil
+}
+
+func (self *sqliteStreamObj) Close() error {
+	return nil
+}
+
+func (self *sqliteStreamObj) countOlder(t time.Time) (uint, error) {
+	var res int64
+	err := self.tx(func(tx *sql.Tx) error {
+		info, err := sqliteInfo(tx, self.name)
+		if err != nil {
+			return err
+		}
+
+		// events are ordered by time, so only events before the first new enough one are counted
+		var seq int64
+		err = tx.QueryRow("SELECT seq FROM events WHERE stream = ? AND time >= ? ORDER BY seq LIMIT 1", self.name, t.UnixNano()).Scan(&seq)
+		if err == sql.ErrNoRows {
+			res = info.count
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRow("SELECT COUNT(*) FROM events WHERE stream = ? AND seq < ?", self.name, seq).Scan(&res)
+	})
+	return uint(res), err
+}
+
+func (self *sqliteStreamObj) countOver(bytes uint64) (uint, error) {
+	var res int64
+	err := self.tx(func(tx *sql.Tx) (rerr error) {
+		info, err := sqliteInfo(tx, self.name)
+		if err != nil {
+			return err
+		}
+
+		if uint64(info.size) <= bytes {
+			return nil
+		}
+
+		rows, err := tx.Query("SELECT LENGTH(data) FROM events WHERE stream = ? ORDER BY seq", self.name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			rerr = errors.List().Add(rerr).Add(rows.Close()).Err()
+		}()
+
+		size := uint64(info.size)
+		for size > bytes && rows.Next() {
+			var l uint64
+			if err := rows.Scan(&l); err != nil {
+				return err
+			}
+
+			size -= l
+			res++
+		}
+		return rows.Err()
+	})
+	return uint(res), err
+}
+
+type sqliteBackend struct {
+	path      string
+	db        *sql.DB
+	lock      sync.Mutex
+	data      map[string]*sqliteStreamObj
+	retention *retainer
+}
+
+func (self *sqliteBackend) Config() (interface{}, error) {
+	return self.retention.config(map[string]interface{}{
+		"type": "sqlite",
+		"arg":  self.path,
+	}), nil
+}
+
+func (self *sqliteBackend) SetRetention(name string, r Retention) error {
+	return self.retention.set(name, r)
+}
+
+func (self *sqliteBackend) Retention() (map[string]Retention, error) {
+	return self.retention.all(), nil
+}
+
+func (self *sqliteBackend) Streams() (rres []string, rerr error) {
+	rows, err := self.db.Query("SELECT name FROM streams ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(rows.Close()).Err()
+	}()
+
+	res := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+func (self *sqliteBackend) GetStream(name string) (BackendStream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	s, ok := self.data[name]
+	if !ok {
+		s = &sqliteStreamObj{self, name}
+		self.data[name] = s
+	}
+	return s, nil
+}
+
+func (self *sqliteBackend) Drop() error {
+	self.retention.drop()
+
+	errs := errors.List().Add(self.db.Close())
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(self.path + suffix); err != nil && !os.IsNotExist(err) {
+			errs.Add(err)
+		}
+	}
+	return errs.Err()
+}
+
+func (self *sqliteBackend) Close() error {
+	self.retention.close()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.data = nil
+	return self.db.Close()
+}
+
+/*
+Create a backend that stores pushed events in an SQLite database file.
+
+Events are stored in the events table with stream, seq, time and data columns,
+so they can be queried with SQL by other programs while the backend is used.
+*/
+func NewSqlite(path string) (Backend, error) {
+	// the write-ahead log lets other programs read the database while events are added
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows only one writer anyway, and with one connection transactions never fail because the database is locked
+	db.SetMaxOpenConns(1)
+
+	for _, q := range sqliteSchema {
+		if _, err := db.Exec(q); err != nil {
+			return nil, errors.List().Add(err).Add(db.Close()).Err()
+		}
+	}
+
+	if err := sqliteRebuildGaps(db); err != nil {
+		return nil, errors.List().Add(err).Add(db.Close()).Err()
+	}
+
+	res := &sqliteBackend{path, db, sync.Mutex{}, map[string]*sqliteStreamObj{}, nil}
+	res.retention = newRetainer(func(name string) (retentionStream, func(), error) {
+		s, err := res.GetStream(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.(*sqliteStreamObj), func() {}, nil
+	})
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+func sqliteGapsCount(t *testing.T, s BackendStream) int {
+	var res int
+	err := s.(*sqliteStreamObj).back.db.QueryRow("SELECT COUNT(*) FROM gaps WHERE stream = ?", "s").Scan(&res)
+	assert.Nil(t, err)
+	return res
+}
+
+/*
+Test that events deleted from the middle of an sqlite stream are recorded as merged gaps of sequence numbers
+and that gaps are rebuilt for databases which don't have them.
+*/
+func TestSqliteGaps(t *testing.T) {
+	dels := []struct {
+		From uint
+		To   uint
+		Gaps int
+	}{
+		{10, 20, 1},
+		// right after the first gap
+		{10, 15, 1},
+		{30, 35, 2},
+		// covering both gaps
+		{5, 40, 1},
+		{20, 21, 2},
+		// only gaps after the new first event are kept
+		{0, 10, 1},
+		// from the end
+		{30, 34, 2},
+	}
+
+	path := t.TempDir() + "/sqlite.db"
+	b, err := NewSqlite(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	s, err := b.GetStream("s")
+	assert.Nil(t, err)
+
+	model := testEvents(0, 100)
+	addEvents(t, s, model)
+	base := uint(0)
+	for _, d := range dels {
+		name := fmt.Sprintf("Del(%v, %v)", d.From, d.To)
+		_, err := s.Del(d.From, d.To)
+		assert.Nil(t, err, name)
+
+		model = append(append([]string{}, model[:d.From]...), model[d.To:]...)
+		if d.From == 0 {
+			base += d.To
+		}
+		checkStream(t, name, s, model, base)
+		assert.Equal(t, d.Gaps, sqliteGapsCount(t, s), name)
+	}
+
+	more := testEvents(100, 110)
+	addEvents(t, s, more)
+	model = append(model, more...)
+	checkStream(t, "added", s, model, base)
+
+	// as if the database was created by an older version
+	_, err = s.(*sqliteStreamObj).back.db.Exec("DELETE FROM gaps")
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	b, err = NewSqlite(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer b.Drop()
+
+	s, err = b.GetStream("s")
+	assert.Nil(t, err)
+	checkStream(t, "rebuilt", s, model, base)
+	assert.Equal(t, 2, sqliteGapsCount(t, s))
+}
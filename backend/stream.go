@@ -13,6 +13,26 @@ type Stream interface {
 	Close() error
 }
 
+// BatchAdder is an optional interface for streams that can add multiple events at once faster than one by one.
+type BatchAdder interface {
+	// Push events to the stream.
+	AddBatch(evts []stream.Event) error
+}
+
+// Push events to a stream at once if it's a BatchAdder or one by one otherwise.
+func AddBatch(s Stream, evts []stream.Event) error {
+	if b, ok := s.(BatchAdder); ok {
+		return b.AddBatch(evts)
+	}
+
+	for _, evt := range evts {
+		if err := s.Add(evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*
 Copy a producer stream to a consumer stream.
 
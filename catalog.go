@@ -0,0 +1,287 @@
+package golfstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A saved stream: it's name, backend stream's name, named input backend streams and definitions.
+type CatalogStream struct {
+	Name    string            `json:"name"`
+	Bstream string            `json:"backend_stream"`
+	Inputs  map[string]string `json:"inputs,omitempty"`
+	Defs    []string          `json:"definitions"`
+}
+
+// A saved backend: it's name, config as returned by backend.Backend.Config() and all it's streams.
+type CatalogBackend struct {
+	Name    string          `json:"name"`
+	Config  interface{}     `json:"config"`
+	Streams []CatalogStream `json:"streams"`
+}
+
+/*
+Catalog is an interface for persisting golfstream service state: backends and streams added to them.
+
+A service created with NewWithCatalog records every change to the catalog and restores it's state from the catalog on creation.
+*/
+type Catalog interface {
+	// List all saved backends with their streams.
+	Backends() ([]CatalogBackend, error)
+
+	// Save backend config by backend name.
+	AddBackend(name string, cfg interface{}) error
+	// Remove backend and all it's streams by backend name.
+	RmBackend(name string) error
+	// Replace saved backend config by backend name.
+	UpdateBackend(name string, cfg interface{}) error
+
+	// Save stream with given name, named input backend streams and definition to a backend stream.
+	AddStream(back, bstream, name string, inputs map[string]string, defs []string) error
+	// Remove stream by name.
+	RmStream(back, name string) error
+
+	// Close the catalog handler.
+	Close() error
+}
+
+type nilCatalog struct{}
+
+func (self nilCatalog) Backends() ([]CatalogBackend, error) {
+	return []CatalogBackend{}, nil
+}
+
+func (self nilCatalog) AddBackend(name string, cfg interface{}) error {
+	return nil
+}
+
+func (self nilCatalog) RmBackend(name string) error {
+	return nil
+}
+
+func (self nilCatalog) UpdateBackend(name string, cfg interface{}) error {
+	return nil
+}
+
+func (self nilCatalog) AddStream(back, bstream, name string, inputs map[string]string, defs []string) error {
+	return nil
+}
+
+func (self nilCatalog) RmStream(back, name string) error {
+	return nil
+}
+
+func (self nilCatalog) Close() error {
+	return nil
+}
+
+// Create a nil catalog, that doesn't save anything.
+func NilCatalog() Catalog {
+	return nilCatalog{}
+}
+
+type fileCatalogData struct {
+	Backends []CatalogBackend `json:"backends"`
+}
+
+type fileCatalog struct {
+	path string
+
+	lock sync.Mutex
+	data fileCatalogData
+}
+
+func (self *fileCatalog) findBackend(name string) int {
+	for i, v := range self.data.Backends {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *fileCatalog) save() (rerr error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(self.path), filepath.Base(self.path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			rerr = errors.List().Add(rerr).Add(os.Remove(tmp.Name())).Err()
+		}
+	}()
+
+	if err := json.NewEncoder(tmp).Encode(&self.data); err != nil {
+		return errors.List().Add(err).Add(tmp.Close()).Err()
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return errors.List().Add(err).Add(tmp.Close()).Err()
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), self.path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(self.path))
+	if err != nil {
+		return err
+	}
+	return errors.List().Add(dir.Sync()).Add(dir.Close()).Err()
+}
+
+func (self *fileCatalog) Backends() ([]CatalogBackend, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make([]CatalogBackend, len(self.data.Backends))
+	for i, v := range self.data.Backends {
+		res[i] = v
+		res[i].Streams = append([]CatalogStream{}, v.Streams...)
+	}
+	return res, nil
+}
+
+func (self *fileCatalog) AddBackend(name string, cfg interface{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.findBackend(name) != -1 {
+		return errors.New(fmt.Sprintf("fileCatalog.AddBackend: backend with name \"%s\" already exists", name))
+	}
+
+	self.data.Backends = append(self.data.Backends, CatalogBackend{name, cfg, []CatalogStream{}})
+	if err := self.save(); err != nil {
+		self.data.Backends = self.data.Backends[:len(self.data.Backends)-1]
+		return err
+	}
+	return nil
+}
+
+func (self *fileCatalog) RmBackend(name string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.findBackend(name)
+	if i == -1 {
+		return errors.New(fmt.Sprintf("fileCatalog.RmBackend: backend with name \"%s\" does not exist", name))
+	}
+
+	old := self.data.Backends
+	self.data.Backends = append(append([]CatalogBackend{}, old[:i]...), old[i+1:]...)
+	if err := self.save(); err != nil {
+		self.data.Backends = old
+		return err
+	}
+	return nil
+}
+
+func (self *fileCatalog) UpdateBackend(name string, cfg interface{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.findBackend(name)
+	if i == -1 {
+		return errors.New(fmt.Sprintf("fileCatalog.UpdateBackend: backend with name \"%s\" does not exist", name))
+	}
+
+	old := self.data.Backends[i].Config
+	self.data.Backends[i].Config = cfg
+	if err := self.save(); err != nil {
+		self.data.Backends[i].Config = old
+		return err
+	}
+	return nil
+}
+
+func (self *fileCatalog) AddStream(back, bstream, name string, inputs map[string]string, defs []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.findBackend(back)
+	if i == -1 {
+		return errors.New(fmt.Sprintf("fileCatalog.AddStream: backend with name \"%s\" does not exist", back))
+	}
+
+	b := &self.data.Backends[i]
+	for _, v := range b.Streams {
+		if v.Name == name {
+			return errors.New(fmt.Sprintf("fileCatalog.AddStream: backend with name \"%s\" already has stream \"%s\"", back, name))
+		}
+	}
+
+	old := b.Streams
+	b.Streams = append(append([]CatalogStream{}, old...), CatalogStream{name, bstream, inputs, defs})
+	if err := self.save(); err != nil {
+		b.Streams = old
+		return err
+	}
+	return nil
+}
+
+func (self *fileCatalog) RmStream(back, name string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.findBackend(back)
+	if i == -1 {
+		return errors.New(fmt.Sprintf("fileCatalog.RmStream: backend with name \"%s\" does not exist", back))
+	}
+
+	b := &self.data.Backends[i]
+	for j, v := range b.Streams {
+		if v.Name != name {
+			continue
+		}
+
+		old := b.Streams
+		b.Streams = append(append([]CatalogStream{}, old[:j]...), old[j+1:]...)
+		if err := self.save(); err != nil {
+			b.Streams = old
+			return err
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("fileCatalog.RmStream: backend with name \"%s\" does not have stream \"%s\"", back, name))
+}
+
+func (self *fileCatalog) Close() error {
+	return nil
+}
+
+/*
+Create a catalog that stores the service state as a JSON document in a file.
+
+The file is rewritten and synced to disk on every change, so it is always in a consistent state.
+If the file does not exist, the catalog is empty.
+*/
+func NewFileCatalog(path string) (Catalog, error) {
+	res := &fileCatalog{path, sync.Mutex{}, fileCatalogData{[]CatalogBackend{}}}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&res.data); err != nil {
+		return nil, err
+	}
+
+	if res.data.Backends == nil {
+		res.data.Backends = []CatalogBackend{}
+	}
+	return res, nil
+}
@@ -0,0 +1,111 @@
+package golfstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Definition of a stream in the catalog which passes all events through.
+const catalogDef = `{"id": {"load": "input"}}`
+
+// Add numbers in [from, to) to a stream and check that it has all numbers in [0, to).
+func addCatalogNumbers(t *testing.T, s backend.BackendStream, from int, to int) {
+	for i := from; i < to; i++ {
+		assert.Nil(t, s.Add([]byte(fmt.Sprint(i))))
+	}
+
+	data, err := s.Read(0, uint(to))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res := []string{}
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		if !assert.Nil(t, err) {
+			return
+		}
+		res = append(res, string(evt.([]byte)))
+	}
+
+	expected := []string{}
+	for i := 0; i < to; i++ {
+		expected = append(expected, fmt.Sprint(i))
+	}
+	assert.Equal(t, expected, res)
+}
+
+// Test that backends and streams saved to a file catalog are restored by a service created with it after a restart.
+func TestCatalogRestore(t *testing.T) {
+	stream.RegisterDefault()
+	backend.RegisterDefault()
+
+	dir := t.TempDir()
+	c, err := NewFileCatalog(dir + "/catalog.json")
+	assert.Nil(t, err)
+	s, err := NewWithCatalog(c)
+	assert.Nil(t, err)
+
+	bk, err := backend.NewDir(dir + "/dir")
+	assert.Nil(t, err)
+	b, err := s.AddBackend("d", bk)
+	assert.Nil(t, err)
+	st, err := b.AddStream("bs", "s", []string{catalogDef})
+	assert.Nil(t, err)
+	_, err = b.AddStream("bs2", "s2", []string{catalogDef})
+	assert.Nil(t, err)
+	_, err = b.AddStream("bs3", "s3", []string{catalogDef})
+	assert.Nil(t, err)
+	assert.Nil(t, b.RmStream("s3"))
+	addCatalogNumbers(t, st, 0, 10)
+
+	_, err = s.AddBackend("m", backend.NewMem())
+	assert.Nil(t, err)
+	assert.Nil(t, s.RmBackend("m"))
+
+	assert.Nil(t, s.Close())
+	assert.Nil(t, bk.Close())
+
+	c, err = NewFileCatalog(dir + "/catalog.json")
+	assert.Nil(t, err)
+	s, err = NewWithCatalog(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	bs, err := s.Backends()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d"}, bs)
+
+	b, err = s.GetBackend("d")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer b.Backend().Close()
+
+	names, bstreams, defs, err := b.Streams()
+	assert.Nil(t, err)
+	byName := map[string]string{}
+	for i, n := range names {
+		byName[n] = bstreams[i]
+		assert.Equal(t, []string{catalogDef}, defs[i])
+	}
+	assert.Equal(t, map[string]string{"s": "bs", "s2": "bs2"}, byName)
+
+	// the restored stream still writes to it's backend stream, which kept the events
+	st, bname, err := b.GetStream("s")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "bs", bname)
+	addCatalogNumbers(t, st, 10, 12)
+}
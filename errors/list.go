@@ -76,6 +76,11 @@ func (self *ErrorList) Err() error {
 	}
 }
 
+// Get all errors in the list.
+func (self *ErrorList) Errors() []error {
+	return append([]error{}, self.errs...)
+}
+
 // Implementation of an error interface for error list.
 func (self *ErrorList) Error() string {
 	err := self.Err()
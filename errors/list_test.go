@@ -149,3 +149,15 @@ func TestListError(t *testing.T) {
 		assert.Equal(t, e.Msg, e.List.Error())
 	}
 }
+
+// Test that Errors() returns all added errors and not the internal slice.
+func TestListErrors(t *testing.T) {
+	el := []error{New(""), nil, New("1"), New("abcdef")}
+	l := AsList(el...)
+	errs := l.Errors()
+	assert.Equal(t, []error{el[0], el[2], el[3]}, errs)
+
+	errs[0] = nil
+	assert.Equal(t, []error{el[0], el[2], el[3]}, l.Errors())
+	assert.Equal(t, []error{}, List().Errors())
+}
@@ -17,6 +17,10 @@ type Backend interface {
 
 	// Add stream with given name and definition to a backend stream.
 	AddStream(bstream, name string, defs []string) (backend.BackendStream, error)
+	// Add stream with given name and definition with named inputs to a backend stream:
+	// events added to each input backend stream are pushed to the input with it's name, see stream.RunNamed.
+	// Events added to the stream itself are pushed to the input "input".
+	AddStreamInputs(bstream, name string, inputs map[string]string, defs []string) (backend.BackendStream, error)
 	// Get stream and it's backend stream's name by stream name.
 	GetStream(name string) (backend.BackendStream, string, error)
 	// Remove stream by name.
@@ -25,9 +29,33 @@ type Backend interface {
 	// Add subscriber to a backend stream.
 	// Returns a range from history.
 	AddSub(bstream string, s backend.Stream, hFrom int, hTo int) (uint, uint, error)
+	// Add subscriber to a backend stream with options of delivering events to it,
+	// with stream definitions in the options it only gets the events resulting from running them.
+	// Returns a range from history.
+	AddSubOptions(bstream string, s backend.Stream, hFrom int, hTo int, opts SubOptions) (uint, uint, error)
 	// Remove a subscriber from a backend stream.
 	// Returns true if this subscribes actually was subscribed, false otherwise.
 	RmSub(bstream string, s backend.Stream) (bool, error)
+	// Get delivery stats of a subscriber of a backend stream.
+	SubStats(bstream string, s backend.Stream) (SubStats, error)
+	// Acknowledge that a subscriber processed events of a backend stream up to and including the offset.
+	// A remote subscriber which acknowledged events replays the ones after them when it's subscribed again after reconnecting.
+	Ack(bstream string, s backend.Stream, offset uint) error
+
+	// Join a named consumer group of a backend stream: events are divided among the group members.
+	// A group that's joined again gets events after the last committed offset.
+	// Committed offsets are saved to the backend stream "<bstream>.<group>.offsets" of the same backend, so they last as long as the backend's data.
+	JoinGroup(bstream, group string, s backend.Stream) error
+	// Commit that a member of a group processed events of a backend stream delivered to it up to and including the offset.
+	Commit(bstream, group string, s backend.Stream, offset uint) error
+	// Leave a consumer group.
+	// Returns true if this subscriber actually was a member, false otherwise, including when the group does not exist.
+	// A group is removed with it's last member.
+	LeaveGroup(bstream, group string, s backend.Stream) (bool, error)
+
+	// Set a retention policy of a backend stream, if the underlying backend supports it.
+	// An empty policy removes it.
+	SetRetention(bstream string, r backend.Retention) error
 }
 
 /*
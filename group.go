@@ -0,0 +1,525 @@
+package golfstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"log"
+	"sync"
+)
+
+// A member of a consumer group and events delivered to it, but not committed yet.
+type groupMember struct {
+	s       backend.Stream
+	pending []subEvent
+}
+
+// Forget pending events up to and including the offset.
+func (self *groupMember) commit(offset uint) {
+	pending := self.pending[:0]
+	for _, v := range self.pending {
+		if v.offset > offset {
+			pending = append(pending, v)
+		}
+	}
+	self.pending = pending
+}
+
+/*
+A consumer group: a subscriber of a backend stream, which divides events among members round-robin.
+
+Members commit events delivered to them and the group's committed offset is the lowest one of an event
+which is not committed yet, so that when the group is joined again it gets all events that might not be processed.
+Events of a member which fails or leaves are given to the others and wait in the group while it has no members.
+Committed offsets are saved to a backend stream of the same backend, outside of the group lock, so that a slow backend doesn't hold up delivering events.
+
+The group's queue drops the oldest events instead of holding up adding events to the backend stream when members are slow,
+the group reads dropped events from the backend stream and delivers them before the next one.
+*/
+type groupT struct {
+	back    *serviceBackend
+	bstream string
+	name    string
+
+	lock    sync.Mutex
+	members []*groupMember
+	next    int
+	// events waiting for a member to join
+	waiting []subEvent
+	// offset of the next event added to the group
+	offset uint
+}
+
+func (self *groupT) find(s backend.Stream) int {
+	for i, v := range self.members {
+		if v.s == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// The lowest offset of an event delivered to the group, but not committed, must be called under lock.
+func (self *groupT) watermark() uint {
+	res := self.offset
+	for _, v := range self.waiting {
+		if v.offset < res {
+			res = v.offset
+		}
+	}
+	for _, m := range self.members {
+		for _, v := range m.pending {
+			if v.offset < res {
+				res = v.offset
+			}
+		}
+	}
+	return res
+}
+
+// Commit events delivered to a member up to and including the offset, returns the group's committed offset.
+func (self *groupT) commitMember(s backend.Stream, offset uint) (uint, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.find(s)
+	if i == -1 {
+		return 0, errors.New(fmt.Sprintf("groupT.commit: Expected a member of group \"%s\" of backend stream \"%s\"", self.name, self.bstream))
+	}
+
+	self.members[i].commit(offset)
+	return self.watermark(), nil
+}
+
+// Commit events delivered to a member up to and including the offset and save the group's committed offset.
+func (self *groupT) commit(s backend.Stream, offset uint) error {
+	committed, err := self.commitMember(s, offset)
+	if err != nil {
+		return err
+	}
+
+	return self.back.saveCommit(self.bstream, self.name, committed)
+}
+
+// Add a member, returns events which were waiting for it.
+func (self *groupT) join(s backend.Stream) []subEvent {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.members = append(self.members, &groupMember{s, []subEvent{}})
+
+	res := self.waiting
+	self.waiting = []subEvent{}
+	return res
+}
+
+// Remove a member, returns if it was a member, it's pending events and how many members are left.
+func (self *groupT) leave(s backend.Stream) (bool, []subEvent, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	i := self.find(s)
+	if i == -1 {
+		return false, nil, len(self.members)
+	}
+
+	m := self.members[i]
+	self.members = append(self.members[:i], self.members[i+1:]...)
+	return true, m.pending, len(self.members)
+}
+
+func (self *groupT) size() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return len(self.members)
+}
+
+// Pick the next member for an event, or keep it waiting if there are no members.
+func (self *groupT) assign(evt subEvent) *groupMember {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// the event is pending as soon as it counts as added, so that it's not committed before it's delivered
+	if evt.offset >= self.offset {
+		self.offset = evt.offset + 1
+	}
+
+	if len(self.members) == 0 {
+		self.waiting = append(self.waiting, evt)
+		return nil
+	}
+
+	m := self.members[self.next%len(self.members)]
+	self.next++
+	m.pending = append(m.pending, evt)
+	return m
+}
+
+// Deliver events to members, events of a member that fails are given to the others and the member is closed.
+func (self *groupT) deliver(evts []subEvent) {
+	for len(evts) != 0 {
+		evt := evts[0]
+		evts = evts[1:]
+
+		m := self.assign(evt)
+		if m == nil {
+			continue
+		}
+
+		_, err := addOffsets(m.s, evt.offset, []stream.Event{evt.evt})
+		if err == nil {
+			continue
+		}
+
+		log.Println(fmt.Sprintf("groupT.deliver: failed to add event to member of group \"%s\": %s", self.name, err.Error()))
+		ok, pending, n := self.leave(m.s)
+		if !ok {
+			continue
+		}
+
+		evts = append(evts, pending...)
+		if err := m.s.Close(); err != nil {
+			log.Println(fmt.Sprintf("groupT.deliver: failed to close member of group \"%s\": %s", self.name, err.Error()))
+		}
+		if n == 0 {
+			go func() {
+				if err := self.back.rmGroup(self); err != nil {
+					log.Println(fmt.Sprintf("groupT.deliver: failed to remove group \"%s\": %s", self.name, err.Error()))
+				}
+			}()
+		}
+	}
+}
+
+func (self *groupT) Add(evt stream.Event) error {
+	return errors.New(fmt.Sprintf("groupT.Add: Expected an event with an offset, got %v", evt))
+}
+
+// Get the offset of the next event added to the group.
+func (self *groupT) nextOffset() uint {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.offset
+}
+
+// Deliver events from the backend stream which were dropped from the group's queue.
+func (self *groupT) redeliver(from uint, to uint) error {
+	data, err := self.back.readOffsets(self.bstream, from, to)
+	if err != nil {
+		return err
+	}
+	defer stream.Drain(data)
+
+	for offset := from; offset < to; offset++ {
+		evt, err := data.Next()
+		if err != nil {
+			return err
+		}
+
+		self.deliver([]subEvent{{offset, evt}})
+	}
+	return nil
+}
+
+func (self *groupT) AddOffset(offset uint, evt stream.Event) error {
+	next := self.nextOffset()
+	if offset < next {
+		return nil
+	}
+
+	if offset > next {
+		if err := self.redeliver(next, offset); err != nil {
+			log.Println(fmt.Sprintf("groupT.AddOffset: failed to deliver events dropped from the queue of group \"%s\": %s", self.name, err.Error()))
+		}
+	}
+
+	self.deliver([]subEvent{{offset, evt}})
+	return nil
+}
+
+// The group is disconnected from the backend stream, so the next member to join creates a new one.
+func (self *groupT) Close() error {
+	self.lock.Lock()
+	members := self.members
+	self.members = nil
+	self.lock.Unlock()
+
+	self.back.dropGroup(self)
+
+	errs := errors.List()
+	for _, m := range members {
+		errs.Add(m.s.Close())
+	}
+	return errs.Err()
+}
+
+type groupKey struct {
+	bstream string
+	name    string
+}
+
+// Number of committed offsets saved in the backend stream of a group after which the old ones are deleted.
+const groupCommitsMax = 64
+
+// Name of the backend stream where committed offsets of a consumer group of a backend stream are saved.
+func groupStreamName(bstream, group string) string {
+	return fmt.Sprintf("%s.%s.offsets", bstream, group)
+}
+
+type groupCommit struct {
+	Offset uint `json:"offset"`
+}
+
+// Append the committed offset of a group to it's backend stream and delete the old ones.
+func (self *serviceBackend) writeCommit(bstream, group string, offset uint) error {
+	bs, err := json.Marshal(&groupCommit{offset})
+	if err != nil {
+		return err
+	}
+
+	commits, err := self.back.GetStream(groupStreamName(bstream, group))
+	if err != nil {
+		return err
+	}
+
+	if err := commits.Add(bs); err != nil {
+		return errors.List().Add(err).Add(commits.Close()).Err()
+	}
+
+	l, err := commits.Len()
+	if err != nil {
+		return errors.List().Add(err).Add(commits.Close()).Err()
+	}
+
+	if l > groupCommitsMax {
+		if _, err := commits.Del(0, l-1); err != nil {
+			return errors.List().Add(err).Add(commits.Close()).Err()
+		}
+	}
+	return commits.Close()
+}
+
+// Read the last committed offset of a group from it's backend stream, zero if it has never committed.
+func (self *serviceBackend) readCommit(bstream, group string) (uint, error) {
+	commits, err := self.back.GetStream(groupStreamName(bstream, group))
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := lastCommit(commits)
+	return res, errors.List().Add(err).Add(commits.Close()).Err()
+}
+
+func lastCommit(commits backend.BackendStream) (uint, error) {
+	l, err := commits.Len()
+	if err != nil {
+		return 0, err
+	}
+
+	if l == 0 {
+		return 0, nil
+	}
+
+	data, err := commits.Read(l-1, l)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Drain(data)
+
+	evt, err := data.Next()
+	if err != nil {
+		return 0, err
+	}
+
+	bs, ok := evt.([]byte)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("lastCommit: Expected []byte event, got %v", evt))
+	}
+
+	c := groupCommit{}
+	if err := json.Unmarshal(bs, &c); err != nil {
+		return 0, err
+	}
+	return c.Offset, nil
+}
+
+/*
+Save the committed offset of a group to the backend, returns when it or a later one is saved.
+
+Commits made while the backend is being written are coalesced: the next write saves the latest offset for all of them.
+*/
+func (self *serviceBackend) saveCommit(bstream, group string, offset uint) error {
+	key := groupKey{bstream, group}
+
+	self.clock.Lock()
+	if offset > self.commits[key] {
+		self.commits[key] = offset
+	}
+	self.clock.Unlock()
+
+	self.cwlock.Lock()
+	defer self.cwlock.Unlock()
+
+	self.clock.Lock()
+	latest, saved := self.commits[key], self.saved[key]
+	self.clock.Unlock()
+
+	// saved by a write of a commit made meanwhile
+	if offset <= saved {
+		return nil
+	}
+
+	if err := self.writeCommit(bstream, group, latest); err != nil {
+		return err
+	}
+
+	self.clock.Lock()
+	defer self.clock.Unlock()
+
+	if latest > self.saved[key] {
+		self.saved[key] = latest
+	}
+	return nil
+}
+
+// Read events of a backend stream with subscribers by their offsets.
+func (self *serviceBackend) readOffsets(bstream string, from uint, to uint) (stream.Stream, error) {
+	self.lock.Lock()
+	bs, ok := self.bstreams[bstream]
+	self.lock.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("serviceBackend.readOffsets: backend with name \"%s\" does not have backend stream \"%s\" with subscribers", self.name, bstream))
+	}
+
+	return bs.readOffsets(from, to)
+}
+
+// Get the committed offset of a group: the latest one made since the service was created, or the one saved in the backend.
+func (self *serviceBackend) getCommit(bstream, group string) (uint, error) {
+	self.clock.Lock()
+	res, ok := self.commits[groupKey{bstream, group}]
+	self.clock.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	return self.readCommit(bstream, group)
+}
+
+func (self *serviceBackend) joinGroup(bstream, group string, s backend.Stream) (*groupT, []subEvent, error) {
+	self.glock.Lock()
+	defer self.glock.Unlock()
+
+	if g, ok := self.groups[groupKey{bstream, group}]; ok {
+		return g, g.join(s), nil
+	}
+
+	bs, err := self.back.GetStream(bstream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base, l, err := backend.Base(bs)
+	if err := errors.List().Add(err).Add(bs.Close()).Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// events after the committed offset might have been deleted since
+	from, err := self.getCommit(bstream, group)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from < base {
+		from = base
+	}
+	if from > base+l {
+		from = base + l
+	}
+
+	g := &groupT{self, bstream, group, sync.Mutex{}, []*groupMember{&groupMember{s, []subEvent{}}}, 0, []subEvent{}, from}
+	if _, _, err := self.AddSubOptions(bstream, g, 0, 0, SubOptions{DefaultSubOptions.Queue, OverflowDropOldest, true, from, nil}); err != nil {
+		return nil, nil, err
+	}
+
+	self.groups[groupKey{bstream, group}] = g
+	return g, nil, nil
+}
+
+func (self *serviceBackend) JoinGroup(bstream, group string, s backend.Stream) error {
+	g, waiting, err := self.joinGroup(bstream, group, s)
+	if err != nil {
+		return err
+	}
+
+	g.deliver(waiting)
+	return nil
+}
+
+// Find a group, returns nil if the backend stream does not have it.
+func (self *serviceBackend) findGroup(bstream, group string) *groupT {
+	self.glock.Lock()
+	defer self.glock.Unlock()
+
+	return self.groups[groupKey{bstream, group}]
+}
+
+func (self *serviceBackend) getGroup(bstream, group string) (*groupT, error) {
+	g := self.findGroup(bstream, group)
+	if g == nil {
+		return nil, errors.New(fmt.Sprintf("serviceBackend.getGroup: backend stream \"%s\" does not have group \"%s\"", bstream, group))
+	}
+	return g, nil
+}
+
+func (self *serviceBackend) Commit(bstream, group string, s backend.Stream, offset uint) error {
+	g, err := self.getGroup(bstream, group)
+	if err != nil {
+		return err
+	}
+
+	return g.commit(s, offset)
+}
+
+// Forget a group which has no members, returns if it was forgotten.
+func (self *serviceBackend) dropGroup(g *groupT) bool {
+	self.glock.Lock()
+	defer self.glock.Unlock()
+
+	key := groupKey{g.bstream, g.name}
+	if self.groups[key] != g || g.size() != 0 {
+		return false
+	}
+
+	delete(self.groups, key)
+	return true
+}
+
+// Remove a group which has no members, events after the committed offset will be delivered to the next one to join.
+func (self *serviceBackend) rmGroup(g *groupT) error {
+	if !self.dropGroup(g) {
+		return nil
+	}
+
+	_, err := self.RmSub(g.bstream, g)
+	return err
+}
+
+func (self *serviceBackend) LeaveGroup(bstream, group string, s backend.Stream) (bool, error) {
+	// the group is removed with it's last member, so the subscriber is not a member of it anyway
+	g := self.findGroup(bstream, group)
+	if g == nil {
+		return false, nil
+	}
+
+	r, pending, n := g.leave(s)
+	g.deliver(pending)
+	if n != 0 {
+		return r, nil
+	}
+
+	return r, self.rmGroup(g)
+}
@@ -0,0 +1,196 @@
+package golfstream
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Get sorted offsets of events of all subscribers after they get at least n events.
+func groupOffsets(subs []*testSub, n int) []uint {
+	waitEvents(subs, n)
+
+	res := []uint{}
+	for _, s := range subs {
+		offs, _ := s.get()
+		res = append(res, offs...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+func offsetRange(from uint, to uint) []uint {
+	res := []uint{}
+	for i := from; i < to; i++ {
+		res = append(res, i)
+	}
+	return res
+}
+
+/*
+Test a group on a backend stream with events added to st:
+events are divided among members and the lowest uncommitted one is where the group starts when it's joined again.
+*/
+func testGroup(t *testing.T, b Backend, st backend.Stream) {
+	a, c := &testSub{}, &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", a))
+	assert.Nil(t, b.JoinGroup("bs", "g", c))
+
+	addNumbers(t, st, 0, 100)
+	assert.Equal(t, offsetRange(0, 100), groupOffsets([]*testSub{a, c}, 100))
+	offs, _ := a.get()
+	assert.Equal(t, 50, len(offs))
+
+	// a processed everything, c only the first half, so the group is at the first event c got after 49
+	assert.Nil(t, b.Commit("bs", "g", a, 98))
+	assert.Nil(t, b.Commit("bs", "g", c, 49))
+	assert.NotNil(t, b.Commit("bs", "nogroup", c, 49))
+	assert.NotNil(t, b.Commit("bs", "g", &testSub{}, 49))
+
+	r, err := b.LeaveGroup("bs", "g", a)
+	assert.Nil(t, err)
+	assert.True(t, r)
+	r, err = b.LeaveGroup("bs", "g", c)
+	assert.Nil(t, err)
+	assert.True(t, r)
+	r, err = b.LeaveGroup("bs", "g", c)
+	assert.Nil(t, err)
+	assert.False(t, r)
+}
+
+// Test that a group joined again gets events starting from the lowest uncommitted one up to n.
+func testRejoin(t *testing.T, b Backend, n uint) {
+	d := &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", d))
+	checkOffsets(t, "rejoined", d, 51, n)
+
+	r, err := b.LeaveGroup("bs", "g", d)
+	assert.Nil(t, err)
+	assert.True(t, r)
+}
+
+// Test that group members divide events and commit them.
+func TestGroup(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	testGroup(t, b, st)
+	addNumbers(t, st, 100, 120)
+	testRejoin(t, b, 120)
+}
+
+// Test that events of a member that fails or leaves are given to the other members.
+func TestGroupReassign(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	f, a := &failingSub{testSub{}, 3}, &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", f))
+	assert.Nil(t, b.JoinGroup("bs", "g", a))
+	addNumbers(t, st, 0, 40)
+
+	// uncommitted events of the failed member are redelivered to a
+	assert.Equal(t, offsetRange(0, 40), groupOffsets([]*testSub{a}, 40))
+	assert.True(t, f.isClosed())
+	r, err := b.LeaveGroup("bs", "g", f)
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	// nothing is committed, so all events of a are given to e
+	e := &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", e))
+	r, err = b.LeaveGroup("bs", "g", a)
+	assert.Nil(t, err)
+	assert.True(t, r)
+	assert.Equal(t, offsetRange(0, 40), groupOffsets([]*testSub{e}, 40))
+
+	// the group is removed with the last member and starts from the committed offset when it's joined again
+	assert.Nil(t, b.Commit("bs", "g", e, 39))
+	r, err = b.LeaveGroup("bs", "g", e)
+	assert.Nil(t, err)
+	assert.True(t, r)
+	addNumbers(t, st, 40, 50)
+
+	e = &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", e))
+	checkOffsets(t, "joined again", e, 40, 50)
+}
+
+// Test that a stalled member doesn't hold up adding events and gets the ones dropped from the group's queue later.
+func TestGroupStalled(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	a := newGatedSub()
+	assert.Nil(t, b.JoinGroup("bs", "g", a))
+
+	n := DefaultSubOptions.Queue * 3
+	done := make(chan struct{})
+	go func() {
+		addNumbers(t, st, 0, n)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adding events waits for a stalled member")
+	}
+
+	close(a.gate)
+	checkOffsets(t, "stalled", a, 0, uint(n))
+}
+
+// Test that committed offsets of groups are saved to the backend and restored with it.
+func TestGroupRestart(t *testing.T) {
+	stream.RegisterDefault()
+
+	dir := t.TempDir()
+	bk, err := backend.NewDir(dir)
+	assert.Nil(t, err)
+	s := New()
+	b, err := s.AddBackend("d", bk)
+	assert.Nil(t, err)
+	st, err := b.AddStream("bs", "s", []string{testDef})
+	assert.Nil(t, err)
+
+	testGroup(t, b, st)
+	addNumbers(t, st, 100, 120)
+	testRejoin(t, b, 120)
+	assert.Nil(t, s.Close())
+	assert.Nil(t, bk.Close())
+
+	bk, err = backend.NewDir(dir)
+	assert.Nil(t, err)
+	defer bk.Close()
+	s = New()
+	defer s.Close()
+	b, err = s.AddBackend("d", bk)
+	assert.Nil(t, err)
+	testRejoin(t, b, 120)
+
+	// old commits are deleted, so that the backend stream of a group doesn't grow forever
+	d := &testSub{}
+	assert.Nil(t, b.JoinGroup("bs", "g", d))
+	checkOffsets(t, "committing", d, 51, 120)
+	for i := uint(51); i < 120; i++ {
+		assert.Nil(t, b.Commit("bs", "g", d, i))
+	}
+
+	commits, err := bk.GetStream(groupStreamName("bs", "g"))
+	assert.Nil(t, err)
+	l, err := commits.Len()
+	assert.Nil(t, err)
+	assert.True(t, l <= groupCommitsMax)
+	c, err := lastCommit(commits)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(120), c)
+	assert.Nil(t, commits.Close())
+}
@@ -54,38 +54,22 @@ func NewHandler(s Service, errorCb func(error)) http.Handler {
 		}
 	}).Methods("POST")
 
-	r.HandleFunc("/sbackends/add/{back}", func(w http.ResponseWriter, r *http.Request) {
-		var icfg interface{}
-		if err := json.NewDecoder(r.Body).Decode(&icfg); err != nil {
+	r.HandleFunc("/functions", func(w http.ResponseWriter, r *http.Request) {
+		res := functionsRes{Fns: stream.Functions(), Encoders: stream.Encoders(), Decoders: stream.Decoders()}
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
 			sendErr(w, err, errorCb)
 			return
 		}
+	}).Methods("POST")
 
-		cfg, ok := icfg.(map[string]interface{})
-		if !ok {
-			sendErr(w, errors.New(fmt.Sprintf("backend.Add: config expected to be of type map[string]interface{}, got %v", cfg)), errorCb)
-			return
-		}
-
-		ibtype, ok := cfg["type"]
-		if !ok {
-			sendErr(w, errors.New(fmt.Sprintf("backend.Add: config expected to have field \"type\" of type string, got %v", cfg)), errorCb)
-			return
-		}
-
-		btype, ok := ibtype.(string)
-		if !ok {
-			sendErr(w, errors.New(fmt.Sprintf("backend.Add: config expected to have field \"type\" of type string, got %v", cfg)), errorCb)
-			return
-		}
-
-		barg, ok := cfg["arg"]
-		if !ok {
-			sendErr(w, errors.New(fmt.Sprintf("backend.Add: config expected to have field \"arg\", got %v", cfg)), errorCb)
+	r.HandleFunc("/sbackends/add/{back}", func(w http.ResponseWriter, r *http.Request) {
+		var icfg interface{}
+		if err := json.NewDecoder(r.Body).Decode(&icfg); err != nil {
+			sendErr(w, err, errorCb)
 			return
 		}
 
-		back, err := backend.Create(btype, barg)
+		back, err := backend.CreateConfig(icfg)
 		if err != nil {
 			sendErr(w, err, errorCb)
 			return
@@ -169,10 +153,114 @@ func NewHandler(s Service, errorCb func(error)) http.Handler {
 			return
 		}
 
-		_, err = b.AddStream(rr.Bname, vars["name"], rr.Defs)
+		_, err = b.AddStreamInputs(rr.Bname, vars["name"], rr.Inputs, rr.Defs)
 		sendErr(w, err, errorCb)
 	}).Methods("POST")
 
+	r.HandleFunc("/sbackends/{back}/retention/{bstream}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		b, err := s.GetBackend(vars["back"])
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		var icfg interface{}
+		if err := json.NewDecoder(r.Body).Decode(&icfg); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		rt, err := backend.ParseRetention(icfg)
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		sendErr(w, b.SetRetention(vars["bstream"], rt), errorCb)
+	}).Methods("POST")
+
+	r.HandleFunc("/sbackends/{back}/streams/validate", func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.GetBackend(mux.Vars(r)["back"])
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		var rr validateArgs
+		if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		errs, err := validateStream(b, rr)
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		res := validateRes{Errs: []string{}}
+		for _, e := range errs.Errors() {
+			res.Errs = append(res.Errs, e.Error())
+		}
+
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+	}).Methods("POST")
+
+	r.HandleFunc("/sbackends/{back}/streams/dryrun", func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.GetBackend(mux.Vars(r)["back"])
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		var rr dryRunArgs
+		if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+
+		// a stream that can't be added to the backend is not run
+		errs, err := validateStream(b, validateArgs{Name: rr.Name, Bname: rr.Bname, Defs: rr.Defs})
+		if err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+		if err := errs.Err(); err != nil {
+			if err := json.NewEncoder(w).Encode(&dryRunRes{Evts: []json.RawMessage{}, Err: err.Error()}); err != nil {
+				sendErr(w, err, errorCb)
+			}
+			return
+		}
+
+		evts := make([]stream.Event, len(rr.Evts))
+		for i, v := range rr.Evts {
+			evts[i] = stream.Event([]byte(v))
+		}
+
+		out, err := stream.DryRun(rr.Defs, evts)
+		res := dryRunRes{Evts: make([]json.RawMessage, len(out))}
+		if err != nil {
+			res.Err = err.Error()
+		}
+		for i, v := range out {
+			data, err := dryRunEvent(v)
+			if err != nil {
+				sendErr(w, err, errorCb)
+				return
+			}
+			res.Evts[i] = data
+		}
+
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
+			sendErr(w, err, errorCb)
+			return
+		}
+	}).Methods("POST")
+
 	r.HandleFunc("/sbackends/{back}/streams/get/{name}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		b, err := s.GetBackend(vars["back"])
@@ -227,8 +315,6 @@ func NewHandler(s Service, errorCb func(error)) http.Handler {
 
 	upgrader := websocket.Upgrader{}
 
-	slock := sync.Mutex{}
-	subs := map[uint32]*wsSub{}
 	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -241,7 +327,7 @@ func NewHandler(s Service, errorCb func(error)) http.Handler {
 			}
 		}()
 
-		if err := handleWs(s, ws, subs, &slock); err != nil {
+		if err := handleWs(s, ws); err != nil {
 			errorCb(err)
 			return
 		}
@@ -250,30 +336,160 @@ func NewHandler(s Service, errorCb func(error)) http.Handler {
 	return r
 }
 
+type functionsRes struct {
+	Fns      []stream.FunctionInfo `json:"functions"`
+	Encoders []string              `json:"encoders"`
+	Decoders []string              `json:"decoders"`
+}
+
+// Arguments of adding a stream, the name is optional and only checked to be free if it's set.
+type validateArgs struct {
+	Name   string            `json:"name,omitempty"`
+	Bname  string            `json:"backend_stream"`
+	Inputs map[string]string `json:"inputs,omitempty"`
+	Defs   []string          `json:"definitions"`
+}
+
+type validateRes struct {
+	Errs []string `json:"errors"`
+}
+
+// Arguments of adding a stream without inputs and events to run it on.
+type dryRunArgs struct {
+	Name  string            `json:"name,omitempty"`
+	Bname string            `json:"backend_stream"`
+	Defs  []string          `json:"definitions"`
+	Evts  []json.RawMessage `json:"events"`
+}
+
+type dryRunRes struct {
+	Evts []json.RawMessage `json:"events"`
+	Err  string            `json:"error,omitempty"`
+}
+
+/*
+Check if a stream can be added to a backend without adding it and report all problems at once.
+
+The returned error is only for failing to get the backend's streams.
+*/
+func validateStream(b Backend, args validateArgs) (*errors.ErrorList, error) {
+	errs := errors.List()
+	if args.Name != "" {
+		ss, _, _, err := b.Streams()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range ss {
+			if v == args.Name {
+				errs.Add(errors.New(fmt.Sprintf("Stream \"%s\" already exists", args.Name)))
+			}
+		}
+	}
+
+	if args.Bname == "" {
+		errs.Add(errors.New("Expected backend_stream the stream writes to"))
+	}
+
+	inputs := []string{"input"}
+	for k, v := range args.Inputs {
+		if v == "" || v == args.Bname {
+			errs.Add(errors.New(fmt.Sprintf("Expected input \"%s\" to be a backend stream other than \"%s\" the stream writes to", k, args.Bname)))
+		}
+		if k != "input" {
+			inputs = append(inputs, k)
+		}
+	}
+
+	return errs.Add(stream.ValidateNamed(inputs, args.Defs)), nil
+}
+
+// Encode a resulting event of a dry run: JSON bytes are sent as is, everything else is encoded to JSON.
+func dryRunEvent(evt stream.Event) (json.RawMessage, error) {
+	if bs, ok := evt.([]byte); ok && json.Valid(bs) {
+		return json.RawMessage(bs), nil
+	}
+
+	if bs, ok := evt.([]byte); ok {
+		evt = string(bs)
+	}
+	return json.Marshal(evt)
+}
+
+// Messages to send to a websocket connection, they are dropped after it's closed.
+type wsOut struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+func (self *wsOut) send(bs []byte) bool {
+	select {
+	case self.ch <- bs:
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
+// Send a message only if the connection's writer is ready to take it right away.
+func (self *wsOut) trySend(bs []byte) bool {
+	select {
+	case self.ch <- bs:
+		return true
+	default:
+		return false
+	}
+}
+
 type wsSub struct {
 	back  string
 	bname string
+	// name of the consumer group, if it's a member of one
+	group string
 	sid   uint32
-	ch    chan []byte
+	out   *wsOut
 }
 
 func (self *wsSub) Add(evt stream.Event) error {
+	return self.send(nil, evt)
+}
+
+func (self *wsSub) AddOffset(offset uint, evt stream.Event) error {
+	return self.send(&offset, evt)
+}
+
+func (self *wsSub) send(offset *uint, evt stream.Event) error {
 	bs, ok := evt.([]byte)
 	if !ok {
 		return errors.New(fmt.Sprintf("wsSub.Add: expected []byte event, got %v", evt))
 	}
 
-	cmd := cmdResult{Back: self.back, Bname: self.bname, Sid: self.sid, Data: json.RawMessage(bs)}
+	cmd := cmdResult{Back: self.back, Bname: self.bname, Sid: self.sid, Data: json.RawMessage(bs), Offset: offset}
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(&cmd); err != nil {
 		return err
 	}
 
-	self.ch <- buf.Bytes()
+	if !self.out.send(buf.Bytes()) {
+		return errors.New(fmt.Sprintf("wsSub.Add: connection of subscriber %v is closed", self.sid))
+	}
 	return nil
 }
 
+/*
+Tell the client that the subscriber was disconnected.
+
+A client that stopped reading is why subscribers are disconnected in the first place,
+so the notice is dropped if the connection's writer is busy instead of waiting for it.
+*/
 func (self *wsSub) Close() error {
+	cmd := cmdResult{Back: self.back, Bname: self.bname, Sid: self.sid, Err: "disconnected"}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&cmd); err != nil {
+		return err
+	}
+
+	self.out.trySend(buf.Bytes())
 	return nil
 }
 
@@ -288,6 +504,18 @@ func getSub(sid uint32, subs map[uint32]*wsSub, slock *sync.Mutex) backend.Strea
 	return s
 }
 
+// Register a subscriber under its id, unless the id is already taken by another one.
+func putSub(sub *wsSub, subs map[uint32]*wsSub, slock *sync.Mutex) error {
+	slock.Lock()
+	defer slock.Unlock()
+
+	if _, ok := subs[sub.sid]; ok {
+		return errors.New(fmt.Sprintf("Subscriber \"%v\" already exists!", sub.sid))
+	}
+	subs[sub.sid] = sub
+	return nil
+}
+
 type cmdName struct {
 	Cmd  string          `json:"cmd"`
 	Data json.RawMessage `json:"data"`
@@ -303,6 +531,11 @@ type unsubResult struct {
 	Data okRes  `json:"data"`
 }
 
+type subStatsResult struct {
+	Id   uint32      `json:"id"`
+	Data subStatsRes `json:"data"`
+}
+
 func addCmdHandler(s Service, d []byte) error {
 	data := addCmdData{}
 	if err := json.NewDecoder(bytes.NewReader(d)).Decode(&data); err != nil {
@@ -322,17 +555,53 @@ func addCmdHandler(s Service, d []byte) error {
 	return str.Add(stream.Event([]byte(data.Evt)))
 }
 
-func subCmdHandler(s Service, data addSubCmdData, ch chan []byte, subs map[uint32]*wsSub, slock *sync.Mutex) (res subResult, rerr error) {
+func addBatchCmdHandler(s Service, d []byte) error {
+	data := addBatchCmdData{}
+	if err := json.NewDecoder(bytes.NewReader(d)).Decode(&data); err != nil {
+		return err
+	}
+
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return err
+	}
+
+	str, _, err := b.GetStream(data.Name)
+	if err != nil {
+		return err
+	}
+
+	evts := make([]stream.Event, len(data.Evts))
+	for i, v := range data.Evts {
+		evts[i] = stream.Event([]byte(v))
+	}
+	return backend.AddBatch(str, evts)
+}
+
+func subCmdHandler(s Service, data addSubCmdData, out *wsOut, subs map[uint32]*wsSub, slock *sync.Mutex) (res subResult, rerr error) {
 	b, err := s.GetBackend(data.Back)
 	if err != nil {
 		return subResult{}, err
 	}
 
-	sub := &wsSub{data.Back, data.Bname, data.Sid, ch}
+	// websocket subscribers always have a queue, so that a slow client doesn't hold up adding events
+	opts := SubOptions{data.Queue, data.Overflow, false, 0, data.Defs}
+	if data.Offset != nil {
+		opts.Replay = true
+		opts.From = *data.Offset
+	}
+	if opts.Queue == 0 {
+		opts.Queue = DefaultSubOptions.Queue
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = DefaultSubOptions.Overflow
+	}
+
+	sub := &wsSub{data.Back, data.Bname, "", data.Sid, out}
 
-	slock.Lock()
-	subs[data.Sid] = sub
-	slock.Unlock()
+	if err := putSub(sub, subs, slock); err != nil {
+		return subResult{}, err
+	}
 	defer func() {
 		if rerr == nil {
 			return
@@ -343,13 +612,19 @@ func subCmdHandler(s Service, data addSubCmdData, ch chan []byte, subs map[uint3
 		slock.Unlock()
 	}()
 
-	// TODO: RmSub on failure?
-	nf, nt, err := b.AddSub(data.Bname, sub, data.From, data.To)
+	nf, nt, err := b.AddSubOptions(data.Bname, sub, data.From, data.To, opts)
 	if err != nil {
 		return subResult{}, err
 	}
 
-	return subResult{Id: data.Id, Data: rangeRes{From: nf, To: nt}}, nil
+	// the client replays events from here when it reconnects, even if it didn't get any
+	st, err := b.SubStats(data.Bname, sub)
+	if err != nil {
+		_, rmErr := b.RmSub(data.Bname, sub)
+		return subResult{}, errors.List().Add(err).Add(rmErr).Err()
+	}
+
+	return subResult{Id: data.Id, Data: rangeRes{From: nf, To: nt, Offset: &st.Start}}, nil
 }
 
 func unsubCmdHandler(s Service, data rmSubCmdData, subs map[uint32]*wsSub, slock *sync.Mutex) (res unsubResult, rerr error) {
@@ -368,10 +643,120 @@ func unsubCmdHandler(s Service, data rmSubCmdData, subs map[uint32]*wsSub, slock
 		return unsubResult{}, err
 	}
 
+	slock.Lock()
+	delete(subs, data.Sid)
+	slock.Unlock()
+
+	return unsubResult{Id: data.Id, Data: okRes{Ok: r}}, nil
+}
+
+func subStatsCmdHandler(s Service, data subStatsCmdData, subs map[uint32]*wsSub, slock *sync.Mutex) (subStatsResult, error) {
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return subStatsResult{}, err
+	}
+
+	sub := getSub(data.Sid, subs, slock)
+	if sub == nil {
+		return subStatsResult{}, errors.New(fmt.Sprintf("Unknown subscriber \"%v\"!", data.Sid))
+	}
+
+	st, err := b.SubStats(data.Bname, sub)
+	if err != nil {
+		return subStatsResult{}, err
+	}
+
+	return subStatsResult{Id: data.Id, Data: subStatsRes{Stats: &st}}, nil
+}
+
+func ackCmdHandler(s Service, data ackCmdData, subs map[uint32]*wsSub, slock *sync.Mutex) (unsubResult, error) {
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return unsubResult{}, err
+	}
+
+	slock.Lock()
+	sub, ok := subs[data.Sid]
+	slock.Unlock()
+	if !ok {
+		return unsubResult{}, errors.New(fmt.Sprintf("Unknown subscriber \"%v\"!", data.Sid))
+	}
+
+	// members of groups commit offsets instead
+	if sub.group != "" {
+		return unsubResult{}, errors.New(fmt.Sprintf("Subscriber \"%v\" is a member of group \"%s\", expected a plain subscriber!", data.Sid, sub.group))
+	}
+
+	if err := b.Ack(data.Bname, sub, data.Offset); err != nil {
+		return unsubResult{}, err
+	}
+
+	return unsubResult{Id: data.Id, Data: okRes{Ok: true}}, nil
+}
+
+func joinGroupCmdHandler(s Service, data groupCmdData, out *wsOut, subs map[uint32]*wsSub, slock *sync.Mutex) (unsubResult, error) {
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return unsubResult{}, err
+	}
+
+	sub := &wsSub{data.Back, data.Bname, data.Group, data.Sid, out}
+	if err := putSub(sub, subs, slock); err != nil {
+		return unsubResult{}, err
+	}
+
+	if err := b.JoinGroup(data.Bname, data.Group, sub); err != nil {
+		slock.Lock()
+		delete(subs, data.Sid)
+		slock.Unlock()
+		return unsubResult{}, err
+	}
+
+	return unsubResult{Id: data.Id, Data: okRes{Ok: true}}, nil
+}
+
+func leaveGroupCmdHandler(s Service, data groupCmdData, subs map[uint32]*wsSub, slock *sync.Mutex) (unsubResult, error) {
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return unsubResult{}, err
+	}
+
+	sub := getSub(data.Sid, subs, slock)
+	if sub == nil {
+		return unsubResult{}, errors.New(fmt.Sprintf("Unknown subscriber \"%v\"!", data.Sid))
+	}
+
+	r, err := b.LeaveGroup(data.Bname, data.Group, sub)
+	if err != nil {
+		return unsubResult{}, err
+	}
+
+	slock.Lock()
+	delete(subs, data.Sid)
+	slock.Unlock()
+
 	return unsubResult{Id: data.Id, Data: okRes{Ok: r}}, nil
 }
 
-func iter(ch chan []byte, msg []byte, s Service, subs map[uint32]*wsSub, slock *sync.Mutex) error {
+func commitCmdHandler(s Service, data commitCmdData, subs map[uint32]*wsSub, slock *sync.Mutex) (unsubResult, error) {
+	b, err := s.GetBackend(data.Back)
+	if err != nil {
+		return unsubResult{}, err
+	}
+
+	sub := getSub(data.Sid, subs, slock)
+	if sub == nil {
+		return unsubResult{}, errors.New(fmt.Sprintf("Unknown subscriber \"%v\"!", data.Sid))
+	}
+
+	if err := b.Commit(data.Bname, data.Group, sub, data.Offset); err != nil {
+		return unsubResult{}, err
+	}
+
+	return unsubResult{Id: data.Id, Data: okRes{Ok: true}}, nil
+}
+
+func iter(out *wsOut, msg []byte, s Service, subs map[uint32]*wsSub, slock *sync.Mutex) error {
 	cmd := cmdName{}
 	if err := json.NewDecoder(bytes.NewReader(msg)).Decode(&cmd); err != nil {
 		return err
@@ -382,13 +767,17 @@ func iter(ch chan []byte, msg []byte, s Service, subs map[uint32]*wsSub, slock *
 		if err := addCmdHandler(s, []byte(cmd.Data)); err != nil {
 			return err
 		}
+	case "add_batch":
+		if err := addBatchCmdHandler(s, []byte(cmd.Data)); err != nil {
+			return err
+		}
 	case "subscribe":
 		data := addSubCmdData{}
 		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
 			return err
 		}
 
-		res, err := subCmdHandler(s, data, ch, subs, slock)
+		res, err := subCmdHandler(s, data, out, subs, slock)
 		if err != nil {
 			res = subResult{Id: data.Id, Data: rangeRes{Err: err.Error()}}
 		}
@@ -398,9 +787,7 @@ func iter(ch chan []byte, msg []byte, s Service, subs map[uint32]*wsSub, slock *
 			return err
 		}
 
-		go func() {
-			ch <- buf.Bytes()
-		}()
+		go out.send(buf.Bytes())
 	case "unsubscribe":
 		data := rmSubCmdData{}
 		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
@@ -417,29 +804,128 @@ func iter(ch chan []byte, msg []byte, s Service, subs map[uint32]*wsSub, slock *
 			return err
 		}
 
-		go func() {
-			ch <- buf.Bytes()
-		}()
+		go out.send(buf.Bytes())
+	case "ack":
+		data := ackCmdData{}
+		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
+			return err
+		}
+
+		res, err := ackCmdHandler(s, data, subs, slock)
+		if err != nil {
+			res = unsubResult{Id: data.Id, Data: okRes{Err: err.Error()}}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(&res); err != nil {
+			return err
+		}
+
+		go out.send(buf.Bytes())
+	case "sub_stats":
+		data := subStatsCmdData{}
+		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
+			return err
+		}
+
+		res, err := subStatsCmdHandler(s, data, subs, slock)
+		if err != nil {
+			res = subStatsResult{Id: data.Id, Data: subStatsRes{Err: err.Error()}}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(&res); err != nil {
+			return err
+		}
+
+		go out.send(buf.Bytes())
+	case "join_group", "leave_group":
+		data := groupCmdData{}
+		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
+			return err
+		}
+
+		var res unsubResult
+		var err error
+		if cmd.Cmd == "join_group" {
+			res, err = joinGroupCmdHandler(s, data, out, subs, slock)
+		} else {
+			res, err = leaveGroupCmdHandler(s, data, subs, slock)
+		}
+		if err != nil {
+			res = unsubResult{Id: data.Id, Data: okRes{Err: err.Error()}}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(&res); err != nil {
+			return err
+		}
+
+		go out.send(buf.Bytes())
+	case "commit":
+		data := commitCmdData{}
+		if err := json.NewDecoder(bytes.NewReader([]byte(cmd.Data))).Decode(&data); err != nil {
+			return err
+		}
+
+		res, err := commitCmdHandler(s, data, subs, slock)
+		if err != nil {
+			res = unsubResult{Id: data.Id, Data: okRes{Err: err.Error()}}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(&res); err != nil {
+			return err
+		}
+
+		go out.send(buf.Bytes())
 	default:
 		return errors.New(fmt.Sprintf("Unknown command \"%s\"!", cmd.Cmd))
 	}
 	return nil
 }
 
-func handleWs(s Service, ws *websocket.Conn, subs map[uint32]*wsSub, slock *sync.Mutex) error {
-	ch := make(chan []byte)
-	defer close(ch)
+// Remove subscribers of a closed websocket connection.
+func rmSubs(s Service, subs map[uint32]*wsSub) error {
+	errs := errors.List()
+	for _, sub := range subs {
+		b, err := s.GetBackend(sub.back)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+
+		if sub.group != "" {
+			_, err = b.LeaveGroup(sub.bname, sub.group, sub)
+		} else {
+			_, err = b.RmSub(sub.bname, sub)
+		}
+		errs.Add(err)
+	}
+	return errs.Err()
+}
+
+func handleWs(s Service, ws *websocket.Conn) (rerr error) {
+	out := &wsOut{make(chan []byte), make(chan struct{})}
+
+	// subscriber ids are chosen by the client, so they are per connection
+	slock := sync.Mutex{}
+	subs := map[uint32]*wsSub{}
+	defer func() {
+		rerr = errors.List().Add(rerr).Add(rmSubs(s, subs)).Err()
+		close(out.done)
+	}()
 
 	go func() {
 		for {
-			v, ok := <-ch
-			if !ok {
-				break
-			}
-
-			if err := ws.WriteMessage(websocket.BinaryMessage, v); err != nil {
-				fmt.Printf("ws.WriteMessage: %#v\n", err)
-				break
+			select {
+			case v := <-out.ch:
+				if err := ws.WriteMessage(websocket.BinaryMessage, v); err != nil {
+					fmt.Printf("ws.WriteMessage: %#v\n", err)
+					return
+				}
+			case <-out.done:
+				return
 			}
 		}
 	}()
@@ -455,7 +941,7 @@ func handleWs(s Service, ws *websocket.Conn, subs map[uint32]*wsSub, slock *sync
 			continue
 		}
 
-		if err := iter(ch, msg, s, subs, slock); err != nil {
+		if err := iter(out, msg, s, subs, &slock); err != nil {
 			return err
 		}
 	}
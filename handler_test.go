@@ -0,0 +1,150 @@
+package golfstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Definition of a stream which passes all events through.
+const testDef = `{"filter": [{"load": "input"}, {"expr": [{"load": "input"}, "true"]}]}`
+
+// Start a server of a service with a mem backend "m".
+func startHandler(t *testing.T) *httptest.Server {
+	stream.RegisterDefault()
+
+	s := New()
+	if _, err := s.AddBackend("m", backend.NewMem()); !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return httptest.NewServer(NewHandler(s, nil))
+}
+
+// Post a JSON request to a server and decode a JSON response.
+func post(t *testing.T, url string, req interface{}, res interface{}) {
+	body, err := json.Marshal(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	resp, err := http.Post(url, "text/json", bytes.NewReader(body))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(res))
+}
+
+// Test that all problems of a stream to add are reported by the validation route.
+func TestHandlerValidate(t *testing.T) {
+	srv := startHandler(t)
+	defer srv.Close()
+
+	res := validateRes{}
+	post(t, srv.URL+"/sbackends/m/streams/validate", &validateArgs{Name: "s", Bname: "bs", Defs: []string{testDef}}, &res)
+	assert.Equal(t, []string{}, res.Errs)
+
+	res = validateRes{}
+	post(t, srv.URL+"/sbackends/m/streams/validate", &validateArgs{Bname: "bs", Inputs: map[string]string{"other": "bs2"}, Defs: []string{
+		`{"zip": [{"load": "input"}, {"load": "other"}]}`,
+		`{"load": "nothing"}`,
+		`{"get_field": [{"load": "input"}]}`,
+	}}, &res)
+	assert.Equal(t, 2, len(res.Errs), res.Errs)
+
+	// the stream is checked against the backend
+	e := errorObj{}
+	post(t, srv.URL+"/sbackends/m/streams/add/s", &addStreamArgs{Bname: "bs", Defs: []string{testDef}}, &e)
+	assert.Equal(t, "", e.Err)
+	res = validateRes{}
+	post(t, srv.URL+"/sbackends/m/streams/validate", &validateArgs{Name: "s", Inputs: map[string]string{"other": ""}, Defs: []string{testDef}}, &res)
+	assert.Equal(t, 3, len(res.Errs), res.Errs)
+
+	e = errorObj{}
+	post(t, srv.URL+"/sbackends/nobackend/streams/validate", &validateArgs{Bname: "bs", Defs: []string{testDef}}, &e)
+	assert.NotEqual(t, "", e.Err)
+}
+
+// Test that the dry run route returns transformed events as JSON and the error that stopped the run.
+func TestHandlerDryRun(t *testing.T) {
+	srv := startHandler(t)
+	defer srv.Close()
+
+	defs := []string{`{"+": [{"get_field": [{"decode": [{"load": "input"}, "json"]}, "a"]}, 1]}`}
+	res := dryRunRes{}
+	post(t, srv.URL+"/sbackends/m/streams/dryrun", &dryRunArgs{Bname: "bs", Defs: defs, Evts: []json.RawMessage{
+		json.RawMessage(`{"a": 1}`),
+		json.RawMessage(`{"a": 2.5}`),
+		json.RawMessage(`{"b": 3}`),
+	}}, &res)
+	assert.Equal(t, []json.RawMessage{json.RawMessage("2"), json.RawMessage("3.5")}, res.Evts)
+	assert.NotEqual(t, "", res.Err)
+
+	res = dryRunRes{}
+	post(t, srv.URL+"/sbackends/m/streams/dryrun", &dryRunArgs{Bname: "bs", Defs: []string{testDef}, Evts: []json.RawMessage{json.RawMessage(`{"a":1}`)}}, &res)
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`{"a":1}`)}, res.Evts)
+	assert.Equal(t, "", res.Err)
+
+	// a stream that can't be added is not run
+	res = dryRunRes{}
+	post(t, srv.URL+"/sbackends/m/streams/dryrun", &dryRunArgs{Defs: []string{testDef}, Evts: []json.RawMessage{json.RawMessage(`{"a":1}`)}}, &res)
+	assert.Equal(t, []json.RawMessage{}, res.Evts)
+	assert.NotEqual(t, "", res.Err)
+}
+
+// Test that the functions route describes all stream functions, encoders and decoders.
+func TestHandlerFunctions(t *testing.T) {
+	srv := startHandler(t)
+	defer srv.Close()
+
+	res := functionsRes{}
+	post(t, srv.URL+"/functions", struct{}{}, &res)
+	assert.Equal(t, stream.Functions(), res.Fns)
+	assert.Equal(t, []string{"json"}, res.Encoders)
+	assert.Equal(t, []string{"json"}, res.Decoders)
+
+	fns := map[string]stream.FunctionInfo{}
+	for i, fn := range res.Fns {
+		if i != 0 {
+			assert.True(t, res.Fns[i-1].Name < fn.Name, fn.Name)
+		}
+		assert.NotEqual(t, "", fn.Desc, fn.Name)
+		fns[fn.Name] = fn
+	}
+	assert.Equal(t, stream.FunctionInfo{
+		Name:    "load",
+		MinArgs: 1,
+		MaxArgs: 3,
+		Args:    []stream.ArgKind{stream.ArgString, stream.ArgAny},
+		Desc:    "Load a named stream: an input or one saved with save.",
+	}, fns["load"])
+	assert.Equal(t, -1, fns["zip"].MaxArgs)
+	assert.Equal(t, []stream.ArgKind{"stream|number", "stream|number"}, fns["pow"].Args)
+
+	// the JSON names of the description fields
+	raw := struct {
+		Fns []map[string]interface{} `json:"functions"`
+	}{}
+	post(t, srv.URL+"/functions", struct{}{}, &raw)
+	assert.Equal(t, len(res.Fns), len(raw.Fns))
+	for _, fn := range raw.Fns {
+		if fn["name"] != "save" {
+			continue
+		}
+		assert.Equal(t, map[string]interface{}{
+			"name":        "save",
+			"min_args":    2.0,
+			"max_args":    2.0,
+			"args":        []interface{}{"string", "stream"},
+			"description": "Save a stream by name to be loaded later with load, produces an empty stream.",
+		}, fn)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"time"
 )
 
 // A Poster is an interface for creating JSON HTTP POST requests.
@@ -26,6 +27,11 @@ func Http() Poster {
 	return httpPoster{&http.Client{}}
 }
 
+// Create a Poster implementation with standart net/http library with a time limit for requests, zero means no limit.
+func HttpTimeout(timeout time.Duration) Poster {
+	return httpPoster{&http.Client{Timeout: timeout}}
+}
+
 type PosterCloser interface {
 	io.Closer
 	Poster
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type errorObj struct {
@@ -49,6 +50,10 @@ func (self *remoteStreamT) Add(evt stream.Event) error {
 	return self.s.add(self.back, self.name, evt)
 }
 
+func (self *remoteStreamT) AddBatch(evts []stream.Event) error {
+	return self.s.addBatch(self.back, self.name, evts)
+}
+
 func (self *remoteStreamT) Read(from uint, to uint) (stream.Stream, error) {
 	return self.bs.Read(from, to)
 }
@@ -80,6 +85,20 @@ func nextId(val *uint32) uint32 {
 	}
 }
 
+// What's needed to subscribe a subscriber again after reconnecting.
+type remoteSub struct {
+	bstream string
+	// name of the consumer group, if it's a member of one
+	group string
+	opts  SubOptions
+	// the server has the subscriber
+	active bool
+	// offset of the next event, the one of the backend stream when the subscriber was added until it gets events
+	next uint
+	// events before this offset are acknowledged, zero if the subscriber didn't acknowledge any
+	acked uint
+}
+
 type remoteServiceBackend struct {
 	s        *remoteService
 	p        poster.Poster
@@ -89,9 +108,10 @@ type remoteServiceBackend struct {
 
 	subId uint32
 
-	lock sync.Mutex
-	ids  map[backend.Stream]uint32
-	subs map[uint32]backend.Stream
+	lock    sync.Mutex
+	ids     map[backend.Stream]uint32
+	subs    map[uint32]backend.Stream
+	remotes map[uint32]*remoteSub
 }
 
 func (self *remoteServiceBackend) Backend() backend.Backend {
@@ -125,8 +145,9 @@ func (self *remoteServiceBackend) Streams() ([]string, []string, [][]string, err
 }
 
 type addStreamArgs struct {
-	Bname string   `json:"backend_stream"`
-	Defs  []string `json:"definitions"`
+	Bname  string            `json:"backend_stream"`
+	Inputs map[string]string `json:"inputs,omitempty"`
+	Defs   []string          `json:"definitions"`
 }
 
 func (self *remoteServiceBackend) getStream(name string, bs backend.BackendStream) backend.BackendStream {
@@ -134,8 +155,12 @@ func (self *remoteServiceBackend) getStream(name string, bs backend.BackendStrea
 }
 
 func (self *remoteServiceBackend) AddStream(bstream, name string, defs []string) (backend.BackendStream, error) {
+	return self.AddStreamInputs(bstream, name, nil, defs)
+}
+
+func (self *remoteServiceBackend) AddStreamInputs(bstream, name string, inputs map[string]string, defs []string) (backend.BackendStream, error) {
 	buf := new(bytes.Buffer)
-	if err := json.NewEncoder(buf).Encode(&addStreamArgs{Bname: bstream, Defs: defs}); err != nil {
+	if err := json.NewEncoder(buf).Encode(&addStreamArgs{Bname: bstream, Inputs: inputs, Defs: defs}); err != nil {
 		return nil, err
 	}
 
@@ -184,20 +209,122 @@ func (self *remoteServiceBackend) RmStream(name string) error {
 	return callErr(self.p, fmt.Sprintf("%s/streams/rm/%s", self.sbaseUrl, name), nil)
 }
 
-func (self *remoteServiceBackend) AddSub(bstream string, s backend.Stream, hFrom int, hTo int) (rf uint, rt uint, rerr error) {
-	sid := nextId(&self.subId)
+func (self *remoteServiceBackend) SetRetention(bstream string, r backend.Retention) error {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(r.Config()); err != nil {
+		return err
+	}
+
+	return callErr(self.p, fmt.Sprintf("%s/retention/%s", self.sbaseUrl, bstream), buf)
+}
 
-	nf, nt, err := self.s.addSub(self.name, bstream, sid, hFrom, hTo)
+func (self *remoteServiceBackend) AddSub(bstream string, s backend.Stream, hFrom int, hTo int) (uint, uint, error) {
+	return self.AddSubOptions(bstream, s, hFrom, hTo, SubOptions{})
+}
+
+// Options are applied by the server to sending events to the client, zero queue size means the default one.
+func (self *remoteServiceBackend) AddSubOptions(bstream string, s backend.Stream, hFrom int, hTo int, opts SubOptions) (uint, uint, error) {
+	if err := opts.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	// events might come before the result of the command
+	sid := self.register(s, &remoteSub{bstream, "", opts, false, 0, 0})
+
+	nf, nt, offset, err := self.s.addSub(self.name, bstream, sid, hFrom, hTo, opts)
 	if err != nil {
+		self.unregister(s, sid)
 		return 0, 0, err
 	}
 
+	self.activate(sid, offset)
+	return nf, nt, nil
+}
+
+func (self *remoteServiceBackend) register(s backend.Stream, rs *remoteSub) uint32 {
+	sid := nextId(&self.subId)
+
 	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	self.ids[s] = sid
 	self.subs[sid] = s
-	self.lock.Unlock()
+	self.remotes[sid] = rs
+	return sid
+}
 
-	return nf, nt, nil
+func (self *remoteServiceBackend) unregister(s backend.Stream, sid uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.ids, s)
+	delete(self.subs, sid)
+	delete(self.remotes, sid)
+}
+
+// Mark a subscriber as added by the server, which starts sending it events from the offset.
+func (self *remoteServiceBackend) activate(sid uint32, offset uint) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if rs, ok := self.remotes[sid]; ok {
+		rs.active = true
+		// events might come before the result of the command
+		if offset > rs.next {
+			rs.next = offset
+		}
+	}
+}
+
+// Subscribers the server has.
+func (self *remoteServiceBackend) activeSubs() map[uint32]remoteSub {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := map[uint32]remoteSub{}
+	for sid, rs := range self.remotes {
+		if rs.active {
+			res[sid] = *rs
+		}
+	}
+	return res
+}
+
+/*
+Subscribe again after reconnecting, replaying events which the subscriber might have missed.
+
+A subscriber which acknowledged events replays all events after the acknowledged ones, even if it got them,
+so that events it didn't process are delivered again.
+*/
+func (self *remoteServiceBackend) resubscribe(sid uint32, rs remoteSub) error {
+	if rs.group != "" {
+		if _, err := self.s.group("join_group", self.name, rs.bstream, rs.group, sid); err != nil {
+			return err
+		}
+	} else {
+		opts := rs.opts
+		opts.Replay = true
+		opts.From = rs.next
+		if rs.acked != 0 {
+			opts.From = rs.acked
+		}
+
+		if _, _, _, err := self.s.addSub(self.name, rs.bstream, sid, 0, 0, opts); err != nil {
+			return err
+		}
+	}
+
+	// it might have been removed meanwhile
+	if _, ok := self.getSub(sid); ok {
+		return nil
+	}
+
+	if rs.group != "" {
+		_, err := self.s.group("leave_group", self.name, rs.bstream, rs.group, sid)
+		return err
+	}
+	_, err := self.s.rmSub(self.name, rs.bstream, sid)
+	return err
 }
 
 func (self *remoteServiceBackend) getSid(s backend.Stream) (uint32, bool) {
@@ -227,27 +354,122 @@ func (self *remoteServiceBackend) RmSub(bstream string, s backend.Stream) (bool,
 		return false, err
 	}
 
+	self.unregister(s, sid)
+	return r, nil
+}
+
+func (self *remoteServiceBackend) SubStats(bstream string, s backend.Stream) (SubStats, error) {
+	sid, ok := self.getSid(s)
+	if !ok {
+		return SubStats{}, errors.New(fmt.Sprintf("remoteServiceBackend.SubStats: backend stream \"%s\" does not have the subscriber", bstream))
+	}
+
+	return self.s.subStats(self.name, bstream, sid)
+}
+
+func (self *remoteServiceBackend) Ack(bstream string, s backend.Stream, offset uint) error {
+	sid, ok := self.getSid(s)
+	if !ok {
+		return errors.New(fmt.Sprintf("remoteServiceBackend.Ack: backend stream \"%s\" does not have the subscriber", bstream))
+	}
+
+	if err := self.s.ack(self.name, bstream, sid, offset); err != nil {
+		return err
+	}
+
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	delete(self.ids, s)
-	delete(self.subs, sid)
+	if rs, ok := self.remotes[sid]; ok && offset+1 > rs.acked {
+		rs.acked = offset + 1
+	}
+	return nil
+}
+
+// The server disconnected a subscriber.
+func (self *remoteServiceBackend) closeSub(sid uint32) error {
+	self.lock.Lock()
+	s, ok := self.subs[sid]
+	if ok {
+		delete(self.ids, s)
+		delete(self.subs, sid)
+		delete(self.remotes, sid)
+	}
+	self.lock.Unlock()
+
+	// it might have been removed before the notice arrived
+	if !ok {
+		return nil
+	}
+	return s.Close()
+}
+
+func (self *remoteServiceBackend) JoinGroup(bstream, group string, s backend.Stream) error {
+	// events might come before the result of the command
+	sid := self.register(s, &remoteSub{bstream, group, SubOptions{}, false, 0, 0})
+
+	if _, err := self.s.group("join_group", self.name, bstream, group, sid); err != nil {
+		self.unregister(s, sid)
+		return err
+	}
+
+	self.activate(sid, 0)
+	return nil
+}
+
+func (self *remoteServiceBackend) Commit(bstream, group string, s backend.Stream, offset uint) error {
+	sid, ok := self.getSid(s)
+	if !ok {
+		return errors.New(fmt.Sprintf("remoteServiceBackend.Commit: group \"%s\" of backend stream \"%s\" does not have the member", group, bstream))
+	}
+
+	return self.s.commit(self.name, bstream, group, sid, offset)
+}
+
+func (self *remoteServiceBackend) LeaveGroup(bstream, group string, s backend.Stream) (bool, error) {
+	sid, ok := self.getSid(s)
+	if !ok {
+		return false, nil
+	}
+
+	r, err := self.s.group("leave_group", self.name, bstream, group, sid)
+	if err != nil {
+		return false, err
+	}
+
+	self.unregister(s, sid)
 	return r, nil
 }
 
-func (self *remoteServiceBackend) pushToSub(sid uint32, evt stream.Event) error {
-	s, ok := self.getSub(sid)
+func (self *remoteServiceBackend) pushToSub(sid uint32, offset *uint, evt stream.Event) error {
+	self.lock.Lock()
+	s, ok := self.subs[sid]
+	if rs, rok := self.remotes[sid]; rok && offset != nil && *offset+1 > rs.next {
+		rs.next = *offset + 1
+	}
+	self.lock.Unlock()
 	if !ok {
-		return errors.New(fmt.Sprintf("remoteServiceBackend.pushToSub: Backend \"%s\" doesn't have subscriber %v", sid))
+		return errors.New(fmt.Sprintf("remoteServiceBackend.pushToSub: Backend \"%s\" doesn't have subscriber %v", self.name, sid))
 	}
 
+	if os, ok := s.(OffsetStream); ok && offset != nil {
+		return os.AddOffset(*offset, evt)
+	}
 	return s.Add(evt)
 }
 
+// Delays between attempts to reconnect the websocket, doubled after each failed one.
+const (
+	reconnectDelayMin = 100 * time.Millisecond
+	reconnectDelayMax = 30 * time.Second
+)
+
 type remoteService struct {
 	baseUrl string
+	wsUrl   string
 	async   bool
 	p       poster.Poster
+	errorCb func(error)
 
 	cmdId uint32
 
@@ -256,6 +478,9 @@ type remoteService struct {
 
 	wlock sync.Mutex
 	ws    *websocket.Conn
+	// number of lost connections
+	lost   uint
+	closed chan struct{}
 
 	clock sync.Mutex
 	cmds  map[uint32]chan json.RawMessage
@@ -292,10 +517,16 @@ func (self *remoteService) delBackend(back string) {
 	delete(self.backends, back)
 }
 
-func (self *remoteService) getBackend(back string) *remoteServiceBackend {
+func (self *remoteService) getBackend(back string) (*remoteServiceBackend, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	select {
+	case <-self.closed:
+		return nil, errors.New(fmt.Sprintf("remoteService.getBackend: Service is closed, can't get backend \"%s\"", back))
+	default:
+	}
+
 	res, ok := self.backends[back]
 	if !ok {
 		res = &remoteServiceBackend{
@@ -308,10 +539,11 @@ func (self *remoteService) getBackend(back string) *remoteServiceBackend {
 			sync.Mutex{},
 			map[backend.Stream]uint32{},
 			map[uint32]backend.Stream{},
+			map[uint32]*remoteSub{},
 		}
 		self.backends[back] = res
 	}
-	return res
+	return res, nil
 }
 
 func getBaseConfig(cfg interface{}) (interface{}, error) {
@@ -363,7 +595,11 @@ func (self *remoteService) AddBackend(back string, b backend.Backend) (Backend,
 		return nil, err
 	}
 
-	return self.getBackend(back), nil
+	res, err := self.getBackend(back)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 func (self *remoteService) GetBackend(back string) (Backend, error) {
@@ -372,7 +608,11 @@ func (self *remoteService) GetBackend(back string) (Backend, error) {
 		return nil, err
 	}
 
-	return self.getBackend(back), nil
+	res, err := self.getBackend(back)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 func (self *remoteService) RmBackend(back string) error {
@@ -385,7 +625,22 @@ func (self *remoteService) RmBackend(back string) error {
 }
 
 func (self *remoteService) Close() error {
-	self.backends = nil
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	select {
+	case <-self.closed:
+		return nil
+	default:
+	}
+
+	// the run loop might still be looking up backends to handle messages
+	self.lock.Lock()
+	close(self.closed)
+	self.backends = map[string]*remoteServiceBackend{}
+	self.lock.Unlock()
+
+	self.failCmds()
 	return self.ws.Close()
 }
 
@@ -411,11 +666,27 @@ func (self *remoteService) rmCmd(id uint32) {
 	self.clock.Lock()
 	defer self.clock.Unlock()
 
-	ch := self.cmds[id]
+	// it might have been failed already
+	ch, ok := self.cmds[id]
+	if !ok {
+		return
+	}
+
 	delete(self.cmds, id)
 	close(ch)
 }
 
+// Fail all commands waiting for results, which won't come after the connection is lost.
+func (self *remoteService) failCmds() {
+	self.clock.Lock()
+	defer self.clock.Unlock()
+
+	for _, ch := range self.cmds {
+		close(ch)
+	}
+	self.cmds = map[uint32]chan json.RawMessage{}
+}
+
 func (self *remoteService) getCmdRes(id uint32, arg interface{}) (res []byte, rerr error) {
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(arg); err != nil {
@@ -423,18 +694,30 @@ func (self *remoteService) getCmdRes(id uint32, arg interface{}) (res []byte, re
 	}
 
 	ch := make(chan json.RawMessage, 1)
-	self.addCmd(id, ch)
 	defer func() {
 		if rerr != nil {
 			self.rmCmd(id)
 		}
 	}()
 
-	if err := self.send(buf.Bytes()); err != nil {
+	// add it with the write lock, so that it's either sent to the current connection and failed with it or isn't sent at all
+	if err := self.sendCmd(id, ch, buf.Bytes()); err != nil {
 		return nil, err
 	}
 
-	return []byte(<-ch), nil
+	res, ok := <-ch
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("remoteService.getCmdRes: Connection was lost before getting result of command %v", id))
+	}
+	return []byte(res), nil
+}
+
+func (self *remoteService) sendCmd(id uint32, ch chan json.RawMessage, bs []byte) error {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	self.addCmd(id, ch)
+	return self.ws.WriteMessage(websocket.BinaryMessage, bs)
 }
 
 type addCmdData struct {
@@ -471,13 +754,58 @@ func (self *remoteService) add(back, name string, evt stream.Event) error {
 	return self.send(buf.Bytes())
 }
 
+type addBatchCmdData struct {
+	Back string            `json:"back"`
+	Name string            `json:"name"`
+	Evts []json.RawMessage `json:"events"`
+}
+
+type addBatchCmd struct {
+	Cmd  string          `json:"cmd"`
+	Data addBatchCmdData `json:"data"`
+}
+
+func (self *remoteService) addBatch(back, name string, evts []stream.Event) error {
+	data := make([]json.RawMessage, len(evts))
+	for i, evt := range evts {
+		bs, ok := evt.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("remoteStreamT.AddBatch: expected []byte event, got %v", evt))
+		}
+
+		data[i] = json.RawMessage(bs)
+	}
+
+	cmd := addBatchCmd{
+		Cmd: "add_batch",
+		Data: addBatchCmdData{
+			Back: back,
+			Name: name,
+			Evts: data,
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(&cmd); err != nil {
+		return err
+	}
+
+	return self.send(buf.Bytes())
+}
+
 type addSubCmdData struct {
-	Id    uint32 `json:"id"`
-	Back  string `json:"backend"`
-	Bname string `json:"stream"`
-	Sid   uint32 `json:"sid"`
-	From  int    `json:"from"`
-	To    int    `json:"to"`
+	Id       uint32 `json:"id"`
+	Back     string `json:"backend"`
+	Bname    string `json:"stream"`
+	Sid      uint32 `json:"sid"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Queue    int    `json:"queue,omitempty"`
+	Overflow string `json:"overflow,omitempty"`
+	// replay events starting from the offset
+	Offset *uint `json:"offset,omitempty"`
+	// send only events resulting from running these stream definitions
+	Defs []string `json:"definitions,omitempty"`
 }
 
 type addSubCmd struct {
@@ -486,39 +814,52 @@ type addSubCmd struct {
 }
 
 type rangeRes struct {
-	From uint   `json:"from,omitempty"`
-	To   uint   `json:"to,omitempty"`
-	Err  string `json:"error,omitempty"`
+	From uint `json:"from,omitempty"`
+	To   uint `json:"to,omitempty"`
+	// offset of the first event the subscriber gets
+	Offset *uint  `json:"offset,omitempty"`
+	Err    string `json:"error,omitempty"`
 }
 
-func (self *remoteService) addSub(back, bname string, sid uint32, hFrom int, hTo int) (uint, uint, error) {
+// Send a "subscribe" command, returns the range from history and the offset of the first event the subscriber gets.
+func (self *remoteService) addSub(back, bname string, sid uint32, hFrom int, hTo int, opts SubOptions) (uint, uint, uint, error) {
 	cmd := addSubCmd{
 		Cmd: "subscribe",
 		Data: addSubCmdData{
-			Id:    self.getCmdId(),
-			Back:  back,
-			Bname: bname,
-			Sid:   sid,
-			From:  hFrom,
-			To:    hTo,
+			Id:       self.getCmdId(),
+			Back:     back,
+			Bname:    bname,
+			Sid:      sid,
+			From:     hFrom,
+			To:       hTo,
+			Queue:    opts.Queue,
+			Overflow: opts.Overflow,
+			Defs:     opts.Defs,
 		},
 	}
+	if opts.Replay {
+		cmd.Data.Offset = &opts.From
+	}
 
 	v, err := self.getCmdRes(cmd.Data.Id, &cmd)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
 	rr := rangeRes{}
 	if err := json.NewDecoder(bytes.NewReader(v)).Decode(&rr); err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
 	if rr.Err != "" {
-		return 0, 0, errors.New(rr.Err)
+		return 0, 0, 0, errors.New(rr.Err)
 	}
 
-	return rr.From, rr.To, nil
+	if rr.Offset == nil {
+		return 0, 0, 0, errors.New(fmt.Sprintf("remoteService.addSub: Expected the offset of the subscriber in the result, got %s", string(v)))
+	}
+
+	return rr.From, rr.To, *rr.Offset, nil
 }
 
 type rmSubCmdData struct {
@@ -566,6 +907,181 @@ func (self *remoteService) rmSub(back, bname string, sid uint32) (bool, error) {
 	return rr.Ok, nil
 }
 
+type ackCmdData struct {
+	Id     uint32 `json:"id"`
+	Back   string `json:"backend"`
+	Bname  string `json:"stream"`
+	Sid    uint32 `json:"sid"`
+	Offset uint   `json:"offset"`
+}
+
+type ackCmd struct {
+	Cmd  string     `json:"cmd"`
+	Data ackCmdData `json:"data"`
+}
+
+func (self *remoteService) ack(back, bname string, sid uint32, offset uint) error {
+	cmd := ackCmd{
+		Cmd: "ack",
+		Data: ackCmdData{
+			Id:     self.getCmdId(),
+			Back:   back,
+			Bname:  bname,
+			Sid:    sid,
+			Offset: offset,
+		},
+	}
+
+	v, err := self.getCmdRes(cmd.Data.Id, &cmd)
+	if err != nil {
+		return err
+	}
+
+	rr := okRes{}
+	if err := json.NewDecoder(bytes.NewReader(v)).Decode(&rr); err != nil {
+		return err
+	}
+
+	if rr.Err != "" {
+		return errors.New(rr.Err)
+	}
+	return nil
+}
+
+type subStatsCmdData struct {
+	Id    uint32 `json:"id"`
+	Back  string `json:"backend"`
+	Bname string `json:"stream"`
+	Sid   uint32 `json:"sid"`
+}
+
+type subStatsCmd struct {
+	Cmd  string          `json:"cmd"`
+	Data subStatsCmdData `json:"data"`
+}
+
+type subStatsRes struct {
+	Stats *SubStats `json:"stats,omitempty"`
+	Err   string    `json:"error,omitempty"`
+}
+
+func (self *remoteService) subStats(back, bname string, sid uint32) (SubStats, error) {
+	cmd := subStatsCmd{
+		Cmd: "sub_stats",
+		Data: subStatsCmdData{
+			Id:    self.getCmdId(),
+			Back:  back,
+			Bname: bname,
+			Sid:   sid,
+		},
+	}
+
+	v, err := self.getCmdRes(cmd.Data.Id, &cmd)
+	if err != nil {
+		return SubStats{}, err
+	}
+
+	rr := subStatsRes{}
+	if err := json.NewDecoder(bytes.NewReader(v)).Decode(&rr); err != nil {
+		return SubStats{}, err
+	}
+
+	if rr.Err != "" {
+		return SubStats{}, errors.New(rr.Err)
+	}
+
+	if rr.Stats == nil {
+		return SubStats{}, errors.New(fmt.Sprintf("remoteService.subStats: Expected stats, got %s", string(v)))
+	}
+	return *rr.Stats, nil
+}
+
+type groupCmdData struct {
+	Id    uint32 `json:"id"`
+	Back  string `json:"backend"`
+	Bname string `json:"stream"`
+	Group string `json:"group"`
+	Sid   uint32 `json:"sid"`
+}
+
+type groupCmd struct {
+	Cmd  string       `json:"cmd"`
+	Data groupCmdData `json:"data"`
+}
+
+// Send a "join_group" or a "leave_group" command.
+func (self *remoteService) group(name, back, bname, group string, sid uint32) (bool, error) {
+	cmd := groupCmd{
+		Cmd: name,
+		Data: groupCmdData{
+			Id:    self.getCmdId(),
+			Back:  back,
+			Bname: bname,
+			Group: group,
+			Sid:   sid,
+		},
+	}
+
+	v, err := self.getCmdRes(cmd.Data.Id, &cmd)
+	if err != nil {
+		return false, err
+	}
+
+	rr := okRes{}
+	if err := json.NewDecoder(bytes.NewReader(v)).Decode(&rr); err != nil {
+		return false, err
+	}
+
+	if rr.Err != "" {
+		return false, errors.New(rr.Err)
+	}
+
+	return rr.Ok, nil
+}
+
+type commitCmdData struct {
+	Id     uint32 `json:"id"`
+	Back   string `json:"backend"`
+	Bname  string `json:"stream"`
+	Group  string `json:"group"`
+	Sid    uint32 `json:"sid"`
+	Offset uint   `json:"offset"`
+}
+
+type commitCmd struct {
+	Cmd  string        `json:"cmd"`
+	Data commitCmdData `json:"data"`
+}
+
+func (self *remoteService) commit(back, bname, group string, sid uint32, offset uint) error {
+	cmd := commitCmd{
+		Cmd: "commit",
+		Data: commitCmdData{
+			Id:     self.getCmdId(),
+			Back:   back,
+			Bname:  bname,
+			Group:  group,
+			Sid:    sid,
+			Offset: offset,
+		},
+	}
+
+	v, err := self.getCmdRes(cmd.Data.Id, &cmd)
+	if err != nil {
+		return err
+	}
+
+	rr := okRes{}
+	if err := json.NewDecoder(bytes.NewReader(v)).Decode(&rr); err != nil {
+		return err
+	}
+
+	if rr.Err != "" {
+		return errors.New(rr.Err)
+	}
+	return nil
+}
+
 func (self *remoteService) popCmd(id uint32) chan json.RawMessage {
 	self.clock.Lock()
 	defer self.clock.Unlock()
@@ -590,7 +1106,7 @@ func (self *remoteService) handleCmdRes(id uint32, data json.RawMessage) error {
 	return nil
 }
 
-func (self *remoteService) handleEvent(back string, sid uint32, evt stream.Event) error {
+func (self *remoteService) handleEvent(back string, sid uint32, offset *uint, evt stream.Event) error {
 	self.lock.Lock()
 	b, ok := self.backends[back]
 	self.lock.Unlock()
@@ -598,49 +1114,181 @@ func (self *remoteService) handleEvent(back string, sid uint32, evt stream.Event
 		return errors.New(fmt.Sprintf("remoteService.handleEvent: No backend with name \"%v\"", back))
 	}
 
-	return b.pushToSub(sid, evt)
+	return b.pushToSub(sid, offset, evt)
 }
 
+func (self *remoteService) handleDisconnect(back string, sid uint32) error {
+	self.lock.Lock()
+	b, ok := self.backends[back]
+	self.lock.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("remoteService.handleDisconnect: No backend with name \"%v\"", back))
+	}
+
+	return b.closeSub(sid)
+}
+
+// A result of a command or, without an id, an event for a subscriber or a notice that it was disconnected.
 type cmdResult struct {
 	Id    *uint32         `json:"id,omitempty"`
 	Back  string          `json:"backend,omitempty"`
 	Bname string          `json:"stream,omitempty"`
 	Sid   uint32          `json:"sid,omitempty"`
 	Data  json.RawMessage `json:"data"`
+	Err   string          `json:"error,omitempty"`
+	// offset of an event in the backend stream
+	Offset *uint `json:"offset,omitempty"`
+}
+
+func (self *remoteService) handle(msg []byte) error {
+	cmd := cmdResult{}
+	if err := json.NewDecoder(bytes.NewReader(msg)).Decode(&cmd); err != nil {
+		return err
+	}
+
+	if cmd.Id == nil && cmd.Err != "" {
+		return self.handleDisconnect(cmd.Back, cmd.Sid)
+	} else if cmd.Id == nil {
+		return self.handleEvent(cmd.Back, cmd.Sid, cmd.Offset, stream.Event([]byte(cmd.Data)))
+	} else {
+		return self.handleCmdRes(*cmd.Id, cmd.Data)
+	}
 }
 
-func (self *remoteService) run(ws *websocket.Conn) error {
+// Read messages until the connection is lost.
+func (self *remoteService) read(ws *websocket.Conn) error {
 	for {
 		mt, msg, err := ws.ReadMessage()
 		if err != nil {
-			fmt.Printf("remoteService.run: %#v\n", err)
-			break
+			return err
 		}
 
 		if mt != websocket.BinaryMessage {
 			continue
 		}
 
-		cmd := cmdResult{}
-		if err := json.NewDecoder(bytes.NewReader(msg)).Decode(&cmd); err != nil {
-			return err
+		if err := self.handle(msg); err != nil {
+			self.errorCb(err)
 		}
+	}
+}
+
+// Fail commands sent to a lost connection, returns false if it was lost because the service is closed.
+func (self *remoteService) disconnect(ws *websocket.Conn) bool {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	select {
+	case <-self.closed:
+		return false
+	default:
+	}
+
+	if err := ws.Close(); err != nil {
+		self.errorCb(err)
+	}
+	self.lost++
+	self.failCmds()
+	return true
+}
 
-		if cmd.Id == nil {
-			if err := self.handleEvent(cmd.Back, cmd.Sid, stream.Event([]byte(cmd.Data))); err != nil {
-				return err
+func (self *remoteService) getLost() uint {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	return self.lost
+}
+
+// Dial the websocket until it succeeds, returns nil if the service is closed meanwhile.
+func (self *remoteService) reconnect() (*websocket.Conn, map[*remoteServiceBackend]map[uint32]remoteSub) {
+	delay := reconnectDelayMin
+	for {
+		select {
+		case <-self.closed:
+			return nil, nil
+		case <-time.After(delay):
+		}
+
+		ws, _, err := websocket.DefaultDialer.Dial(self.wsUrl, nil)
+		if err != nil {
+			self.errorCb(err)
+			delay *= 2
+			if delay > reconnectDelayMax {
+				delay = reconnectDelayMax
 			}
-		} else {
-			if err := self.handleCmdRes(*cmd.Id, cmd.Data); err != nil {
-				return err
+			continue
+		}
+
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
+
+		select {
+		case <-self.closed:
+			if err := ws.Close(); err != nil {
+				self.errorCb(err)
+			}
+			return nil, nil
+		default:
+		}
+
+		self.ws = ws
+
+		// subscribers added from now on are sent to the new connection by themselves
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		subs := map[*remoteServiceBackend]map[uint32]remoteSub{}
+		for _, b := range self.backends {
+			subs[b] = b.activeSubs()
+		}
+		return ws, subs
+	}
+}
+
+// Subscribe subscribers again after reconnecting, the ones that can't be are closed.
+func (self *remoteService) resubscribe(lost uint, subs map[*remoteServiceBackend]map[uint32]remoteSub) {
+	for b, rss := range subs {
+		for sid, rs := range rss {
+			if err := b.resubscribe(sid, rs); err != nil {
+				self.errorCb(err)
+
+				// the connection is lost again, they'll be subscribed after reconnecting
+				if self.getLost() != lost {
+					return
+				}
+
+				if err := b.closeSub(sid); err != nil {
+					self.errorCb(err)
+				}
 			}
 		}
 	}
-	return nil
+}
+
+// Read messages and reconnect when the connection is lost until the service is closed.
+func (self *remoteService) run(ws *websocket.Conn) {
+	for {
+		err := self.read(ws)
+		if !self.disconnect(ws) {
+			return
+		}
+		self.errorCb(err)
+
+		var subs map[*remoteServiceBackend]map[uint32]remoteSub
+		ws, subs = self.reconnect()
+		if ws == nil {
+			return
+		}
+
+		// results of the commands are read by this loop
+		go self.resubscribe(self.getLost(), subs)
+	}
 }
 
 // Create a golfstream remote service implementation that doesn't itseld do anything except sending commands to remote server
 // wia HTTP and a websoket.
+// When the websocket connection is lost, commands waiting for results fail, and the connection is reestablished
+// with exponential backoff, after which all subscribers are subscribed again.
 func NewHttp(baseUrl string, p poster.Poster, errorCb func(error)) (Service, error) {
 	if errorCb == nil {
 		errorCb = func(error) {}
@@ -654,24 +1302,21 @@ func NewHttp(baseUrl string, p poster.Poster, errorCb func(error)) (Service, err
 		url = url[len("http://"):]
 	}
 
-	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/events", url), nil)
+	wsUrl := fmt.Sprintf("ws://%s/events", url)
+	ws, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	self := &remoteService{
-		baseUrl, true, p,
+		baseUrl, wsUrl, true, p, errorCb,
 		0,
 		sync.Mutex{}, map[string]*remoteServiceBackend{},
-		sync.Mutex{}, ws,
+		sync.Mutex{}, ws, 0, make(chan struct{}),
 		sync.Mutex{}, map[uint32]chan json.RawMessage{},
 	}
 
-	go func() {
-		if err := self.run(ws); err != nil {
-			errorCb(err)
-		}
-	}()
+	go self.run(ws)
 
 	return self, nil
 }
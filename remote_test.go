@@ -0,0 +1,319 @@
+package golfstream
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/poster"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// A listener which can drop all connections it accepted.
+type dropListener struct {
+	net.Listener
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (self *dropListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.conns = append(self.conns, c)
+	return c, nil
+}
+
+func (self *dropListener) drop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, c := range self.conns {
+		c.Close()
+	}
+	self.conns = nil
+}
+
+// Start a server of a service with a backend "m" and a stream "s" writing to it's backend stream "bs", on a given address if it's not empty.
+func startServer(t *testing.T, addr string, b backend.Backend) (*httptest.Server, *dropListener, backend.Stream) {
+	stream.RegisterDefault()
+	backend.RegisterDefault()
+
+	s := New()
+	sb, err := s.AddBackend("m", b)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	st, err := sb.AddStream("bs", "s", []string{testDef})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	// connections are closed after tests are done
+	srv := httptest.NewUnstartedServer(NewHandler(s, func(err error) {
+		log.Println(err)
+	}))
+	if addr != "" {
+		srv.Listener.Close()
+		l, err := net.Listen("tcp", addr)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		srv.Listener = l
+	}
+
+	l := &dropListener{Listener: srv.Listener}
+	srv.Listener = l
+	srv.Start()
+	return srv, l, st
+}
+
+// Test that remote subscribers get all events after the connection is lost and the server is restarted.
+func TestRemoteReconnect(t *testing.T) {
+	mem := backend.NewMem()
+	srv, l, st := startServer(t, "", mem)
+
+	s, err := NewHttp(srv.URL, nil, func(err error) {
+		t.Log(err)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	b, err := s.GetBackend("m")
+	assert.Nil(t, err)
+
+	sub, g := &testSub{}, &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, b.JoinGroup("bs", "g", g))
+
+	addNumbers(t, st, 0, 50)
+	checkOffsets(t, "connected", sub, 0, 50)
+	checkOffsets(t, "connected group", g, 0, 50)
+	// uncommitted events would be delivered to the group again
+	assert.Nil(t, b.Commit("bs", "g", g, 49))
+
+	l.drop()
+	addNumbers(t, st, 50, 100)
+	checkOffsets(t, "reconnected", sub, 0, 100)
+	checkOffsets(t, "reconnected group", g, 0, 100)
+
+	stats, err := b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(100), stats.Offset)
+
+	r, err := b.LeaveGroup("bs", "g", g)
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	// a new server with the same data on the same address
+	addr := srv.Listener.Addr().String()
+	srv.CloseClientConnections()
+	l.drop()
+	srv.Close()
+
+	srv, _, st = startServer(t, addr, mem)
+	defer srv.Close()
+
+	addNumbers(t, st, 100, 150)
+	checkOffsets(t, "restarted", sub, 0, 150)
+
+	r, err = b.RmSub("bs", sub)
+	assert.Nil(t, err)
+	assert.True(t, r)
+	assert.Nil(t, s.Close())
+
+	// a closed service doesn't give out backends anymore
+	_, err = s.GetBackend("m")
+	assert.NotNil(t, err)
+}
+
+// Test that events added to a remote stream in batches are added in order with the ones added one by one.
+func TestRemoteAddBatch(t *testing.T) {
+	srv, _, _ := startServer(t, "", backend.NewMem())
+	defer srv.Close()
+
+	s, err := NewHttp(srv.URL, nil, func(err error) {
+		t.Log(err)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	b, err := s.GetBackend("m")
+	assert.Nil(t, err)
+	st, _, err := b.GetStream("s")
+	assert.Nil(t, err)
+
+	sub := &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{})
+	assert.Nil(t, err)
+
+	batch := func(from int, to int) []stream.Event {
+		res := []stream.Event{}
+		for i := from; i < to; i++ {
+			res = append(res, []byte(fmt.Sprint(i)))
+		}
+		return res
+	}
+
+	assert.Nil(t, backend.AddBatch(st, batch(0, 10)))
+	addNumbers(t, st, 10, 15)
+	assert.Nil(t, backend.AddBatch(st, []stream.Event{}))
+	assert.Nil(t, backend.AddBatch(st, batch(15, 100)))
+	assert.NotNil(t, backend.AddBatch(st, []stream.Event{"not bytes"}))
+	checkOffsets(t, "batches", sub, 0, 100)
+
+	data, err := st.Read(0, 100)
+	assert.Nil(t, err)
+	evts := []string{}
+	for {
+		evt, err := data.Next()
+		if err == stream.EOI {
+			break
+		}
+		if !assert.Nil(t, err) {
+			break
+		}
+		evts = append(evts, string(evt.([]byte)))
+	}
+	_, expected := sub.get()
+	assert.Equal(t, expected, evts)
+}
+
+// Test that a remote subscriber which didn't get any events before the connection is lost gets events after it subscribed.
+func TestRemoteReconnectNoEvents(t *testing.T) {
+	srv, l, st := startServer(t, "", backend.NewMem())
+	defer srv.Close()
+
+	addNumbers(t, st, 0, 10)
+
+	s, err := NewHttp(srv.URL, nil, func(err error) {
+		t.Log(err)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	b, err := s.GetBackend("m")
+	assert.Nil(t, err)
+
+	sub := &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{})
+	assert.Nil(t, err)
+
+	l.drop()
+	addNumbers(t, st, 10, 30)
+	checkOffsets(t, "reconnected", sub, 10, 30)
+}
+
+// Test that remote subscribers replay events and get their offsets.
+func TestRemoteReplay(t *testing.T) {
+	stream.RegisterDefault()
+	backend.RegisterDefault()
+
+	p, url := poster.Handle(NewHandler(New(), func(err error) {
+		log.Println(err)
+	}))
+	defer p.Close()
+
+	s, err := NewHttp(url, p, func(err error) {
+		t.Log(err)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	b, err := s.AddBackend("m", backend.NewMem())
+	assert.Nil(t, err)
+	st, err := b.AddStream("bs", "s", []string{testDef})
+	assert.Nil(t, err)
+
+	addNumbers(t, st, 0, 100)
+
+	done := make(chan struct{})
+	go func() {
+		addNumbers(t, st, 100, 200)
+		close(done)
+	}()
+
+	sub := &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{4, OverflowBlock, true, 20, nil})
+	assert.Nil(t, err)
+	<-done
+	checkOffsets(t, "replayed", sub, 20, 200)
+
+	stats, err := b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(20), stats.Start)
+	assert.Equal(t, uint(200), stats.Offset)
+
+	_, _, err = b.AddSubOptions("bs", &testSub{}, 0, 0, SubOptions{0, "", true, 1000, nil})
+	assert.NotNil(t, err)
+}
+
+// Test that a remote subscriber which acknowledged events gets the ones after them again after reconnecting.
+func TestRemoteAck(t *testing.T) {
+	srv, l, st := startServer(t, "", backend.NewMem())
+	defer srv.Close()
+
+	s, err := NewHttp(srv.URL, nil, func(err error) {
+		t.Log(err)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	b, err := s.GetBackend("m")
+	assert.Nil(t, err)
+
+	sub, g := &testSub{}, &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, b.JoinGroup("bs", "g", g))
+
+	addNumbers(t, st, 0, 10)
+	checkOffsets(t, "connected", sub, 0, 10)
+
+	assert.Nil(t, b.Ack("bs", sub, 4))
+	assert.Nil(t, b.Ack("bs", sub, 2))
+	assert.NotNil(t, b.Ack("bs", sub, 10))
+	assert.NotNil(t, b.Ack("bs", &testSub{}, 4))
+	// members of groups commit instead
+	assert.NotNil(t, b.Ack("bs", g, 4))
+
+	stats, err := b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), stats.Acked)
+
+	// events after the acknowledged ones are delivered again
+	l.drop()
+	addNumbers(t, st, 10, 20)
+	waitEvents([]*testSub{sub}, 25)
+	offs, _ := sub.get()
+	assert.Equal(t, append(offsetRange(0, 10), offsetRange(5, 20)...), offs)
+
+	stats, err = b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), stats.Start)
+	assert.Equal(t, uint(5), stats.Acked)
+	assert.Equal(t, uint(20), stats.Offset)
+}
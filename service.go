@@ -5,6 +5,7 @@ import (
 	"github.com/Monnoroch/golfstream/backend"
 	"github.com/Monnoroch/golfstream/errors"
 	"github.com/Monnoroch/golfstream/stream"
+	"log"
 	"sync"
 )
 
@@ -15,58 +16,187 @@ type backendStreamT struct {
 	async   bool
 
 	lock sync.Mutex
-	subs []backend.Stream
+	subs []*subQueue
+
+	// queues of subscribers by subscriber, they don't wait for adding events which might be blocked by a full queue
+	qlock  sync.Mutex
+	queues map[backend.Stream]*subQueue
 
 	// protected by service lock
 	refcnt int
 }
 
-func (self *backendStreamT) addSub(s backend.Stream, hFrom int, hTo int) (uint, uint, error) {
+func (self *backendStreamT) addSub(s backend.Stream, hFrom int, hTo int, opts SubOptions, onDisconnect func()) (uint, uint, error) {
+	sink := s
+	if len(opts.Defs) != 0 {
+		fs, err := newFilterSub(s, opts.Defs)
+		if err != nil {
+			return 0, 0, err
+		}
+		sink = fs
+	}
+
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	self.subs = append(self.subs, s)
-	return self.bs.Interval(hFrom, hTo)
+	base, l, err := backend.Base(self.bs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset := base + l
+	if opts.Replay && (opts.From < base || opts.From > offset) {
+		return 0, 0, errors.New(fmt.Sprintf("backendStreamT.addSub: Expected offset to replay from to be between %v and %v, got %v", base, offset, opts.From))
+	}
+
+	f, t, err := self.bs.Interval(hFrom, hTo)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	q := newSubQueue(sink, opts, offset, self.readOffsets, onDisconnect)
+	self.subs = append(self.subs, q)
+
+	self.qlock.Lock()
+	self.queues[s] = q
+	self.qlock.Unlock()
+
+	return f, t, nil
+}
+
+func (self *backendStreamT) getQueue(s backend.Stream) *subQueue {
+	self.qlock.Lock()
+	defer self.qlock.Unlock()
+
+	return self.queues[s]
 }
 
 func (self *backendStreamT) rmSub(s backend.Stream) bool {
+	self.qlock.Lock()
+	q, ok := self.queues[s]
+	delete(self.queues, s)
+	self.qlock.Unlock()
+	if !ok {
+		return false
+	}
+
+	// stop it first to unblock adding events waiting for it
+	q.stop()
+
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
 	for i, v := range self.subs {
-		if v == s {
+		if v == q {
 			self.subs = append(self.subs[:i], self.subs[i+1:]...)
-			return true
+			break
 		}
 	}
-	return false
+	return true
 }
 
-func (self *backendStreamT) Add(evt stream.Event) error {
+func (self *backendStreamT) subStats(s backend.Stream) (SubStats, bool) {
+	q := self.getQueue(s)
+	if q == nil {
+		return SubStats{}, false
+	}
+	return q.getStats(), true
+}
+
+func (self *backendStreamT) ack(s backend.Stream, offset uint) (bool, error) {
+	q := self.getQueue(s)
+	if q == nil {
+		return false, nil
+	}
+	return true, q.ack(offset)
+}
+
+/*
+Read events by their offsets.
+
+Events might be deleted from the beginning of the backend stream between getting it's base and reading,
+then reading is retried with the new base.
+*/
+func (self *backendStreamT) readOffsets(from uint, to uint) (stream.Stream, error) {
+	for {
+		base, _, err := backend.Base(self.bs)
+		if err != nil {
+			return nil, err
+		}
+
+		if from < base {
+			return nil, errors.New(fmt.Sprintf("backendStreamT.readOffsets: Expected offset of an event that's not deleted, at least %v, got %v", base, from))
+		}
+
+		data, rerr := self.bs.Read(from-base, to-base)
+
+		nbase, _, err := backend.Base(self.bs)
+		if err != nil {
+			if rerr == nil {
+				stream.Drain(data)
+			}
+			return nil, err
+		}
+
+		if nbase == base {
+			return data, rerr
+		}
+
+		if rerr == nil {
+			stream.Drain(data)
+		}
+	}
+}
+
+// Store events and add them to all subscribers along with their offsets.
+func (self *backendStreamT) add(evts []stream.Event, store func() error) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
+	base, l, err := backend.Base(self.bs)
+	if err != nil {
+		return err
+	}
+
+	offset := base + l
+
 	if self.async {
-		errs := make([]error, len(self.subs))
+		errs := make([]error, len(self.subs)+1)
 		wg := sync.WaitGroup{}
-		wg.Add(len(self.subs))
-		for i, s := range self.subs {
-			go func(n int, st backend.Stream) {
+		wg.Add(len(self.subs) + 1)
+		go func() {
+			defer wg.Done()
+			errs[0] = store()
+		}()
+		for i, q := range self.subs {
+			go func(n int, q *subQueue) {
 				defer wg.Done()
-				errs[n] = st.Add(evt)
-			}(i, s)
+				errs[n] = q.add(offset, evts)
+			}(i+1, q)
 		}
 		wg.Wait()
 		return errors.List().AddAll(errs).Err()
 	} else {
-		errs := errors.List()
-		for _, v := range self.subs {
-			errs.Add(v.Add(evt))
+		errs := errors.List().Add(store())
+		for _, q := range self.subs {
+			errs.Add(q.add(offset, evts))
 		}
 		return errs.Err()
 	}
 }
 
+func (self *backendStreamT) Add(evt stream.Event) error {
+	return self.add([]stream.Event{evt}, func() error {
+		return self.bs.Add(evt)
+	})
+}
+
+func (self *backendStreamT) AddBatch(evts []stream.Event) error {
+	return self.add(evts, func() error {
+		return backend.AddBatch(self.bs, evts)
+	})
+}
+
 func (self *backendStreamT) Read(from uint, to uint) (stream.Stream, error) {
 	return self.bs.Read(from, to)
 }
@@ -84,80 +214,59 @@ func (self *backendStreamT) Len() (uint, error) {
 }
 
 func (self *backendStreamT) Close() error {
-	return self.bs.Close()
-}
-
-type valueStream struct {
-	evt          stream.Event
-	iterDone     bool
-	markerIssued bool
-	finished     bool
-}
+	self.qlock.Lock()
+	for _, q := range self.queues {
+		q.stop()
+	}
+	self.qlock.Unlock()
 
-func (self *valueStream) set(evt stream.Event) {
-	self.evt = evt
-	self.iterDone = false
-	self.markerIssued = false
+	return self.bs.Close()
 }
 
-var marker = errors.New("valueStream marker")
-
-func (self *valueStream) Next() (stream.Event, error) {
-	if self.finished {
-		return nil, stream.EOI
-	}
+type streamT struct {
+	bs     *backendStreamT
+	inputs map[string]string
+	defs   []string
 
-	if self.iterDone {
-		self.markerIssued = true
-		return nil, marker
-	}
+	lock sync.Mutex
+	p    *stream.Pusher
 
-	self.iterDone = true
-	return self.evt, nil
+	// subscribers of input backend streams, protected by service lock
+	ins []*inputSub
 }
 
-type streamT struct {
-	bs   *backendStreamT
-	defs []string
+// Push an event to the named input through the stream function code.
+func (self *streamT) run(input string, evt stream.Event, res []stream.Event) ([]stream.Event, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-	val  *valueStream
-	data stream.Stream
+	return self.p.Push(input, evt, res)
 }
 
-/*
-This one is a bit tricky.
-So the general idea is that we set a new value in the valueStream object
-which then gets pulled by a function code in stream.Run()
-which then gets pulled by self.data.Next() here.
-The problem is that the function code does't return one event for each input: it can be 1:N or K:1.
-So, the first problem is that we might need to call self.data.Next() multimple times, and
-a second is that valueStream.Next() can be called several times for each self.data.Next().
-So, what we do is make the value stream return the set event once, and the second time it's called we return a marker error,
-and also set a flag, that this marker was issued. Then we call self.data.Next() in a loop until the marker was issued.
-We can not directly check if the error is the marker because function code can change the error by, for example,
-wrapping it in a errors list, so we need a flag.
-So we loop until the  marker was issued and we pull 0 or more events and add them all to self.bs,
-colecting the errors while doing it.
-*/
 func (self *streamT) Add(evt stream.Event) error {
-	self.val.set(evt)
+	res, err := self.run("input", evt, nil)
+
+	errs := errors.List().Add(err)
+	for _, v := range res {
+		errs.Add(self.bs.Add(v))
+	}
+	return errs.Err()
+}
 
+// Push events through the stream function code and add all the results to the backend stream at once.
+func (self *streamT) AddBatch(evts []stream.Event) error {
 	errs := errors.List()
-	for {
-		res, err := self.data.Next()
-		if err != nil {
-			if self.val.markerIssued {
-				if err != marker { // marker was transformed
-					// TODO: log error? Not sure if we need it.
-				}
-				return errs.Err()
-			}
-			return errs.Add(err).Err()
-		}
-		if err := self.bs.Add(res); err != nil {
-			errs.Add(err)
-		}
+	res := []stream.Event{}
+	for _, evt := range evts {
+		var err error
+		res, err = self.run("input", evt, res)
+		errs.Add(err)
+	}
+
+	if len(res) != 0 {
+		errs.Add(self.bs.AddBatch(res))
 	}
+	return errs.Err()
 }
 
 func (self *streamT) Read(from uint, to uint) (stream.Stream, error) {
@@ -177,18 +286,49 @@ func (self *streamT) Len() (uint, error) {
 }
 
 func (self *streamT) Close() error {
-	self.val.finished = true
+	return nil
+}
+
+// A subscriber of an input backend stream of a stream which pushes events to the input with it's name.
+type inputSub struct {
+	s     *streamT
+	bs    *backendStreamT
+	input string
+}
+
+func (self *inputSub) Add(evt stream.Event) error {
+	res, err := self.s.run(self.input, evt, nil)
+
+	errs := errors.List().Add(err)
+	if len(res) != 0 {
+		errs.Add(self.s.bs.AddBatch(res))
+	}
+	return errs.Err()
+}
+
+func (self *inputSub) Close() error {
 	return nil
 }
 
 type serviceBackend struct {
-	back  backend.Backend
-	name  string
-	async bool
+	back    backend.Backend
+	name    string
+	async   bool
+	catalog Catalog
 
 	lock     sync.Mutex
 	bstreams map[string]*backendStreamT
 	streams  map[string]*streamT
+
+	glock  sync.Mutex
+	groups map[groupKey]*groupT
+
+	// committed offsets of groups, including the ones without members, and the ones saved to the backend
+	clock   sync.Mutex
+	commits map[groupKey]uint
+	saved   map[groupKey]uint
+	// backend writes of committed offsets, one at a time
+	cwlock sync.Mutex
 }
 
 func (self *serviceBackend) Backend() backend.Backend {
@@ -210,14 +350,20 @@ func (self *serviceBackend) Streams() ([]string, []string, [][]string, error) {
 	return ss, bs, ds, nil
 }
 
-func (self *serviceBackend) AddStream(bstream, name string, defs []string) (res backend.BackendStream, rerr error) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
+func (self *serviceBackend) AddStream(bstream, name string, defs []string) (backend.BackendStream, error) {
+	return self.AddStreamInputs(bstream, name, nil, defs)
+}
 
-	if _, ok := self.streams[name]; ok {
-		return nil, errors.New(fmt.Sprintf("serviceBackend.AddStream: backend with name \"%s\" already has stream \"%s\"", self.name, name))
+func (self *serviceBackend) AddStreamInputs(bstream, name string, inputs map[string]string, defs []string) (backend.BackendStream, error) {
+	s, err := self.addStream(bstream, name, inputs, defs, true)
+	if err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
+// Get a backend stream and hold a reference to it, must be called under lock.
+func (self *serviceBackend) acquire(bstream string) (*backendStreamT, error) {
 	bs, ok := self.bstreams[bstream]
 	if !ok {
 		bstr, err := self.back.GetStream(bstream)
@@ -225,51 +371,121 @@ func (self *serviceBackend) AddStream(bstream, name string, defs []string) (res
 			return nil, err
 		}
 
-		bs = &backendStreamT{bstr, self.name, bstream, self.async, sync.Mutex{}, []backend.Stream{bstr}, 0}
+		bs = &backendStreamT{bstr, self.name, bstream, self.async, sync.Mutex{}, []*subQueue{}, sync.Mutex{}, map[backend.Stream]*subQueue{}, 0}
 		self.bstreams[bstream] = bs
 	}
 
-	st := &valueStream{nil, false, false, false}
-	data, err := stream.Run(st, defs)
+	bs.refcnt += 1
+	return bs, nil
+}
+
+// Release a reference to a backend stream and close it if it was the last one, must be called under lock.
+func (self *serviceBackend) release(bs *backendStreamT) error {
+	bs.refcnt -= 1
+	if bs.refcnt != 0 {
+		return nil
+	}
+
+	delete(self.bstreams, bs.bstream)
+	return bs.Close()
+}
+
+// Subscribe a stream to it's input backend streams, must be called under lock.
+func (self *serviceBackend) addInputs(s *streamT) error {
+	for input, bstream := range s.inputs {
+		bs, err := self.acquire(bstream)
+		if err != nil {
+			return errors.List().Add(err).Add(self.rmInputs(s)).Err()
+		}
+
+		// a queue makes adding events to the output backend stream happen outside of the input one's lock
+		sub := &inputSub{s, bs, input}
+		if _, _, err := bs.addSub(sub, 0, 0, SubOptions{DefaultSubOptions.Queue, OverflowBlock, false, 0, nil}, func() {}); err != nil {
+			return errors.List().Add(err).Add(self.release(bs)).Add(self.rmInputs(s)).Err()
+		}
+		s.ins = append(s.ins, sub)
+	}
+	return nil
+}
+
+// Unsubscribe a stream from it's input backend streams, must be called under lock.
+func (self *serviceBackend) rmInputs(s *streamT) error {
+	errs := errors.List()
+	for _, v := range s.ins {
+		v.bs.rmSub(v)
+		errs.Add(self.release(v.bs))
+	}
+	s.ins = nil
+	return errs.Err()
+}
+
+func (self *serviceBackend) addStream(bstream, name string, inputs map[string]string, defs []string, save bool) (*streamT, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.streams[name]; ok {
+		return nil, errors.New(fmt.Sprintf("serviceBackend.AddStream: backend with name \"%s\" already has stream \"%s\"", self.name, name))
+	}
+
+	names := []string{"input"}
+	for k, v := range inputs {
+		if v == bstream {
+			return nil, errors.New(fmt.Sprintf("serviceBackend.AddStream: Expected input \"%s\" to be a backend stream other than \"%s\" the stream writes to", k, bstream))
+		}
+		if k != "input" {
+			names = append(names, k)
+		}
+	}
+
+	p, err := stream.NewPusher(names, defs)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := self.acquire(bstream)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &streamT{bs, defs, st, data}
+	s := &streamT{bs, inputs, defs, sync.Mutex{}, p, nil}
+	if err := self.addInputs(s); err != nil {
+		return nil, errors.List().Add(err).Add(self.release(bs)).Err()
+	}
+
+	if save {
+		if err := self.catalog.AddStream(self.name, bstream, name, inputs, defs); err != nil {
+			return nil, errors.List().Add(err).Add(self.rmInputs(s)).Add(self.release(bs)).Err()
+		}
+	}
+
 	self.streams[name] = s
-	bs.refcnt += 1
 	return s, nil
 }
 
-func (self *serviceBackend) rmStream(name string) (*streamT, *backendStreamT, error) {
+func (self *serviceBackend) rmStream(name string) (*streamT, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
 	s, ok := self.streams[name]
 	if !ok {
-		return nil, nil, errors.New(fmt.Sprintf("serviceBackend.RmStream: backend with name \"%s\" does not have stream \"%s\"", self.name, name))
+		return nil, errors.New(fmt.Sprintf("serviceBackend.RmStream: backend with name \"%s\" does not have stream \"%s\"", self.name, name))
 	}
 
-	delete(self.streams, name)
-	s.bs.refcnt -= 1
-	if s.bs.refcnt == 0 {
-		delete(self.bstreams, s.bs.bstream)
-		return s, s.bs, nil
+	if err := self.catalog.RmStream(self.name, name); err != nil {
+		return nil, err
 	}
-	return s, nil, nil
+
+	delete(self.streams, name)
+	return s, errors.List().Add(self.rmInputs(s)).Add(self.release(s.bs)).Err()
 }
 
 func (self *serviceBackend) RmStream(name string) error {
-	s, bs, err := self.rmStream(name)
-	if err != nil {
+	s, err := self.rmStream(name)
+	if s == nil {
 		return err
 	}
 
-	errs := errors.List().Add(s.Close())
-	if bs != nil {
-		errs.Add(bs.Close())
-	}
-	return errs.Err()
+	return errors.List().Add(err).Add(s.Close()).Err()
 }
 
 func (self *serviceBackend) GetStream(name string) (backend.BackendStream, string, error) {
@@ -288,53 +504,100 @@ func (self *serviceBackend) addSub(bstream string) (*backendStreamT, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	bs, ok := self.bstreams[bstream]
-	if !ok {
-		bstr, err := self.back.GetStream(bstream)
-		if err != nil {
-			return nil, err
-		}
-
-		bs = &backendStreamT{bstr, self.name, bstream, self.async, sync.Mutex{}, []backend.Stream{bstr}, 0}
-		self.bstreams[bstream] = bs
-	}
-
-	bs.refcnt += 1
-	return bs, nil
+	return self.acquire(bstream)
 }
 
 func (self *serviceBackend) AddSub(bstream string, s backend.Stream, hFrom int, hTo int) (uint, uint, error) {
+	return self.AddSubOptions(bstream, s, hFrom, hTo, SubOptions{})
+}
+
+func (self *serviceBackend) AddSubOptions(bstream string, s backend.Stream, hFrom int, hTo int, opts SubOptions) (uint, uint, error) {
+	if err := opts.validate(); err != nil {
+		return 0, 0, err
+	}
+
 	bs, err := self.addSub(bstream)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	return bs.addSub(s, hFrom, hTo)
+	f, t, err := bs.addSub(s, hFrom, hTo, opts, func() {
+		if _, err := self.RmSub(bstream, s); err != nil {
+			log.Println(fmt.Sprintf("serviceBackend.AddSub: failed to remove disconnected subscriber: %s", err.Error()))
+		}
+	})
+	if err != nil {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		return 0, 0, errors.List().Add(err).Add(self.release(bs)).Err()
+	}
+	return f, t, nil
 }
 
-func (self *serviceBackend) rmSub(bstream string) (*backendStreamT, error) {
+func (self *serviceBackend) RmSub(bstream string, s backend.Stream) (bool, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
 	bs, ok := self.bstreams[bstream]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("serviceBackend.RmSub: backend with name \"%s\" does not have backend stream \"%s\"", self.name, bstream))
+		return false, errors.New(fmt.Sprintf("serviceBackend.RmSub: backend with name \"%s\" does not have backend stream \"%s\"", self.name, bstream))
 	}
 
-	bs.refcnt -= 1
-	if bs.refcnt == 0 {
-		delete(self.bstreams, bstream)
+	// a disconnected subscriber is removed by itself
+	if !bs.rmSub(s) {
+		return false, nil
 	}
-	return bs, nil
+
+	return true, self.release(bs)
 }
 
-func (self *serviceBackend) RmSub(bstream string, s backend.Stream) (bool, error) {
-	bs, err := self.rmSub(bstream)
+func (self *serviceBackend) SubStats(bstream string, s backend.Stream) (SubStats, error) {
+	self.lock.Lock()
+	bs, ok := self.bstreams[bstream]
+	self.lock.Unlock()
+	if !ok {
+		return SubStats{}, errors.New(fmt.Sprintf("serviceBackend.SubStats: backend with name \"%s\" does not have backend stream \"%s\"", self.name, bstream))
+	}
+
+	res, ok := bs.subStats(s)
+	if !ok {
+		return SubStats{}, errors.New(fmt.Sprintf("serviceBackend.SubStats: backend stream \"%s\" does not have the subscriber", bstream))
+	}
+	return res, nil
+}
+
+func (self *serviceBackend) Ack(bstream string, s backend.Stream, offset uint) error {
+	self.lock.Lock()
+	bs, ok := self.bstreams[bstream]
+	self.lock.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("serviceBackend.Ack: backend with name \"%s\" does not have backend stream \"%s\"", self.name, bstream))
+	}
+
+	ok, err := bs.ack(s, offset)
+	if !ok {
+		return errors.New(fmt.Sprintf("serviceBackend.Ack: backend stream \"%s\" does not have the subscriber", bstream))
+	}
+	return err
+}
+
+func (self *serviceBackend) SetRetention(bstream string, r backend.Retention) error {
+	rb, ok := self.back.(backend.RetentionBackend)
+	if !ok {
+		return errors.New(fmt.Sprintf("serviceBackend.SetRetention: backend with name \"%s\" doesn't support retention", self.name))
+	}
+
+	if err := rb.SetRetention(bstream, r); err != nil {
+		return err
+	}
+
+	cfg, err := self.back.Config()
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	return bs.rmSub(s), nil
+	return self.catalog.UpdateBackend(self.name, cfg)
 }
 
 func (self *serviceBackend) close() error {
@@ -348,6 +611,10 @@ func (self *serviceBackend) close() error {
 	for _, v := range self.bstreams {
 		errs.Add(v.Close())
 	}
+
+	self.glock.Lock()
+	self.groups = map[groupKey]*groupT{}
+	self.glock.Unlock()
 	return errs.Err()
 }
 
@@ -355,6 +622,7 @@ type service struct {
 	lock     sync.Mutex
 	backends map[string]*serviceBackend
 	async    bool
+	catalog  Catalog
 }
 
 func (self *service) Backends() ([]string, error) {
@@ -369,6 +637,14 @@ func (self *service) Backends() ([]string, error) {
 }
 
 func (self *service) AddBackend(back string, b backend.Backend) (Backend, error) {
+	res, err := self.addBackend(back, b, true)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (self *service) addBackend(back string, b backend.Backend, save bool) (*serviceBackend, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
@@ -376,7 +652,18 @@ func (self *service) AddBackend(back string, b backend.Backend) (Backend, error)
 		return nil, errors.New(fmt.Sprintf("service.AddBackend: backend with name \"%s\" already exists", back))
 	}
 
-	res := &serviceBackend{b, back, self.async, sync.Mutex{}, map[string]*backendStreamT{}, map[string]*streamT{}}
+	if save {
+		cfg, err := b.Config()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := self.catalog.AddBackend(back, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &serviceBackend{b, back, self.async, self.catalog, sync.Mutex{}, map[string]*backendStreamT{}, map[string]*streamT{}, sync.Mutex{}, map[groupKey]*groupT{}, sync.Mutex{}, map[groupKey]uint{}, map[groupKey]uint{}, sync.Mutex{}}
 	self.backends[back] = res
 	return res, nil
 }
@@ -390,6 +677,10 @@ func (self *service) rmBackend(back string) (*serviceBackend, error) {
 		return nil, errors.New(fmt.Sprintf("service.RmBackend: backend with name \"%s\" does not exist", back))
 	}
 
+	if err := self.catalog.RmBackend(back); err != nil {
+		return nil, err
+	}
+
 	delete(self.backends, back)
 	return v, nil
 }
@@ -424,10 +715,57 @@ func (self *service) Close() error {
 		errs.Add(v.close())
 	}
 	self.backends = nil
+	errs.Add(self.catalog.Close())
 	return errs.Err()
 }
 
+func (self *service) restore() error {
+	bs, err := self.catalog.Backends()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bs {
+		back, err := backend.CreateConfig(b.Config)
+		if err != nil {
+			return err
+		}
+
+		sb, err := self.addBackend(b.Name, back, false)
+		if err != nil {
+			return errors.List().Add(err).Add(back.Close()).Err()
+		}
+
+		for _, s := range b.Streams {
+			if _, err := sb.addStream(s.Bstream, s.Name, s.Inputs, s.Defs, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Create the golfstream service.
 func New() Service {
-	return &service{sync.Mutex{}, map[string]*serviceBackend{}, true}
+	return &service{sync.Mutex{}, map[string]*serviceBackend{}, true, NilCatalog()}
+}
+
+/*
+Create the golfstream service that saves added backends and streams to a catalog
+and restore the backends and streams previously saved there.
+
+Backends are recreated from their saved configs with backend.CreateConfig, so their types must be registered before the call.
+Closing the service closes the catalog.
+If restoring fails, all restored backends are closed, but the catalog is not.
+*/
+func NewWithCatalog(c Catalog) (Service, error) {
+	res := &service{sync.Mutex{}, map[string]*serviceBackend{}, true, c}
+	if err := res.restore(); err != nil {
+		errs := errors.List().Add(err)
+		for _, v := range res.backends {
+			errs.Add(v.close()).Add(v.back.Close())
+		}
+		return nil, errs.Err()
+	}
+	return res, nil
 }
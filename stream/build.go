@@ -1,8 +1,8 @@
 package stream
 
 import (
-	"errors"
 	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
 )
 
 // Build a stream from JSON definition.
@@ -11,7 +11,20 @@ func Run(stream Stream, defs []string) (Stream, error) {
 		return stream, nil
 	}
 
-	ctx := Context{"input": &StreamContext{stream, Multiplexer(stream)}}
+	return RunNamed(map[string]Stream{"input": stream}, defs)
+}
+
+/*
+Build a stream from JSON definition with multiple named input streams.
+
+Each input can be loaded in the definition by it's name, so Run(s, defs) is the same as RunNamed(map[string]Stream{"input": s}, defs).
+*/
+func RunNamed(inputs map[string]Stream, defs []string) (Stream, error) {
+	ctx := Context{streams: map[string]*StreamContext{}}
+	for k, v := range inputs {
+		ctx.streams[k] = &StreamContext{stream: v, mp: Multiplexer(v)}
+	}
+
 	var res Stream = nil
 	for _, d := range defs {
 		funcDef, err := ParseJson([]byte(d))
@@ -29,7 +42,85 @@ func Run(stream Stream, defs []string) (Stream, error) {
 	return res, nil
 }
 
+/*
+Check stream JSON definitions without running them.
+
+Unlike Run, it doesn't stop at the first problem and reports all of them: parse errors, unknown functions,
+numbers and kinds of arguments that don't match functions' descriptions, wrong arguments and loads of undefined names.
+The returned error is nil or *errors.ErrorList for multiple problems.
+*/
+func Validate(defs []string) error {
+	return ValidateNamed([]string{"input"}, defs)
+}
+
+// Check stream JSON definitions with multiple named inputs without running them, see Validate.
+func ValidateNamed(inputs []string, defs []string) error {
+	ctx := Context{streams: map[string]*StreamContext{}}
+	for _, k := range inputs {
+		s := Empty()
+		ctx.streams[k] = &StreamContext{stream: s, mp: Multiplexer(s)}
+	}
+
+	errs := errors.List()
+	for i, d := range defs {
+		funcDef, err := ParseJson([]byte(d))
+		if err != nil {
+			errs.Add(errors.New(fmt.Sprintf("defs[%v]: %s", i, err.Error())))
+			continue
+		}
+
+		// build records it's errors in the context and never fails
+		ctx.errs = errors.List()
+		build(ctx, funcDef)
+		for _, e := range ctx.errs.Errors() {
+			errs.Add(errors.New(fmt.Sprintf("defs[%v]: %s", i, e.Error())))
+		}
+	}
+	return errs.Err()
+}
+
+/*
+Run stream JSON definitions on a list of events and collect the results.
+
+Returns all the resulting events produced before an error, if there was one.
+*/
+func DryRun(defs []string, events []Event) ([]Event, error) {
+	s, err := Run(List(events), defs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Event{}
+	for {
+		evt, err := s.Next()
+		if err == EOI {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+
+		res = append(res, evt)
+	}
+	return res, nil
+}
+
 func build(ctx Context, def FArg) (Stream, error) {
+	res, err := buildFn(ctx, def)
+	if err == nil {
+		return res, nil
+	}
+
+	if ctx.errs == nil {
+		return nil, err
+	}
+
+	// continue validation with a placeholder stream
+	ctx.errs.Add(err)
+	return Empty(), nil
+}
+
+func buildFn(ctx Context, def FArg) (Stream, error) {
 	smap, ok := def.(map[string]interface{})
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("build: Expected map[string]interface{}, got %v", def))
@@ -59,5 +150,157 @@ func build(ctx Context, def FArg) (Stream, error) {
 		return nil, errors.New(fmt.Sprintf("build: No such function %s", name))
 	}
 
-	return fn(ctx, args)
+	// when validating, check arguments against the function's description first
+	if ctx.errs != nil {
+		if err := fn.info.check(args); err != nil {
+			return nil, err
+		}
+	}
+
+	return fn.fn(ctx, args)
+}
+
+var pushMarker = errors.New("pushInput marker")
+
+// Check if an error is the marker of a pushInput without an event, maybe in an error list with other markers.
+func isPushMarker(err error) bool {
+	if err == pushMarker {
+		return true
+	}
+
+	list, ok := err.(*errors.ErrorList)
+	if !ok {
+		return false
+	}
+	for _, e := range list.Errors() {
+		if e != pushMarker {
+			return false
+		}
+	}
+	return true
+}
+
+// An input stream of a Pusher which yields a pushed event once and then a marker error.
+type pushInput struct {
+	evt          Event
+	pending      bool
+	markerIssued bool
+	finished     bool
+}
+
+func (self *pushInput) Next() (Event, error) {
+	if self.finished {
+		return nil, EOI
+	}
+
+	if !self.pending {
+		self.markerIssued = true
+		return nil, pushMarker
+	}
+
+	self.pending = false
+	return self.evt, nil
+}
+
+/*
+Pusher runs a stream on events pushed to it's named inputs one by one instead of pulling them from input streams.
+
+This one is a bit tricky.
+So the general idea is that we set a new value in an input stream
+which then gets pulled by a function code
+which then gets pulled by data.Next() here.
+The problem is that the function code does't return one event for each input: it can be 1:N or K:1.
+So, the first problem is that we might need to call data.Next() multimple times, and
+a second is that input streams can be pulled several times for each data.Next().
+So, what we do is make the input stream return the set event once, and the second time it's called we return a marker error,
+and also set a flag, that this marker was issued. Then we call data.Next() in a loop until a marker was issued.
+Other inputs don't have events at this point, so they issue markers right away when pulled.
+We can not directly check if the error is the marker because function code can change the error by, for example,
+wrapping it in a errors list, so we need a flag.
+So we loop until a marker was issued and we pull 0 or more events and append them all to res.
+
+Calling methods of a Pusher from multiple goroutines at once is unsafe.
+*/
+type Pusher struct {
+	inputs map[string]*pushInput
+	data   Stream
+}
+
+// Create a Pusher for a stream built from JSON definitions with named inputs, see RunNamed.
+func NewPusher(inputs []string, defs []string) (*Pusher, error) {
+	ins := map[string]*pushInput{}
+	streams := map[string]Stream{}
+	for _, k := range inputs {
+		in := &pushInput{nil, false, false, false}
+		ins[k] = in
+		streams[k] = in
+	}
+
+	data, err := RunNamed(streams, defs)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		if len(inputs) != 1 {
+			return nil, errors.New(fmt.Sprintf("NewPusher: Expected definitions for %v inputs, got none", len(inputs)))
+		}
+		data = ins[inputs[0]]
+	}
+	return &Pusher{ins, data}, nil
+}
+
+// Create a Pusher for a stream built by fn from an input named "input".
+func PushFunc(fn func(Stream) (Stream, error)) (*Pusher, error) {
+	in := &pushInput{nil, false, false, false}
+	data, err := fn(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pusher{map[string]*pushInput{"input": in}, data}, nil
+}
+
+func (self *Pusher) pull(res []Event) ([]Event, error) {
+	for {
+		v, err := self.data.Next()
+		if err != nil {
+			for _, in := range self.inputs {
+				if in.markerIssued {
+					return res, nil
+				}
+			}
+			return res, err
+		}
+		res = append(res, v)
+	}
+}
+
+// Push an event to the named input and append all events the stream produces from it to res.
+func (self *Pusher) Push(input string, evt Event, res []Event) ([]Event, error) {
+	in, ok := self.inputs[input]
+	if !ok {
+		return res, errors.New(fmt.Sprintf("Pusher.Push: No input with name \"%s\"", input))
+	}
+
+	for _, v := range self.inputs {
+		v.markerIssued = false
+	}
+	in.evt = evt
+	in.pending = true
+	return self.pull(res)
+}
+
+// End all inputs and append the rest of events the stream produces to res.
+func (self *Pusher) Finish(res []Event) ([]Event, error) {
+	for _, v := range self.inputs {
+		v.finished = true
+		v.markerIssued = false
+	}
+
+	res, err := self.pull(res)
+	if err == EOI {
+		return res, nil
+	}
+	return res, err
 }
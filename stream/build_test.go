@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Monnoroch/golfstream/errors"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Check that errors are reported for the definitions with given indices, in order, and contain the given texts.
+func checkErrors(t *testing.T, err error, prefixes []string, texts []string) {
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	errs := errors.AsList(err).Errors()
+	if !assert.Equal(t, len(prefixes), len(errs), err.Error()) {
+		return
+	}
+
+	for i, e := range errs {
+		assert.True(t, strings.HasPrefix(e.Error(), prefixes[i]), e.Error())
+		assert.True(t, strings.Contains(e.Error(), texts[i]), e.Error())
+	}
+}
+
+// Test that validation reports all problems of all definitions at once instead of stopping at the first one.
+func TestValidate(t *testing.T) {
+	RegisterDefault()
+
+	assert.Nil(t, Validate([]string{
+		`{"save": ["x", {"get_field": [{"load": "input"}, "a"]}]}`,
+		`{"+": [{"load": "x"}, 1]}`,
+	}))
+
+	checkErrors(t, Validate([]string{
+		`{"load": "nothing"}`,
+		`{"get_field": [{"load": "input"}]}`,
+		`{"no_such_function": [{"load": "input"}]}`,
+		`{"load": `,
+		`{"zip": [{"load": "input"}, {"load": "missing"}, {"get_field": [{"load": "input"}, "a", "b"]}]}`,
+	}), []string{"defs[0]: ", "defs[1]: ", "defs[2]: ", "defs[3]: ", "defs[4]: ", "defs[4]: "}, []string{
+		"There is no Stream with name nothing",
+		"get_field: Expected 2 args, got 1",
+		"No such function no_such_function",
+		"",
+		"There is no Stream with name missing",
+		"get_field: Expected 2 args, got 3",
+	})
+}
+
+// Test that named inputs can be loaded, but not the default one unless it's listed.
+func TestValidateNamed(t *testing.T) {
+	RegisterDefault()
+
+	assert.Nil(t, ValidateNamed([]string{"left", "right"}, []string{`{"zip": [{"load": "left"}, {"load": "right"}]}`}))
+	checkErrors(t, ValidateNamed([]string{"left", "right"}, []string{`{"zip": [{"load": "left"}, {"load": "input"}]}`}),
+		[]string{"defs[0]: "}, []string{"There is no Stream with name input"})
+}
+
+// Test that no name is reserved for validation: any name can be loaded and saved as usual.
+func TestValidateAnyName(t *testing.T) {
+	RegisterDefault()
+
+	checkErrors(t, Validate([]string{`{"load": "\u0000validate"}`}),
+		[]string{"defs[0]: "}, []string{"There is no Stream with name \x00validate"})
+	assert.Nil(t, Validate([]string{
+		`{"save": ["\u0000validate", {"load": "input"}]}`,
+		`{"load": "\u0000validate"}`,
+	}))
+	assert.Nil(t, ValidateNamed([]string{"\x00validate"}, []string{`{"load": "\u0000validate"}`}))
+
+	res, err := DryRun([]string{
+		`{"save": ["\u0000validate", {"load": "input"}]}`,
+		`{"load": "\u0000validate"}`,
+	}, []Event{int64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{int64(1)}, res)
+}
+
+// Test that a dry run returns the transformed events and the ones produced before an error.
+func TestDryRun(t *testing.T) {
+	RegisterDefault()
+
+	defs := []string{`{"+": [{"get_field": [{"load": "input"}, "a"]}, 1]}`}
+	res, err := DryRun(defs, []Event{
+		map[string]interface{}{"a": int64(1)},
+		map[string]interface{}{"a": 2.5, "b": "c"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{int64(2), 3.5}, res)
+
+	res, err = DryRun(defs, []Event{
+		map[string]interface{}{"a": int64(1)},
+		map[string]interface{}{"b": int64(2)},
+		map[string]interface{}{"a": int64(3)},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []Event{int64(2)}, res)
+
+	_, err = DryRun([]string{`{"load": "nothing"}`}, []Event{})
+	assert.NotNil(t, err)
+}
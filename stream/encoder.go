@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"sort"
 	"sync"
 )
 
@@ -36,6 +37,19 @@ func getEncoder(name string) (Encoder, bool) {
 	return r, ok
 }
 
+// Get names of all registered encoders sorted.
+func Encoders() []string {
+	elock.Lock()
+	defer elock.Unlock()
+
+	res := make([]string, 0, len(encoders))
+	for k := range encoders {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
 var decoders map[string]Decoder
 var dlock sync.Mutex
 
@@ -57,3 +71,16 @@ func getDecoder(name string) (Decoder, bool) {
 	r, ok := decoders[name]
 	return r, ok
 }
+
+// Get names of all registered decoders sorted.
+func Decoders() []string {
+	dlock.Lock()
+	defer dlock.Unlock()
+
+	res := make([]string, 0, len(decoders))
+	for k := range decoders {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,682 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type exprNode interface {
+	eval(evt Event) (Event, error)
+}
+
+type exprLiteral struct {
+	val Event
+}
+
+func (self exprLiteral) eval(evt Event) (Event, error) {
+	return self.val, nil
+}
+
+type exprField struct {
+	field string
+}
+
+func (self exprField) eval(evt Event) (Event, error) {
+	res, ok := getFieldImpl(evt, self.field)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expr: Expected event to have field %s, got %v", self.field, evt))
+	}
+	return res, nil
+}
+
+type exprUnary struct {
+	op  string
+	arg exprNode
+}
+
+func (self exprUnary) eval(evt Event) (Event, error) {
+	v, err := self.arg.eval(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	switch self.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("expr: Expected bool operand of !, got %v", v))
+		}
+		return !b, nil
+	default: // "-"
+		// -math.MinInt64 doesn't fit into int64
+		if i, ok := v.(int64); ok && i != math.MinInt64 {
+			return -i, nil
+		}
+		f, ok := getIntOrFloat(v)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("expr: Expected number operand of -, got %v", v))
+		}
+		return -f, nil
+	}
+}
+
+type exprLogical struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (self exprLogical) eval(evt Event) (Event, error) {
+	l, err := self.left.eval(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	lb, ok := l.(bool)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expr: Expected bool operand of %s, got %v", self.op, l))
+	}
+
+	if (self.op == "&&" && !lb) || (self.op == "||" && lb) {
+		return lb, nil
+	}
+
+	r, err := self.right.eval(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	rb, ok := r.(bool)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expr: Expected bool operand of %s, got %v", self.op, r))
+	}
+	return rb, nil
+}
+
+func exprEqual(a Event, b Event) bool {
+	af, aok := getIntOrFloat(a)
+	bf, bok := getIntOrFloat(b)
+	if aok && bok {
+		return af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func exprCompare(op string, a Event, b Event) (bool, error) {
+	var c int
+	af, aok := getIntOrFloat(a)
+	bf, bok := getIntOrFloat(b)
+	as, asok := a.(string)
+	bs, bsok := b.(string)
+	if aok && bok {
+		if af < bf {
+			c = -1
+		} else if af > bf {
+			c = 1
+		}
+	} else if asok && bsok {
+		c = strings.Compare(as, bs)
+	} else {
+		return false, errors.New(fmt.Sprintf("expr: Expected two numbers or two strings as operands of %s, got %v and %v", op, a, b))
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default: // ">="
+		return c >= 0, nil
+	}
+}
+
+type exprBinary struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (self exprBinary) eval(evt Event) (Event, error) {
+	l, err := self.left.eval(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := self.right.eval(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	switch self.op {
+	case "==":
+		return exprEqual(l, r), nil
+	case "!=":
+		return !exprEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		return exprCompare(self.op, l, r)
+	case "+":
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		if lok && rok {
+			return ls + rs, nil
+		}
+	}
+
+	res, err := arith(self.op, l, r)
+	if err != nil {
+		return nil, errors.New("expr: " + err.Error())
+	}
+	return res, nil
+}
+
+type exprFunc struct {
+	name  string
+	arity int // -1 for any
+	fn    func(args []Event) (Event, error)
+}
+
+func exprString(name string, v Event) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("expr: %s: Expected string argument, got %v", name, v))
+	}
+	return s, nil
+}
+
+func exprStringFn(name string, fn func(string) Event) exprFunc {
+	return exprFunc{name, 1, func(args []Event) (Event, error) {
+		s, err := exprString(name, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}}
+}
+
+func exprStringsFn(name string, fn func(string, string) Event) exprFunc {
+	return exprFunc{name, 2, func(args []Event) (Event, error) {
+		a, err := exprString(name, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := exprString(name, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return fn(a, b), nil
+	}}
+}
+
+var exprFuncs = map[string]exprFunc{
+	"lower": exprStringFn("lower", func(s string) Event { return strings.ToLower(s) }),
+	"upper": exprStringFn("upper", func(s string) Event { return strings.ToUpper(s) }),
+	"trim":  exprStringFn("trim", func(s string) Event { return strings.TrimSpace(s) }),
+	"len":   exprStringFn("len", func(s string) Event { return int64(len(s)) }),
+	"contains": exprStringsFn("contains", func(a string, b string) Event {
+		return strings.Contains(a, b)
+	}),
+	"starts_with": exprStringsFn("starts_with", func(a string, b string) Event {
+		return strings.HasPrefix(a, b)
+	}),
+	"ends_with": exprStringsFn("ends_with", func(a string, b string) Event {
+		return strings.HasSuffix(a, b)
+	}),
+	"substr": {"substr", 3, func(args []Event) (Event, error) {
+		s, err := exprString("substr", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		from, ok1 := args[1].(int64)
+		to, ok2 := args[2].(int64)
+		if !ok1 || !ok2 || from < 0 || from > to || to > int64(len(s)) {
+			return nil, errors.New(fmt.Sprintf("expr: substr: Expected valid integer bounds for %v, got %v and %v", s, args[1], args[2]))
+		}
+		return s[from:to], nil
+	}},
+	"concat": {"concat", -1, func(args []Event) (Event, error) {
+		res := ""
+		for _, v := range args {
+			s, err := exprString("concat", v)
+			if err != nil {
+				return nil, err
+			}
+			res += s
+		}
+		return res, nil
+	}},
+	"str": {"str", 1, func(args []Event) (Event, error) {
+		if s, ok := args[0].(string); ok {
+			return s, nil
+		}
+		return fmt.Sprintf("%v", args[0]), nil
+	}},
+	"num": {"num", 1, func(args []Event) (Event, error) {
+		if _, ok := getIntOrFloat(args[0]); ok {
+			return args[0], nil
+		}
+
+		s, err := exprString("num", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		return strconv.ParseFloat(s, 64)
+	}},
+}
+
+type exprCall struct {
+	fn   exprFunc
+	args []exprNode
+}
+
+func (self exprCall) eval(evt Event) (Event, error) {
+	args := make([]Event, len(self.args))
+	for i, a := range self.args {
+		v, err := a.eval(evt)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return self.fn.fn(args)
+}
+
+type exprHas struct {
+	field string
+}
+
+func (self exprHas) eval(evt Event) (Event, error) {
+	_, ok := getFieldImpl(evt, self.field)
+	return ok, nil
+}
+
+type exprToken struct {
+	kind string // "num", "str", "ident", "op", "end"
+	text string
+	val  Event
+	pos  int
+}
+
+func exprIsIdent(r rune, first bool) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func exprLex(src string) ([]exprToken, error) {
+	res := []exprToken{}
+	rs := []rune(src)
+	i := 0
+	for i < len(rs) {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			start := i
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || rs[i] == 'e' || rs[i] == 'E' ||
+				((rs[i] == '+' || rs[i] == '-') && (rs[i-1] == 'e' || rs[i-1] == 'E'))) {
+				i++
+			}
+			text := string(rs[start:i])
+			if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+				res = append(res, exprToken{"num", text, v, start})
+			} else if v, err := strconv.ParseFloat(text, 64); err == nil {
+				res = append(res, exprToken{"num", text, v, start})
+			} else {
+				return nil, errors.New(fmt.Sprintf("expr: Bad number %s at %v", text, start))
+			}
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			for i < len(rs) && rs[i] != r {
+				if rs[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(rs) {
+				return nil, errors.New(fmt.Sprintf("expr: Unterminated string at %v", start))
+			}
+			i++
+			text := string(rs[start:i])
+			if r == '\'' {
+				text = exprSingleQuoted(rs[start+1 : i-1])
+			}
+			v, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("expr: Bad string %s at %v", text, start))
+			}
+			res = append(res, exprToken{"str", text, v, start})
+		case exprIsIdent(r, true):
+			start := i
+			for i < len(rs) && (exprIsIdent(rs[i], false) || (rs[i] == '.' && i+1 < len(rs) && exprIsIdent(rs[i+1], false))) {
+				i++
+			}
+			res = append(res, exprToken{"ident", string(rs[start:i]), nil, start})
+		default:
+			found := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(string(rs[i:]), op) {
+					res = append(res, exprToken{"op", op, nil, i})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New(fmt.Sprintf("expr: Unexpected character %q at %v", r, i))
+			}
+		}
+	}
+	return append(res, exprToken{"end", "", nil, len(rs)}), nil
+}
+
+// Convert the contents of a single quoted string to a double quoted string.
+func exprSingleQuoted(rs []rune) string {
+	res := []rune{'"'}
+	for i := 0; i < len(rs); i++ {
+		switch {
+		case rs[i] == '\\' && i+1 < len(rs) && rs[i+1] == '\'':
+			res = append(res, '\'')
+			i++
+		case rs[i] == '\\' && i+1 < len(rs):
+			res = append(res, rs[i], rs[i+1])
+			i++
+		case rs[i] == '"':
+			res = append(res, '\\', '"')
+		default:
+			res = append(res, rs[i])
+		}
+	}
+	return string(append(res, '"'))
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (self *exprParser) peek() exprToken {
+	return self.tokens[self.pos]
+}
+
+func (self *exprParser) next() exprToken {
+	t := self.tokens[self.pos]
+	if t.kind != "end" {
+		self.pos++
+	}
+	return t
+}
+
+func (self *exprParser) isOp(ops ...string) (string, bool) {
+	t := self.peek()
+	if t.kind != "op" {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (self *exprParser) expect(op string) error {
+	if _, ok := self.isOp(op); !ok {
+		t := self.peek()
+		return errors.New(fmt.Sprintf("expr: Expected %s at %v, got %q", op, t.pos, t.text))
+	}
+	self.next()
+	return nil
+}
+
+func (self *exprParser) parseLogical(op string, sub func() (exprNode, error)) (exprNode, error) {
+	left, err := sub()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if _, ok := self.isOp(op); !ok {
+			return left, nil
+		}
+		self.next()
+
+		right, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		left = exprLogical{op, left, right}
+	}
+}
+
+func (self *exprParser) parseOr() (exprNode, error) {
+	return self.parseLogical("||", self.parseAnd)
+}
+
+func (self *exprParser) parseAnd() (exprNode, error) {
+	return self.parseLogical("&&", self.parseCmp)
+}
+
+func (self *exprParser) parseCmp() (exprNode, error) {
+	left, err := self.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := self.isOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	self.next()
+
+	right, err := self.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	return exprBinary{op, left, right}, nil
+}
+
+func (self *exprParser) parseBinary(ops []string, sub func() (exprNode, error)) (exprNode, error) {
+	left, err := sub()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := self.isOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		self.next()
+
+		right, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (self *exprParser) parseAdd() (exprNode, error) {
+	return self.parseBinary([]string{"+", "-"}, self.parseMul)
+}
+
+func (self *exprParser) parseMul() (exprNode, error) {
+	return self.parseBinary([]string{"*", "/", "%"}, self.parseUnary)
+}
+
+func (self *exprParser) parseUnary() (exprNode, error) {
+	if op, ok := self.isOp("!", "-"); ok {
+		self.next()
+		arg, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, arg}, nil
+	}
+	return self.parsePrimary()
+}
+
+func (self *exprParser) parseCall(name string, pos int) (exprNode, error) {
+	self.next() // "("
+
+	if name == "has" {
+		t := self.next()
+		if t.kind != "ident" {
+			return nil, errors.New(fmt.Sprintf("expr: has: Expected field path at %v, got %q", t.pos, t.text))
+		}
+		if err := self.expect(")"); err != nil {
+			return nil, err
+		}
+		return exprHas{exprFieldPath(t.text)}, nil
+	}
+
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expr: No such function %s at %v", name, pos))
+	}
+
+	args := []exprNode{}
+	if _, ok := self.isOp(")"); !ok {
+		for {
+			arg, err := self.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := self.isOp(","); !ok {
+				break
+			}
+			self.next()
+		}
+	}
+	if err := self.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if fn.arity >= 0 && fn.arity != len(args) {
+		return nil, errors.New(fmt.Sprintf("expr: %s: Expected %v args, got %v", name, fn.arity, len(args)))
+	}
+	return exprCall{fn, args}, nil
+}
+
+// "$" is the event itself, "$.a.b" and "a.b" are fields of it.
+func exprFieldPath(path string) string {
+	if path == "$" {
+		return ""
+	}
+	return strings.TrimPrefix(path, "$.")
+}
+
+func (self *exprParser) parsePrimary() (exprNode, error) {
+	t := self.next()
+	switch t.kind {
+	case "num", "str":
+		return exprLiteral{t.val}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return exprLiteral{true}, nil
+		case "false":
+			return exprLiteral{false}, nil
+		case "null":
+			return exprLiteral{nil}, nil
+		}
+
+		if _, ok := self.isOp("("); ok {
+			return self.parseCall(t.text, t.pos)
+		}
+		return exprField{exprFieldPath(t.text)}, nil
+	case "op":
+		if t.text == "(" {
+			res, err := self.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := self.expect(")"); err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+	}
+
+	if t.kind == "end" {
+		return nil, errors.New(fmt.Sprintf("expr: Unexpected end of expression at %v", t.pos))
+	}
+	return nil, errors.New(fmt.Sprintf("expr: Unexpected %q at %v", t.text, t.pos))
+}
+
+/*
+A compiled expression over an event.
+
+Expressions consist of:
+
+	literals: 1, -2.5, "str", 'str', true, false, null
+	field paths: a, a.b.c; $ is the event itself and $.a is the same as a
+	arithmetic: + - * / %; + also concatenates strings
+	comparison: == != < <= > >=; numbers are compared by value, strings lexicographically
+	boolean logic: && || !
+	functions: lower(s), upper(s), trim(s), len(s), contains(s, sub), starts_with(s, pref), ends_with(s, suf),
+		substr(s, from, to), concat(s...), str(v), num(v), has(field)
+	parentheses for grouping
+
+Arithmetic on two integers gives an integer, as in Go, and a float otherwise.
+Field paths are resolved the same way as in GetField, so a missing field is an error unless checked with has().
+*/
+type Expression struct {
+	src  string
+	root exprNode
+}
+
+// Compile an expression.
+func ParseExpr(src string) (*Expression, error) {
+	tokens, err := exprLex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens, 0}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != "end" {
+		return nil, errors.New(fmt.Sprintf("expr: Unexpected %q at %v", t.text, t.pos))
+	}
+	return &Expression{src, root}, nil
+}
+
+// Evaluate the expression on an event.
+func (self *Expression) Eval(evt Event) (Event, error) {
+	return self.root.eval(evt)
+}
+
+// Get the source of the expression.
+func (self *Expression) String() string {
+	return self.src
+}
+
+/*
+Creates a stream with events which are results of evaluating the expression on events of the original stream.
+
+Boolean expressions produce streams suitable for Filter.
+*/
+func EvalExpr(stream Stream, e *Expression) Stream {
+	return Map(stream, e.Eval)
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"testing"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+func testEvent() Event {
+	res, err := ParseJson([]byte(`{"a": {"b": 5, "f": 2.5}, "c": "x", "s": "Hello", "ok": true}`))
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// Test that expressions evaluate to expected values.
+func TestExprEval(t *testing.T) {
+	examples := []struct {
+		Src string
+		Res Event
+	}{
+		{`1 + 2 * 3`, int64(7)},
+		{`(1 + 2) * 3`, int64(9)},
+		{`7 / 2`, int64(3)},
+		{`7 / 2.0`, 3.5},
+		{`7 % 4`, int64(3)},
+		{`-a.b`, int64(-5)},
+		{`a.b * a.f`, 12.5},
+		{`a.b > 3 && c == "x"`, true},
+		{`a.b > 3 && c == 'y'`, false},
+		{`a.b < 3 || !ok`, false},
+		{`a.b == 5.0`, true},
+		{`a.b != 5`, false},
+		{`"ab" < "b"`, true},
+		{`s + ", " + c`, "Hello, x"},
+		{`lower(s)`, "hello"},
+		{`upper(c)`, "X"},
+		{`len(s)`, int64(5)},
+		{`contains(s, "ell")`, true},
+		{`starts_with(s, "He") && ends_with(s, "lo")`, true},
+		{`substr(s, 1, 3)`, "el"},
+		{`concat(c, c, c)`, "xxx"},
+		{`str(a.b)`, "5"},
+		{`num("12") + 1`, int64(13)},
+		{`has(a.b) && !has(a.z)`, true},
+		{`$.c`, "x"},
+		{`null == null`, true},
+		{`'it\'s' + "\n"`, "it's\n"},
+		{`1e3`, 1000.0},
+		{`-num("-9223372036854775808")`, 9223372036854775808.0},
+	}
+	for _, e := range examples {
+		ex, err := ParseExpr(e.Src)
+		if !assert.Nil(t, err, e.Src) {
+			continue
+		}
+
+		res, err := ex.Eval(testEvent())
+		assert.Nil(t, err, e.Src)
+		assert.Equal(t, e.Res, res, e.Src)
+	}
+}
+
+// Test that bad expressions fail to compile.
+func TestExprParseErrors(t *testing.T) {
+	examples := []string{``, `1 +`, `(1`, `1 2`, `f(1)`, `lower(1, 2)`, `"abc`, `a.b #`, `has(1)`}
+	for _, src := range examples {
+		_, err := ParseExpr(src)
+		assert.NotNil(t, err, src)
+	}
+}
+
+// Test that type errors and missing fields are reported on evaluation.
+func TestExprEvalErrors(t *testing.T) {
+	examples := []string{`a.z`, `c + 1`, `c && ok`, `!c`, `1 / 0`, `c < 1`, `substr(s, 3, 1)`}
+	for _, src := range examples {
+		ex, err := ParseExpr(src)
+		if !assert.Nil(t, err, src) {
+			continue
+		}
+
+		_, err = ex.Eval(testEvent())
+		assert.NotNil(t, err, src)
+	}
+}
+
+// Test that expr function filters a stream.
+func TestExprFilter(t *testing.T) {
+	RegisterDefault()
+
+	evts := []Event{
+		map[string]interface{}{"v": int64(1)},
+		map[string]interface{}{"v": int64(5)},
+		map[string]interface{}{"v": int64(3)},
+	}
+	s, err := Run(List(evts), []string{`{"filter": [{"load": "input"}, {"expr": [{"load": "input"}, "v >= 3"]}]}`})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res := []Event{}
+	for {
+		evt, err := s.Next()
+		if err == EOI {
+			break
+		}
+		if !assert.Nil(t, err) {
+			return
+		}
+		res = append(res, evt)
+	}
+	assert.Equal(t, []Event{evts[1], evts[2]}, res)
+}
@@ -1,6 +1,10 @@
 package stream
 
 import (
+	"fmt"
+	"github.com/Monnoroch/golfstream/errors"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -21,26 +25,182 @@ type StreamContext struct {
 }
 
 // A context to be used by functions for building a stream from JSON definition.
-type Context map[string]*StreamContext
+type Context struct {
+	streams map[string]*StreamContext
+	// only set in the validation context to collect errors instead of failing
+	errs *errors.ErrorList
+}
+
+// A kind of a stream function argument in it's description.
+type ArgKind string
+
+const (
+	// A stream definition.
+	ArgStream ArgKind = "stream"
+	ArgString ArgKind = "string"
+	// A string or an array of strings.
+	ArgStrings ArgKind = "strings"
+	ArgNumber  ArgKind = "number"
+	ArgBool    ArgKind = "bool"
+	ArgObject  ArgKind = "object"
+	// A stream definition built on it's own "input" stream rather than on the streams of the definition it's in.
+	ArgDefinition ArgKind = "definition"
+	// Any JSON value.
+	ArgAny ArgKind = "any"
+)
 
-var functions map[string]Function
+// Combine argument kinds for arguments that can be of either of them, like "number|object".
+func ArgOneOf(kinds ...ArgKind) ArgKind {
+	res := ""
+	for i, k := range kinds {
+		if i != 0 {
+			res += "|"
+		}
+		res += string(k)
+	}
+	return ArgKind(res)
+}
+
+/*
+A description of a stream function: it's name, arity, kinds of arguments and a human readable description.
+
+MaxArgs is -1 for functions with unlimited number of arguments.
+If there are less Args than the function can take, the last kind is for all the rest of arguments.
+*/
+type FunctionInfo struct {
+	Name    string    `json:"name"`
+	MinArgs int       `json:"min_args"`
+	MaxArgs int       `json:"max_args"`
+	Args    []ArgKind `json:"args"`
+	Desc    string    `json:"description"`
+}
+
+type function struct {
+	fn   Function
+	info FunctionInfo
+}
+
+var functions map[string]function
 var flock sync.Mutex
 
 // Register stream function by name for building it from JSON definitions.
 func Register(name string, fn Function) {
+	RegisterInfo(FunctionInfo{name, 0, -1, []ArgKind{ArgAny}, ""}, fn)
+}
+
+// Register stream function with it's description for building it from JSON definitions.
+func RegisterInfo(info FunctionInfo, fn Function) {
 	flock.Lock()
 	defer flock.Unlock()
 
 	if functions == nil {
-		functions = map[string]Function{}
+		functions = map[string]function{}
 	}
-	functions[name] = fn
+	functions[info.Name] = function{fn, info}
 }
 
-func getFn(name string) (Function, bool) {
+func getFn(name string) (function, bool) {
 	flock.Lock()
 	defer flock.Unlock()
 
 	fn, ok := functions[name]
 	return fn, ok
 }
+
+// Check if an argument is of the kind.
+func (self ArgKind) matches(arg FArg) bool {
+	switch self {
+	case ArgStream, ArgDefinition, ArgObject:
+		_, ok := arg.(map[string]interface{})
+		return ok
+	case ArgString:
+		_, ok := arg.(string)
+		return ok
+	case ArgStrings:
+		if _, ok := arg.(string); ok {
+			return true
+		}
+		vs, ok := arg.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range vs {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+		return true
+	case ArgNumber:
+		_, ok := getIntOrFloat(arg)
+		return ok
+	case ArgBool:
+		_, ok := arg.(bool)
+		return ok
+	case ArgAny:
+		return true
+	}
+
+	for _, k := range strings.Split(string(self), "|") {
+		if k != string(self) && ArgKind(k).matches(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the number and kinds of arguments of a function call against it's description.
+func (self FunctionInfo) check(args []FArg) error {
+	if len(args) < self.MinArgs || (self.MaxArgs != -1 && len(args) > self.MaxArgs) {
+		if self.MaxArgs == -1 {
+			return errors.New(fmt.Sprintf("%s: Expected at least %v args, got %v", self.Name, self.MinArgs, len(args)))
+		}
+		if self.MinArgs == self.MaxArgs {
+			return errors.New(fmt.Sprintf("%s: Expected %v args, got %v", self.Name, self.MinArgs, len(args)))
+		}
+		return errors.New(fmt.Sprintf("%s: Expected %v to %v args, got %v", self.Name, self.MinArgs, self.MaxArgs, len(args)))
+	}
+
+	if len(self.Args) == 0 {
+		return nil
+	}
+
+	errs := errors.List()
+	for i, arg := range args {
+		kind := self.Args[len(self.Args)-1]
+		if i < len(self.Args) {
+			kind = self.Args[i]
+		}
+
+		if !kind.matches(arg) {
+			errs.Add(errors.New(fmt.Sprintf("%s: Expected args[%v] to be %s, got %v", self.Name, i, kind, arg)))
+		}
+	}
+	return errs.Err()
+}
+
+// Get descriptions of all registered stream functions sorted by name.
+func Functions() []FunctionInfo {
+	flock.Lock()
+	defer flock.Unlock()
+
+	res := make([]FunctionInfo, 0, len(functions))
+	for _, v := range functions {
+		res = append(res, v.info)
+	}
+	sort.Sort(functionInfos(res))
+	return res
+}
+
+type functionInfos []FunctionInfo
+
+func (self functionInfos) Len() int {
+	return len(self)
+}
+
+func (self functionInfos) Less(i, j int) bool {
+	return self[i].Name < self[j].Name
+}
+
+func (self functionInfos) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"testing"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Test that arguments of arithmetic operators are checked to be streams or numbers.
+func TestValidateArith(t *testing.T) {
+	RegisterDefault()
+
+	good := []string{
+		`{"+": [{"load": "input"}, 1, 2.5]}`,
+		`{"*": [2, {"load": "input"}]}`,
+		`{"pow": [{"load": "input"}, 2]}`,
+	}
+	for _, def := range good {
+		assert.Nil(t, Validate([]string{def}), def)
+	}
+
+	bad := []string{
+		`{"+": [{"load": "input"}, "1"]}`,
+		`{"-": [{"load": "input"}, true]}`,
+		`{"%": [{"load": "input"}, [1]]}`,
+		`{"pow": [{"load": "input"}, null]}`,
+	}
+	for _, def := range bad {
+		assert.NotNil(t, Validate([]string{def}), def)
+	}
+
+	for _, info := range Functions() {
+		if info.Name == "+" {
+			assert.Equal(t, []ArgKind{"stream|number"}, info.Args)
+		}
+	}
+}
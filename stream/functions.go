@@ -3,6 +3,7 @@ package stream
 import (
 	"errors"
 	"fmt"
+	"math"
 )
 
 // Register stream functions pre-defined by this library.
@@ -10,36 +11,57 @@ func RegisterDefault() {
 	RegisterDefaultEncoders()
 	RegisterDefaultDecoders()
 
-	Register("", id)
-	Register("id", id)
-	Register("load", load)
-	Register("save", save)
-	Register("encode", encode)
-	Register("decode", decode)
-	Register("zip", zip)
-	Register("get_field", getField)
-	Register("set_field", setField)
-	Register("==", eq)
-	Register("!=", neq)
-	Register(">", more)
-	Register(">=", moreEq)
-	Register("<", less)
-	Register("<=", lessEq)
-	Register("&&", and)
-	Register("||", or)
-	Register("filter", filter)
-	Register("max_by", maxBy)
-	Register("min_by", minBy)
-	Register("repeat", repeat)
-	Register("ema", ema)
-	Register("ema_n", emaN)
-	Register("max_by_roll", rollingMaxBy)
-	Register("min_by_roll", rollingMinBy)
-	Register("max_by_roll_all", rollingMaxByAll)
-	Register("min_by_roll_all", rollingMinByAll)
-	Register("append", sappend)
-	Register("prepend", sprepend)
-	Register("sprintf", sprintf)
+	RegisterInfo(FunctionInfo{"", 1, 1, []ArgKind{ArgStream}, "Same as id."}, id)
+	RegisterInfo(FunctionInfo{"id", 1, 1, []ArgKind{ArgStream}, "The stream itself."}, id)
+	RegisterInfo(FunctionInfo{"load", 1, 3, []ArgKind{ArgString, ArgAny}, "Load a named stream: an input or one saved with save."}, load)
+	RegisterInfo(FunctionInfo{"save", 2, 2, []ArgKind{ArgString, ArgStream}, "Save a stream by name to be loaded later with load, produces an empty stream."}, save)
+	RegisterInfo(FunctionInfo{"encode", 2, 2, []ArgKind{ArgStream, ArgString}, "Encode events to bytes with an encoder by name."}, encode)
+	RegisterInfo(FunctionInfo{"decode", 2, 2, []ArgKind{ArgStream, ArgString}, "Decode events from bytes with a decoder by name."}, decode)
+	RegisterInfo(FunctionInfo{"zip", 2, -1, []ArgKind{ArgStream}, "Zip streams into a stream of arrays of their events."}, zip)
+	RegisterInfo(FunctionInfo{"get_field", 2, 2, []ArgKind{ArgStream, ArgString}, "Get a field of events, the field might be deep inside, as in \"object.value.data\"."}, getField)
+	RegisterInfo(FunctionInfo{"set_field", 3, 3, []ArgKind{ArgStream, ArgString, ArgStream}, "Set a field of events from the first stream to events from the second stream."}, setField)
+	RegisterInfo(FunctionInfo{"==", 2, 2, []ArgKind{ArgStream, ArgAny}, "Check if events are equal to a value."}, eq)
+	RegisterInfo(FunctionInfo{"!=", 2, 2, []ArgKind{ArgStream, ArgAny}, "Check if events are not equal to a value."}, neq)
+	RegisterInfo(FunctionInfo{">", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Check if events are more than a number."}, more)
+	RegisterInfo(FunctionInfo{">=", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Check if events are more than or equal to a number."}, moreEq)
+	RegisterInfo(FunctionInfo{"<", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Check if events are less than a number."}, less)
+	RegisterInfo(FunctionInfo{"<=", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Check if events are less than or equal to a number."}, lessEq)
+	RegisterInfo(FunctionInfo{"&&", 2, -1, []ArgKind{ArgStream}, "And boolean streams."}, and)
+	RegisterInfo(FunctionInfo{"||", 2, -1, []ArgKind{ArgStream}, "Or boolean streams."}, or)
+	RegisterInfo(FunctionInfo{"filter", 2, 2, []ArgKind{ArgStream, ArgStream}, "Filter events of the first stream by boolean flags from the second stream."}, filter)
+	RegisterInfo(FunctionInfo{"max_by", 2, 2, []ArgKind{ArgStream, ArgStream}, "An event from the first stream for which the value from the second stream is maximal."}, maxBy)
+	RegisterInfo(FunctionInfo{"min_by", 2, 2, []ArgKind{ArgStream, ArgStream}, "An event from the first stream for which the value from the second stream is minimal."}, minBy)
+	RegisterInfo(FunctionInfo{"repeat", 1, 1, []ArgKind{ArgStream}, "Repeat the first event of a stream infinitely."}, repeat)
+	RegisterInfo(FunctionInfo{"ema", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Exponential moving average of numbers with given alpha."}, ema)
+	RegisterInfo(FunctionInfo{"ema_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Exponential moving average of numbers over about n last events."}, emaN)
+	RegisterInfo(FunctionInfo{"max_by_roll", 2, 2, []ArgKind{ArgStream, ArgStream}, "Events from the first stream when the maximal value from the second stream changes."}, rollingMaxBy)
+	RegisterInfo(FunctionInfo{"min_by_roll", 2, 2, []ArgKind{ArgStream, ArgStream}, "Events from the first stream when the minimal value from the second stream changes."}, rollingMinBy)
+	RegisterInfo(FunctionInfo{"max_by_roll_all", 2, 2, []ArgKind{ArgStream, ArgStream}, "Events from the first stream for which the current value from the second stream is maximal."}, rollingMaxByAll)
+	RegisterInfo(FunctionInfo{"min_by_roll_all", 2, 2, []ArgKind{ArgStream, ArgStream}, "Events from the first stream for which the current value from the second stream is minimal."}, rollingMinByAll)
+	RegisterInfo(FunctionInfo{"append", 2, 2, []ArgKind{ArgStream, ArgString}, "Append a string to string events."}, sappend)
+	RegisterInfo(FunctionInfo{"prepend", 2, 2, []ArgKind{ArgStream, ArgString}, "Prepend a string to string events."}, sprepend)
+	RegisterInfo(FunctionInfo{"sprintf", 3, 3, []ArgKind{ArgStream, ArgString, ArgStrings}, "Format fields of events into strings."}, sprintf)
+	RegisterInfo(FunctionInfo{"window_tumbling", 4, 5, []ArgKind{ArgStream, ArgString, ArgNumber, ArgString, ArgStrings}, "Aggregate a field of events over fixed time windows: time field, window size, value field and aggregates (count, sum, avg, min, max)."}, windowTumbling)
+	RegisterInfo(FunctionInfo{"window_sliding", 5, 6, []ArgKind{ArgStream, ArgString, ArgNumber, ArgNumber, ArgString, ArgStrings}, "Aggregate a field of events over sliding time windows: time field, window size, slide, value field and aggregates (count, sum, avg, min, max)."}, windowSliding)
+	RegisterInfo(FunctionInfo{"sum_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Rolling sum of numbers over n last events."}, rollingN("sum_n", RollingSum))
+	RegisterInfo(FunctionInfo{"mean_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Rolling mean of numbers over n last events."}, rollingN("mean_n", RollingMean))
+	RegisterInfo(FunctionInfo{"stddev_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Rolling standard deviation of numbers over n last events."}, rollingN("stddev_n", RollingStddev))
+	RegisterInfo(FunctionInfo{"min_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Rolling minimum of numbers over n last events."}, rollingN("min_n", RollingMin))
+	RegisterInfo(FunctionInfo{"max_n", 2, 2, []ArgKind{ArgStream, ArgNumber}, "Rolling maximum of numbers over n last events."}, rollingN("max_n", RollingMax))
+	RegisterInfo(FunctionInfo{"quantile_n", 3, 3, []ArgKind{ArgStream, ArgNumber, ArgNumber}, "Rolling quantile in [0, 1] of numbers over n last events."}, rollingQuantile)
+	RegisterInfo(FunctionInfo{"group_by", 3, 4, []ArgKind{ArgStream, ArgString, ArgDefinition, ArgBool}, "Run a definition with input stream for each distinct value of a field, optionally tagging results with the key."}, groupBy)
+	RegisterInfo(FunctionInfo{"expr", 2, 2, []ArgKind{ArgStream, ArgString}, "Evaluate an expression for each event."}, expr)
+	RegisterInfo(FunctionInfo{"+", 2, -1, []ArgKind{ArgOneOf(ArgStream, ArgNumber)}, "Add numbers from streams and constants."}, arithFn("+", Plus))
+	RegisterInfo(FunctionInfo{"-", 2, -1, []ArgKind{ArgOneOf(ArgStream, ArgNumber)}, "Subtract numbers from streams and constants."}, arithFn("-", Minus))
+	RegisterInfo(FunctionInfo{"*", 2, -1, []ArgKind{ArgOneOf(ArgStream, ArgNumber)}, "Multiply numbers from streams and constants."}, arithFn("*", Mul))
+	RegisterInfo(FunctionInfo{"/", 2, -1, []ArgKind{ArgOneOf(ArgStream, ArgNumber)}, "Divide numbers from streams and constants."}, arithFn("/", Div))
+	RegisterInfo(FunctionInfo{"%", 2, -1, []ArgKind{ArgOneOf(ArgStream, ArgNumber)}, "Remainder of division of numbers from streams and constants."}, arithFn("%", Mod))
+	RegisterInfo(FunctionInfo{"abs", 1, 1, []ArgKind{ArgStream}, "Absolute value of numbers."}, mathFn("abs", Abs))
+	RegisterInfo(FunctionInfo{"round", 1, 1, []ArgKind{ArgStream}, "Round numbers to integers."}, mathFn("round", Round))
+	RegisterInfo(FunctionInfo{"log", 1, 2, []ArgKind{ArgStream, ArgNumber}, "Logarithm of numbers with given base, natural by default."}, mathLog)
+	RegisterInfo(FunctionInfo{"pow", 2, 2, []ArgKind{ArgOneOf(ArgStream, ArgNumber), ArgOneOf(ArgStream, ArgNumber)}, "Raise numbers to powers."}, mathPow)
+	RegisterInfo(FunctionInfo{"join", 3, 3, []ArgKind{ArgStream, ArgStream, ArgObject}, "Join events of two streams by key within count and time bounds."}, join)
+	RegisterInfo(FunctionInfo{"dedup", 3, 3, []ArgKind{ArgStream, ArgString, ArgOneOf(ArgNumber, ArgObject)}, "Drop events with a key seen within last n events or a time window."}, dedup)
 }
 
 func id(ctx Context, args []FArg) (Stream, error) {
@@ -60,9 +82,9 @@ func load(ctx Context, args []FArg) (Stream, error) {
 		return nil, errors.New(fmt.Sprintf("load: Expected args[0] to be string, got %v", args[0]))
 	}
 
-	sctx, ok := ctx[name]
+	sctx, ok := ctx.streams[name]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("load: There is no Stream with name %s: %v", name, ctx))
+		return nil, errors.New(fmt.Sprintf("load: There is no Stream with name %s: %v", name, ctx.streams))
 	}
 
 	return sctx.mp.New(), nil
@@ -78,9 +100,9 @@ func save(ctx Context, args []FArg) (Stream, error) {
 		return nil, errors.New(fmt.Sprintf("save: Expected args[0] to be string, got %v", args[0]))
 	}
 
-	_, ok = ctx[name]
+	_, ok = ctx.streams[name]
 	if ok {
-		return nil, errors.New(fmt.Sprintf("save: There already is a Stream with the name %s: %v", name, ctx))
+		return nil, errors.New(fmt.Sprintf("save: There already is a Stream with the name %s: %v", name, ctx.streams))
 	}
 
 	proc, err := build(ctx, args[1])
@@ -88,7 +110,7 @@ func save(ctx Context, args []FArg) (Stream, error) {
 		return nil, err
 	}
 
-	ctx[name] = &StreamContext{
+	ctx.streams[name] = &StreamContext{
 		stream: proc,
 		mp:     Multiplexer(proc),
 	}
@@ -584,3 +606,445 @@ func sprintf(ctx Context, args []FArg) (Stream, error) {
 
 	return Sprintf(proc, sfmt, fields), nil
 }
+
+func getStrings(arg FArg) ([]string, bool) {
+	if s, ok := arg.(string); ok {
+		return []string{s}, true
+	}
+
+	arr, ok := arg.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	res := make([]string, len(arr))
+	for i, v := range arr {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+
+		res[i] = s
+	}
+	return res, true
+}
+
+func windowAggsArg(fn string, args []FArg, n int) ([]string, error) {
+	if len(args) <= n {
+		return windowAggs, nil
+	}
+
+	aggs, ok := getStrings(args[n])
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: Expected args[%v] to be string or []string, got %v", fn, n, args[n]))
+	}
+
+	if err := checkWindowAggs(aggs); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", fn, err.Error()))
+	}
+	return aggs, nil
+}
+
+func windowTumbling(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New(fmt.Sprintf("window_tumbling: Expected 4 or 5 args, got %v", len(args)))
+	}
+
+	proc, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	timeField, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("window_tumbling: Expected args[1] to be string, got %v", args[1]))
+	}
+
+	size, ok := getIntOrFloat(args[2])
+	if !ok || size <= 0 {
+		return nil, errors.New(fmt.Sprintf("window_tumbling: Expected args[2] to be positive number, got %v", args[2]))
+	}
+
+	valField, ok := args[3].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("window_tumbling: Expected args[3] to be string, got %v", args[3]))
+	}
+
+	aggs, err := windowAggsArg("window_tumbling", args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	return WindowTumbling(proc, timeField, valField, size, aggs), nil
+}
+
+func windowSliding(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 5 && len(args) != 6 {
+		return nil, errors.New(fmt.Sprintf("window_sliding: Expected 5 or 6 args, got %v", len(args)))
+	}
+
+	proc, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	timeField, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("window_sliding: Expected args[1] to be string, got %v", args[1]))
+	}
+
+	size, ok := getIntOrFloat(args[2])
+	if !ok || size <= 0 {
+		return nil, errors.New(fmt.Sprintf("window_sliding: Expected args[2] to be positive number, got %v", args[2]))
+	}
+
+	slide, ok := getIntOrFloat(args[3])
+	if !ok || slide <= 0 {
+		return nil, errors.New(fmt.Sprintf("window_sliding: Expected args[3] to be positive number, got %v", args[3]))
+	}
+
+	valField, ok := args[4].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("window_sliding: Expected args[4] to be string, got %v", args[4]))
+	}
+
+	aggs, err := windowAggsArg("window_sliding", args, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	return WindowSliding(proc, timeField, valField, size, slide, aggs), nil
+}
+
+func rollingN(fn string, ctor func(Stream, int) Stream) Function {
+	return func(ctx Context, args []FArg) (Stream, error) {
+		if len(args) != 2 {
+			return nil, errors.New(fmt.Sprintf("%s: Expected 2 args, got %v", fn, len(args)))
+		}
+
+		vals, err := build(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		n, ok := args[1].(int64)
+		if !ok || n <= 0 {
+			return nil, errors.New(fmt.Sprintf("%s: Expected args[1] to be positive integer, got %v", fn, args[1]))
+		}
+
+		return ctor(vals, int(n)), nil
+	}
+}
+
+func rollingQuantile(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 3 {
+		return nil, errors.New(fmt.Sprintf("quantile_n: Expected 3 args, got %v", len(args)))
+	}
+
+	vals, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := args[1].(int64)
+	if !ok || n <= 0 {
+		return nil, errors.New(fmt.Sprintf("quantile_n: Expected args[1] to be positive integer, got %v", args[1]))
+	}
+
+	q, ok := getIntOrFloat(args[2])
+	if !ok || q < 0 || q > 1 {
+		return nil, errors.New(fmt.Sprintf("quantile_n: Expected args[2] to be number in [0, 1], got %v", args[2]))
+	}
+
+	return RollingQuantile(vals, int(n), q), nil
+}
+
+func groupBy(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errors.New(fmt.Sprintf("group_by: Expected 3 or 4 args, got %v", len(args)))
+	}
+
+	proc, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("group_by: Expected args[1] to be string, got %v", args[1]))
+	}
+
+	tag := false
+	if len(args) == 4 {
+		tag, ok = args[3].(bool)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("group_by: Expected args[3] to be bool, got %v", args[3]))
+		}
+	}
+
+	def := args[2]
+	fn := func(s Stream) (Stream, error) {
+		return build(Context{streams: map[string]*StreamContext{"input": &StreamContext{stream: s, mp: Multiplexer(s)}}}, def)
+	}
+
+	// check the definition before any events arrive
+	if _, err := fn(Empty()); err != nil {
+		return nil, err
+	}
+
+	return GroupBy(proc, field, fn, tag), nil
+}
+
+func expr(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 2 {
+		return nil, errors.New(fmt.Sprintf("expr: Expected 2 args, got %v", len(args)))
+	}
+
+	proc, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	src, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expr: Expected args[1] to be string, got %v", args[1]))
+	}
+
+	e, err := ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return EvalExpr(proc, e), nil
+}
+
+// Build a stream from a definition or a constant stream from a number.
+func buildOrConst(ctx Context, arg FArg) (Stream, bool, error) {
+	if _, ok := getIntOrFloat(arg); ok {
+		return Const(arg), true, nil
+	}
+
+	s, err := build(ctx, arg)
+	if err != nil {
+		return nil, false, err
+	}
+	return s, false, nil
+}
+
+func arithFn(name string, ctor func(...Stream) Stream) Function {
+	return func(ctx Context, args []FArg) (Stream, error) {
+		if len(args) <= 1 {
+			return nil, errors.New(fmt.Sprintf("%s: Expected > 1 args, got %v", name, len(args)))
+		}
+
+		consts := true
+		streams := make([]Stream, len(args))
+		for i, a := range args {
+			s, isConst, err := buildOrConst(ctx, a)
+			if err != nil {
+				return nil, err
+			}
+
+			consts = consts && isConst
+			streams[i] = s
+		}
+
+		if consts {
+			return nil, errors.New(fmt.Sprintf("%s: Expected at least one arg to be a stream, got %v", name, args))
+		}
+
+		return ctor(streams...), nil
+	}
+}
+
+func mathFn(name string, ctor func(Stream) Stream) Function {
+	return func(ctx Context, args []FArg) (Stream, error) {
+		if len(args) != 1 {
+			return nil, errors.New(fmt.Sprintf("%s: Expected 1 arg, got %v", name, len(args)))
+		}
+
+		vals, err := build(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return ctor(vals), nil
+	}
+}
+
+func mathLog(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New(fmt.Sprintf("log: Expected 1 or 2 args, got %v", len(args)))
+	}
+
+	vals, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	base := math.E
+	if len(args) == 2 {
+		b, ok := getIntOrFloat(args[1])
+		if !ok || b <= 0 || b == 1 {
+			return nil, errors.New(fmt.Sprintf("log: Expected args[1] to be positive number other than 1, got %v", args[1]))
+		}
+		base = b
+	}
+
+	return Log(vals, base), nil
+}
+
+func mathPow(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 2 {
+		return nil, errors.New(fmt.Sprintf("pow: Expected 2 args, got %v", len(args)))
+	}
+
+	bases, bconst, err := buildOrConst(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	exps, econst, err := buildOrConst(ctx, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if bconst && econst {
+		return nil, errors.New(fmt.Sprintf("pow: Expected at least one arg to be a stream, got %v", args))
+	}
+
+	return Pow(bases, exps), nil
+}
+
+func join(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 3 {
+		return nil, errors.New(fmt.Sprintf("join: Expected 3 args, got %v", len(args)))
+	}
+
+	left, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := build(ctx, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, ok := args[2].(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("join: Expected args[2] to be object, got %v", args[2]))
+	}
+
+	opts := JoinOptions{Count: 1000}
+	for k, v := range cfg {
+		ok := true
+		switch k {
+		case "left_key":
+			opts.LeftKey, ok = v.(string)
+		case "right_key":
+			opts.RightKey, ok = v.(string)
+		case "left_time":
+			opts.LeftTime, ok = v.(string)
+		case "right_time":
+			opts.RightTime, ok = v.(string)
+		case "count":
+			n, isInt := v.(int64)
+			ok = isInt && n > 0
+			opts.Count = int(n)
+		case "time":
+			opts.Time, ok = getIntOrFloat(v)
+			ok = ok && opts.Time > 0
+		case "type":
+			switch v {
+			case "inner":
+				opts.Outer = false
+			case "left":
+				opts.Outer = true
+			default:
+				ok = false
+			}
+		default:
+			return nil, errors.New(fmt.Sprintf("join: Unknown option \"%s\" in %v", k, cfg))
+		}
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("join: Bad value of option \"%s\": %v", k, v))
+		}
+	}
+
+	if _, ok := cfg["left_key"]; !ok {
+		return nil, errors.New(fmt.Sprintf("join: Expected option \"left_key\", got %v", cfg))
+	}
+
+	if _, ok := cfg["right_key"]; !ok {
+		opts.RightKey = opts.LeftKey
+	}
+
+	if opts.Time != 0 && (opts.LeftTime == "" || opts.RightTime == "") {
+		return nil, errors.New(fmt.Sprintf("join: Expected options \"left_time\" and \"right_time\" with \"time\", got %v", cfg))
+	}
+
+	return JoinBy(left, right, opts), nil
+}
+
+func dedup(ctx Context, args []FArg) (Stream, error) {
+	if len(args) != 3 {
+		return nil, errors.New(fmt.Sprintf("dedup: Expected 3 args, got %v", len(args)))
+	}
+
+	proc, err := build(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("dedup: Expected args[1] to be string, got %v", args[1]))
+	}
+
+	if n, ok := args[2].(int64); ok {
+		if n <= 0 {
+			return nil, errors.New(fmt.Sprintf("dedup: Expected args[2] to be positive integer, got %v", args[2]))
+		}
+		return Dedup(proc, field, int(n)), nil
+	}
+
+	cfg, ok := args[2].(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("dedup: Expected args[2] to be integer or object, got %v", args[2]))
+	}
+
+	n := int64(10000)
+	window := float64(0)
+	timeField := ""
+	for k, v := range cfg {
+		ok := true
+		switch k {
+		case "count":
+			n, ok = v.(int64)
+			ok = ok && n > 0
+		case "time":
+			window, ok = getIntOrFloat(v)
+			ok = ok && window > 0
+		case "time_field":
+			timeField, ok = v.(string)
+		default:
+			return nil, errors.New(fmt.Sprintf("dedup: Unknown option \"%s\" in %v", k, cfg))
+		}
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("dedup: Bad value of option \"%s\": %v", k, v))
+		}
+	}
+
+	if window == 0 {
+		return Dedup(proc, field, int(n)), nil
+	}
+
+	if _, ok := cfg["time_field"]; !ok {
+		return nil, errors.New(fmt.Sprintf("dedup: Expected option \"time_field\" with \"time\", got %v", cfg))
+	}
+
+	return DedupTime(proc, field, timeField, window, int(n)), nil
+}
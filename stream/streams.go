@@ -3,11 +3,14 @@ package stream
 import (
 	"github.com/Monnoroch/golfstream/errors"
 
+	"container/list"
 	"fmt"
 	"log"
 	"math"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 var DebugLog = true
@@ -515,6 +518,316 @@ func LessEqVal(stream Stream, val float64) Stream {
 	})
 }
 
+/*
+Apply an arithmetic operator to two numbers.
+
+The result is int64 if both numbers are int64, as in numbers parsed with ParseJson, and float64 otherwise.
+If the int64 result overflows, the operator is applied to float64 numbers instead, as in Pow.
+*/
+func arith(op string, a Event, b Event) (Event, error) {
+	ai, aok := a.(int64)
+	bi, bok := b.(int64)
+	if aok && bok {
+		switch op {
+		case "+":
+			if res, ok := addInt(ai, bi); ok {
+				return res, nil
+			}
+		case "-":
+			if res, ok := subInt(ai, bi); ok {
+				return res, nil
+			}
+		case "*":
+			if res, ok := mulInt(ai, bi); ok {
+				return res, nil
+			}
+		case "/", "%":
+			if bi == 0 {
+				return nil, errors.New(fmt.Sprintf("Integer division by zero: %v %s %v", a, op, b))
+			}
+			if op == "%" {
+				return ai % bi, nil
+			}
+			if ai != math.MinInt64 || bi != -1 {
+				return ai / bi, nil
+			}
+		}
+	}
+
+	af, ok := getIntOrFloat(a)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Expected number operand of %s, got %v", op, a))
+	}
+
+	bf, ok := getIntOrFloat(b)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Expected number operand of %s, got %v", op, b))
+	}
+
+	switch op {
+	case "+":
+		return af + bf, nil
+	case "-":
+		return af - bf, nil
+	case "*":
+		return af * bf, nil
+	case "/":
+		return af / bf, nil
+	case "%":
+		return math.Mod(af, bf), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown operator %s", op))
+}
+
+type constStream struct {
+	val Event
+}
+
+func (self constStream) Next() (Event, error) {
+	return self.val, nil
+}
+
+/*
+Create a stream of one constant value repeated infinitely.
+*/
+func Const(val Event) Stream {
+	return constStream{val}
+}
+
+type arithStream struct {
+	op      string
+	name    string
+	streams []Stream
+}
+
+func (self arithStream) Next() (Event, error) {
+	vals := make([]Event, len(self.streams))
+	errs := make([]error, len(self.streams))
+	for i, s := range self.streams {
+		vals[i], errs[i] = s.Next()
+	}
+
+	if err := getError(errs...); err != nil {
+		return nil, err
+	}
+
+	res := vals[0]
+	for _, v := range vals[1:] {
+		r, err := arith(self.op, res, v)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", self.name, err.Error()))
+		}
+		res = r
+	}
+	return res, nil
+}
+
+/*
+Takes multiple number streams and creates a stream of sums of their events.
+
+The result is int64 if all the numbers are int64 and the sum doesn't overflow int64, and float64 otherwise.
+Use Const to add a constant.
+*/
+func Plus(streams ...Stream) Stream {
+	return arithStream{"+", "Plus", streams}
+}
+
+/*
+Takes multiple number streams and creates a stream of events of the first one minus events of others.
+
+The result is int64 if all the numbers are int64 and the difference doesn't overflow int64, and float64 otherwise.
+*/
+func Minus(streams ...Stream) Stream {
+	return arithStream{"-", "Minus", streams}
+}
+
+/*
+Takes multiple number streams and creates a stream of products of their events.
+
+The result is int64 if all the numbers are int64 and the product doesn't overflow int64, and float64 otherwise.
+*/
+func Mul(streams ...Stream) Stream {
+	return arithStream{"*", "Mul", streams}
+}
+
+/*
+Takes multiple number streams and creates a stream of events of the first one divided by events of others.
+
+The result is int64 if all the numbers are int64 and the quotient doesn't overflow int64, in which case the division is integer, as in Go,
+and float64 otherwise.
+*/
+func Div(streams ...Stream) Stream {
+	return arithStream{"/", "Div", streams}
+}
+
+/*
+Takes multiple number streams and creates a stream of remainders of dividing events of the first one by events of others.
+
+The result is int64 if all the numbers are int64, and float64 otherwise.
+*/
+func Mod(streams ...Stream) Stream {
+	return arithStream{"%", "Mod", streams}
+}
+
+/*
+Creates a stream of absolute values of numbers from the original stream.
+
+The result is int64 for int64 numbers except math.MinInt64, which absolute value doesn't fit into int64, and float64 otherwise.
+*/
+func Abs(stream Stream) Stream {
+	return Map(stream, func(e Event) (Event, error) {
+		if i, ok := e.(int64); ok && i != math.MinInt64 {
+			if i < 0 {
+				return -i, nil
+			}
+			return i, nil
+		}
+
+		v, ok := getIntOrFloat(e)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Abs: Expected event to be number, got %v", e))
+		}
+		return math.Abs(v), nil
+	})
+}
+
+/*
+Creates a stream of numbers from the original stream rounded to the nearest integer.
+
+The result is int64, except for NaNs, infinities and numbers out of int64 range, which are kept as float64.
+*/
+func Round(stream Stream) Stream {
+	return Map(stream, func(e Event) (Event, error) {
+		if i, ok := e.(int64); ok {
+			return i, nil
+		}
+
+		v, ok := getIntOrFloat(e)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Round: Expected event to be number, got %v", e))
+		}
+
+		r := math.Round(v)
+		// -2^63 converts exactly, 2^63 is already out of range, NaN fails both checks
+		if r >= math.MinInt64 && r < -math.MinInt64 {
+			return int64(r), nil
+		}
+		return r, nil
+	})
+}
+
+/*
+Creates a stream of logarithms of numbers from the original stream by a given base.
+*/
+func Log(stream Stream, base float64) Stream {
+	lbase := math.Log(base)
+	return Map(stream, func(e Event) (Event, error) {
+		v, ok := getIntOrFloat(e)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Log: Expected event to be number, got %v", e))
+		}
+		return math.Log(v) / lbase, nil
+	})
+}
+
+// Add integers, returns false on overflow.
+func addInt(a int64, b int64) (int64, bool) {
+	res := a + b
+	if (b > 0 && res < a) || (b < 0 && res > a) {
+		return 0, false
+	}
+	return res, true
+}
+
+// Subtract integers, returns false on overflow.
+func subInt(a int64, b int64) (int64, bool) {
+	res := a - b
+	if (b < 0 && res < a) || (b > 0 && res > a) {
+		return 0, false
+	}
+	return res, true
+}
+
+// Multiply integers, returns false on overflow.
+func mulInt(a int64, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	res := a * b
+	if res/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return res, true
+}
+
+// Raise an integer to a non-negative integer power by squaring, returns false on overflow.
+func powInt(b int64, e int64) (int64, bool) {
+	res := int64(1)
+	for {
+		if e&1 == 1 {
+			r, ok := mulInt(res, b)
+			if !ok {
+				return 0, false
+			}
+			res = r
+		}
+
+		e >>= 1
+		if e == 0 {
+			return res, true
+		}
+
+		sq, ok := mulInt(b, b)
+		if !ok {
+			return 0, false
+		}
+		b = sq
+	}
+}
+
+type powStream struct {
+	bases Stream
+	exps  Stream
+}
+
+func (self powStream) Next() (Event, error) {
+	b, err1 := self.bases.Next()
+	e, err2 := self.exps.Next()
+
+	if err := getError(err1, err2); err != nil {
+		return nil, err
+	}
+
+	bi, bok := b.(int64)
+	ei, eok := e.(int64)
+	if bok && eok && ei >= 0 {
+		if res, ok := powInt(bi, ei); ok {
+			return res, nil
+		}
+	}
+
+	bf, ok := getIntOrFloat(b)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Pow: Expected base to be number, got %v", b))
+	}
+
+	ef, ok := getIntOrFloat(e)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Pow: Expected exponent to be number, got %v", e))
+	}
+	return math.Pow(bf, ef), nil
+}
+
+/*
+Takes a stream of bases and a stream of exponents and creates a stream of bases raised to exponents.
+
+The result is int64 if the base is int64, the exponent is non-negative int64 and the result doesn't overflow int64, and float64 otherwise.
+*/
+func Pow(bases Stream, exps Stream) Stream {
+	return powStream{bases, exps}
+}
+
 type orStream struct {
 	streams []Stream
 }
@@ -777,6 +1090,226 @@ func Ema(stream Stream, alpha float64) Stream {
 	return &emaStream{stream, alpha, 0, false}
 }
 
+// A statistic over a sliding set of numbers.
+type rollingStat interface {
+	push(v float64)
+	pop(v float64)
+	value() float64
+}
+
+type sumStat struct {
+	sum   float64
+	count int
+}
+
+func (self *sumStat) push(v float64) {
+	self.sum += v
+	self.count += 1
+}
+
+func (self *sumStat) pop(v float64) {
+	self.sum -= v
+	self.count -= 1
+}
+
+func (self *sumStat) value() float64 {
+	return self.sum
+}
+
+type meanStat struct {
+	sumStat
+}
+
+func (self *meanStat) value() float64 {
+	return self.sum / float64(self.count)
+}
+
+// Welford's algorithm: the mean and the sum of squared differences from it are updated incrementally.
+type stddevStat struct {
+	mean  float64
+	m2    float64
+	count int
+}
+
+func (self *stddevStat) push(v float64) {
+	self.count += 1
+	d := v - self.mean
+	self.mean += d / float64(self.count)
+	self.m2 += d * (v - self.mean)
+}
+
+func (self *stddevStat) pop(v float64) {
+	if self.count == 1 {
+		*self = stddevStat{}
+		return
+	}
+
+	self.count -= 1
+	d := v - self.mean
+	self.mean -= d / float64(self.count)
+	self.m2 -= d * (v - self.mean)
+}
+
+func (self *stddevStat) value() float64 {
+	if self.m2 < 0 {
+		// rounding errors
+		return 0
+	}
+	return math.Sqrt(self.m2 / float64(self.count))
+}
+
+// Monotonic queue: the front is always the extremum of the window.
+type extremumStat struct {
+	queue []float64
+	less  bool
+}
+
+func (self *extremumStat) before(a float64, b float64) bool {
+	if self.less {
+		return a < b
+	}
+	return a > b
+}
+
+func (self *extremumStat) push(v float64) {
+	l := len(self.queue)
+	for l > 0 && self.before(v, self.queue[l-1]) {
+		l--
+	}
+	self.queue = append(self.queue[:l], v)
+}
+
+func (self *extremumStat) pop(v float64) {
+	if len(self.queue) > 0 && self.queue[0] == v {
+		self.queue = self.queue[1:]
+	}
+}
+
+func (self *extremumStat) value() float64 {
+	return self.queue[0]
+}
+
+type quantileStat struct {
+	sorted []float64
+	q      float64
+}
+
+func (self *quantileStat) push(v float64) {
+	i := sort.SearchFloat64s(self.sorted, v)
+	self.sorted = append(self.sorted, 0)
+	copy(self.sorted[i+1:], self.sorted[i:])
+	self.sorted[i] = v
+}
+
+func (self *quantileStat) pop(v float64) {
+	i := sort.SearchFloat64s(self.sorted, v)
+	if i < len(self.sorted) && self.sorted[i] == v {
+		self.sorted = append(self.sorted[:i], self.sorted[i+1:]...)
+	}
+}
+
+func (self *quantileStat) value() float64 {
+	pos := self.q * float64(len(self.sorted)-1)
+	i := int(math.Floor(pos))
+	if i+1 >= len(self.sorted) {
+		return self.sorted[len(self.sorted)-1]
+	}
+	frac := pos - float64(i)
+	return self.sorted[i]*(1-frac) + self.sorted[i+1]*frac
+}
+
+type rollingStatStream struct {
+	vals Stream
+	name string
+	stat rollingStat
+	n    int
+
+	// grows up to n numbers as they come, so that a huge n doesn't allocate anything up front
+	window []float64
+	pos    int
+}
+
+func (self *rollingStatStream) Next() (Event, error) {
+	if self.n <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: Expected positive number of events, got %v", self.name, self.n))
+	}
+
+	val, err := self.vals.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := getIntOrFloat(val)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: Expected number event, got %v", self.name, val))
+	}
+
+	if len(self.window) < self.n {
+		self.window = append(self.window, v)
+		self.stat.push(v)
+		return self.stat.value(), nil
+	}
+
+	self.stat.pop(self.window[self.pos])
+	self.window[self.pos] = v
+	self.stat.push(v)
+
+	self.pos += 1
+	if self.pos == self.n {
+		self.pos = 0
+	}
+	return self.stat.value(), nil
+}
+
+// A stream of statistics of the last n numbers, it fails if n is not positive.
+func rollingStatN(stream Stream, n int, name string, stat rollingStat) Stream {
+	return &rollingStatStream{stream, name, stat, n, nil, 0}
+}
+
+/*
+Get a numbers stream and produce a stream of sums of the last n numbers.
+*/
+func RollingSum(stream Stream, n int) Stream {
+	return rollingStatN(stream, n, "RollingSum", &sumStat{})
+}
+
+/*
+Get a numbers stream and produce a stream of means of the last n numbers.
+*/
+func RollingMean(stream Stream, n int) Stream {
+	return rollingStatN(stream, n, "RollingMean", &meanStat{})
+}
+
+/*
+Get a numbers stream and produce a stream of standard deviations of the last n numbers.
+*/
+func RollingStddev(stream Stream, n int) Stream {
+	return rollingStatN(stream, n, "RollingStddev", &stddevStat{})
+}
+
+/*
+Get a numbers stream and produce a stream of minimums of the last n numbers.
+*/
+func RollingMin(stream Stream, n int) Stream {
+	return rollingStatN(stream, n, "RollingMin", &extremumStat{nil, true})
+}
+
+/*
+Get a numbers stream and produce a stream of maximums of the last n numbers.
+*/
+func RollingMax(stream Stream, n int) Stream {
+	return rollingStatN(stream, n, "RollingMax", &extremumStat{nil, false})
+}
+
+/*
+Get a numbers stream and produce a stream of q-quantiles of the last n numbers, where q is in [0, 1].
+
+The quantile is linearly interpolated between the closest ranks, so RollingQuantile(s, n, 0.5) is a rolling median.
+*/
+func RollingQuantile(stream Stream, n int, q float64) Stream {
+	return rollingStatN(stream, n, "RollingQuantile", &quantileStat{nil, q})
+}
+
 type rollingMaxByStream struct {
 	datas Stream
 	vals  Stream
@@ -918,15 +1451,419 @@ func RollingMinByAll(datas Stream, vals Stream) Stream {
 	return &rollingMinByAllStream{datas, vals, nil, math.MaxFloat64}
 }
 
-/*
-Takes a stream af strings and append a given string to all of them.
-*/
-func StringAppend(stream Stream, suf string) Stream {
-	return Map(stream, func(val Event) (Event, error) {
-		v, ok := val.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("StringAppend: Expected event to be string, got %v", v))
-		}
+func getTimestamp(evt Event, field string) (float64, error) {
+	v, ok := getFieldImpl(evt, field)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Expected event to have field %s, got %v", field, evt))
+	}
+
+	if ts, ok := getIntOrFloat(v); ok {
+		return ts, nil
+	}
+
+	if s, ok := v.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, err
+		}
+		return float64(t.UnixNano()) / float64(time.Second), nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("Expected field %s to be number or RFC3339 string, got %v", field, v))
+}
+
+var windowAggs = []string{"count", "sum", "avg", "min", "max"}
+
+func checkWindowAggs(aggs []string) error {
+	for _, a := range aggs {
+		found := false
+		for _, v := range windowAggs {
+			if a == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("Unknown window aggregate \"%s\", expected one of %v", a, windowAggs))
+		}
+	}
+	return nil
+}
+
+type windowStats struct {
+	from  float64
+	to    float64
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func newWindowStats(from float64, to float64) *windowStats {
+	return &windowStats{from, to, 0, 0, math.MaxFloat64, -math.MaxFloat64}
+}
+
+func (self *windowStats) add(v float64) {
+	self.count += 1
+	self.sum += v
+	if v < self.min {
+		self.min = v
+	}
+	if v > self.max {
+		self.max = v
+	}
+}
+
+func (self *windowStats) event(aggs []string) Event {
+	res := map[string]interface{}{
+		"from": self.from,
+		"to":   self.to,
+	}
+	for _, a := range aggs {
+		switch a {
+		case "count":
+			res[a] = self.count
+		case "sum":
+			res[a] = self.sum
+		case "avg":
+			res[a] = self.sum / float64(self.count)
+		case "min":
+			res[a] = self.min
+		case "max":
+			res[a] = self.max
+		}
+	}
+	return res
+}
+
+type windowSource struct {
+	stream    Stream
+	timeField string
+	valField  string
+	needVal   bool
+}
+
+func newWindowSource(stream Stream, timeField string, valField string, aggs []string) windowSource {
+	needVal := false
+	for _, a := range aggs {
+		if a != "count" {
+			needVal = true
+		}
+	}
+	return windowSource{stream, timeField, valField, needVal}
+}
+
+func (self windowSource) next(fn string) (Event, float64, float64, error) {
+	evt, err := self.stream.Next()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	ts, err := getTimestamp(evt, self.timeField)
+	if err != nil {
+		return nil, 0, 0, errors.New(fmt.Sprintf("%s: %s", fn, err.Error()))
+	}
+
+	if !self.needVal {
+		return evt, ts, 0, nil
+	}
+
+	val, ok := getFieldImpl(evt, self.valField)
+	if !ok {
+		return nil, 0, 0, errors.New(fmt.Sprintf("%s: Expected event to have field %s, got %v", fn, self.valField, evt))
+	}
+
+	v, ok := getIntOrFloat(val)
+	if !ok {
+		return nil, 0, 0, errors.New(fmt.Sprintf("%s: Expected number value, got %v", fn, val))
+	}
+
+	return evt, ts, v, nil
+}
+
+type tumblingWindowStream struct {
+	src  windowSource
+	size float64
+	aggs []string
+
+	cur  *windowStats
+	done bool
+}
+
+func (self *tumblingWindowStream) Next() (Event, error) {
+	if self.done {
+		return nil, EOI
+	}
+
+	for {
+		evt, ts, v, err := self.src.next("WindowTumbling")
+		if err == EOI {
+			self.done = true
+			if self.cur == nil {
+				return nil, EOI
+			}
+			return self.cur.event(self.aggs), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		from := math.Floor(ts/self.size) * self.size
+		if self.cur != nil && from < self.cur.from {
+			logPrintf("WindowTumbling: dropping late event %v\n", evt)
+			continue
+		}
+
+		if self.cur != nil && from > self.cur.from {
+			res := self.cur
+			self.cur = newWindowStats(from, from+self.size)
+			self.cur.add(v)
+			return res.event(self.aggs), nil
+		}
+
+		if self.cur == nil {
+			self.cur = newWindowStats(from, from+self.size)
+		}
+		self.cur.add(v)
+	}
+}
+
+/*
+Group events of a stream into consecutive non-overlapping time windows of a given size
+and produce a stream of aggregates of values from each window.
+
+Timestamps are read from the timeField of events and might be numbers or RFC3339 strings, which are converted to unix time in seconds.
+Values are read from the valField and must be numbers.
+Both fields might be deep inside, as in "object.value.data".
+
+Each resulting event has fields "from" and "to" with window bounds and a field for every requested aggregate,
+which are "count", "sum", "avg", "min" and "max".
+
+A window is emitted when the first event past it's end arrives, so events are expected to be ordered by time.
+Events for windows that were already emitted are dropped.
+*/
+func WindowTumbling(stream Stream, timeField string, valField string, size float64, aggs []string) Stream {
+	return &tumblingWindowStream{newWindowSource(stream, timeField, valField, aggs), size, aggs, nil, false}
+}
+
+type slidingWindowStream struct {
+	src   windowSource
+	size  float64
+	slide float64
+	aggs  []string
+
+	windows []*windowStats
+	out     []*windowStats
+	started bool
+	nextK   int64
+	done    bool
+}
+
+func (self *slidingWindowStream) Next() (Event, error) {
+	for {
+		if len(self.out) > 0 {
+			res := self.out[0]
+			self.out[0] = nil // help GC
+			self.out = self.out[1:]
+			return res.event(self.aggs), nil
+		}
+
+		if self.done {
+			return nil, EOI
+		}
+
+		evt, ts, v, err := self.src.next("WindowSliding")
+		if err == EOI {
+			self.done = true
+			self.out = self.windows
+			self.windows = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		closed := 0
+		for closed < len(self.windows) && self.windows[closed].to <= ts {
+			closed++
+		}
+		self.out = append(self.out, self.windows[:closed]...)
+		self.windows = self.windows[closed:]
+
+		first := int64(math.Floor((ts-self.size)/self.slide)) + 1
+		last := int64(math.Floor(ts / self.slide))
+		if self.started && first < self.nextK {
+			first = self.nextK
+		}
+		for k := first; k <= last; k++ {
+			from := float64(k) * self.slide
+			self.windows = append(self.windows, newWindowStats(from, from+self.size))
+			self.nextK = k + 1
+			self.started = true
+		}
+
+		added := false
+		for _, w := range self.windows {
+			if w.from <= ts && ts < w.to {
+				w.add(v)
+				added = true
+			}
+		}
+		if !added {
+			logPrintf("WindowSliding: dropping late event %v\n", evt)
+		}
+	}
+}
+
+/*
+Group events of a stream into overlapping time windows of a given size, starting every slide,
+and produce a stream of aggregates of values from each window.
+
+Fields and aggregates are the same as in WindowTumbling.
+Windows without events are not emitted.
+*/
+func WindowSliding(stream Stream, timeField string, valField string, size float64, slide float64, aggs []string) Stream {
+	return &slidingWindowStream{newWindowSource(stream, timeField, valField, aggs), size, slide, aggs, nil, nil, false, 0, false}
+}
+
+type group struct {
+	key interface{}
+	p   *Pusher
+}
+
+type groupByStream struct {
+	stream   Stream
+	keyField string
+	fn       func(Stream) (Stream, error)
+	tag      bool
+
+	groups map[interface{}]*group
+	order  []*group
+	out    []Event
+	done   bool
+}
+
+func (self *groupByStream) result(g *group, evt Event) Event {
+	if !self.tag {
+		return evt
+	}
+	return map[string]interface{}{
+		"key":   g.key,
+		"value": evt,
+	}
+}
+
+// Check that a key can be used in a map.
+func checkKey(fn string, key interface{}) error {
+	switch key.(type) {
+	case string, int64, float64, bool, nil:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%s: Expected key to be string, number, bool or null, got %v", fn, key))
+}
+
+func (self *groupByStream) getGroup(key interface{}) (*group, error) {
+	if err := checkKey("GroupBy", key); err != nil {
+		return nil, err
+	}
+
+	g, ok := self.groups[key]
+	if ok {
+		return g, nil
+	}
+
+	p, err := PushFunc(self.fn)
+	if err != nil {
+		return nil, err
+	}
+
+	g = &group{key, p}
+	self.groups[key] = g
+	self.order = append(self.order, g)
+	return g, nil
+}
+
+// Collect events the group's stream produced.
+func (self *groupByStream) collect(g *group, res []Event, err error) error {
+	for _, evt := range res {
+		self.out = append(self.out, self.result(g, evt))
+	}
+	if err == EOI {
+		return nil
+	}
+	return err
+}
+
+func (self *groupByStream) Next() (Event, error) {
+	for {
+		if len(self.out) > 0 {
+			res := self.out[0]
+			self.out[0] = nil // help GC
+			self.out = self.out[1:]
+			return res, nil
+		}
+
+		if self.done {
+			return nil, EOI
+		}
+
+		evt, err := self.stream.Next()
+		if err == EOI {
+			self.done = true
+			errs := errors.List()
+			for _, g := range self.order {
+				res, err := g.p.Finish(nil)
+				errs.Add(self.collect(g, res, err))
+			}
+			if err := errs.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := getFieldImpl(evt, self.keyField)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("GroupBy: Expected event to have field %s, got %v", self.keyField, evt))
+		}
+
+		g, err := self.getGroup(key)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := g.p.Push("input", evt, nil)
+		if err := self.collect(g, res, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+Partition a stream by a value of the key field of it's events and run an independent stream
+created by fn on the events with each distinct key.
+
+The key field might be deep inside, as in "object.value.data", and it's values must be strings, numbers, bools or nulls.
+If tag is true, each resulting event is wrapped into an object {"key": key, "value": event}.
+
+Streams are created lazily when the first event with a new key arrives and are never deleted,
+so the memory consumption is linear to the number of distinct keys.
+*/
+func GroupBy(stream Stream, keyField string, fn func(Stream) (Stream, error), tag bool) Stream {
+	return &groupByStream{stream, keyField, fn, tag, map[interface{}]*group{}, nil, nil, false}
+}
+
+/*
+Takes a stream af strings and append a given string to all of them.
+*/
+func StringAppend(stream Stream, suf string) Stream {
+	return Map(stream, func(val Event) (Event, error) {
+		v, ok := val.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("StringAppend: Expected event to be string, got %v", v))
+		}
 
 		return v + suf, nil
 	})
@@ -976,6 +1913,330 @@ func Join(streams ...Stream) Stream {
 	return &joinStream{streams}
 }
 
+type joinEntry struct {
+	key     interface{}
+	evt     Event
+	ts      float64
+	matched bool
+}
+
+type joinSide struct {
+	stream    Stream
+	keyField  string
+	timeField string
+
+	next *joinEntry
+	done bool
+	// buffered events are buf[head:], evicted ones before head are dropped when they take half of buf
+	buf  []*joinEntry
+	head int
+}
+
+func (self *joinSide) buffered() []*joinEntry {
+	return self.buf[self.head:]
+}
+
+func (self *joinSide) fill(timed bool) error {
+	if self.next != nil || self.done {
+		return nil
+	}
+
+	evt, err := self.stream.Next()
+	if err == EOI {
+		self.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	key, ok := getFieldImpl(evt, self.keyField)
+	if !ok {
+		return errors.New(fmt.Sprintf("JoinBy: Expected event to have field %s, got %v", self.keyField, evt))
+	}
+
+	ts := float64(0)
+	if timed {
+		ts, err = getTimestamp(evt, self.timeField)
+		if err != nil {
+			return errors.New(fmt.Sprintf("JoinBy: %s", err.Error()))
+		}
+	}
+
+	self.next = &joinEntry{key, evt, ts, false}
+	return nil
+}
+
+/*
+Options for joining two streams.
+*/
+type JoinOptions struct {
+	// Fields with keys in events of the left and the right streams, might be deep inside, as in "object.value.data".
+	LeftKey  string
+	RightKey string
+	// Maximum number of events buffered from each stream.
+	// Events are only joined with the last Count events from the other stream.
+	Count int
+	// If Time is not 0, events are only joined if their timestamps differ by no more than Time.
+	// Timestamps are read from LeftTime and RightTime fields as in WindowTumbling.
+	Time      float64
+	LeftTime  string
+	RightTime string
+	// Left outer join: left events that were never joined are emitted with null right events.
+	Outer bool
+}
+
+type joinByStream struct {
+	opts  JoinOptions
+	left  *joinSide
+	right *joinSide
+
+	watermark float64
+	pullRight bool
+	out       []Event
+	finished  bool
+}
+
+func (self *joinByStream) pair(l Event, r Event) Event {
+	return map[string]interface{}{
+		"left":  l,
+		"right": r,
+	}
+}
+
+func (self *joinByStream) evicted(side *joinSide, e *joinEntry) {
+	if side == self.left && self.opts.Outer && !e.matched {
+		self.out = append(self.out, self.pair(e.evt, nil))
+	}
+}
+
+func (self *joinByStream) evict(side *joinSide) {
+	for side.head < len(side.buf) {
+		e := side.buf[side.head]
+		if len(side.buf)-side.head <= self.opts.Count && (self.opts.Time == 0 || e.ts >= self.watermark-self.opts.Time) {
+			break
+		}
+
+		self.evicted(side, e)
+		side.buf[side.head] = nil // help GC
+		side.head++
+	}
+
+	if side.head > len(side.buf)/2 {
+		n := copy(side.buf, side.buf[side.head:])
+		side.buf = side.buf[:n]
+		side.head = 0
+	}
+}
+
+func (self *joinByStream) inWindow(a *joinEntry, b *joinEntry) bool {
+	if self.opts.Time == 0 {
+		return true
+	}
+	return math.Abs(a.ts-b.ts) <= self.opts.Time
+}
+
+func (self *joinByStream) add(side *joinSide, other *joinSide, e *joinEntry) {
+	if e.ts > self.watermark {
+		self.watermark = e.ts
+	}
+
+	for _, o := range other.buffered() {
+		if !reflect.DeepEqual(o.key, e.key) || !self.inWindow(e, o) {
+			continue
+		}
+
+		o.matched = true
+		e.matched = true
+		if side == self.left {
+			self.out = append(self.out, self.pair(e.evt, o.evt))
+		} else {
+			self.out = append(self.out, self.pair(o.evt, e.evt))
+		}
+	}
+
+	side.buf = append(side.buf, e)
+	self.evict(self.left)
+	self.evict(self.right)
+}
+
+func (self *joinByStream) Next() (Event, error) {
+	for {
+		if len(self.out) > 0 {
+			res := self.out[0]
+			self.out[0] = nil // help GC
+			self.out = self.out[1:]
+			return res, nil
+		}
+
+		if self.finished {
+			return nil, EOI
+		}
+
+		// a side without a pushed event doesn't stop the other one, as events are pushed to one of them at a time,
+		// but any other error stops the join
+		timed := self.opts.Time != 0
+		lerr := self.left.fill(timed)
+		if lerr != nil && !isPushMarker(lerr) {
+			return nil, lerr
+		}
+		rerr := self.right.fill(timed)
+		if rerr != nil && !isPushMarker(rerr) {
+			return nil, rerr
+		}
+
+		var side, other *joinSide
+		l, r := self.left.next, self.right.next
+		switch {
+		case l == nil && r == nil:
+			if lerr != nil {
+				return nil, lerr
+			}
+			if rerr != nil {
+				return nil, rerr
+			}
+
+			self.finished = true
+			for _, e := range self.left.buffered() {
+				self.evicted(self.left, e)
+			}
+			self.left.buf, self.left.head = nil, 0
+			self.right.buf, self.right.head = nil, 0
+			continue
+		case l == nil:
+			side, other = self.right, self.left
+		case r == nil:
+			side, other = self.left, self.right
+		case timed:
+			if r.ts < l.ts {
+				side, other = self.right, self.left
+			} else {
+				side, other = self.left, self.right
+			}
+		default:
+			if self.pullRight {
+				side, other = self.right, self.left
+			} else {
+				side, other = self.left, self.right
+			}
+			self.pullRight = !self.pullRight
+		}
+
+		e := side.next
+		side.next = nil
+		self.add(side, other, e)
+	}
+}
+
+/*
+Join two streams by keys: produce a stream of {"left": l, "right": r} objects for all pairs of events from the left and the right streams with equal keys.
+
+Only a bounded number of events from each stream is kept, see JoinOptions.
+If events are timed, both streams are read in order of their timestamps, otherwise they are read alternately.
+*/
+func JoinBy(left Stream, right Stream, opts JoinOptions) Stream {
+	return &joinByStream{
+		opts,
+		&joinSide{left, opts.LeftKey, opts.LeftTime, nil, false, nil, 0},
+		&joinSide{right, opts.RightKey, opts.RightTime, nil, false, nil, 0},
+		-math.MaxFloat64, false, nil, false,
+	}
+}
+
+type dedupEntry struct {
+	key interface{}
+	ts  float64
+	// position of the event in the stream
+	pos uint64
+}
+
+type dedupStream struct {
+	stream    Stream
+	name      string
+	keyField  string
+	timeField string
+	window    float64
+	n         int
+
+	// entries of passed events in the order they came, so that the oldest ones are in the front
+	seen *list.List
+	keys map[interface{}]*list.Element
+	pos  uint64
+}
+
+// Forget keys of events that are not among the last n ones or out of the time window.
+func (self *dedupStream) evict(watermark float64) {
+	for self.seen.Len() > 0 {
+		front := self.seen.Front()
+		e := front.Value.(dedupEntry)
+		if self.pos-e.pos <= uint64(self.n) && (self.window == 0 || e.ts >= watermark-self.window) {
+			break
+		}
+
+		self.seen.Remove(front)
+		delete(self.keys, e.key)
+	}
+}
+
+func (self *dedupStream) Next() (Event, error) {
+	for {
+		evt, err := self.stream.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := getFieldImpl(evt, self.keyField)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s: Expected event to have field %s, got %v", self.name, self.keyField, evt))
+		}
+
+		if err := checkKey(self.name, key); err != nil {
+			return nil, err
+		}
+
+		ts := float64(0)
+		if self.window != 0 {
+			ts, err = getTimestamp(evt, self.timeField)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s", self.name, err.Error()))
+			}
+		}
+
+		// expire old keys before the check, so that they are not considered seen
+		self.pos++
+		self.evict(ts)
+
+		// a dropped duplicate doesn't renew the key, so it's let through again when the passed one expires
+		if _, ok := self.keys[key]; ok {
+			continue
+		}
+
+		self.keys[key] = self.seen.PushBack(dedupEntry{key, ts, self.pos})
+		return evt, nil
+	}
+}
+
+/*
+Drop events with the value of the key field that was already seen among the last n events.
+
+The key field might be deep inside, as in "object.value.data", and it's values must be strings, numbers, bools or nulls.
+Only passed events count as seen, so a key that keeps repeating is let through once every n events.
+*/
+func Dedup(stream Stream, keyField string, n int) Stream {
+	return &dedupStream{stream, "Dedup", keyField, "", 0, n, list.New(), map[interface{}]*list.Element{}, 0}
+}
+
+/*
+Drop events with the value of the key field that was already seen within the time window,
+but remember keys of no more than n last events.
+
+Timestamps are read from the timeField as in WindowTumbling and events are expected to be ordered by time.
+Only passed events count as seen, so a key that keeps repeating is let through once every window.
+*/
+func DedupTime(stream Stream, keyField string, timeField string, window float64, n int) Stream {
+	return &dedupStream{stream, "DedupTime", keyField, timeField, window, n, list.New(), map[interface{}]*list.Element{}, 0}
+}
+
 type drainStream interface {
 	Stream
 	Drain()
@@ -0,0 +1,384 @@
+package stream
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+// Read all events of a stream until EOI or an error.
+func collect(s Stream) ([]Event, error) {
+	res := []Event{}
+	for {
+		evt, err := s.Next()
+		if err == EOI {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, evt)
+	}
+}
+
+func numbers(vals ...interface{}) Stream {
+	evts := make([]Event, len(vals))
+	for i, v := range vals {
+		evts[i] = v
+	}
+	return List(evts)
+}
+
+// Check that a stream produces the expected numbers up to a rounding error.
+func checkFloats(t *testing.T, name string, expected []float64, s Stream) {
+	res, err := collect(s)
+	assert.Nil(t, err, name)
+	if !assert.Equal(t, len(expected), len(res), name) {
+		return
+	}
+
+	for i, v := range expected {
+		assert.InDelta(t, v, res[i], 1e-6, name)
+	}
+}
+
+func timed(t interface{}, v int64) Event {
+	return map[string]interface{}{"t": t, "v": v}
+}
+
+func window(from float64, to float64, count int64, sum float64) Event {
+	return map[string]interface{}{"from": from, "to": to, "count": count, "sum": sum}
+}
+
+// Test that tumbling windows are emitted when the first event past their end arrives and late events are dropped.
+func TestWindowTumbling(t *testing.T) {
+	evts := []Event{timed(int64(1), 1), timed(5.5, 2), timed(int64(10), 3), timed(int64(7), 100), timed(int64(25), 4)}
+	res, err := collect(WindowTumbling(List(evts), "t", "v", 10, []string{"count", "sum"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		window(0, 10, 2, 3),
+		// an event at the boundary opens the next window, the late one is not counted
+		window(10, 20, 1, 3),
+		window(20, 30, 1, 4),
+	}, res)
+
+	res, err = collect(WindowTumbling(List([]Event{}), "t", "v", 10, []string{"count"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{}, res)
+}
+
+// Test that RFC3339 timestamps are converted to unix time in seconds.
+func TestWindowTumblingRFC3339(t *testing.T) {
+	evts := []Event{
+		timed("2020-01-01T00:00:10Z", 4),
+		timed("2020-01-01T00:00:50.5Z", 2),
+		timed("2020-01-01T01:00:59+01:00", 7),
+		timed("2020-01-01T00:01:05Z", 1),
+	}
+	res, err := collect(WindowTumbling(List(evts), "t", "v", 60, []string{"count", "avg", "min", "max"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		map[string]interface{}{"from": 1577836800.0, "to": 1577836860.0, "count": int64(3), "avg": 13.0 / 3.0, "min": 2.0, "max": 7.0},
+		map[string]interface{}{"from": 1577836860.0, "to": 1577836920.0, "count": int64(1), "avg": 1.0, "min": 1.0, "max": 1.0},
+	}, res)
+
+	_, err = WindowTumbling(List([]Event{timed("yesterday", 1)}), "t", "v", 60, []string{"count"}).Next()
+	assert.NotNil(t, err)
+}
+
+// Test that sliding windows overlap, so that an event is counted in every window that covers it.
+func TestWindowSliding(t *testing.T) {
+	evts := []Event{timed(int64(1), 1), timed(int64(6), 2), timed(int64(12), 3)}
+	res, err := collect(WindowSliding(List(evts), "t", "v", 10, 5, []string{"count", "sum"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		window(-5, 5, 1, 1),
+		window(0, 10, 2, 3),
+		window(5, 15, 2, 5),
+		window(10, 20, 1, 3),
+	}, res)
+}
+
+// Test that rolling statistics cover the numbers so far while the window fills up and the last n ones after that.
+func TestRollingStats(t *testing.T) {
+	checkFloats(t, "sum", []float64{1, 3, 6, 9, 12}, RollingSum(numbers(int64(1), int64(2), 3.0, int64(4), int64(5)), 3))
+	checkFloats(t, "mean", []float64{1, 1.5, 2, 3, 4}, RollingMean(numbers(int64(1), int64(2), int64(3), int64(4), int64(5)), 3))
+	checkFloats(t, "min", []float64{5, 3, 3, 1, 1, 1, 4}, RollingMin(numbers(int64(5), int64(3), int64(4), int64(1), int64(6), int64(7), int64(4)), 3))
+	checkFloats(t, "max", []float64{1, 3, 3, 3, 5, 5, 5}, RollingMax(numbers(int64(1), int64(3), int64(2), int64(1), int64(5), int64(4), int64(0)), 3))
+	checkFloats(t, "window of one", []float64{1, 2, 3}, RollingSum(numbers(int64(1), int64(2), int64(3)), 1))
+	checkFloats(t, "window bigger than the stream", []float64{1, 3, 6}, RollingSum(numbers(int64(1), int64(2), int64(3)), 1000000000))
+}
+
+// Test that the rolling standard deviation stays exact as numbers are evicted from the window, even for big ones.
+func TestRollingStddev(t *testing.T) {
+	checkFloats(t, "small", []float64{0, 1, math.Sqrt(8.0 / 3.0), math.Sqrt(8.0 / 3.0), math.Sqrt(32.0 / 9.0), 0},
+		RollingStddev(numbers(int64(1), int64(3), int64(5), int64(1), int64(1), int64(1)), 3))
+	checkFloats(t, "big", []float64{0, 1.5, 3, 1.5},
+		RollingStddev(numbers(1e9+4, 1e9+7, 1e9+13, 1e9+16), 2))
+}
+
+// Test that rolling quantiles are interpolated between the closest ranks of the numbers in the window.
+func TestRollingQuantile(t *testing.T) {
+	checkFloats(t, "median", []float64{1, 2, 2, 2.5, 3.5}, RollingQuantile(numbers(int64(1), int64(3), int64(2), int64(10), int64(4)), 4, 0.5))
+	checkFloats(t, "interpolated", []float64{1, 1.1, 1.2, 1.3, 1.4}, RollingQuantile(numbers(int64(1), int64(2), int64(3), int64(4), int64(5)), 5, 0.1))
+	checkFloats(t, "min", []float64{2, 2, 2, 1}, RollingQuantile(numbers(int64(2), int64(2), int64(2), int64(1)), 2, 0))
+	checkFloats(t, "max", []float64{2, 5, 5, 1}, RollingQuantile(numbers(int64(2), int64(5), int64(1), int64(1)), 2, 1))
+}
+
+// Test that rolling statistics fail on non-positive windows and non-number events.
+func TestRollingErrors(t *testing.T) {
+	_, err := RollingSum(numbers(int64(1)), 0).Next()
+	assert.NotNil(t, err)
+	_, err = RollingMean(numbers(int64(1)), -1).Next()
+	assert.NotNil(t, err)
+	_, err = RollingStddev(numbers("a"), 2).Next()
+	assert.NotNil(t, err)
+}
+
+func keyed(k interface{}, v int64) Event {
+	return map[string]interface{}{"k": k, "v": v}
+}
+
+// Test that group_by keeps independent state for each key and tags results with the key.
+func TestGroupBy(t *testing.T) {
+	RegisterDefault()
+
+	evts := []Event{keyed("a", 1), keyed("b", 10), keyed("a", 2), keyed(int64(1), 5), keyed("b", 20), keyed("a", 3)}
+	s, err := Run(List(evts), []string{`{"group_by": [{"load": "input"}, "k", {"sum_n": [{"get_field": [{"load": "input"}, "v"]}, 10]}, true]}`})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res, err := collect(s)
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		map[string]interface{}{"key": "a", "value": 1.0},
+		map[string]interface{}{"key": "b", "value": 10.0},
+		map[string]interface{}{"key": "a", "value": 3.0},
+		map[string]interface{}{"key": int64(1), "value": 5.0},
+		map[string]interface{}{"key": "b", "value": 30.0},
+		map[string]interface{}{"key": "a", "value": 6.0},
+	}, res)
+
+	s, err = Run(List(evts), []string{`{"group_by": [{"load": "input"}, "k", {"sum_n": [{"get_field": [{"load": "input"}, "v"]}, 10]}]}`})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res, err = collect(s)
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{1.0, 10.0, 3.0, 5.0, 30.0, 6.0}, res)
+}
+
+// Test that group_by fails on events without the key field or with keys that can't be compared.
+func TestGroupByErrors(t *testing.T) {
+	fn := func(s Stream) (Stream, error) {
+		return s, nil
+	}
+
+	res, err := collect(GroupBy(List([]Event{keyed("a", 1), map[string]interface{}{"v": int64(2)}}), "k", fn, false))
+	assert.NotNil(t, err)
+	assert.Equal(t, []Event{keyed("a", 1)}, res)
+
+	_, err = collect(GroupBy(List([]Event{keyed([]interface{}{"a"}, 1)}), "k", fn, false))
+	assert.NotNil(t, err)
+}
+
+// Test that integer arithmetic falls back to floats on overflow, the same as Pow.
+func TestArithOverflow(t *testing.T) {
+	examples := []struct {
+		Name string
+		S    Stream
+		Res  Event
+	}{
+		{"plus", Plus(Const(int64(2)), Const(int64(3))), int64(5)},
+		{"plus overflow", Plus(Const(int64(math.MaxInt64)), Const(int64(1))), float64(math.MaxInt64) + 1},
+		{"plus negative overflow", Plus(Const(int64(math.MinInt64)), Const(int64(-1))), float64(math.MinInt64) - 1},
+		{"minus", Minus(Const(int64(2)), Const(int64(3))), int64(-1)},
+		{"minus overflow", Minus(Const(int64(math.MinInt64)), Const(int64(1))), float64(math.MinInt64) - 1},
+		{"minus negative overflow", Minus(Const(int64(0)), Const(int64(math.MinInt64))), -float64(math.MinInt64)},
+		{"mul", Mul(Const(int64(-4)), Const(int64(3))), int64(-12)},
+		{"mul overflow", Mul(Const(int64(math.MaxInt64/2+1)), Const(int64(2))), float64(math.MaxInt64/2+1) * 2},
+		{"mul overflow of min", Mul(Const(int64(math.MinInt64)), Const(int64(-1))), -float64(math.MinInt64)},
+		{"div overflow", Div(Const(int64(math.MinInt64)), Const(int64(-1))), -float64(math.MinInt64)},
+		{"mod", Mod(Const(int64(math.MinInt64)), Const(int64(-1))), int64(0)},
+		{"mixed", Plus(Const(int64(math.MaxInt64)), Const(int64(1)), Const(int64(-1))), float64(math.MaxInt64)},
+		{"pow overflow", Pow(Const(int64(2)), Const(int64(64))), math.Pow(2, 64)},
+		{"abs", Abs(Const(int64(-5))), int64(5)},
+		{"abs of min", Abs(Const(int64(math.MinInt64))), -float64(math.MinInt64)},
+		{"round", Round(Const(-2.5)), int64(-3)},
+		{"round of min", Round(Const(float64(math.MinInt64))), int64(math.MinInt64)},
+		{"round out of range", Round(Const(1e19)), 1e19},
+		{"round of inf", Round(Const(math.Inf(-1))), math.Inf(-1)},
+	}
+	for _, e := range examples {
+		res, err := e.S.Next()
+		assert.Nil(t, err, e.Name)
+		assert.Equal(t, e.Res, res, e.Name)
+	}
+
+	res, err := Round(Const(math.NaN())).Next()
+	assert.Nil(t, err)
+	assert.True(t, math.IsNaN(res.(float64)))
+}
+
+func joinEvent(k int64, t int64, v string) Event {
+	return map[string]interface{}{"k": k, "t": t, "v": v}
+}
+
+// Get pairs of values of joined events, "-" for a null right event.
+func joinedValues(t *testing.T, s Stream) [][2]string {
+	res, err := collect(s)
+	assert.Nil(t, err)
+
+	vals := [][2]string{}
+	for _, evt := range res {
+		pair := [2]string{"-", "-"}
+		for i, side := range []string{"left", "right"} {
+			if v, ok := getFieldImpl(evt, side+".v"); ok {
+				pair[i] = v.(string)
+			}
+		}
+		vals = append(vals, pair)
+	}
+	return vals
+}
+
+type errStream struct{}
+
+func (self errStream) Next() (Event, error) {
+	return nil, errors.New("errStream: failed")
+}
+
+// Test that inner and left outer joins pair events with equal keys.
+func TestJoin(t *testing.T) {
+	left := []Event{joinEvent(1, 0, "a"), joinEvent(2, 0, "b")}
+	right := []Event{joinEvent(1, 0, "x"), joinEvent(3, 0, "y"), joinEvent(1, 0, "z")}
+
+	opts := JoinOptions{LeftKey: "k", RightKey: "k", Count: 1000}
+	assert.Equal(t, [][2]string{{"a", "x"}, {"a", "z"}}, joinedValues(t, JoinBy(List(left), List(right), opts)))
+
+	opts.Outer = true
+	assert.Equal(t, [][2]string{{"a", "x"}, {"a", "z"}, {"b", "-"}}, joinedValues(t, JoinBy(List(left), List(right), opts)))
+}
+
+// Test that events are only joined with the last Count events from the other stream.
+func TestJoinCount(t *testing.T) {
+	left := []Event{joinEvent(1, 0, "a"), joinEvent(1, 0, "b")}
+	right := []Event{joinEvent(1, 0, "x"), joinEvent(1, 0, "y")}
+
+	opts := JoinOptions{LeftKey: "k", RightKey: "k", Count: 1}
+	assert.Equal(t, [][2]string{{"a", "x"}, {"b", "x"}, {"b", "y"}}, joinedValues(t, JoinBy(List(left), List(right), opts)))
+
+	opts.Count = 2
+	assert.Equal(t, [][2]string{{"a", "x"}, {"b", "x"}, {"a", "y"}, {"b", "y"}}, joinedValues(t, JoinBy(List(left), List(right), opts)))
+}
+
+// Test that timed events are joined within Time and unmatched left ones are emitted by an outer join when they are evicted.
+func TestJoinTime(t *testing.T) {
+	left := []Event{joinEvent(1, 0, "a"), joinEvent(2, 1, "c"), joinEvent(1, 10, "b")}
+	right := []Event{joinEvent(1, 3, "x"), joinEvent(1, 12, "y")}
+
+	opts := JoinOptions{LeftKey: "k", RightKey: "k", Count: 1000, Time: 5, LeftTime: "t", RightTime: "t", Outer: true}
+	assert.Equal(t, [][2]string{{"a", "x"}, {"c", "-"}, {"b", "y"}}, joinedValues(t, JoinBy(List(left), List(right), opts)))
+}
+
+// Test that errors of either side stop the join even if the other side has events.
+func TestJoinErrors(t *testing.T) {
+	good := []Event{joinEvent(1, 0, "x"), joinEvent(1, 0, "y")}
+	opts := JoinOptions{LeftKey: "k", RightKey: "k", Count: 1000}
+	check := func(name string, s Stream) {
+		_, err := s.Next()
+		assert.True(t, err != nil && err != EOI, name)
+	}
+
+	check("left key", JoinBy(List([]Event{map[string]interface{}{"v": "a"}}), List(good), opts))
+	check("right key", JoinBy(List(good), List([]Event{map[string]interface{}{"v": "a"}}), opts))
+	check("left read", JoinBy(errStream{}, List(good), opts))
+	check("right read", JoinBy(List(good), errStream{}, opts))
+
+	opts.Time, opts.LeftTime, opts.RightTime = 5, "t", "t"
+	check("left time", JoinBy(List([]Event{map[string]interface{}{"k": int64(1), "t": "now"}}), List(good), opts))
+}
+
+// Test that a join of named inputs gets events pushed to one of them at a time.
+func TestJoinPushed(t *testing.T) {
+	RegisterDefault()
+
+	p, err := NewPusher([]string{"l", "r"}, []string{`{"join": [{"load": "l"}, {"load": "r"}, {"left_key": "k", "right_key": "k"}]}`})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	res, err := p.Push("l", joinEvent(1, 0, "a"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	res, err = p.Push("r", joinEvent(1, 0, "x"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{map[string]interface{}{"left": joinEvent(1, 0, "a"), "right": joinEvent(1, 0, "x")}}, res)
+
+	res, err = p.Push("l", map[string]interface{}{"v": "b"}, nil)
+	assert.NotNil(t, err)
+}
+
+func dedupKeys(t *testing.T, s Stream) []string {
+	res, err := collect(s)
+	assert.Nil(t, err)
+
+	keys := []string{}
+	for _, evt := range res {
+		k, _ := getFieldImpl(evt, "k")
+		keys = append(keys, k.(string))
+	}
+	return keys
+}
+
+func dedupEvents(keys string, times ...int64) Stream {
+	evts := []Event{}
+	for i, k := range keys {
+		evt := map[string]interface{}{"k": string(k)}
+		if len(times) != 0 {
+			evt["t"] = times[i]
+		}
+		evts = append(evts, evt)
+	}
+	return List(evts)
+}
+
+// Test that Dedup drops keys seen among the last n events and lets a repeating key through once every n events.
+func TestDedup(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c", "a", "b"}, dedupKeys(t, Dedup(dedupEvents("abacaab"), "k", 2)))
+	assert.Equal(t, []string{"a", "a", "a"}, dedupKeys(t, Dedup(dedupEvents("aaaaaaa"), "k", 2)))
+	assert.Equal(t, []string{"a", "b", "a", "b"}, dedupKeys(t, Dedup(dedupEvents("abababab"), "k", 2)))
+
+	_, err := Dedup(List([]Event{map[string]interface{}{"v": "a"}}), "k", 2).Next()
+	assert.True(t, err != nil && err != EOI)
+}
+
+// Test that DedupTime lets a repeating key through once every window and only remembers keys of the last n events.
+func TestDedupTime(t *testing.T) {
+	assert.Equal(t, []string{"a", "a", "a"}, dedupKeys(t, DedupTime(dedupEvents("aaaaaaa", 0, 4, 8, 12, 16, 20, 24), "k", "t", 10, 1000)))
+	assert.Equal(t, []string{"a", "b", "a"}, dedupKeys(t, DedupTime(dedupEvents("aba", 0, 1, 2), "k", "t", 10, 1)))
+
+	_, err := DedupTime(List([]Event{map[string]interface{}{"k": "a"}}), "k", "t", 10, 1).Next()
+	assert.True(t, err != nil && err != EOI)
+}
+
+// Test the dedup function with a count and a time window.
+func TestDedupFn(t *testing.T) {
+	RegisterDefault()
+
+	s, err := Run(dedupEvents("abacaab"), []string{`{"dedup": [{"load": "input"}, "k", 2]}`})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"a", "b", "c", "a", "b"}, dedupKeys(t, s))
+	}
+
+	s, err = Run(dedupEvents("aaa", 0, 5, 11), []string{`{"dedup": [{"load": "input"}, "k", {"time": 10, "time_field": "t"}]}`})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"a", "a"}, dedupKeys(t, s))
+	}
+}
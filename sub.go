@@ -0,0 +1,418 @@
+package golfstream
+
+import (
+	"fmt"
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	"log"
+	"sync"
+)
+
+// Policies of handling subscribers which queues are full.
+const (
+	// Wait until the subscriber takes an event from it's queue, so adding events to the backend stream waits too.
+	OverflowBlock = "block"
+	// Drop the oldest event in the queue.
+	OverflowDropOldest = "drop_oldest"
+	// Drop the new event.
+	OverflowDropNewest = "drop_newest"
+	// Remove the subscriber from the backend stream and close it.
+	OverflowDisconnect = "disconnect"
+)
+
+/*
+Options of delivering events to a subscriber.
+
+With Replay, the subscriber first gets events of the backend stream starting from the offset From
+and then the new ones, without gaps or duplicates unless the overflow policy drops events.
+*/
+type SubOptions struct {
+	// Size of the subscriber's queue, zero means that events are added to the subscriber as they are added to the backend stream.
+	Queue int
+	// What to do when the queue is full: OverflowBlock, which is the default, OverflowDropOldest, OverflowDropNewest or OverflowDisconnect.
+	Overflow string
+	// Replay events starting from the offset From, new events wait in the queue meanwhile, so a subscriber without one gets the default queue size.
+	Replay bool
+	From   uint
+	// Stream definitions, the same as of a stream, to run events through before adding them to the subscriber,
+	// so that it only gets the resulting ones.
+	Defs []string
+}
+
+// Options of websocket subscribers which didn't specify any, a client which stops reading events is disconnected instead of holding up adding them.
+var DefaultSubOptions = SubOptions{1024, OverflowDisconnect, false, 0, nil}
+
+func (self SubOptions) validate() error {
+	if self.Queue < 0 {
+		return errors.New(fmt.Sprintf("SubOptions: Expected non-negative queue size, got %v", self.Queue))
+	}
+
+	switch self.Overflow {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("SubOptions: Expected overflow policy to be one of \"%s\", \"%s\", \"%s\" and \"%s\", got \"%s\"", OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDisconnect, self.Overflow))
+}
+
+/*
+OffsetStream is a subscriber which gets offsets of events in the backend stream along with the events.
+
+Offsets are positions of events in the backend stream plus the number of events ever deleted from it's beginning,
+as in backend.BaseStream, so deleting old events doesn't change offsets of the following ones.
+*/
+type OffsetStream interface {
+	backend.Stream
+	AddOffset(offset uint, evt stream.Event) error
+}
+
+/*
+Add events with consecutive offsets starting from the offset to a subscriber, returns how many of them were added.
+
+Events of a batch added to a subscriber without offsets are all counted as not added if adding the batch fails.
+*/
+func addOffsets(s backend.Stream, offset uint, evts []stream.Event) (int, error) {
+	os, ok := s.(OffsetStream)
+	if !ok {
+		if err := backend.AddBatch(s, evts); err != nil {
+			return 0, err
+		}
+		return len(evts), nil
+	}
+
+	for i, evt := range evts {
+		if err := os.AddOffset(offset+uint(i), evt); err != nil {
+			return i, err
+		}
+	}
+	return len(evts), nil
+}
+
+/*
+A subscriber which gets events transformed by stream definitions.
+
+Resulting events get the offset of the event they were produced from, so several of them might have the same one.
+*/
+type filterSub struct {
+	s backend.Stream
+
+	lock sync.Mutex
+	p    *stream.Pusher
+}
+
+func newFilterSub(s backend.Stream, defs []string) (*filterSub, error) {
+	p, err := stream.NewPusher([]string{"input"}, defs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterSub{s, sync.Mutex{}, p}, nil
+}
+
+func (self *filterSub) run(evt stream.Event) ([]stream.Event, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.p.Push("input", evt, nil)
+}
+
+func (self *filterSub) Add(evt stream.Event) error {
+	res, err := self.run(evt)
+
+	errs := errors.List().Add(err)
+	if len(res) != 0 {
+		errs.Add(backend.AddBatch(self.s, res))
+	}
+	return errs.Err()
+}
+
+func (self *filterSub) AddOffset(offset uint, evt stream.Event) error {
+	res, err := self.run(evt)
+
+	errs := errors.List().Add(err)
+	os, ok := self.s.(OffsetStream)
+	for _, v := range res {
+		if ok {
+			errs.Add(os.AddOffset(offset, v))
+		} else {
+			errs.Add(self.s.Add(v))
+		}
+	}
+	return errs.Err()
+}
+
+func (self *filterSub) Close() error {
+	return self.s.Close()
+}
+
+// Delivery stats of a subscriber.
+type SubStats struct {
+	// Number of events in the queue: how far the subscriber is behind the backend stream.
+	Lag int `json:"lag"`
+	// Maximum lag so far.
+	MaxLag int `json:"max_lag"`
+	// Number of events successfully added to the subscriber.
+	Delivered uint64 `json:"delivered"`
+	// Number of events dropped because the queue was full or the subscriber failed to get them and was disconnected.
+	Dropped uint64 `json:"dropped"`
+	// Offset of the next event to add to the subscriber.
+	Offset uint `json:"offset"`
+	// Offset of the first event added to the subscriber, the backend stream's one when it subscribed unless it replays events.
+	Start uint `json:"start"`
+	// Events before this offset are acknowledged by the subscriber, it's Start until it acknowledges any.
+	Acked uint `json:"acked"`
+}
+
+type subEvent struct {
+	offset uint
+	evt    stream.Event
+}
+
+/*
+A subscriber with a queue of events, which are added to it in the background.
+
+Without a queue, events are added to the subscriber right away, only the stats are collected.
+*/
+type subQueue struct {
+	s    backend.Stream
+	opts SubOptions
+	// called once when the subscriber is disconnected
+	onDisconnect func()
+	// read events to replay
+	history func(from uint, to uint) (stream.Stream, error)
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []subEvent
+	stats   SubStats
+	stopped bool
+}
+
+// Create a queue of a subscriber which gets events starting from the offset.
+func newSubQueue(s backend.Stream, opts SubOptions, offset uint, history func(uint, uint) (stream.Stream, error), onDisconnect func()) *subQueue {
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowBlock
+	}
+	if opts.Replay && opts.Queue == 0 {
+		opts.Queue = DefaultSubOptions.Queue
+	}
+
+	stats := SubStats{}
+	stats.Offset = offset
+	if opts.Replay {
+		stats.Offset = opts.From
+	}
+	stats.Start = stats.Offset
+	stats.Acked = stats.Offset
+
+	res := &subQueue{s, opts, onDisconnect, history, sync.Mutex{}, nil, []subEvent{}, stats, false}
+	res.cond = sync.NewCond(&res.lock)
+	if opts.Queue > 0 {
+		go res.run(offset)
+	}
+	return res
+}
+
+// Add events with consecutive offsets starting from the offset.
+func (self *subQueue) add(offset uint, evts []stream.Event) error {
+	if self.opts.Queue == 0 {
+		n, err := addOffsets(self.s, offset, evts)
+		if n != 0 {
+			self.delivered(offset, n)
+		}
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, evt := range evts {
+		if !self.push(subEvent{offset + uint(i), evt}) {
+			break
+		}
+	}
+	self.cond.Broadcast()
+	return nil
+}
+
+// Push an event to the queue according to the overflow policy, returns false if the subscriber is gone.
+func (self *subQueue) push(evt subEvent) bool {
+	for !self.stopped && len(self.queue) >= self.opts.Queue {
+		switch self.opts.Overflow {
+		case OverflowBlock:
+			self.cond.Wait()
+		case OverflowDropOldest:
+			self.queue = self.queue[1:]
+			self.stats.Dropped++
+		case OverflowDropNewest:
+			self.stats.Dropped++
+			return true
+		case OverflowDisconnect:
+			self.stats.Dropped += uint64(len(self.queue)) + 1
+			self.stopLocked()
+			go self.disconnect()
+			return false
+		}
+	}
+	if self.stopped {
+		return false
+	}
+
+	self.queue = append(self.queue, evt)
+	if len(self.queue) > self.stats.MaxLag {
+		self.stats.MaxLag = len(self.queue)
+	}
+	return true
+}
+
+func (self *subQueue) disconnect() {
+	if err := self.s.Close(); err != nil {
+		log.Println(fmt.Sprintf("subQueue.disconnect: failed to close subscriber: %s", err.Error()))
+	}
+	self.onDisconnect()
+}
+
+func (self *subQueue) isStopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.stopped
+}
+
+func (self *subQueue) delivered(offset uint, n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.stats.Delivered += uint64(n)
+	self.stats.Offset = offset + uint(n)
+}
+
+// Replay events from the backend stream up to the offset of the first queued one.
+func (self *subQueue) replay(to uint) error {
+	if !self.opts.Replay || self.opts.From >= to {
+		return nil
+	}
+
+	data, err := self.history(self.opts.From, to)
+	if err != nil {
+		return err
+	}
+	defer stream.Drain(data)
+
+	for offset := self.opts.From; offset < to; offset++ {
+		if self.isStopped() {
+			return nil
+		}
+
+		evt, err := data.Next()
+		if err != nil {
+			return err
+		}
+
+		if _, err := addOffsets(self.s, offset, []stream.Event{evt}); err != nil {
+			return err
+		}
+		self.delivered(offset, 1)
+	}
+	return nil
+}
+
+// Disconnect a subscriber which failed to get events, the ones it didn't get, including the queued ones, are counted as dropped.
+func (self *subQueue) fail(lost int) {
+	self.lock.Lock()
+	stopped := self.stopped
+	self.stats.Dropped += uint64(lost + len(self.queue))
+	self.stopLocked()
+	self.lock.Unlock()
+
+	if !stopped {
+		self.disconnect()
+	}
+}
+
+// The subscriber would miss events that failed to replay or to be added, so it's disconnected.
+func (self *subQueue) run(offset uint) {
+	if err := self.replay(offset); err != nil {
+		log.Println(fmt.Sprintf("subQueue.run: failed to replay events to subscriber: %s", err.Error()))
+		self.fail(0)
+		return
+	}
+
+	for {
+		self.lock.Lock()
+		for !self.stopped && len(self.queue) == 0 {
+			self.cond.Wait()
+		}
+		if self.stopped {
+			self.lock.Unlock()
+			return
+		}
+
+		queue := self.queue
+		self.queue = make([]subEvent, 0, len(queue))
+		self.cond.Broadcast()
+		self.lock.Unlock()
+
+		// dropped events break the queue into runs of consecutive offsets
+		for len(queue) != 0 {
+			n := 1
+			for n < len(queue) && queue[n].offset == queue[0].offset+uint(n) {
+				n++
+			}
+
+			evts := make([]stream.Event, n)
+			for i, v := range queue[:n] {
+				evts[i] = v.evt
+			}
+
+			added, err := addOffsets(self.s, queue[0].offset, evts)
+			if added != 0 {
+				self.delivered(queue[0].offset, added)
+			}
+			if err != nil {
+				log.Println(fmt.Sprintf("subQueue.run: failed to add events to subscriber: %s", err.Error()))
+				self.fail(len(queue) - added)
+				return
+			}
+			queue = queue[n:]
+		}
+	}
+}
+
+// Acknowledge events up to and including the offset.
+func (self *subQueue) ack(offset uint) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if offset < self.stats.Start || offset >= self.stats.Offset {
+		return errors.New(fmt.Sprintf("subQueue.ack: Expected offset of a delivered event, in [%v, %v), got %v", self.stats.Start, self.stats.Offset, offset))
+	}
+
+	if offset+1 > self.stats.Acked {
+		self.stats.Acked = offset + 1
+	}
+	return nil
+}
+
+func (self *subQueue) stopLocked() {
+	self.stopped = true
+	self.queue = nil
+	self.cond.Broadcast()
+}
+
+// Stop delivering events, the ones left in the queue are dropped.
+func (self *subQueue) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.stopLocked()
+}
+
+func (self *subQueue) getStats() SubStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := self.stats
+	res.Lag = len(self.queue)
+	return res
+}
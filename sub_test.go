@@ -0,0 +1,428 @@
+package golfstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Monnoroch/golfstream/backend"
+	"github.com/Monnoroch/golfstream/errors"
+	"github.com/Monnoroch/golfstream/stream"
+	// TODO: move to original repo.
+	"github.com/Monnoroch/testify/assert"
+)
+
+/*
+A subscriber which records events with their offsets.
+
+With a gate, it signals entering the first AddOffset and waits for the gate to be closed.
+*/
+type testSub struct {
+	lock   sync.Mutex
+	offs   []uint
+	evts   []string
+	closed bool
+
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func newGatedSub() *testSub {
+	return &testSub{gate: make(chan struct{}), entered: make(chan struct{})}
+}
+
+func (self *testSub) Add(evt stream.Event) error {
+	return errors.New(fmt.Sprintf("testSub.Add: Expected an event with an offset, got %v", evt))
+}
+
+func (self *testSub) AddOffset(offset uint, evt stream.Event) error {
+	if self.gate != nil {
+		self.lock.Lock()
+		first := len(self.offs) == 0
+		self.lock.Unlock()
+
+		if first {
+			close(self.entered)
+			<-self.gate
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.offs = append(self.offs, offset)
+	self.evts = append(self.evts, string(evt.([]byte)))
+	return nil
+}
+
+func (self *testSub) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.closed = true
+	return nil
+}
+
+func (self *testSub) get() ([]uint, []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return append([]uint{}, self.offs...), append([]string{}, self.evts...)
+}
+
+func (self *testSub) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.closed
+}
+
+// A subscriber which fails to add events after it got some.
+type failingSub struct {
+	testSub
+	after int
+}
+
+func (self *failingSub) AddOffset(offset uint, evt stream.Event) error {
+	if offs, _ := self.get(); len(offs) >= self.after {
+		return errors.New("failingSub.AddOffset: failed")
+	}
+	return self.testSub.AddOffset(offset, evt)
+}
+
+// Wait until subscribers get at least n events in total.
+func waitEvents(subs []*testSub, n int) {
+	for i := 0; i < 500; i++ {
+		all := 0
+		for _, s := range subs {
+			offs, _ := s.get()
+			all += len(offs)
+		}
+		if all >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Wait until the subscriber gets events with offsets in [from, to) and check that it got exactly them.
+func checkOffsets(t *testing.T, name string, s *testSub, from uint, to uint) {
+	waitEvents([]*testSub{s}, int(to-from))
+
+	offs, evts := s.get()
+	expected := []uint{}
+	expectedEvts := []string{}
+	for i := from; i < to; i++ {
+		expected = append(expected, i)
+		expectedEvts = append(expectedEvts, fmt.Sprint(i))
+	}
+	assert.Equal(t, expected, offs, name)
+	assert.Equal(t, expectedEvts, evts, name)
+}
+
+func addNumbers(t *testing.T, s backend.Stream, from int, to int) {
+	for i := from; i < to; i++ {
+		assert.Nil(t, s.Add([]byte(fmt.Sprint(i))))
+	}
+}
+
+// Create a service with a mem backend and a stream "s" writing to the backend stream "bs".
+func newTestService(t *testing.T) (Service, Backend, backend.BackendStream) {
+	stream.RegisterDefault()
+
+	s := New()
+	b, err := s.AddBackend("m", backend.NewMem())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	st, err := b.AddStream("bs", "s", []string{testDef})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return s, b, st
+}
+
+// Test that events that don't fit into a subscriber's queue are handled according to it's overflow policy.
+func TestSubOverflow(t *testing.T) {
+	examples := []struct {
+		Overflow string
+		Offs     []uint
+		Dropped  uint64
+	}{
+		{OverflowBlock, []uint{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 0},
+		{"", []uint{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 0},
+		{OverflowDropOldest, []uint{0, 8, 9}, 7},
+		{OverflowDropNewest, []uint{0, 1, 2}, 7},
+		{OverflowDisconnect, []uint{0}, 3},
+	}
+	for _, e := range examples {
+		s, b, st := newTestService(t)
+
+		sub := newGatedSub()
+		_, _, err := b.AddSubOptions("bs", sub, 0, 0, SubOptions{2, e.Overflow, false, 0, nil})
+		assert.Nil(t, err, e.Overflow)
+
+		// the first event is being added and the next ones wait in the queue
+		assert.Nil(t, st.Add([]byte("0")), e.Overflow)
+		<-sub.entered
+
+		done := make(chan struct{})
+		go func() {
+			addNumbers(t, st, 1, 10)
+			close(done)
+		}()
+
+		if len(e.Offs) == 10 {
+			select {
+			case <-done:
+				t.Error(e.Overflow, "Expected adding events to wait for the subscriber")
+			case <-time.After(50 * time.Millisecond):
+			}
+		} else {
+			<-done
+		}
+
+		if e.Overflow != OverflowDisconnect {
+			stats, err := b.SubStats("bs", sub)
+			assert.Nil(t, err, e.Overflow)
+			assert.Equal(t, 2, stats.Lag, e.Overflow)
+			assert.Equal(t, 2, stats.MaxLag, e.Overflow)
+			assert.Equal(t, e.Dropped, stats.Dropped, e.Overflow)
+		}
+
+		close(sub.gate)
+		<-done
+		waitEvents([]*testSub{sub}, len(e.Offs))
+		offs, _ := sub.get()
+		assert.Equal(t, e.Offs, offs, e.Overflow)
+
+		if e.Overflow == OverflowDisconnect {
+			// it's closed and removed in the background
+			for i := 0; i < 100; i++ {
+				if _, err := b.SubStats("bs", sub); err != nil {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			_, err := b.SubStats("bs", sub)
+			assert.NotNil(t, err, e.Overflow)
+			assert.True(t, sub.isClosed(), e.Overflow)
+		} else {
+			stats, err := b.SubStats("bs", sub)
+			assert.Nil(t, err, e.Overflow)
+			assert.Equal(t, SubStats{0, 2, uint64(len(e.Offs)), e.Dropped, e.Offs[len(e.Offs)-1] + 1, 0, 0}, stats, e.Overflow)
+
+			r, err := b.RmSub("bs", sub)
+			assert.Nil(t, err, e.Overflow)
+			assert.True(t, r, e.Overflow)
+		}
+
+		r, err := b.RmSub("bs", sub)
+		assert.Nil(t, err, e.Overflow)
+		assert.False(t, r, e.Overflow)
+		assert.Nil(t, s.Close(), e.Overflow)
+	}
+}
+
+// Test that invalid subscriber options are rejected.
+func TestSubOptionsInvalid(t *testing.T) {
+	s, b, _ := newTestService(t)
+	defer s.Close()
+
+	for _, opts := range []SubOptions{
+		{-1, OverflowBlock, false, 0, nil},
+		{1, "bad", false, 0, nil},
+	} {
+		_, _, err := b.AddSubOptions("bs", &testSub{}, 0, 0, opts)
+		assert.NotNil(t, err, fmt.Sprint(opts))
+	}
+
+	// websocket clients which don't read events must not hold up adding them
+	assert.Equal(t, OverflowDisconnect, DefaultSubOptions.Overflow)
+	assert.True(t, DefaultSubOptions.Queue > 0)
+}
+
+// Test that a websocket subscriber of a client which stopped reading is removed without waiting for the connection to close.
+func TestSubDisconnectStalled(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	// nobody reads messages of the connection
+	out := &wsOut{make(chan []byte), make(chan struct{})}
+	defer close(out.done)
+
+	sub := &wsSub{"m", "bs", "", 1, out}
+	_, _, err := b.AddSubOptions("bs", sub, 0, 0, SubOptions{2, OverflowDisconnect, false, 0, nil})
+	assert.Nil(t, err)
+	addNumbers(t, st, 0, 10)
+
+	for i := 0; i < 100; i++ {
+		if _, err := b.SubStats("bs", sub); err != nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, err = b.SubStats("bs", sub)
+	assert.NotNil(t, err)
+}
+
+// Test that a subscriber that fails to get events is disconnected and they are not counted as delivered.
+func TestSubAddFail(t *testing.T) {
+	sub := &failingSub{testSub{}, 3}
+	disconnected := make(chan struct{})
+	q := newSubQueue(sub, SubOptions{16, OverflowBlock, false, 0, nil}, 0, nil, func() {
+		close(disconnected)
+	})
+
+	evts := []stream.Event{}
+	for i := 0; i < 10; i++ {
+		evts = append(evts, []byte(fmt.Sprint(i)))
+	}
+	assert.Nil(t, q.add(0, evts))
+	<-disconnected
+	assert.True(t, sub.isClosed())
+
+	stats := q.getStats()
+	assert.Equal(t, uint64(3), stats.Delivered)
+	assert.Equal(t, uint64(7), stats.Dropped)
+	assert.Equal(t, uint(3), stats.Offset)
+
+	assert.Nil(t, q.add(10, []stream.Event{[]byte("10")}))
+	offs, _ := sub.get()
+	assert.Equal(t, []uint{0, 1, 2}, offs)
+}
+
+// Test that a subscriber is disconnected instead of missing events if they fail to replay.
+func TestSubReplayFail(t *testing.T) {
+	sub := &testSub{}
+	disconnected := make(chan struct{})
+	q := newSubQueue(sub, SubOptions{4, OverflowBlock, true, 0, nil}, 10, func(uint, uint) (stream.Stream, error) {
+		return nil, errors.New("history is gone")
+	}, func() {
+		close(disconnected)
+	})
+	<-disconnected
+	assert.True(t, sub.isClosed())
+
+	assert.Nil(t, q.add(10, []stream.Event{[]byte("10")}))
+	offs, _ := sub.get()
+	assert.Equal(t, []uint{}, offs)
+}
+
+// Test that subscribers replaying events get them and the new ones without gaps or duplicates.
+func TestSubReplay(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	addNumbers(t, st, 0, 100)
+
+	done := make(chan struct{})
+	go func() {
+		addNumbers(t, st, 100, 600)
+		close(done)
+	}()
+
+	subs := []*testSub{}
+	for i := 0; i < 5; i++ {
+		sub := &testSub{}
+		_, _, err := b.AddSubOptions("bs", sub, 0, 0, SubOptions{4, OverflowBlock, true, uint(i * 20), nil})
+		assert.Nil(t, err)
+		subs = append(subs, sub)
+	}
+	<-done
+
+	for i, sub := range subs {
+		checkOffsets(t, fmt.Sprint(i), sub, uint(i*20), 600)
+
+		stats, err := b.SubStats("bs", sub)
+		assert.Nil(t, err)
+		assert.Equal(t, uint(600), stats.Offset)
+		assert.Equal(t, uint(i*20), stats.Start)
+	}
+
+	_, _, err := b.AddSubOptions("bs", &testSub{}, 0, 0, SubOptions{0, "", true, 601, nil})
+	assert.NotNil(t, err)
+}
+
+// Test that offsets don't change when events are deleted from the beginning of the backend stream.
+func TestSubReplayDeleted(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	addNumbers(t, st, 0, 100)
+	bs, err := b.Backend().GetStream("bs")
+	assert.Nil(t, err)
+	_, err = bs.Del(0, 30)
+	assert.Nil(t, err)
+
+	_, _, err = b.AddSubOptions("bs", &testSub{}, 0, 0, SubOptions{0, "", true, 10, nil})
+	assert.NotNil(t, err)
+
+	sub := &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{0, "", true, 40, nil})
+	assert.Nil(t, err)
+	addNumbers(t, st, 100, 120)
+	checkOffsets(t, "replayed", sub, 40, 120)
+
+	// new subscribers start at the end
+	sub = &testSub{}
+	_, _, err = b.AddSub("bs", sub, 0, 0)
+	assert.Nil(t, err)
+	stats, err := b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(120), stats.Start)
+
+	addNumbers(t, st, 120, 130)
+	checkOffsets(t, "new", sub, 120, 130)
+}
+
+// Test that subscribers with stream definitions only get the resulting events, with offsets of events they were produced from.
+func TestSubFilter(t *testing.T) {
+	s, b, st := newTestService(t)
+	defer s.Close()
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, st.Add([]byte(fmt.Sprintf(`{"v": %d}`, i))))
+	}
+
+	def := `{"encode": [{"filter": [{"decode": [{"load": "input"}, "json"]}, {"expr": [{"decode": [{"load": "input"}, "json"]}, "v >= %d"]}]}, "json"]}`
+	replayed := &testSub{}
+	_, _, err := b.AddSubOptions("bs", replayed, 0, 0, SubOptions{0, "", true, 0, []string{fmt.Sprintf(def, 40)}})
+	assert.Nil(t, err)
+
+	sub := &testSub{}
+	_, _, err = b.AddSubOptions("bs", sub, 0, 0, SubOptions{0, "", false, 0, []string{fmt.Sprintf(def, 95)}})
+	assert.Nil(t, err)
+
+	_, _, err = b.AddSubOptions("bs", &testSub{}, 0, 0, SubOptions{0, "", false, 0, []string{`{"nofn": []}`}})
+	assert.NotNil(t, err)
+
+	for i := 50; i < 100; i++ {
+		assert.Nil(t, st.Add([]byte(fmt.Sprintf(`{"v": %d}`, i))))
+	}
+
+	waitEvents([]*testSub{replayed}, 60)
+	offs, evts := replayed.get()
+	expected := []uint{}
+	for i := uint(40); i < 100; i++ {
+		expected = append(expected, i)
+	}
+	assert.Equal(t, expected, offs)
+	assert.Equal(t, `{"v":40}`, evts[0])
+
+	waitEvents([]*testSub{sub}, 5)
+	offs, evts = sub.get()
+	assert.Equal(t, []uint{95, 96, 97, 98, 99}, offs)
+	assert.Equal(t, `{"v":99}`, evts[4])
+
+	// events are counted before filtering
+	stats, err := b.SubStats("bs", sub)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(100), stats.Offset)
+
+	r, err := b.RmSub("bs", sub)
+	assert.Nil(t, err)
+	assert.True(t, r)
+}